@@ -0,0 +1,15 @@
+package fly
+
+import "time"
+
+// clock is source of current time and timers, it is replaced by fake one in tests
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
@@ -0,0 +1,116 @@
+package fly
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NewCommand returns neutral command (sticks at rest, no flags) to be built without driver
+//
+// Eg. NewCommand().Roll(0.5).Pitch(-0.2).Flags(TakeOffFlag).Bytes() for test vectors or packet analyzers.
+// Sticks are normalized around the default neutral (0x80) and crc is kept valid by every setter.
+func NewCommand() *Cmd {
+	cmd := NewCmd()
+	return &cmd
+}
+
+// Roll sets roll stick to val (-1 … +1, clamped)
+func (c *Cmd) Roll(val float64) *Cmd {
+	return c.Stick(Roll, val)
+}
+
+// Pitch sets pitch stick to val (-1 … +1, clamped)
+func (c *Cmd) Pitch(val float64) *Cmd {
+	return c.Stick(Pitch, val)
+}
+
+// Throttle sets throttle stick to val (-1 … +1, clamped)
+func (c *Cmd) Throttle(val float64) *Cmd {
+	return c.Stick(Throttle, val)
+}
+
+// Yaw sets yaw stick to val (-1 … +1, clamped)
+func (c *Cmd) Yaw(val float64) *Cmd {
+	return c.Stick(Yaw, val)
+}
+
+// Stick sets given axis to val (-1 … +1, clamped), unknown axis is ignored
+func (c *Cmd) Stick(axis Axis, val float64) *Cmd {
+	switch axis {
+	case Roll, Pitch, Throttle, Yaw:
+		c.update(func(data []byte) {
+			data[axis] = normalize(val)
+		})
+	}
+	return c
+}
+
+// Flags replaces all flags of the command by given ones (eg. TakeOffFlag|CompassFlag)
+func (c *Cmd) Flags(flags byte) *Cmd {
+	c.update(func(data []byte) {
+		data[flagsByte] = flags
+	})
+	return c
+}
+
+// UseChecksum makes the command compute its crc byte by given function (nil = Checksum), see WithChecksum
+func (c *Cmd) UseChecksum(checksum ChecksumFunc) *Cmd {
+	c.Lock()
+	c.checksum = checksum
+	c.Unlock()
+	c.update(func([]byte) {})
+	return c
+}
+
+// Bytes returns copy of the 8 byte frame as it is transmitted
+func (c *Cmd) Bytes() []byte {
+	data, _ := c.MarshalBinary()
+	return data
+}
+
+// DecodedCmd is command frame in human readable form, see Cmd.Decode
+type DecodedCmd struct {
+	Roll, Pitch, Throttle, Yaw float64 // -1 … +1, around the default neutral (0x80)
+	Flags                      byte
+}
+
+// Decode returns stick values and flags of the command, eg. for dumping frames caught by Listen
+//
+// Sticks are de-normalized, so they match values passed to NewCommand setters up to 1/127 (byte quantization).
+func (c *Cmd) Decode() DecodedCmd {
+	c.RLock()
+	defer c.RUnlock()
+	return DecodedCmd{
+		Roll:     denormalizeAround(c.data[rollByte], defaultNeutral),
+		Pitch:    denormalizeAround(c.data[pitchByte], defaultNeutral),
+		Throttle: denormalizeAround(c.data[throttleByte], defaultNeutral),
+		Yaw:      denormalizeAround(c.data[yawByte], defaultNeutral),
+		Flags:    c.data[flagsByte],
+	}
+}
+
+// String formats the command like "roll=+0.50 pitch=0.00 throttle=-0.25 yaw=0.00 flags=[takeoff,compass]"
+func (dc DecodedCmd) String() string {
+	stick := func(val float64) string {
+		if val == 0 {
+			return "0.00"
+		}
+		return fmt.Sprintf("%+.2f", val)
+	}
+	return fmt.Sprintf("roll=%s pitch=%s throttle=%s yaw=%s flags=[%s]",
+		stick(dc.Roll), stick(dc.Pitch), stick(dc.Throttle), stick(dc.Yaw), strings.Join(flagNames(dc.Flags), ","))
+}
+
+// names of flags by their bit order
+var flagNamesByBit = [8]string{"takeoff", "land", "stop", "flip", "compass", "photo", "video", "gyro"}
+
+// flagNames lists names of flags set in given flags byte
+func flagNames(flags byte) []string {
+	names := []string{}
+	for bit, name := range flagNamesByBit {
+		if flags&(1<<bit) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
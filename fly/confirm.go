@@ -0,0 +1,59 @@
+package fly
+
+import "sync"
+
+// confirmer tracks which flags were actually transmitted
+type confirmer struct {
+	sync.Mutex
+	waiters []*flagWaiter
+}
+
+// flagWaiter waits until given flag is transmitted in enough frames
+type flagWaiter struct {
+	flag      byte
+	remaining int
+	done      chan struct{}
+}
+
+// StopConfirmed commands drone to stop rotors like Stop
+// and returns channel which is closed once the stop flag was transmitted in at least minFrames frames
+//
+// It is for emergencies when it matters that the stop bit really went out.
+// The channel is never closed when the flag is not transmitted enough times
+// (eg. radio is not running or Halt came first), so wait for it with timeout.
+func (d *Driver) StopConfirmed(minFrames int) <-chan struct{} {
+	done := d.flagSent(stopFlag, minFrames)
+	d.Stop()
+	return done
+}
+
+// flagSent returns channel which is closed once the flag was transmitted in minFrames frames from now
+func (d *Driver) flagSent(flag byte, minFrames int) <-chan struct{} {
+	waiter := &flagWaiter{flag: flag, remaining: minFrames, done: make(chan struct{})}
+	if minFrames <= 0 {
+		close(waiter.done)
+		return waiter.done
+	}
+	d.confirm.Lock()
+	d.confirm.waiters = append(d.confirm.waiters, waiter)
+	d.confirm.Unlock()
+	return waiter.done
+}
+
+// confirmSent counts transmitted frame to waiters of its flags
+func (d *Driver) confirmSent(frame []byte) {
+	d.confirm.Lock()
+	defer d.confirm.Unlock()
+	waiting := d.confirm.waiters[:0]
+	for _, waiter := range d.confirm.waiters {
+		if frame[flagsByte]&waiter.flag != 0 {
+			waiter.remaining--
+		}
+		if waiter.remaining <= 0 {
+			close(waiter.done)
+			continue
+		}
+		waiting = append(waiting, waiter)
+	}
+	d.confirm.waiters = waiting
+}
@@ -0,0 +1,80 @@
+package fly
+
+import "math"
+
+// curve is transformation of stick values applied before they are normalized
+type curve struct {
+	deadzone float64 // 0 … <1, values closer to center are zero
+	expo     float64 // 0 … 1, 0 = linear, 1 = cubic
+}
+
+// apply transforms stick value; 0 stays 0 and ±1 stays ±1
+func (c curve) apply(val float64) float64 {
+	abs := math.Abs(val)
+	if abs <= c.deadzone {
+		return 0
+	}
+	x := (abs - c.deadzone) / (1 - c.deadzone) // rescale rest of the range to 0 … 1
+	x = (1-c.expo)*x + c.expo*x*x*x
+	return math.Copysign(x, val)
+}
+
+// SetDeadzone sets fraction of stick range around center which is treated as zero
+//
+// It is useful for noisy inputs (gamepads, phone tilt) which would othervise make the drone drift.
+// The rest of the range is stretched, so small values above deadzone are still small.
+// frac is from 0 (default, no deadzone) to 1 (exclusive).
+// Applies to Sticks and Go* methods.
+func (d *Driver) SetDeadzone(frac float64) {
+	frac = math.Max(0, math.Min(frac, 0.99))
+	d.cmd.update(func(data []byte) {
+		d.curve.deadzone = frac
+	})
+}
+
+// SetExpo sets how much is stick response softened near center
+//
+// amount 0 (default) is linear response, 1 is fully cubic curve - half stick then means 1/8 of speed.
+// Full stick is always full speed.
+// Applies to Sticks and Go* methods.
+func (d *Driver) SetExpo(amount float64) {
+	amount = math.Max(0, math.Min(amount, 1))
+	d.cmd.update(func(data []byte) {
+		d.curve.expo = amount
+	})
+}
+
+// maxTrim is the largest trim offset, as fraction of full stick
+const maxTrim = 0.2
+
+// SetTrim sets offsets added to stick values, to compensate drift of the drone
+//
+// Eg. drone which drifts forward at neutral sticks needs small negative pitch trim.
+// Values are in speed scale of the driver and they are clamped to ±0.2 of full stick (±20 with Percent scale).
+// Resting sticks (Hover) transmit the trimmed center, inputs are still clamped to full deflection.
+func (d *Driver) SetTrim(pitch, roll, yaw, throttle float64) {
+	trim := map[Axis]float64{}
+	for axis, val := range map[Axis]float64{Pitch: pitch, Roll: roll, Yaw: yaw, Throttle: throttle} {
+		trim[axis] = math.Max(-maxTrim, math.Min(d.unit(val), maxTrim))
+	}
+	d.cmd.update(func(data []byte) {
+		resting := map[Axis]bool{}
+		for axis := range trim {
+			resting[axis] = data[axis] == d.axisByte(axis, 0)
+		}
+		d.trim = trim
+		for axis := range trim {
+			if resting[axis] { // move resting stick to new center
+				data[axis] = d.axisByte(axis, 0)
+			}
+		}
+	})
+}
+
+// Trim returns offsets set by SetTrim, in speed scale of the driver
+func (d *Driver) Trim() (pitch, roll, yaw, throttle float64) {
+	d.cmd.RLock()
+	defer d.cmd.RUnlock()
+	scale := float64(d.scale)
+	return scale * d.trim[Pitch], scale * d.trim[Roll], scale * d.trim[Yaw], scale * d.trim[Throttle]
+}
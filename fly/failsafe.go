@@ -0,0 +1,86 @@
+package fly
+
+import (
+	"sync"
+	"time"
+)
+
+type failsafe struct {
+	sync.Mutex
+	timeout  time.Duration // 0 = disabled
+	last     time.Time     // of last control call
+	tripped  bool          // sticks were centered since last control call
+	suspend  int           // number of running sequences which suspended the failsafe
+	callback func()
+}
+
+// SetFailsafe makes the drone hover when no control command arrives for given timeout
+//
+// Control commands are Sticks, Hover, RawCommand and all Go* methods and maneuvers
+// (those which hold sticks for longer than timeout without other control call will be interrupted).
+// It guards against app which stalled and would othervise leave the drone flying away with last command.
+// Zero timeout (default) disables the failsafe.
+func (d *Driver) SetFailsafe(timeout time.Duration) {
+	if timeout < 0 {
+		timeout = 0
+	}
+	d.failsafe.Lock()
+	d.failsafe.timeout = timeout
+	d.failsafe.Unlock()
+	d.touch()
+}
+
+// OnFailsafe sets callback called when the failsafe centers sticks
+//
+// It is called from the radio loop, so it should not block.
+func (d *Driver) OnFailsafe(callback func()) {
+	d.failsafe.Lock()
+	d.failsafe.callback = callback
+	d.failsafe.Unlock()
+}
+
+// touch marks control call, restarting the failsafe timeout
+func (d *Driver) touch() {
+	now := d.clock.Now()
+	d.failsafe.Lock()
+	d.failsafe.last = now
+	d.failsafe.tripped = false
+	d.failsafe.Unlock()
+}
+
+// checkFailsafe centers sticks when there was no control call for failsafe timeout
+//
+// It is called by radio loop before each transmission.
+func (d *Driver) checkFailsafe() {
+	now := d.clock.Now()
+	fs := &d.failsafe
+	fs.Lock()
+	if fs.timeout == 0 || fs.tripped || fs.suspend > 0 || now.Sub(fs.last) < fs.timeout {
+		fs.Unlock()
+		return
+	}
+	fs.tripped = true
+	callback := fs.callback
+	fs.Unlock()
+
+	d.cmd.unhold(throttleByte) // held throttle could take the drone away too
+	d.cmd.update(d.centerSticks)
+	if callback != nil {
+		callback()
+	}
+}
+
+// suspendFailsafe disables failsafe until resumeFailsafe is called
+func (d *Driver) suspendFailsafe() {
+	d.failsafe.Lock()
+	d.failsafe.suspend++
+	d.failsafe.Unlock()
+}
+
+// resumeFailsafe enables failsafe suspended by suspendFailsafe, with fresh timeout
+func (d *Driver) resumeFailsafe() {
+	d.failsafe.Lock()
+	d.failsafe.suspend--
+	d.failsafe.Unlock()
+	d.touch()
+}
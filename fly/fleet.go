@@ -0,0 +1,90 @@
+package fly
+
+import "fmt"
+
+// Fleet controls several drones at once
+//
+// Each drone has its own Driver (with its own socket and radio loop),
+// so they have to be reachable on different addresses (eg. through different wifi interfaces).
+// Commands of Fleet are broadcasted to all of them, use Drone(i) to control single one.
+type Fleet struct {
+	drivers []*Driver
+}
+
+// NewFleet creates fleet of given drivers
+func NewFleet(drivers ...*Driver) *Fleet {
+	return &Fleet{drivers: drivers}
+}
+
+// Len returns number of drones in the fleet
+func (f *Fleet) Len() int {
+	return len(f.drivers)
+}
+
+// Drone returns driver of i-th drone of the fleet
+func (f *Fleet) Drone(i int) *Driver {
+	return f.drivers[i]
+}
+
+// each calls fn for every driver, even if some of them fails
+//
+// First error is returned, annotated with index of the drone.
+func (f *Fleet) each(fn func(d *Driver) error) (err error) {
+	for i, d := range f.drivers {
+		if e := fn(d); e != nil && err == nil {
+			err = fmt.Errorf("fly: drone %d: %w", i, e)
+		}
+	}
+	return err
+}
+
+// Start starts radio loops of all drones
+func (f *Fleet) Start() error {
+	return f.each((*Driver).Start)
+}
+
+// Halt stops radio loops of all drones, even if some of them returns error
+func (f *Fleet) Halt() error {
+	return f.each((*Driver).Halt)
+}
+
+// Sticks sets the same sticks position to all drones
+//
+// See Driver.Sticks
+func (f *Fleet) Sticks(up, rotate, forwards, sideways float64) error {
+	return f.each(func(d *Driver) error {
+		return d.Sticks(up, rotate, forwards, sideways)
+	})
+}
+
+// Hover commands all drones to hover
+func (f *Fleet) Hover() {
+	f.each(func(d *Driver) error {
+		d.Hover()
+		return nil
+	})
+}
+
+// TakeOff commands all drones to take off
+func (f *Fleet) TakeOff() {
+	f.each(func(d *Driver) error {
+		d.TakeOff()
+		return nil
+	})
+}
+
+// Land commands all drones to land
+func (f *Fleet) Land() {
+	f.each(func(d *Driver) error {
+		d.Land()
+		return nil
+	})
+}
+
+// Stop commands all drones to stop motors immediately
+func (f *Fleet) Stop() {
+	f.each(func(d *Driver) error {
+		d.Stop()
+		return nil
+	})
+}
@@ -0,0 +1,121 @@
+package fly
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Direction of flip, see DoFlip and SafeFlip
+type Direction int
+
+// Directions of flips
+const (
+	Forward Direction = iota
+	Backward
+	Left
+	Right
+)
+
+// stick returns axis and its value which makes the flip in the direction
+func (dir Direction) stick() (Axis, float64, error) {
+	switch dir {
+	case Forward:
+		return Pitch, +1, nil
+	case Backward:
+		return Pitch, -1, nil
+	case Left:
+		return Roll, -1, nil
+	case Right:
+		return Roll, +1, nil
+	}
+	return 0, 0, fmt.Errorf("fly: unknown flip direction %d", dir)
+}
+
+// FlipPolicy says how SafeFlip gains headroom before the flip
+type FlipPolicy struct {
+	Boost    float64       // throttle during boost, 0 … 1 of full throttle (regardless of speed scale)
+	BoostFor time.Duration // how long is throttle boosted before the flip
+	FlipFor  time.Duration // how long is the direction stick held after flip flag is set
+}
+
+// DefaultFlipPolicy climbs at half throttle for 0.4s and then holds the direction for 0.5s (as Do*Flip)
+var DefaultFlipPolicy = FlipPolicy{
+	Boost:    0.5,
+	BoostFor: time.Second * 2 / 5,
+	FlipFor:  time.Second / 2,
+}
+
+// SetFlipPolicy sets boost and timing of SafeFlip, zero durations are replaced by defaults
+func (d *Driver) SetFlipPolicy(policy FlipPolicy) {
+	if policy.Boost < 0 {
+		policy.Boost = 0
+	}
+	if policy.Boost > 1 {
+		policy.Boost = 1
+	}
+	if policy.BoostFor <= 0 {
+		policy.BoostFor = DefaultFlipPolicy.BoostFor
+	}
+	if policy.FlipFor <= 0 {
+		policy.FlipFor = DefaultFlipPolicy.FlipFor
+	}
+	d.Lock()
+	d.flip = policy
+	d.Unlock()
+}
+
+// DoFlip commands drone to do a flip in given direction (it blocks for .5s)
+func (d *Driver) DoFlip(direction Direction) {
+	d.DoFlipContext(context.Background(), direction)
+}
+
+// DoFlipContext is the same as DoFlip, but it can be canceled by ctx.
+// Error is returned for unknown direction too.
+func (d *Driver) DoFlipContext(ctx context.Context, direction Direction) error {
+	axis, val, err := direction.stick()
+	if err != nil {
+		return err
+	}
+	d.Flip()
+	return d.goAxis(ctx, axis, val)
+}
+
+// SafeFlip boosts throttle to gain headroom, then flips in given direction and hovers
+//
+// Unlike DoFlip it does not fail on drones which sink too low before the flip (they don't beep then).
+// Boost and timing is given by flip policy (see SetFlipPolicy). It blocks until the drone hovers again.
+func (d *Driver) SafeFlip(direction Direction) {
+	d.SafeFlipContext(context.Background(), direction)
+}
+
+// SafeFlipContext is the same as SafeFlip, but it can be canceled by ctx.
+// Drone hovers when canceled.
+func (d *Driver) SafeFlipContext(ctx context.Context, direction Direction) error {
+	axis, val, err := direction.stick()
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	policy := d.flip
+	d.Unlock()
+
+	defer d.Hover()
+	d.Hover()
+	d.setAxis(Throttle, policy.Boost)
+	select {
+	case <-d.clock.After(policy.BoostFor):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	d.Hover()
+	d.Flip()
+	d.setAxis(axis, val)
+	select {
+	case <-d.clock.After(policy.FlipFor):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
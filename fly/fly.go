@@ -3,17 +3,33 @@
 // Usage
 //
 //  - use Start() and Halt() to turn on/off the transmitter
+//  - use Pause() and Resume() to stop/continue sending commands without tearing down the connection
 //  - use Calibrate() to calibrate the gyro before flight
-//  - use CompassOn() and CompassOff() to turn on/off the headless mode
+//  - use CompassOn() and CompassOff() to turn on/off the headless mode (or ToggleCompass() and CompassEnabled())
 //  - use TakeOff() and Land() to get the drone to air and back on the ground
 //  - use Sticks(up, rotate, forwards, sideways) and Hover() to control the flight
+//  - use HoldThrottle(level) and ReleaseThrottle() to keep throttle fixed while controlling the rest
+//  - use Move(MoveSpec{Pitch: 0.5, Duration: time.Second}) to move more axes at once for a while and wait on returned channel
 //  - use Flip() to prepare for flip
 //  - use Stop() to emergency stop
+//  - use SetFlag(flag, on) and Flags() to control and read flags directly (eg. CompassFlag)
+//  - use NewCommand() to build command frames without driver (eg. NewCommand().Roll(0.5).Flags(TakeOffFlag).Bytes())
+//  - use Listen(addr) or Relay(ctx, listenAddr, droneAddr) to sniff commands sent by other controller apps
 //
 //
 //  Following commands blocks for .5s:
 //  - use GoUp(speed), GoDown(speed), GoLeft(speed), GoRight(speed), GoClockwise(speed), GoCounterClockwise(speed) to move in direction in steps
-//  - use DoBackFlip(), DoFrontFlip(), DoRightFlip() and DoLeftFlip() to do various flips
+//  - use DoFlip(direction) to do flip Forward, Backward, Left or Right
+//  - use their *Context(ctx, ...) variants (eg. GoUpContext(ctx, speed)) to be able to cancel them
+//  - use their Nudge*(speed, duration) variants (eg. NudgeLeft(speed, duration)) to not block at all
+//
+//  Following maneuvers blocks until they are done or canceled by context:
+//  - use Orbit(ctx, radiusSpeed, yawSpeed, duration) to circle around a point
+//  - use Descend(rate, until) to slowly go down (gentler than Land(), safer than Stop())
+//  - use SafeFlip(direction) to boost throttle before flip, so the drone has enough power for it
+//  - use AutoLandContext(ctx) to descend, land and stop (or AutoLand() to run it in background)
+//  - use TakeOffAndHover(ctx) to take off and wait until the drone is in the air
+//  - use Sequence() to script timed maneuvers (eg. Sequence().TakeOff().Wait(d).Forward(speed, d).Land()) and Run(ctx) them
 //
 //
 // Caution:
@@ -24,6 +40,11 @@
 //  - opposite of `Start()`
 //  - makes drone unresponsive to any subsequent commands
 //  - should be only called at the end of the session, when drone is safely on ground whith propellers not spinning
+//  - use `OnSuspend(mode)` instead when the app loses focus, it hovers or lands before halting
+//
+// Shutdown(ctx) = land and then turn off radio transmitting
+//  - use it instead of `Halt()` at the end of the session when drone might be still flying
+//  - keeps transmitting until the drone settles, falls back to `Stop()` when telemetry says it did not land in time
 //
 // Hover() = reset sticks to neutral position
 //  - stops drone from accelerating when flying
@@ -43,10 +64,12 @@
 package fly
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"gobot.io/x/gobot"
-	"log"
 	"net"
+	"strings"
 	"sync"
 	"time"
 )
@@ -75,11 +98,68 @@ const (
 	gyroFlag
 )
 
+// Flags of cmd, see Driver.SetFlag and Driver.Flags
+const (
+	TakeOffFlag byte = takeOffFlag
+	LandFlag    byte = landFlag
+	StopFlag    byte = stopFlag
+	FlipFlag    byte = flipFlag
+	CompassFlag byte = compassFlag // headless mode
+	PhotoFlag   byte = photoFlag
+	VideoFlag   byte = videoFlag
+	GyroFlag    byte = gyroFlag // calibration
+)
+
+// Axis identifies one of the stick channels of cmd
+type Axis int
+
+// Stick channels
+const (
+	Roll     Axis = rollByte
+	Pitch    Axis = pitchByte
+	Throttle Axis = throttleByte
+	Yaw      Axis = yawByte
+)
+
+func (a Axis) String() string {
+	switch a {
+	case Roll:
+		return "roll"
+	case Pitch:
+		return "pitch"
+	case Throttle:
+		return "throttle"
+	case Yaw:
+		return "yaw"
+	default:
+		return fmt.Sprintf("axis(%d)", int(a))
+	}
+}
+
+// ErrStickRange is returned (wrapped) when stick value is out of -1 … +1 range
+var ErrStickRange = errors.New("fly: stick value out of range")
+
+// defaultNeutral is byte transmitted for stick at rest on most models
+const defaultNeutral = 0x80
+
+// limits and default of transmit rate in Hz
+const (
+	minRate     = 1
+	maxRate     = 200
+	defaultRate = 50
+)
+
+// Cmd is the frame transmitted to the drone, see NewCommand to build one without driver
 type Cmd struct {
 	sync.RWMutex
-	data []byte
+	data     []byte
+	pulses   map[byte]int  // remaining frames of flags set by pulseFlag
+	cancel   chan struct{} // closed by cancelPulses
+	held     map[int]byte  // bytes kept by hold through all updates
+	checksum ChecksumFunc  // nil = Checksum
 }
 
+// NewCmd returns neutral command, see NewCommand
 func NewCmd() Cmd {
 	return Cmd{
 		//              roll        throttle      bitflags       const
@@ -99,13 +179,27 @@ func (c *Cmd) String() (str string) {
 func (c *Cmd) update(f func([]byte)) {
 	c.Lock()
 	f(c.data)
-	c.data[crcByte] = 0
-	c.data[crcByte] = crc(c.data)
+	for i, value := range c.held {
+		c.data[i] = value
+	}
+	c.data[crcByte] = c.sum(c.data)
 	c.Unlock()
 }
 
 func (c *Cmd) isValid() bool {
-	return len(c.data) == 8 && c.data[0] == 0x66 && c.data[7] == 0x99 && crc(c.data) == 0
+	if len(c.data) != 8 || c.data[0] != 0x66 || c.data[7] != 0x99 {
+		return false
+	}
+	return c.sum(append([]byte(nil), c.data...)) == c.data[crcByte]
+}
+
+// sum computes crc byte of the frame by checksum function of the cmd, crc byte of the frame is zeroed
+func (c *Cmd) sum(frame []byte) byte {
+	frame[crcByte] = 0
+	if c.checksum == nil {
+		return crc(frame)
+	}
+	return c.checksum(frame)
 }
 
 func (c *Cmd) setFlag(flag byte) {
@@ -120,67 +214,191 @@ func (c *Cmd) clearFlag(flag byte) {
 	})
 }
 
-func (c *Cmd) tempSetFlag(flag byte, duration time.Duration) {
+// pulseFlag sets flag and clears it after it was in given number of frames
+//
+// Calling it again for the same flag before the pulse ends will prolong the flag.
+// Frames are counted by the radio loop (see countPulses), so the flag stays set while radio is not running.
+func (c *Cmd) pulseFlag(flag byte, frames int) {
 	c.setFlag(flag)
-	time.AfterFunc(duration, func() {
-		c.clearFlag(flag)
-	})
+	c.Lock()
+	defer c.Unlock()
+	if c.pulses == nil {
+		c.pulses = make(map[byte]int)
+	}
+	c.pulses[flag] = frames
+}
+
+// countPulses counts frame built from the cmd to pending pulses and clears flags of those which ended
+//
+// It must be called with the cmd locked, right after the frame was taken.
+func (c *Cmd) countPulses() {
+	cleared := false
+	for flag, remaining := range c.pulses {
+		if remaining--; remaining > 0 {
+			c.pulses[flag] = remaining
+			continue
+		}
+		delete(c.pulses, flag)
+		c.data[flagsByte] &^= flag
+		cleared = true
+	}
+	if cleared {
+		c.data[crcByte] = c.sum(c.data)
+	}
+}
+
+// cancelPulses forgets all pending pulses set by pulseFlag
+//
+// Flags which were set by them stay set
+func (c *Cmd) cancelPulses() {
+	c.Lock()
+	defer c.Unlock()
+	for flag := range c.pulses {
+		delete(c.pulses, flag)
+	}
+	if c.cancel != nil {
+		close(c.cancel)
+		c.cancel = nil
+	}
+}
+
+// dropPulses cancels pending pulses (see cancelPulses) and clears flags set by them
+func (c *Cmd) dropPulses() {
+	c.Lock()
+	var flags byte
+	for flag := range c.pulses {
+		flags |= flag
+	}
+	c.Unlock()
+	c.cancelPulses()
+	c.clearFlag(flags)
+}
+
+// canceled returns channel which will be closed by next cancelPulses call
+func (c *Cmd) canceled() <-chan struct{} {
+	c.Lock()
+	defer c.Unlock()
+	if c.cancel == nil {
+		c.cancel = make(chan struct{})
+	}
+	return c.cancel
 }
 
 type Driver struct {
 	sync.Mutex
-	name    string
+	name    string // guarded by registry lock
 	cmd     Cmd
-	stop    chan bool
+	stop    chan struct{} // closed by Halt to end radio loop
+	conn    *net.UDPConn  // of running radio loop
 	enabled bool
+	paused  bool // by Pause, radio loop runs but sends nothing
 	udpaddr *net.UDPAddr
 	laddr   *net.UDPAddr
 	err     error
 	onError func(error)
+	logger  Logger // set by SetLogger
+
+	onReconnect func()    // called when broken connection was replaced
+	transport   Transport // replaces UDP when set
+
+	neutral map[Axis]byte    // byte transmitted for each axis at rest, guarded by cmd lock
+	curve   curve            // applied to stick values, guarded by cmd lock
+	trim    map[Axis]float64 // added to stick values, guarded by cmd lock
+	model   *Model           // set by SetModel
+	retry   RetryPolicy      // of critical flag pulses
+	flip    FlipPolicy       // of SafeFlip
+	scale   SpeedScale       // of stick values and speeds
+	rate    int              // of transmitted commands in Hz
+	ramp    float64          // max change of sticks per second, 0 = off
+
+	suspendGrace time.Duration      // of OnSuspend, 0 = default
+	suspended    context.CancelFunc // cancels pending halt of OnSuspend
+
+	recorder recorder     // of transmitted frames
+	failsafe failsafe     // centers sticks when control calls stop coming
+	confirm  confirmer    // of transmitted flags
+	nudger   nudger       // of axes moved by Nudge* methods
+	sent     transmission // counts of radio loop for Status
+	clock    clock
+
+	telemetryMu sync.RWMutex
+	telemetry   Telemetry            // last received
+	onTelemetry func(Telemetry)      // called for each received
+	airborne    func(Telemetry) bool // set by SetAirborneCheck
 }
 
 // NewDriver will create new Driver instance
 //
 // Optional destination and source UDP addresses might be passed as first and second argument
 // Othervise 192.168.0.1:50000 is used as destination
-// and automaticly choosen local system adress as source
+// and automaticly choosen local system adress as source.
+// It panics when the address can't be resolved, use NewDriverE to get error instead.
 func NewDriver(address ...string) *Driver {
-	dest := "192.168.0.1:50000"
-	src := "" // any
+	d, err := NewDriverE(address...)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// NewDriverE is the same as NewDriver, but it returns error instead of panicking when address is invalid
+func NewDriverE(address ...string) (*Driver, error) {
+	options := []Option{}
 	if len(address) > 0 {
-		dest = address[0]
+		options = append(options, WithAddress(address[0]))
 	}
 	if len(address) > 1 {
-		src = address[1]
+		options = append(options, WithSource(address[1]))
 	}
-	udpaddr, err := net.ResolveUDPAddr("udp4", dest)
-	if err != nil {
-		panic(err)
+	return NewDriverWith(options...)
+}
+
+// NewDriverWith will create new Driver instance configured by given options
+//
+// Without options it is the same as NewDriver()
+func NewDriverWith(options ...Option) (*Driver, error) {
+	d := &Driver{
+		name:   gobot.DefaultName("Drone"),
+		cmd:    NewCmd(),
+		retry:  DefaultRetryPolicy,
+		flip:   DefaultFlipPolicy,
+		scale:  Unit,
+		rate:   defaultRate,
+		clock:  realClock{},
+		logger: nopLogger{},
+		neutral: map[Axis]byte{
+			Roll:     defaultNeutral,
+			Pitch:    defaultNeutral,
+			Throttle: defaultNeutral,
+			Yaw:      defaultNeutral,
+		},
 	}
-	srcaddr, err := net.ResolveUDPAddr("udp4", src)
-	if err != nil {
-		panic(err)
+	defaults := []Option{
+		WithAddress("192.168.0.1:50000"),
+		WithSource(""), // any
 	}
-	return &Driver{
-		name:    gobot.DefaultName("Drone"),
-		cmd:     NewCmd(),
-		stop:    make(chan bool),
-		udpaddr: udpaddr,
-		laddr:   srcaddr,
+	for _, option := range append(defaults, options...) {
+		if err := option(d); err != nil {
+			return nil, err
+		}
 	}
+	return d, nil
 }
 
 // Name return name of the driver instance
 // it is here to satisfy gobot.Driver intreface
 func (d *Driver) Name() string {
+	registry.Lock()
+	defer registry.Unlock()
 	return d.name
 }
 
 // Name will set the name of the driver instance
 //
-// It is here to satisfy gobot.Driver interface
+// It is here to satisfy gobot.Driver interface.
+// Invalid name is ignored, use SetNameE to get the error.
 func (d *Driver) SetName(name string) {
-	d.name = name
+	d.SetNameE(name)
 }
 
 // Connection is not actually useful so far
@@ -192,12 +410,17 @@ func (d *Driver) Connection() gobot.Connection {
 
 // Start will start transmitting loop
 //
-// Similar to turning on the remote controll
+// Similar to turning on the remote controll. It also resumes transmitting paused by Pause.
 func (d *Driver) Start() error {
 	d.Lock()
 	defer d.Unlock()
+	d.cancelSuspend()
+	d.paused = false
 	d.reset()
+	d.touch()
 	if !d.enabled {
+		d.err = nil // of previous run
+		d.resetSent()
 		d.radioLoop()
 	}
 	return d.err
@@ -205,52 +428,126 @@ func (d *Driver) Start() error {
 
 // Halt will end transmitting loop
 //
-// Similar to turning off the remote controll
+// Similar to turning off the remote controll.
+// It does not block and it is safe to call it repeatedly or when the loop has already ended.
 func (d *Driver) Halt() error {
 	d.Lock()
 	defer d.Unlock()
+	return d.halt()
+}
+
+// halt ends transmitting loop, it must be called with the driver locked
+func (d *Driver) halt() error {
+	d.cancelPendingFlags()
 	if d.enabled {
-		d.stop <- true
+		close(d.stop)
+		d.enabled = false
+		d.err = nil
 	}
 	return d.err
 }
 
 // Set function wchich will be called when error occurs in redioLoop
 func (d *Driver) OnError(callback func(err error)) {
+	d.Lock()
 	d.onError = callback
+	d.Unlock()
 }
 
-func (d *Driver) radioLoop() {
-
-	// create connection
-	conn, err := net.DialUDP("udp4", d.laddr, d.udpaddr)
-	if err != nil {
-		d.err = err
+// reportError passes err to callback set by OnError (if any)
+//
+// Should be called with d locked
+func (d *Driver) reportError(err error) {
+	if d.onError != nil {
 		d.onError(err)
-		return
+	}
+}
+
+// fail stores err and passes it to callback set by OnError (if any)
+//
+// Should be called with d unlocked
+func (d *Driver) fail(err error) {
+	d.Lock()
+	d.err = err
+	onError := d.onError
+	d.Unlock()
+	if onError != nil {
+		onError(err)
+	}
+}
+
+func (d *Driver) radioLoop() {
+	transport := d.transport
+	var conn *net.UDPConn
+	if transport == nil {
+		// create connection
+		var err error
+		conn, err = net.DialUDP("udp4", d.laddr, d.udpaddr)
+		if err != nil {
+			d.err = err
+			d.reportError(err)
+			return
+		}
+		d.conn = conn
+		go d.telemetryLoop(conn) // ends when conn is closed
 	}
 	d.enabled = true
+	stop := make(chan struct{})
+	d.stop = stop
+
+	send := func(frame []byte) error {
+		if transport != nil {
+			return transport.Send(frame)
+		}
+		_, err := conn.Write(frame) // conn is replaced by reconnect
+		return err
+	}
 
 	go func() {
-		log.Println("radio start")
-		defer log.Println("radio end")
+		log := d.log()
+		log.Debug("radio start")
+		defer log.Debug("radio end")
+		defer d.recoverRadio(stop)
 		// loop
-		ticker := time.NewTicker(time.Second / 50)
+		period := d.period()
+		ticker := time.NewTicker(period)
 		defer ticker.Stop()
-		defer conn.Close()
+		defer func() {
+			if conn != nil {
+				conn.Close()
+			}
+		}()
+		ramp := ramper{sum: d.cmd.sum}
 		for now := range ticker.C {
-			_ = now
-			d.cmd.RLock()
-			_, err := conn.Write(d.cmd.data)
-			d.cmd.RUnlock()
-			if err != nil {
-				d.err = err
-				d.onError(err)
+			if p := d.period(); p != period { // rate changed by SetRate
+				period = p
+				ticker.Reset(period)
+			}
+			d.checkNudges()
+			d.checkFailsafe()
+			if !d.Paused() {
+				maxStep := rampStep(d.rampPerSecond(), period)
+				d.cmd.Lock()
+				frame := append([]byte(nil), ramp.step(d.cmd.data, maxStep)...)
+				d.cmd.countPulses()
+				d.cmd.Unlock()
+				sendStart := d.clock.Now()
+				if err := send(frame); err == nil {
+					d.record(now, frame)
+					d.confirmSent(frame)
+					d.markSent(sendStart)
+				} else {
+					d.markFailed()
+					d.fail(err)
+					if transport == nil {
+						if conn = d.reconnect(conn, stop); conn == nil { // halted meanwhile
+							return
+						}
+					}
+				}
 			}
 			select {
-			case <-d.stop:
-				d.err = nil
-				d.enabled = false
+			case <-stop:
 				return
 			default:
 			}
@@ -259,185 +556,513 @@ func (d *Driver) radioLoop() {
 
 }
 
+// ErrRadioPanic is returned (wrapped) when radio loop panicked, the driver can be started again after it
+var ErrRadioPanic = errors.New("fly: radio loop panicked")
+
+// recoverRadio turns panic of radio loop into error reported by OnError, so the app survives it
+//
+// It should be deferred by the radio goroutine. The driver is marked as disabled, so Start can be called again.
+func (d *Driver) recoverRadio(stop chan struct{}) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	d.log().Error("radio panic", "panic", r)
+	d.Lock()
+	if d.enabled && d.stop == stop { // not halted or restarted meanwhile
+		close(stop)
+		d.enabled = false
+	}
+	d.Unlock()
+	d.fail(fmt.Errorf("%w: %v", ErrRadioPanic, r))
+}
+
+// cancelPendingFlags forgets pending pulses of temporary flags (TakeOff, Land, ...)
+//
+// So they won't clear flags of restarted driver
+func (d *Driver) cancelPendingFlags() {
+	d.cmd.cancelPulses()
+}
+
+// pulse sets flag for as many frames as are transmitted during given duration at current rate
+//
+// Eg. one second is exactly 50 frames at 50 Hz, regardless of jitter of the radio loop.
+func (d *Driver) pulse(flag byte, duration time.Duration) {
+	d.cmd.pulseFlag(flag, d.framesIn(duration))
+}
+
+// framesIn returns number of frames transmitted during given duration at current rate (at least one)
+func (d *Driver) framesIn(duration time.Duration) int {
+	d.Lock()
+	rate := d.rate
+	d.Unlock()
+	frames := int((duration*time.Duration(rate) + time.Second/2) / time.Second)
+	if frames < 1 {
+		frames = 1
+	}
+	return frames
+}
+
 // Reset cmd to default state
 func (d *Driver) reset() {
+	d.cancelPendingFlags()
+	d.cmd.unhold(throttleByte)
 	d.cmd.update(func(data []byte) {
-		data[1] = normalize(0)
-		data[2] = normalize(0)
-		data[3] = normalize(0)
-		data[4] = normalize(0)
-		data[5] = 0
+		d.centerSticks(data)
+		data[flagsByte] = 0
 	})
 }
 
+// centerSticks moves all sticks to neutral
+//
+// Should be called only inside of cmd.update
+func (d *Driver) centerSticks(data []byte) {
+	data[rollByte] = d.axisByte(Roll, 0)
+	data[pitchByte] = d.axisByte(Pitch, 0)
+	data[throttleByte] = d.axisByte(Throttle, 0)
+	data[yawByte] = d.axisByte(Yaw, 0)
+}
+
 /* Stick controll commands */
 
+// SetRate sets how many times per second is the command transmitted (50 by default)
+//
+// Some drones drop packets when they are sent too often, others react faster with higher rate.
+// It takes effect immediately even if the radio is already running.
+func (d *Driver) SetRate(hz int) error {
+	if hz < minRate || hz > maxRate {
+		return fmt.Errorf("fly: rate %d Hz is out of %d … %d range", hz, minRate, maxRate)
+	}
+	d.Lock()
+	d.rate = hz
+	d.Unlock()
+	return nil
+}
+
+// period returns interval between two transmitted commands
+func (d *Driver) period() time.Duration {
+	d.Lock()
+	defer d.Unlock()
+	return time.Second / time.Duration(d.rate)
+}
+
+// SetChannelNeutral sets byte which is transmitted when stick of given axis is at rest
+//
+// Stick values -1 … +1 are then mapped to 0x01 … neutral … 0xff.
+// Default neutral is 0x80 (center) for all axes.
+//
+// Drone without altitude hold captured in analysis/flight/capture1 had throttle stick
+// resting at minimum (0x00) - use d.SetChannelNeutral(fly.Throttle, 0x00) for such drone.
+// Unknown axis is ignored.
+func (d *Driver) SetChannelNeutral(axis Axis, neutral byte) {
+	d.cmd.update(func(data []byte) {
+		if _, ok := d.neutral[axis]; !ok {
+			return
+		}
+		if data[axis] == d.neutral[axis] { // move resting stick to new neutral
+			data[axis] = neutral
+		}
+		d.neutral[axis] = neutral
+	})
+}
+
+// axisByte converts stick value of given axis to byte according to its neutral
+// (after deadzone and expo curve is applied and trim added)
+//
+// Should be called only inside of cmd.update
+func (d *Driver) axisByte(axis Axis, val float64) byte {
+	return normalizeAround(d.curve.apply(val)+d.trim[axis], d.neutral[axis])
+}
+
+// setAxis sets stick value of single axis
+func (d *Driver) setAxis(axis Axis, val float64) {
+	d.touch()
+	d.cmd.update(func(data []byte) {
+		data[axis] = d.axisByte(axis, val)
+	})
+}
+
+// goAxis sets stick value of single axis for .5s and then hovers
+//
+// It returns ctx.Err() and hovers immediately when ctx is canceled sooner
+func (d *Driver) goAxis(ctx context.Context, axis Axis, val float64) error {
+	defer d.Hover()
+	d.setAxis(axis, val)
+	timer := time.NewTimer(time.Second / 2)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // Sticks commands drone to fly according to sticks position
 //
-//                      -1.0 … +1.0
+//                      -1.0 … +1.0  (or -100 … +100 with Percent speed scale)
 //  up       (throttle)    ↓ … ↑
 //  rotate   (yaw)         ↶ … ↷
 //  forwards (pitch)       ▼ … ▲
 //  sideways (roll)        ◀ … ▶
 //
 // This does not change flags byte.
-func (d *Driver) Sticks(up, rotate, forwards, sideways float64) {
+//
+// Values out of range are clamped, but error wrapping ErrStickRange is returned for them,
+// so bad joystick mappings can be detected. It is safe to ignore the error.
+func (d *Driver) Sticks(up, rotate, forwards, sideways float64) error {
+	d.touch()
+	d.cmd.update(func(data []byte) {
+		data[rollByte] = d.axisByte(Roll, d.unit(sideways))
+		data[pitchByte] = d.axisByte(Pitch, d.unit(forwards))
+		data[throttleByte] = d.axisByte(Throttle, d.unit(up))
+		data[yawByte] = d.axisByte(Yaw, d.unit(rotate))
+	})
+	return checkRange(d.scale, map[Axis]float64{
+		Throttle: up,
+		Yaw:      rotate,
+		Pitch:    forwards,
+		Roll:     sideways,
+	})
+}
+
+// checkRange returns error wrapping ErrStickRange naming all values which are out of -scale … +scale range
+func checkRange(scale SpeedScale, values map[Axis]float64) error {
+	wrong := []string{}
+	for _, axis := range []Axis{Throttle, Yaw, Pitch, Roll} {
+		if val, ok := values[axis]; ok && (val < -float64(scale) || val > +float64(scale)) {
+			wrong = append(wrong, fmt.Sprintf("%s=%g", axis, val))
+		}
+	}
+	if len(wrong) > 0 {
+		return fmt.Errorf("%w: %s", ErrStickRange, strings.Join(wrong, ", "))
+	}
+	return nil
+}
+
+// CurrentSticks returns current position of sticks as set by Sticks or other commands
+//
+// Values are in -1 … +1 range (or other one given by speed scale), but they are quantized (there is only 256 positions for each axis)
+// Trim (see SetTrim) is subtracted, so hovering drone reports zeros.
+func (d *Driver) CurrentSticks() (up, rotate, forwards, sideways float64) {
+	d.cmd.RLock()
+	defer d.cmd.RUnlock()
+	data := d.cmd.data
+	scale := float64(d.scale)
+	up = scale * (denormalizeAround(data[throttleByte], d.neutral[Throttle]) - d.trim[Throttle])
+	rotate = scale * (denormalizeAround(data[yawByte], d.neutral[Yaw]) - d.trim[Yaw])
+	forwards = scale * (denormalizeAround(data[pitchByte], d.neutral[Pitch]) - d.trim[Pitch])
+	sideways = scale * (denormalizeAround(data[rollByte], d.neutral[Roll]) - d.trim[Roll])
+	return
+}
+
+// RawCommand sets stick and flag bytes of the command directly
+//
+// Values are transmitted as they are, without normalization or range checks (0x80 is neutral stick).
+// It is meant for experimenting with unknown drones or flags, crc is still computed automatically.
+func (d *Driver) RawCommand(roll, pitch, throttle, yaw, flags byte) {
+	d.touch()
 	d.cmd.update(func(data []byte) {
-		data[rollByte] = normalize(sideways)
-		data[pitchByte] = normalize(forwards)
-		data[throttleByte] = normalize(up)
-		data[yawByte] = normalize(rotate)
+		data[rollByte] = roll
+		data[pitchByte] = pitch
+		data[throttleByte] = throttle
+		data[yawByte] = yaw
+		data[flagsByte] = flags
 	})
 }
 
+// CommandBytes returns copy of the whole command as it is being transmitted
+func (d *Driver) CommandBytes() []byte {
+	d.cmd.RLock()
+	defer d.cmd.RUnlock()
+	data := make([]byte, len(d.cmd.data))
+	copy(data, d.cmd.data)
+	return data
+}
+
 // Hover commands drone to stop movement and hover in place.
 // (It sets sticks to rest positions.)
 //
 // Same as d.Sticks(0,0,0,0)
 func (d *Driver) Hover() {
-	d.cmd.update(func(data []byte) {
-		data[rollByte] = normalize(0)
-		data[pitchByte] = normalize(0)
-		data[throttleByte] = normalize(0)
-		data[yawByte] = normalize(0)
-	})
+	d.touch()
+	d.cmd.update(d.centerSticks)
 }
 
 // Up makes the drone gain altitude.
-// speed foat can be a value from `0` to `1`.
+// speed can be a foat value from `0` to `1` (or `100` with Percent speed scale).
 func (d *Driver) GoUp(speed float64) {
-	d.cmd.update(func(d []byte) { d[throttleByte] = normalize(speed / +1) })
-	time.Sleep(time.Second / 2)
-	d.Hover()
+	d.GoUpContext(context.Background(), speed)
+}
+
+// GoUpContext is the same as GoUp, but it can be canceled by ctx.
+// Drone hovers when canceled.
+func (d *Driver) GoUpContext(ctx context.Context, speed float64) error {
+	return d.goAxis(ctx, Throttle, +d.unit(speed))
 }
 
 // Down makes the drone reduce altitude.
-// speed can be a foat value from `0` to `1`.
+// speed can be a foat value from `0` to `1` (or `100` with Percent speed scale).
 func (d *Driver) GoDown(speed float64) {
-	d.cmd.update(func(d []byte) { d[throttleByte] = normalize(speed / -1) })
-	time.Sleep(time.Second / 2)
-	d.Hover()
+	d.GoDownContext(context.Background(), speed)
+}
+
+// GoDownContext is the same as GoDown, but it can be canceled by ctx.
+// Drone hovers when canceled.
+func (d *Driver) GoDownContext(ctx context.Context, speed float64) error {
+	return d.goAxis(ctx, Throttle, -d.unit(speed))
 }
 
 // Right causes the drone to bank to the right, controls the roll.
-// speed can be a foat value from `0` to `1`.
+// speed can be a foat value from `0` to `1` (or `100` with Percent speed scale).
 func (d *Driver) GoRight(speed float64) {
-	d.cmd.update(func(d []byte) { d[rollByte] = normalize(speed / +1) })
-	time.Sleep(time.Second / 2)
-	d.Hover()
+	d.GoRightContext(context.Background(), speed)
+}
+
+// GoRightContext is the same as GoRight, but it can be canceled by ctx.
+// Drone hovers when canceled.
+func (d *Driver) GoRightContext(ctx context.Context, speed float64) error {
+	return d.goAxis(ctx, Roll, +d.unit(speed))
 }
 
 // Left causes the drone to bank to the left, controls the roll.
-// speed can be a foat value from `0` to `1`.
+// speed can be a foat value from `0` to `1` (or `100` with Percent speed scale).
 func (d *Driver) GoLeft(speed float64) {
-	d.cmd.update(func(d []byte) { d[rollByte] = normalize(speed / -1) })
-	time.Sleep(time.Second / 2)
-	d.Hover()
+	d.GoLeftContext(context.Background(), speed)
+}
+
+// GoLeftContext is the same as GoLeft, but it can be canceled by ctx.
+// Drone hovers when canceled.
+func (d *Driver) GoLeftContext(ctx context.Context, speed float64) error {
+	return d.goAxis(ctx, Roll, -d.unit(speed))
 }
 
 // Forward causes the drone go forward, controls the pitch.
-// speed can be a foat value from `0` to `1`.
+// speed can be a foat value from `0` to `1` (or `100` with Percent speed scale).
 func (d *Driver) GoForward(speed float64) {
-	d.cmd.update(func(d []byte) { d[pitchByte] = normalize(speed / +1) })
-	time.Sleep(time.Second / 2)
-	d.Hover()
+	d.GoForwardContext(context.Background(), speed)
+}
+
+// GoForwardContext is the same as GoForward, but it can be canceled by ctx.
+// Drone hovers when canceled.
+func (d *Driver) GoForwardContext(ctx context.Context, speed float64) error {
+	return d.goAxis(ctx, Pitch, +d.unit(speed))
 }
 
 // Backward causes the drone go forward, controls the pitch.
-// speed can be a foat value from `0` to `1`.
+// speed can be a foat value from `0` to `1` (or `100` with Percent speed scale).
 func (d *Driver) GoBackward(speed float64) {
-	d.cmd.update(func(d []byte) { d[pitchByte] = normalize(speed / -1) })
-	time.Sleep(time.Second / 2)
-	d.Hover()
+	d.GoBackwardContext(context.Background(), speed)
+}
+
+// GoBackwardContext is the same as GoBackward, but it can be canceled by ctx.
+// Drone hovers when canceled.
+func (d *Driver) GoBackwardContext(ctx context.Context, speed float64) error {
+	return d.goAxis(ctx, Pitch, -d.unit(speed))
 }
 
 // Clockwise tells drone to rotate in a clockwise direction.
-// speed can be a float value from `0` to `1`.
+// speed can be a float value from `0` to `1` (or `100` with Percent speed scale).
 func (d *Driver) GoClockwise(speed float64) {
-	d.cmd.update(func(d []byte) { d[yawByte] = normalize(speed / -1) })
-	time.Sleep(time.Second / 2)
-	d.Hover()
+	d.GoClockwiseContext(context.Background(), speed)
+}
+
+// GoClockwiseContext is the same as GoClockwise, but it can be canceled by ctx.
+// Drone hovers when canceled.
+func (d *Driver) GoClockwiseContext(ctx context.Context, speed float64) error {
+	return d.goAxis(ctx, Yaw, -d.unit(speed))
 }
 
 // Clockwise tells drone to rotate in a clockwise direction.
-// speed can be a float value from `0` to `1`.
+// speed can be a float value from `0` to `1` (or `100` with Percent speed scale).
 func (d *Driver) GoCounterClockwise(speed float64) {
-	d.cmd.update(func(d []byte) { d[yawByte] = normalize(speed / +1) })
+	d.GoCounterClockwiseContext(context.Background(), speed)
+}
+
+// GoCounterClockwiseContext is the same as GoCounterClockwise, but it can be canceled by ctx.
+// Drone hovers when canceled.
+func (d *Driver) GoCounterClockwiseContext(ctx context.Context, speed float64) error {
+	return d.goAxis(ctx, Yaw, +d.unit(speed))
 }
 
+// Up is integer convenience for GoUp, meant to be used with Percent speed scale
+func (d *Driver) Up(speed int) { d.GoUp(float64(speed)) }
+
+// Down is integer convenience for GoDown, meant to be used with Percent speed scale
+func (d *Driver) Down(speed int) { d.GoDown(float64(speed)) }
+
+// Right is integer convenience for GoRight, meant to be used with Percent speed scale
+func (d *Driver) Right(speed int) { d.GoRight(float64(speed)) }
+
+// Left is integer convenience for GoLeft, meant to be used with Percent speed scale
+func (d *Driver) Left(speed int) { d.GoLeft(float64(speed)) }
+
+// Forward is integer convenience for GoForward, meant to be used with Percent speed scale
+func (d *Driver) Forward(speed int) { d.GoForward(float64(speed)) }
+
+// Backward is integer convenience for GoBackward, meant to be used with Percent speed scale
+func (d *Driver) Backward(speed int) { d.GoBackward(float64(speed)) }
+
+// Clockwise is integer convenience for GoClockwise, meant to be used with Percent speed scale
+func (d *Driver) Clockwise(speed int) { d.GoClockwise(float64(speed)) }
+
+// CounterClockwise is integer convenience for GoCounterClockwise, meant to be used with Percent speed scale
+func (d *Driver) CounterClockwise(speed int) { d.GoCounterClockwise(float64(speed)) }
+
 /* Action commands */
 
 // TakeOff commands drone to take off
 func (d *Driver) TakeOff() {
-	d.cmd.tempSetFlag(takeOffFlag, time.Second)
+	d.pulseCritical(takeOffFlag)
 }
 
 // Land commands drone to land
 func (d *Driver) Land() {
-	d.cmd.tempSetFlag(landFlag, time.Second)
+	d.cmd.unhold(throttleByte) // would keep the drone from descending
+	d.pulseCritical(landFlag)
 }
 
 // Stop commands drone to stop rotors (emergency button)
 func (d *Driver) Stop() {
-	d.cmd.tempSetFlag(stopFlag, time.Second)
+	d.cmd.unhold(throttleByte)
+	d.pulseCritical(stopFlag)
 }
 
 // Calibrate commands drone to calibrate gyroscop
 func (d *Driver) Calibrate() {
-	d.cmd.tempSetFlag(gyroFlag, time.Second)
+	d.pulse(gyroFlag, time.Second)
 }
 
 // CompassOn commands drone to enter compass mode
 func (d *Driver) CompassOn() {
-	d.cmd.setFlag(compassFlag)
+	d.SetFlag(CompassFlag, true)
 }
 
 // CompassOff commands drone to leave compass mode
 func (d *Driver) CompassOff() {
-	d.cmd.clearFlag(compassFlag)
+	d.SetFlag(CompassFlag, false)
+}
+
+// ToggleCompass turns compass (headless) mode on when it is off and vice versa, returns the new state
+//
+// Eg. for single UI button, which shows the returned state.
+func (d *Driver) ToggleCompass() (enabled bool) {
+	d.cmd.update(func(data []byte) {
+		data[flagsByte] ^= compassFlag
+		enabled = data[flagsByte]&compassFlag != 0
+	})
+	return enabled
+}
+
+// CompassEnabled says whether compass (headless) mode is on
+func (d *Driver) CompassEnabled() bool {
+	return d.Flags()&CompassFlag != 0
+}
+
+// SetFlag sets (on = true) or clears (on = false) given flags in the transmitted cmd
+//
+// Flags can be combined (eg. CompassFlag|GyroFlag). Unlike TakeOff, Land etc.
+// flags set this way stay set until they are cleared.
+func (d *Driver) SetFlag(flag byte, on bool) {
+	if on {
+		d.cmd.setFlag(flag)
+	} else {
+		d.cmd.clearFlag(flag)
+	}
+}
+
+// Flags returns flags byte of currently transmitted cmd
+//
+// Use it with flag constants, eg. d.Flags()&CompassFlag != 0 in compass (headless) mode.
+func (d *Driver) Flags() byte {
+	d.cmd.RLock()
+	defer d.cmd.RUnlock()
+	return d.cmd.data[flagsByte]
 }
 
 // Flip commands drone to prepare for flip
 // Making movement in some direction will cause flip in that direction.
 // If drone does not make beep sound, it does not have enough power to make a flip.
 func (d *Driver) Flip() {
-	d.cmd.tempSetFlag(flipFlag, time.Second)
+	d.pulse(flipFlag, time.Second)
 }
 
 // TakePhoto button
 // This will not work for most models - use vtx controller instead
 func (d *Driver) TakePhoto() {
-	d.cmd.tempSetFlag(photoFlag, time.Second)
+	d.pulse(photoFlag, time.Second)
 }
 
 // CaptureVideo button
 // This will not work for most models - use vtx controller instead
 func (d *Driver) CaptureVideo() {
-	d.cmd.tempSetFlag(videoFlag, time.Second)
+	d.pulse(videoFlag, time.Second)
 }
 
-// BackFlip commands drone to do a backflip
+// DoBackFlip commands drone to do a backflip
+//
+// Deprecated: use DoFlip(Backward)
 func (d *Driver) DoBackFlip() {
-	d.Flip()
-	d.GoBackward(100)
+	d.DoFlip(Backward)
 }
 
-// FrontFlip commands drone to do a frontflip
+// DoBackFlipContext is the same as DoBackFlip, but it can be canceled by ctx.
+//
+// Deprecated: use DoFlipContext(ctx, Backward)
+func (d *Driver) DoBackFlipContext(ctx context.Context) error {
+	return d.DoFlipContext(ctx, Backward)
+}
+
+// DoFrontFlip commands drone to do a frontflip
+//
+// Deprecated: use DoFlip(Forward)
 func (d *Driver) DoFrontFlip() {
-	d.Flip()
-	d.GoForward(100)
+	d.DoFlip(Forward)
+}
+
+// DoFrontFlipContext is the same as DoFrontFlip, but it can be canceled by ctx.
+//
+// Deprecated: use DoFlipContext(ctx, Forward)
+func (d *Driver) DoFrontFlipContext(ctx context.Context) error {
+	return d.DoFlipContext(ctx, Forward)
 }
 
-// LeftFlip commands drone to do a flip to the left
+// DoLeftFlip commands drone to do a flip to the left
+//
+// Deprecated: use DoFlip(Left)
 func (d *Driver) DoLeftFlip() {
-	d.Flip()
-	d.GoLeft(100)
+	d.DoFlip(Left)
+}
+
+// DoLeftFlipContext is the same as DoLeftFlip, but it can be canceled by ctx.
+//
+// Deprecated: use DoFlipContext(ctx, Left)
+func (d *Driver) DoLeftFlipContext(ctx context.Context) error {
+	return d.DoFlipContext(ctx, Left)
 }
 
-// RightFlip commands drone to do a flip to the right
+// DoRightFlip commands drone to do a flip to the right
+//
+// Deprecated: use DoFlip(Right)
 func (d *Driver) DoRightFlip() {
-	d.Flip()
-	d.GoRight(100)
+	d.DoFlip(Right)
+}
+
+// DoRightFlipContext is the same as DoRightFlip, but it can be canceled by ctx.
+//
+// Deprecated: use DoFlipContext(ctx, Right)
+func (d *Driver) DoRightFlipContext(ctx context.Context) error {
+	return d.DoFlipContext(ctx, Right)
+}
+
+// RestoringSticks runs maneuver and then returns sticks to position they had before it
+//
+// Usefull with flips which end with Hover() otherwise - eg. d.RestoringSticks(func() { d.DoFlip(fly.Forward) })
+// makes flip during forward flight to resume forward flight instead of killing momentum.
+func (d *Driver) RestoringSticks(maneuver func()) {
+	up, rotate, forwards, sideways := d.CurrentSticks()
+	maneuver()
+	d.Sticks(up, rotate, forwards, sideways)
 }
 
 // Convert float to byte like this
@@ -446,13 +1071,65 @@ func (d *Driver) DoRightFlip() {
 //  0. => 0x80
 // +1. => 0xff
 func normalize(val float64) byte {
+	return normalizeAround(val, defaultNeutral)
+}
+
+// Convert float to byte around given neutral byte
+//
+// -1. => 0x01 (0x00 if neutral is 0x00)
+//  0. => neutral
+// +1. => 0xff
+func normalizeAround(val float64, neutral byte) byte {
 	if val > +1 {
 		val = +1
 	}
 	if val < -1 {
 		val = -1
 	}
-	return byte(128 + val*127)
+	if val < 0 {
+		if neutral == 0 {
+			return 0
+		}
+		return byte(float64(neutral) + val*float64(neutral-1))
+	}
+	return byte(float64(neutral) + val*float64(0xff-neutral))
+}
+
+// Convert byte back to float, inverse of normalizeAround
+func denormalizeAround(b byte, neutral byte) float64 {
+	switch {
+	case b == neutral:
+		return 0
+	case b > neutral:
+		return float64(b-neutral) / float64(0xff-neutral)
+	case neutral <= 1:
+		return -1
+	default:
+		val := -float64(neutral-b) / float64(neutral-1)
+		if val < -1 {
+			val = -1
+		}
+		return val
+	}
+}
+
+// ChecksumFunc computes crc byte of the command frame, see Checksum and WithChecksum
+//
+// The frame is passed with crc byte (7th) set to zero.
+type ChecksumFunc func(frame []byte) byte
+
+// Checksum computes crc byte of the command frame (8 bytes starting with 0x66 and ending with 0x99)
+//
+// It is the default ChecksumFunc: register starting at 0xff is rotated left by one bit
+// for each bit of the frame (most significant first) and the bit is xored into it.
+// The frame is taken with crc byte zeroed, so current value of crc byte (7th) is ignored.
+func Checksum(frame []byte) byte {
+	data := make([]byte, len(frame))
+	copy(data, frame)
+	if len(data) > crcByte {
+		data[crcByte] = 0
+	}
+	return crc(data)
 }
 
 // cyclic redundancy check (polynom = 1)
@@ -1,8 +1,16 @@
 package fly
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"gobot.io/x/gobot"
+	"math"
 	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -62,6 +70,37 @@ func TestCrcValidation(t *testing.T) {
 	}
 }
 
+func TestChecksum(t *testing.T) {
+	frames := []struct {
+		frame []byte
+		crc   byte
+	}{
+		{[]byte{0x66, 0x80, 0x80, 0x80, 0x80, 0x00, 0x00, 0x99}, 0x00}, // default
+		{[]byte{0x66, 0x80, 0x80, 0x80, 0x80, 0x00, 0xaa, 0x99}, 0x00}, // crc byte ignored
+		{[]byte{0x66, 0x58, 0x7e, 0x80, 0x84, 0x00, 0x00, 0x99}, 0x22},
+		{[]byte{0x66, 0x7f, 0x58, 0x80, 0x84, 0x00, 0x00, 0x99}, 0x23},
+		{[]byte{0x66, 0x80, 0x80, 0x7c, 0x05, 0x00, 0x00, 0x99}, 0x79},
+		{[]byte{0x66, 0x80, 0x80, 0x83, 0xff, 0x00, 0x00, 0x99}, 0x7c},
+		{[]byte{0x66, 0x85, 0x7e, 0x80, 0x84, 0x00, 0x00, 0x99}, 0xff},
+	}
+	for _, f := range frames {
+		if crc := Checksum(f.frame); crc != f.crc {
+			t.Errorf("Checksum of % x should be %02x, got %02x", f.frame, f.crc, crc)
+		}
+	}
+
+	for _, data := range [][]byte{
+		{0x66, 0x80, 0x80, 0x80, 0x80, 0x00, 0x01, 0x99}, // wrong crc
+		{0x66, 0x80, 0x80, 0x80, 0x80, 0x00, 0x99},       // too short
+		{0x67, 0x80, 0x80, 0x80, 0x80, 0x00, 0x00, 0x99}, // wrong start
+	} {
+		cmd := Cmd{data: data}
+		if cmd.isValid() {
+			t.Errorf("Malformed frame considered valid (%s)", cmd.String())
+		}
+	}
+}
+
 func TestCrcComputation(t *testing.T) {
 	commands := [][]byte{ // commands without crc
 		{0x66, 0x58, 0x7e, 0x80, 0x84, 0x00, 0x00, 0x99},
@@ -167,3 +206,2348 @@ func TestInterfaces(t *testing.T) {
 	iface, _ := net.InterfaceByName("wi2")
 	println(iface.Name)
 }
+
+func TestCancelPendingFlags(t *testing.T) {
+	driver := NewDriver("192.168.0.1:50000")
+
+	driver.TakeOff()
+	driver.cancelPendingFlags()
+	driver.reset()
+	driver.cmd.setFlag(takeOffFlag) // set by new session
+
+	time.Sleep(time.Second + time.Second/4)
+	if driver.cmd.data[flagsByte]&takeOffFlag == 0 {
+		t.Errorf("Flag cleared by timer from previous session (%s)", driver.cmd.String())
+	}
+}
+
+func TestNormalizeAround(t *testing.T) {
+	cases := []struct {
+		val     float64
+		neutral byte
+		b       byte
+	}{
+		{-1, 0x80, 0x01},
+		{0, 0x80, 0x80},
+		{1, 0x80, 0xff},
+		{-1, 0x00, 0x00},
+		{0, 0x00, 0x00},
+		{1, 0x00, 0xff},
+		{0.5, 0x00, 0x7f},
+		{-1, 0x40, 0x01},
+		{0, 0x40, 0x40},
+		{1, 0x40, 0xff},
+	}
+	for _, c := range cases {
+		if b := normalizeAround(c.val, c.neutral); b != c.b {
+			t.Errorf("Value %f around %#x should be normalized to %#x, but is %#x", c.val, c.neutral, c.b, b)
+		}
+		if c.neutral == 0 && c.val < 0 {
+			continue // not reversible
+		}
+		if val := denormalizeAround(c.b, c.neutral); val < c.val-0.01 || val > c.val+0.01 {
+			t.Errorf("Byte %#x around %#x should be denormalized to %f, but is %f", c.b, c.neutral, c.val, val)
+		}
+	}
+}
+
+func TestSetChannelNeutral(t *testing.T) {
+	driver := NewDriver("192.168.0.1:50000")
+	driver.SetChannelNeutral(Throttle, 0x00)
+	if driver.cmd.data[throttleByte] != 0x00 {
+		t.Errorf("Resting throttle should move to new neutral (%s)", driver.cmd.String())
+	}
+	driver.Sticks(0.5, 0, 0, 0)
+	driver.Hover()
+	if driver.cmd.data[throttleByte] != 0x00 || driver.cmd.data[yawByte] != 0x80 {
+		t.Errorf("Hover should use channel neutrals (%s)", driver.cmd.String())
+	}
+	if !driver.cmd.isValid() {
+		t.Errorf("Invalid cmd (%s)", driver.cmd.String())
+	}
+
+	// concurrent use with other sticks commands
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				driver.SetChannelNeutral(Axis(i+1), byte(0x80-i))
+				driver.SetChannelNeutral(Axis(7), 0x00) // not an axis
+				driver.Sticks(0.1, 0, 0, 0)
+			}
+		}(i)
+	}
+	wg.Wait()
+	driver.Hover()
+	if driver.cmd.data[rollByte] != 0x80 || driver.cmd.data[yawByte] != 0x7d {
+		t.Errorf("Hover should use channel neutrals set concurrently (%s)", driver.cmd.String())
+	}
+}
+
+func TestTrim(t *testing.T) {
+	driver := NewDriver("192.168.0.1:50000")
+	driver.SetTrim(-0.1, 0.2, 0, 0.5)
+	if pitch, roll, yaw, throttle := driver.Trim(); pitch != -0.1 || roll != 0.2 || yaw != 0 || throttle != maxTrim {
+		t.Errorf("Trim should be clamped to ±%v, got %v %v %v %v", maxTrim, pitch, roll, yaw, throttle)
+	}
+	data := driver.cmd.data
+	if data[pitchByte] != normalize(-0.1) || data[rollByte] != normalize(0.2) || data[yawByte] != 0x80 || data[throttleByte] != normalize(0.2) {
+		t.Errorf("Resting sticks should move to trimmed center (%s)", driver.cmd.String())
+	}
+
+	driver.Sticks(1, 0, -1, 1)
+	if data[throttleByte] != 0xff || data[pitchByte] != 0x01 || data[rollByte] != 0xff {
+		t.Errorf("Trimmed sticks should be clamped (%s)", driver.cmd.String())
+	}
+	driver.Hover()
+	if data[pitchByte] != normalize(-0.1) || data[rollByte] != normalize(0.2) || data[yawByte] != 0x80 {
+		t.Errorf("Hover should apply trim (%s)", driver.cmd.String())
+	}
+	if up, rotate, forwards, sideways := driver.CurrentSticks(); math.Abs(up) > 0.01 || rotate != 0 || math.Abs(forwards) > 0.01 || math.Abs(sideways) > 0.01 {
+		t.Errorf("Hovering sticks should be reported without trim, got %v %v %v %v", up, rotate, forwards, sideways)
+	}
+	if !driver.cmd.isValid() {
+		t.Errorf("Invalid cmd (%s)", driver.cmd.String())
+	}
+
+	driver.SetTrim(0, 0, 0, 0)
+	if data[pitchByte] != 0x80 || data[rollByte] != 0x80 || data[throttleByte] != 0x80 {
+		t.Errorf("Resting sticks should return to center (%s)", driver.cmd.String())
+	}
+}
+
+func TestOrbit(t *testing.T) {
+	driver := NewDriver("192.168.0.1:50000")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Second / 4)
+		if driver.cmd.data[rollByte] != normalize(0.5) || driver.cmd.data[yawByte] != normalize(-0.25) {
+			t.Errorf("Orbit sticks not set (%s)", driver.cmd.String())
+		}
+		cancel()
+	}()
+	if err := driver.Orbit(ctx, 0.5, -0.25, time.Minute); err != context.Canceled {
+		t.Errorf("Canceled orbit should return context.Canceled, got %v", err)
+	}
+	if driver.cmd.data[rollByte] != 0x80 || driver.cmd.data[yawByte] != 0x80 {
+		t.Errorf("Drone should hover after orbit (%s)", driver.cmd.String())
+	}
+
+	if err := driver.Orbit(context.Background(), 0.5, 0.5, time.Second/4); err != nil {
+		t.Errorf("Finished orbit should return nil, got %v", err)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	driver := NewDriver("192.168.0.1:50000")
+	if len(driver.Capabilities()) != len(allCapabilities) {
+		t.Errorf("Driver without model should report all capabilities")
+	}
+
+	if err := driver.SetModel("xs000"); err == nil {
+		t.Errorf("Unknown model should not be set")
+	}
+	if err := driver.SetModel("xs809hw"); err != nil {
+		t.Fatal(err)
+	}
+	model := Model{Capabilities: driver.Capabilities()}
+	if !model.Supports(VtxCameraCapability) || !model.Supports(AltitudeHoldCapability) {
+		t.Errorf("xs809hw should support vtx camera and altitude hold, has %v", model.Capabilities)
+	}
+	if model.Supports(FlagCameraCapability) {
+		t.Errorf("xs809hw should not support camera via flags")
+	}
+}
+
+func TestRestoringSticks(t *testing.T) {
+	driver := NewDriver("192.168.0.1:50000")
+	driver.Sticks(0.25, 0, 0.5, 0)
+
+	up, _, forwards, _ := driver.CurrentSticks()
+	if up < 0.24 || up > 0.26 || forwards < 0.49 || forwards > 0.51 {
+		t.Errorf("CurrentSticks do not match Sticks (%f, %f)", up, forwards)
+	}
+
+	before := driver.cmd.String()
+	driver.RestoringSticks(driver.DoLeftFlip)
+	if after := driver.cmd.String(); before[:15] != after[:15] {
+		t.Errorf("Sticks not restored after flip (%s != %s)", before, after)
+	}
+}
+
+func TestDescend(t *testing.T) {
+	driver := NewDriver("192.168.0.1:50000")
+
+	polls := 0
+	driver.Descend(0.5, func() bool {
+		polls++
+		if driver.cmd.data[throttleByte] != normalize(-0.5) {
+			t.Errorf("Throttle should be down while descending (%s)", driver.cmd.String())
+		}
+		return polls == 3
+	})
+	if driver.cmd.data[throttleByte] != 0x80 {
+		t.Errorf("Drone should hover after descend (%s)", driver.cmd.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/10)
+	defer cancel()
+	start := time.Now()
+	driver.Descend(0, UntilDone(ctx))
+	if time.Since(start) > time.Second/2 {
+		t.Errorf("Descend should stop when context is done")
+	}
+}
+
+// countPulses samples flag during given duration and returns how many times it was set
+func countPulses(driver *Driver, flag byte, duration time.Duration) (pulses int) {
+	wasSet := false
+	for end := time.Now().Add(duration); time.Now().Before(end); time.Sleep(time.Millisecond * 5) {
+		driver.cmd.RLock()
+		isSet := driver.cmd.data[flagsByte]&flag != 0
+		driver.cmd.RUnlock()
+		if isSet && !wasSet {
+			pulses++
+		}
+		wasSet = isSet
+	}
+	return pulses
+}
+
+func TestRetryPolicy(t *testing.T) {
+	driver, _ := NewDriverWith(WithTransport(&MemoryTransport{}))
+	driver.Start() // pulses are counted in transmitted frames
+	driver.SetRetryPolicy(RetryPolicy{
+		Attempts: 3,
+		Pulse:    time.Millisecond * 50,
+		Gap:      time.Millisecond * 50,
+	})
+	driver.TakeOff()
+	if pulses := countPulses(driver, takeOffFlag, time.Millisecond*400); pulses != 3 {
+		t.Errorf("TakeOff should be pulsed 3 times, was %d", pulses)
+	}
+
+	var confirms int32
+	driver.SetRetryPolicy(RetryPolicy{
+		Attempts: 3,
+		Pulse:    time.Millisecond * 50,
+		Gap:      time.Millisecond * 50,
+		Confirm: func(flag byte) bool {
+			atomic.AddInt32(&confirms, 1)
+			return flag == landFlag
+		},
+	})
+	driver.Land()
+	if pulses := countPulses(driver, landFlag, time.Millisecond*400); pulses != 1 || atomic.LoadInt32(&confirms) != 1 {
+		t.Errorf("Confirmed Land should be pulsed once, was %d", pulses)
+	}
+
+	driver.Stop()
+	driver.Halt()
+	if pulses := countPulses(driver, stopFlag, time.Millisecond*400); pulses > 1 {
+		t.Errorf("Halt should cancel repetitions, Stop pulsed %d times", pulses)
+	}
+}
+
+func TestPulseFrames(t *testing.T) {
+	transport := &MemoryTransport{}
+	driver, _ := NewDriverWith(WithTransport(transport))
+	driver.Start()
+	defer driver.Halt()
+
+	count := func(flag byte, frames int, pulse func()) {
+		t.Helper()
+		sent := driver.flagSent(flag, frames)
+		pulse()
+		select {
+		case <-sent:
+		case <-time.After(time.Second * 3):
+			t.Fatalf("Flag %#x was not transmitted", flag)
+		}
+		time.Sleep(time.Second / 10) // would be transmitted longer
+		indexes := flagFrames(transport.Frames(), flag)
+		if len(indexes) != frames || indexes[len(indexes)-1]-indexes[0] != frames-1 {
+			t.Errorf("Flag %#x should be in exactly %d consecutive frames, was in %d", flag, frames, len(indexes))
+		}
+	}
+	count(takeOffFlag, 50, driver.TakeOff)
+	count(flipFlag, 50, driver.Flip)
+
+	driver.SetRate(100)
+	count(gyroFlag, 100, driver.Calibrate)
+}
+
+func TestSticksRange(t *testing.T) {
+	driver := NewDriver("192.168.0.1:50000")
+
+	if err := driver.Sticks(1, -1, 0.5, 0); err != nil {
+		t.Errorf("Values in range should not return error, got %v", err)
+	}
+
+	err := driver.Sticks(2, 0, 0, -1.5)
+	if !errors.Is(err, ErrStickRange) {
+		t.Fatalf("Values out of range should return ErrStickRange, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "throttle=2") || !strings.Contains(err.Error(), "roll=-1.5") {
+		t.Errorf("Error should name wrong axes and values, got %v", err)
+	}
+	if driver.cmd.data[throttleByte] != 0xff || driver.cmd.data[rollByte] != 0x01 {
+		t.Errorf("Values out of range should be clamped (%s)", driver.cmd.String())
+	}
+}
+
+func TestSpeedScale(t *testing.T) {
+	if _, err := NewDriverWith(WithSpeedScale(0)); err == nil {
+		t.Errorf("Zero speed scale should be refused")
+	}
+	unit := NewDriver()
+	percent, err := NewDriverWith(WithSpeedScale(Percent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unit.Sticks(0.5, -0.25, 1, -1)
+	if err := percent.Sticks(50, -25, 100, -100); err != nil {
+		t.Errorf("Percent values in range should not return error, got %v", err)
+	}
+	if unit.cmd.String() != percent.cmd.String() {
+		t.Errorf("Percent and unit scale should produce same command: %s != %s", percent.cmd.String(), unit.cmd.String())
+	}
+	if up, _, _, _ := percent.CurrentSticks(); up < 49 || up > 51 {
+		t.Errorf("CurrentSticks should return value in percent, got %v", up)
+	}
+	if err := percent.Sticks(101, 0, 0, 0); !errors.Is(err, ErrStickRange) {
+		t.Errorf("Value over 100 should return ErrStickRange, got %v", err)
+	}
+}
+
+func TestRawCommand(t *testing.T) {
+	driver := NewDriver()
+	driver.RawCommand(0x01, 0x02, 0x03, 0x04, 0x40)
+
+	data := driver.CommandBytes()
+	expected := []byte{0x66, 0x01, 0x02, 0x03, 0x04, 0x40}
+	if string(data[:crcByte]) != string(expected) {
+		t.Errorf("Unexpected command bytes % x, expected % x", data, expected)
+	}
+	if !driver.cmd.isValid() {
+		t.Errorf("Raw command should have valid crc")
+	}
+
+	data[rollByte] = 0xff
+	if driver.cmd.data[rollByte] != 0x01 {
+		t.Errorf("CommandBytes should return copy")
+	}
+}
+
+func TestRamp(t *testing.T) {
+	driver := NewDriver()
+	ramp := ramper{}
+
+	if frame := ramp.step(driver.cmd.data, 0); &frame[0] != &driver.cmd.data[0] {
+		t.Errorf("Without ramping the command should be transmitted as it is")
+	}
+
+	driver.SetRamp(1) // full throttle in one second
+	maxStep := rampStep(driver.rampPerSecond(), time.Second/50)
+	ramp.step(driver.cmd.data, maxStep) // initial position
+
+	driver.Sticks(1, 0, 0, 0)
+	driver.cmd.setFlag(stopFlag)
+	prev := byte(0x80)
+	for tick := 1; tick <= 50; tick++ {
+		frame := ramp.step(driver.cmd.data, maxStep)
+		throttle := frame[throttleByte]
+		if throttle < prev || float64(throttle-prev) > maxStep+1 {
+			t.Fatalf("Tick %d: throttle jumped from %02x to %02x", tick, prev, throttle)
+		}
+		if frame[flagsByte]&stopFlag == 0 {
+			t.Fatalf("Flags should not be ramped")
+		}
+		if crc(frame) != 0 {
+			t.Fatalf("Ramped frame should have valid crc (% x)", frame)
+		}
+		if tick == 25 && (throttle < 0xb8 || throttle > 0xc8) {
+			t.Errorf("Throttle should be half way after half second, got %02x", throttle)
+		}
+		prev = throttle
+	}
+	if prev != 0xff {
+		t.Errorf("Throttle should reach target after one second, got %02x", prev)
+	}
+}
+
+func TestCurve(t *testing.T) {
+	for _, c := range []curve{{}, {deadzone: 0.1}, {expo: 0.5}, {deadzone: 0.2, expo: 1}} {
+		for _, val := range []float64{0, -1, +1} {
+			if got := c.apply(val); got != val {
+				t.Errorf("%+v: %v should stay %v, got %v", c, val, val, got)
+			}
+		}
+	}
+
+	if got := (curve{deadzone: 0.1}).apply(0.05); got != 0 {
+		t.Errorf("Value inside deadzone should be zero, got %v", got)
+	}
+	if got := (curve{deadzone: 0.1}).apply(-0.55); math.Abs(got+0.5) > 1e-9 {
+		t.Errorf("Value outside deadzone should be rescaled, got %v", got)
+	}
+
+	prev := 0.5
+	for _, expo := range []float64{0.25, 0.5, 1} {
+		got := (curve{expo: expo}).apply(0.5)
+		if got >= prev {
+			t.Errorf("Bigger expo should bend mid value more, got %v for %v", got, expo)
+		}
+		prev = got
+	}
+	if got := (curve{expo: 1}).apply(-0.5); got != -0.125 {
+		t.Errorf("Full expo should be cubic, got %v", got)
+	}
+
+	driver := NewDriver()
+	driver.SetDeadzone(0.1)
+	driver.Sticks(0.05, -0.05, 0.05, -0.05)
+	if driver.cmd.String() != NewDriver().cmd.String() {
+		t.Errorf("Sticks inside deadzone should be neutral (%s)", driver.cmd.String())
+	}
+}
+
+func TestNewDriverE(t *testing.T) {
+	for _, address := range [][]string{
+		{"192.168.0.1:notaport"},
+		{"192.168.0.1:50000", "300.1.2.3:0"},
+	} {
+		driver, err := NewDriverE(address...)
+		if err == nil || driver != nil {
+			t.Errorf("Invalid address %v should return error and nil driver, got %v, %v", address, driver, err)
+		}
+	}
+	if _, err := NewDriverE("127.0.0.1:50000"); err != nil {
+		t.Errorf("Valid address should not return error, got %v", err)
+	}
+}
+
+// fakeClock is clock which moves only when advanced
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	timer := fakeTimer{c.now.Add(d), make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, timer)
+	return timer.c
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	waiting := c.waiters[:0]
+	for _, timer := range c.waiters {
+		if c.now.Before(timer.deadline) {
+			waiting = append(waiting, timer)
+		} else {
+			timer.c <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+// waitForTimer blocks until somebody waits for the clock
+func (c *fakeClock) waitForTimer(t *testing.T) {
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		c.Lock()
+		n := len(c.waiters)
+		c.Unlock()
+		if n > 0 {
+			return
+		}
+	}
+	t.Fatalf("Nobody is waiting for the clock")
+}
+
+func TestFailsafe(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	driver := NewDriver()
+	driver.clock = clock
+	neutral := driver.cmd.String()
+	fired := 0
+	driver.OnFailsafe(func() { fired++ })
+
+	driver.Sticks(1, 0, 0, 0)
+	clock.advance(time.Hour)
+	driver.checkFailsafe()
+	if driver.cmd.String() == neutral || fired != 0 {
+		t.Fatalf("Disabled failsafe should not center sticks")
+	}
+
+	driver.SetFailsafe(time.Second)
+	driver.Sticks(1, 0, 0, 0)
+	clock.advance(time.Second / 2)
+	driver.checkFailsafe()
+	driver.Sticks(1, 0, 0, 0) // resets the timeout
+	clock.advance(time.Second / 2)
+	driver.checkFailsafe()
+	if driver.cmd.String() == neutral || fired != 0 {
+		t.Fatalf("Failsafe should not trip before timeout")
+	}
+
+	clock.advance(time.Second / 2)
+	driver.checkFailsafe()
+	driver.checkFailsafe()
+	if driver.cmd.String() != neutral {
+		t.Errorf("Failsafe should center sticks after timeout (%s)", driver.cmd.String())
+	}
+	if fired != 1 {
+		t.Errorf("OnFailsafe should be called once, called %d times", fired)
+	}
+}
+
+func TestAutoLand(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	driver := NewDriver()
+	driver.clock = clock
+	driver.SetFailsafe(time.Second / 2)
+	driver.Sticks(0.5, 0.5, 0.5, 0)
+
+	done := make(chan error)
+	go func() {
+		done <- driver.AutoLandContext(context.Background())
+	}()
+
+	prev := byte(0xff)
+	for driver.CommandBytes()[flagsByte]&landFlag == 0 {
+		clock.waitForTimer(t)
+		data := driver.CommandBytes()
+		if data[flagsByte]&landFlag != 0 {
+			break
+		}
+		if data[throttleByte] > prev {
+			t.Fatalf("Throttle should descend monotonically, went from %02x to %02x", prev, data[throttleByte])
+		}
+		if data[yawByte] != 0x80 || data[pitchByte] != 0x80 {
+			t.Errorf("Other sticks should be centered (% x)", data)
+		}
+		prev = data[throttleByte]
+		driver.checkFailsafe() // should not interfere
+		clock.advance(autoLandStep)
+	}
+	if prev >= 0x80 {
+		t.Errorf("Throttle should end below neutral, got %02x", prev)
+	}
+	if driver.CommandBytes()[flagsByte]&stopFlag != 0 {
+		t.Errorf("Stop should not be issued together with Land")
+	}
+
+	clock.waitForTimer(t)
+	clock.advance(autoLandStopAfter)
+	if err := <-done; err != nil {
+		t.Errorf("AutoLand should end without error, got %v", err)
+	}
+	if driver.CommandBytes()[flagsByte]&stopFlag == 0 {
+		t.Errorf("Stop should be issued after Land")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		done <- driver.AutoLandContext(ctx)
+	}()
+	clock.waitForTimer(t)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Canceled AutoLand should return context.Canceled, got %v", err)
+	}
+}
+
+func TestBatteryDecode(t *testing.T) {
+	for _, tc := range []struct {
+		raw     byte
+		percent int
+	}{
+		{0x00, 0},
+		{0x32, 50},
+		{0x64, 100},
+		{0xc8, 100}, // out of range
+	} {
+		status := []byte{0x66, tc.raw, 0x80, 0x80, 0x80, 0x00, 0x00, 0x99}
+		status[crcByte] = crc(status)
+		telemetry, ok := parseTelemetry(status, time.Now())
+		if !ok {
+			t.Fatalf("Status frame % x should be valid", status)
+		}
+		if percent := telemetry.BatteryPercent(); percent != tc.percent {
+			t.Errorf("Battery byte %#x should be %d%%, got %d%%", tc.raw, tc.percent, percent)
+		}
+	}
+}
+
+// fakeDrone listens for commands on random local UDP port
+func fakeDrone(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// freeUDPAddr returns local address with port which is not used at the moment
+func freeUDPAddr(t *testing.T) string {
+	conn := fakeDrone(t)
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+func TestProbe(t *testing.T) {
+	defer func(orig time.Duration) { probeTimeout = orig }(probeTimeout)
+	probeTimeout = time.Millisecond * 100
+
+	drone := fakeDrone(t)
+	defer drone.Close()
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, from, err := drone.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if (&Cmd{data: buf[:n]}).isValid() {
+				drone.WriteToUDP(NewCommand().Bytes(), from) // status frame
+			}
+		}
+	}()
+	if err := Probe(drone.LocalAddr().String()); err != nil {
+		t.Errorf("Responding drone should pass the probe, got %v", err)
+	}
+
+	silent := fakeDrone(t)
+	defer silent.Close()
+	if err := Probe(silent.LocalAddr().String()); !errors.Is(err, ErrDroneNotResponding) {
+		t.Errorf("Silent drone should be ErrDroneNotResponding, got %v", err)
+	}
+	if err := Probe(freeUDPAddr(t)); !errors.Is(err, ErrDroneNotResponding) {
+		t.Errorf("Absent drone should be ErrDroneNotResponding, got %v", err)
+	}
+
+	defer func(orig func() ([]net.Addr, error)) { systemAddrs = orig }(systemAddrs)
+	systemAddrs = func() ([]net.Addr, error) {
+		_, ipNet, _ := net.ParseCIDR("10.0.0.5/8")
+		return []net.Addr{ipNet}, nil
+	}
+	if err := Probe(drone.LocalAddr().String()); !errors.Is(err, ErrNotOnDroneNetwork) {
+		t.Errorf("Drone out of subnets of the system should be ErrNotOnDroneNetwork, got %v", err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	addr := freeUDPAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmds, err := ListenContext(ctx, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := net.Dial("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	frame := NewCommand().Pitch(1).Flags(TakeOffFlag).Bytes()
+	app.Write([]byte{0x66, 0x80, 0x80, 0x80, 0x80, 0x00, 0x01, 0x99}) // wrong crc
+	app.Write(frame)
+	select {
+	case cmd := <-cmds:
+		if data := cmd.Bytes(); !bytes.Equal(data, frame) {
+			t.Errorf("Expected command % x, got % x", frame, data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No command received")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-cmds:
+		if ok {
+			t.Errorf("Only valid commands should be received")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Channel should be closed when ctx is done")
+	}
+}
+
+func TestRelay(t *testing.T) {
+	drone := fakeDrone(t)
+	defer drone.Close()
+	addr := freeUDPAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmds, err := Relay(ctx, addr, drone.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	app, err := net.Dial("udp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	frame := NewCommand().Flags(CompassFlag).Bytes()
+	app.Write(frame)
+	buf := make([]byte, 16)
+	drone.SetReadDeadline(time.Now().Add(time.Second))
+	n, relay, err := drone.ReadFromUDP(buf)
+	if err != nil || !bytes.Equal(buf[:n], frame) {
+		t.Fatalf("Drone should receive the frame, got % x (%v)", buf[:n], err)
+	}
+	select {
+	case cmd := <-cmds:
+		if !bytes.Equal(cmd.Bytes(), frame) {
+			t.Errorf("Tapped command should be % x, got % x", frame, cmd.Bytes())
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Relayed command should be tapped")
+	}
+
+	drone.WriteToUDP([]byte("telemetry"), relay)
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := app.Read(buf); err != nil || string(buf[:n]) != "telemetry" {
+		t.Errorf("App should receive reply of the drone, got %q (%v)", buf[:n], err)
+	}
+
+	large := bytes.Repeat([]byte{0xab}, 1000) // eg. other traffic than commands
+	app.Write(large)
+	buf = make([]byte, 2000)
+	drone.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := drone.ReadFromUDP(buf); err != nil || !bytes.Equal(buf[:n], large) {
+		t.Errorf("Large packet should be relayed whole, got %d bytes (%v)", n, err)
+	}
+	drone.WriteToUDP(large, relay)
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := app.Read(buf); err != nil || !bytes.Equal(buf[:n], large) {
+		t.Errorf("Large reply should be relayed whole, got %d bytes (%v)", n, err)
+	}
+}
+
+func TestTelemetry(t *testing.T) {
+	drone := fakeDrone(t)
+	defer drone.Close()
+
+	driver := NewDriver(drone.LocalAddr().String())
+	if _, ok := driver.Battery(); ok {
+		t.Errorf("Battery should be unknown before any status")
+	}
+	received := make(chan Telemetry, 1)
+	driver.OnTelemetry(func(telemetry Telemetry) {
+		received <- telemetry
+	})
+	goroutines := runtime.NumGoroutine()
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reply to the controller
+	buf := make([]byte, 8)
+	_, controller, err := drone.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drone.WriteToUDP([]byte{0x66, 0x01, 0x02}, controller) // invalid
+	status := []byte{0x66, 0x5a, 0x80, 0x80, 0x80, 0x00, 0x00, 0x99}
+	status[crcByte] = crc(status)
+	drone.WriteToUDP(status, controller)
+
+	select {
+	case telemetry := <-received:
+		if telemetry.Battery != 0x5a || telemetry.Received.IsZero() {
+			t.Errorf("Wrongly decoded telemetry %+v", telemetry)
+		}
+		if driver.Telemetry() != telemetry {
+			t.Errorf("Last telemetry not stored")
+		}
+		if percent, ok := driver.Battery(); !ok || percent != 90 {
+			t.Errorf("Unexpected battery %d%% (%v)", percent, ok)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Telemetry not received")
+	}
+
+	driver.Halt()
+	time.Sleep(time.Second / 10)
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("Radio goroutines should end after Halt (%d > %d)", n, goroutines)
+	}
+}
+
+// countPackets counts commands received by the fake drone during given duration
+func countPackets(drone *net.UDPConn, duration time.Duration) int {
+	buf := make([]byte, 16)
+	drone.SetReadDeadline(time.Now().Add(duration))
+	count := 0
+	for {
+		if _, _, err := drone.ReadFromUDP(buf); err != nil {
+			return count
+		}
+		count++
+	}
+}
+
+func TestStopConfirmed(t *testing.T) {
+	drone := fakeDrone(t)
+	defer drone.Close()
+	driver := NewDriver(drone.LocalAddr().String())
+
+	select {
+	case <-driver.StopConfirmed(0):
+	default:
+		t.Errorf("Zero frames should be confirmed right away")
+	}
+	select {
+	case <-driver.StopConfirmed(1):
+		t.Errorf("Stop should not be confirmed when radio is not running")
+	case <-time.After(time.Second / 10):
+	}
+
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-driver.StopConfirmed(5):
+	case <-time.After(time.Second):
+		t.Fatalf("Stop not confirmed")
+	}
+	driver.Halt()
+
+	// all transmitted frames wait in the socket
+	withFlag := 0
+	buf := make([]byte, 16)
+	drone.SetReadDeadline(time.Now().Add(time.Second / 10))
+	for {
+		n, _, err := drone.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		if n == 8 && buf[flagsByte]&stopFlag != 0 {
+			withFlag++
+		}
+	}
+	if withFlag < 5 {
+		t.Errorf("Stop confirmed after %d frames with the flag", withFlag)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	driver := NewDriver()
+	if driver.period() != time.Second/50 {
+		t.Errorf("Default period should be 20ms, got %v", driver.period())
+	}
+	for _, hz := range []int{0, -1, 201} {
+		if err := driver.SetRate(hz); err == nil {
+			t.Errorf("Rate %d Hz should be refused", hz)
+		}
+	}
+	if err := driver.SetRate(100); err != nil || driver.period() != 10*time.Millisecond {
+		t.Errorf("Period should reflect rate, got %v (%v)", driver.period(), err)
+	}
+
+	drone := fakeDrone(t)
+	defer drone.Close()
+	driver = NewDriver(drone.LocalAddr().String())
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Halt()
+	countPackets(drone, 100*time.Millisecond) // settle
+
+	driver.SetRate(10)
+	countPackets(drone, 150*time.Millisecond) // let the old tick pass
+	if n := countPackets(drone, time.Second); n < 8 || n > 12 {
+		t.Errorf("Expected ~10 packets per second after SetRate(10), got %d", n)
+	}
+}
+
+func TestRecording(t *testing.T) {
+	drone := fakeDrone(t)
+	defer drone.Close()
+	driver := NewDriver(drone.LocalAddr().String())
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Halt()
+
+	recording := &bytes.Buffer{}
+	driver.StartRecording(recording)
+	time.Sleep(100 * time.Millisecond)
+	driver.Sticks(1, 0, 0, 0)
+	time.Sleep(300 * time.Millisecond)
+	driver.StopRecording()
+	size := recording.Len()
+	time.Sleep(50 * time.Millisecond)
+	if recording.Len() != size {
+		t.Fatalf("Nothing should be recorded after StopRecording")
+	}
+	if size%recordSize != 0 || size/recordSize < 5 {
+		t.Fatalf("Unexpected size of recording %d", size)
+	}
+
+	replayed := NewDriver()
+	throttle := make(chan byte, 1)
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		throttle <- replayed.CommandBytes()[throttleByte]
+	}()
+	started := time.Now()
+	if err := replayed.Replay(recording); err != nil {
+		t.Fatalf("Replay should end without error, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed < 350*time.Millisecond {
+		t.Errorf("Replay should keep original timing, took only %v", elapsed)
+	}
+	if b := <-throttle; b != 0xff {
+		t.Errorf("Replayed throttle should be full, got %02x", b)
+	}
+
+	if err := replayed.Replay(bytes.NewReader(make([]byte, recordSize+3))); err == nil {
+		t.Errorf("Truncated recording should return error")
+	}
+}
+
+func TestFleet(t *testing.T) {
+	drones := []*net.UDPConn{fakeDrone(t), fakeDrone(t)}
+	defer drones[0].Close()
+	defer drones[1].Close()
+	fleet := NewFleet(
+		NewDriver(drones[0].LocalAddr().String()),
+		NewDriver(drones[1].LocalAddr().String()),
+	)
+	if fleet.Len() != 2 {
+		t.Fatalf("Fleet should have 2 drones, has %d", fleet.Len())
+	}
+	if err := fleet.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	fleet.Sticks(1, 0, 0, 0)
+	fleet.Drone(1).Sticks(0, 0, 1, 0)
+	buf := make([]byte, 16)
+	for i, expected := range [][2]byte{{0xff, 0x80}, {0x80, 0xff}} {
+		countPackets(drones[i], 50*time.Millisecond) // skip older commands
+		drones[i].SetReadDeadline(time.Now().Add(time.Second))
+		if _, _, err := drones[i].ReadFromUDP(buf); err != nil {
+			t.Fatalf("Drone %d didn't receive command: %v", i, err)
+		}
+		if buf[throttleByte] != expected[0] || buf[pitchByte] != expected[1] {
+			t.Errorf("Drone %d received unexpected command % x", i, buf[:8])
+		}
+	}
+
+	fleet.Drone(0).Halt()
+	fleet.Drone(0).Lock()
+	fleet.Drone(0).err = errors.New("broken") // halted with error
+	fleet.Drone(0).Unlock()
+	if err := fleet.Halt(); err == nil || !strings.Contains(err.Error(), "drone 0") {
+		t.Errorf("Halt should return error of first drone, got %v", err)
+	}
+	for i := 0; i < fleet.Len(); i++ {
+		fleet.Drone(i).Lock()
+		if fleet.Drone(i).enabled {
+			t.Errorf("Drone %d should be halted", i)
+		}
+		fleet.Drone(i).Unlock()
+	}
+}
+
+func TestSequence(t *testing.T) {
+	drone := fakeDrone(t)
+	defer drone.Close()
+	driver := NewDriver(drone.LocalAddr().String())
+	driver.SetRetryPolicy(RetryPolicy{Attempts: 1, Pulse: time.Millisecond * 50})
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := driver.Sequence().
+		TakeOff().Wait(time.Millisecond*100).
+		Forward(0.5, time.Millisecond*100).
+		Hover().Wait(time.Millisecond * 100).
+		Land().Wait(time.Millisecond * 100).
+		Run(context.Background())
+	if err != nil {
+		t.Errorf("Sequence should succeed, got %v", err)
+	}
+	driver.Halt()
+
+	// compress received frames into phases
+	phases := []string{}
+	buf := make([]byte, 16)
+	drone.SetReadDeadline(time.Now().Add(time.Second / 10))
+	for {
+		n, _, err := drone.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		frame := buf[:n]
+		phase := "hover"
+		switch {
+		case frame[flagsByte]&takeOffFlag != 0:
+			phase = "takeoff"
+		case frame[flagsByte]&landFlag != 0:
+			phase = "land"
+		case frame[pitchByte] > 0x80:
+			phase = "forward"
+		}
+		if len(phases) == 0 || phases[len(phases)-1] != phase {
+			phases = append(phases, phase)
+		}
+	}
+	got := strings.Join(phases, " ")
+	got = strings.TrimSuffix(strings.TrimPrefix(got, "hover "), " hover") // before Start and after Land
+	if expected := "takeoff hover forward hover land"; got != expected {
+		t.Errorf("Expected phases %q, got %q", expected, got)
+	}
+}
+
+func TestSequenceAbort(t *testing.T) {
+	drone := fakeDrone(t)
+	defer drone.Close()
+	driver := NewDriver(drone.LocalAddr().String())
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Halt()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	err := driver.Sequence().Forward(1, time.Second).Land().Run(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Canceled sequence should return ctx error, got %v", err)
+	}
+	if _, _, forwards, _ := driver.CurrentSticks(); forwards != 0 {
+		t.Errorf("Drone should hover after cancel, forwards %v", forwards)
+	}
+	if driver.CommandBytes()[flagsByte]&landFlag != 0 {
+		t.Errorf("Steps after cancel should be skipped")
+	}
+
+	breakConn(driver)
+	err = driver.Sequence().Wait(time.Second).Run(context.Background())
+	if !errors.Is(err, ErrLinkLost) {
+		t.Errorf("Broken connection should be lost link, got %v", err)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	driver := NewDriver()
+	if driver.Flags() != 0 {
+		t.Errorf("No flags should be set by default, got %08b", driver.Flags())
+	}
+	driver.CompassOn()
+	driver.SetFlag(GyroFlag|VideoFlag, true)
+	if flags := driver.Flags(); flags != CompassFlag|GyroFlag|VideoFlag {
+		t.Errorf("Unexpected flags %08b", flags)
+	}
+	driver.SetFlag(VideoFlag, false)
+	driver.CompassOff()
+	if flags := driver.Flags(); flags != GyroFlag {
+		t.Errorf("Unexpected flags %08b", flags)
+	}
+	if cmd := (Cmd{data: driver.CommandBytes()}); !cmd.isValid() {
+		t.Errorf("Cmd should stay valid, got % x", cmd.data)
+	}
+}
+
+func TestToggleCompass(t *testing.T) {
+	driver := NewDriver()
+	driver.SetFlag(GyroFlag, true)
+	for i, expected := range []bool{true, false, true} {
+		if enabled := driver.ToggleCompass(); enabled != expected {
+			t.Errorf("Toggle %d should return %v, got %v", i, expected, enabled)
+		}
+		if driver.CompassEnabled() != expected || (driver.Flags()&CompassFlag != 0) != expected {
+			t.Errorf("Toggle %d should set compass flag to %v, got %08b", i, expected, driver.Flags())
+		}
+		if driver.Flags()&GyroFlag == 0 {
+			t.Errorf("Toggle should keep other flags, got %08b", driver.Flags())
+		}
+	}
+	if cmd := (Cmd{data: driver.CommandBytes()}); !cmd.isValid() {
+		t.Errorf("Cmd should stay valid, got % x", cmd.data)
+	}
+	driver.CompassOff()
+	if driver.CompassEnabled() {
+		t.Errorf("Compass should be disabled by CompassOff")
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	drone := fakeDrone(t)
+	addr := drone.LocalAddr().(*net.UDPAddr)
+
+	driver := NewDriver(addr.String())
+	failed := make(chan error, 100)
+	driver.OnError(func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	})
+	reconnected := make(chan bool, 10)
+	driver.OnReconnect(func() {
+		reconnected <- true
+	})
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.Halt()
+
+	// drone gone; refused packets are noticed by telemetry reading,
+	// so break the socket to get the write error
+	drone.Close()
+	breakConn(driver)
+	for i := 0; i < 2; i++ { // the write error and at least one failed attempt
+		select {
+		case <-failed:
+		case <-time.After(time.Second):
+			t.Fatalf("Write error %d not reported", i)
+		}
+	}
+	select {
+	case <-reconnected:
+		t.Fatalf("Reconnected to missing drone")
+	default:
+	}
+
+	drone, err := net.ListenUDP("udp4", addr) // drone back
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer drone.Close()
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second * 3):
+		t.Fatalf("Not reconnected")
+	}
+	driver.Sticks(0, 0, 1, 0)
+	buf := make([]byte, 16)
+	drone.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		if _, _, err := drone.ReadFromUDP(buf); err != nil {
+			t.Fatalf("Transmission not resumed: %v", err)
+		}
+		if buf[pitchByte] == 0xff {
+			break
+		}
+	}
+}
+
+func TestMemoryTransport(t *testing.T) {
+	transport := &MemoryTransport{}
+	driver, err := NewDriverWith(WithTransport(transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second / 10)
+	driver.Sticks(0, 0, 1, 0)
+	time.Sleep(time.Second / 10)
+	driver.Halt()
+
+	frames := transport.Frames()
+	if len(frames) < 5 {
+		t.Fatalf("Expected frames to be recorded, got %d", len(frames))
+	}
+	if first := frames[0]; first[pitchByte] != 0x80 || !(&Cmd{data: first}).isValid() {
+		t.Errorf("Unexpected first frame % x", first)
+	}
+	if last := frames[len(frames)-1]; last[pitchByte] != 0xff {
+		t.Errorf("Unexpected last frame % x", last)
+	}
+}
+
+func TestFuncTransport(t *testing.T) {
+	sent := make(chan []byte, 1000)
+	driver, _ := NewDriverWith(WithTransport(FuncTransport(func(frame []byte) {
+		sent <- append([]byte(nil), frame...)
+	})))
+	driver.Start()
+	defer driver.Halt()
+	driver.TakeOff()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case frame := <-sent:
+			if frame[flagsByte]&TakeOffFlag != 0 {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("No frame with TakeOffFlag sent")
+		}
+	}
+}
+
+// failingTransport returns error for every frame
+type failingTransport struct{}
+
+func (failingTransport) Send([]byte) error {
+	return errors.New("no link")
+}
+
+func TestTransportError(t *testing.T) {
+	driver, _ := NewDriverWith(WithTransport(failingTransport{}))
+	failed := make(chan error, 100)
+	driver.OnError(func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	})
+	driver.Start()
+	select {
+	case err := <-failed:
+		if err.Error() != "no link" {
+			t.Errorf("Unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Transport error not reported")
+	}
+	driver.Halt()
+}
+
+// breakConn closes connection of running radio loop, so writes to it fail
+func breakConn(driver *Driver) {
+	driver.Lock()
+	driver.conn.Close()
+	driver.Unlock()
+}
+
+func TestHaltNonBlocking(t *testing.T) {
+	drone := fakeDrone(t)
+	defer drone.Close()
+
+	driver := NewDriver(drone.LocalAddr().String())
+	failed := make(chan error, 100)
+	driver.OnError(func(err error) {
+		select {
+		case failed <- err:
+		default:
+		}
+	})
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	breakConn(driver)
+
+	select {
+	case <-failed:
+	case <-time.After(time.Second):
+		t.Fatalf("Write error not triggered")
+	}
+
+	halted := make(chan bool)
+	go func() {
+		driver.Halt()
+		driver.Halt() // idempotent
+		halted <- true
+	}()
+	select {
+	case <-halted:
+	case <-time.After(time.Second):
+		t.Fatalf("Halt blocks")
+	}
+
+	// can be started again
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	driver.Halt()
+}
+
+// Run with -race
+func TestHaltRace(t *testing.T) {
+	drone := fakeDrone(t)
+	defer drone.Close()
+
+	driver := NewDriver(drone.LocalAddr().String())
+	driver.OnError(func(err error) {})
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	breakConn(driver)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Second / 20)
+			driver.Halt()
+		}()
+	}
+	wg.Wait()
+	driver.Start()
+	driver.Halt()
+}
+
+func TestGoContext(t *testing.T) {
+	driver := NewDriver("192.168.0.1:50000")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Second/20, cancel)
+	start := time.Now()
+	if err := driver.GoForwardContext(ctx, 0.5); err != context.Canceled {
+		t.Errorf("Canceled movement should return context.Canceled, got %v", err)
+	}
+	if time.Since(start) > time.Second/4 {
+		t.Errorf("Canceled movement should return early")
+	}
+	if driver.cmd.data[pitchByte] != 0x80 {
+		t.Errorf("Canceled movement should hover (%s)", driver.cmd.String())
+	}
+
+	if err := driver.DoFrontFlipContext(context.Background()); err != nil {
+		t.Errorf("Finished flip should return nil, got %v", err)
+	}
+}
+
+func TestHoldThrottle(t *testing.T) {
+	transport := &MemoryTransport{}
+	driver, err := NewDriverWith(WithTransport(transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.Start()
+	if err := driver.HoldThrottle(0.5); err != nil {
+		t.Fatal(err)
+	}
+	for _, forwards := range []float64{1, -1, 0.5} {
+		driver.Sticks(-1, 0, forwards, 0)
+		time.Sleep(time.Second / 20)
+	}
+	driver.Hover()
+	time.Sleep(time.Second / 20)
+	if !driver.IsThrottleHeld() {
+		t.Errorf("Throttle should be held")
+	}
+	driver.ReleaseThrottle()
+	driver.Sticks(-1, 0, 0, 0)
+	time.Sleep(time.Second / 20)
+	driver.Halt()
+
+	frames := transport.Frames()
+	held := normalizeAround(0.5, 0x80)
+	pitches := map[byte]bool{}
+	released := false
+	for _, frame := range frames {
+		if frame[throttleByte] == 0x01 {
+			released = true
+			continue
+		}
+		if released {
+			t.Fatalf("Throttle should not be held after release, got % x", frame)
+		}
+		if frame[throttleByte] != held && frame[throttleByte] != 0x80 { // 0x80 before the hold
+			t.Errorf("Throttle should stay at %#x, got % x", held, frame)
+		}
+		pitches[frame[pitchByte]] = true
+	}
+	if len(pitches) < 4 || !released {
+		t.Errorf("Other axes should change (%v) and throttle should be released (%v)", pitches, released)
+	}
+	if driver.IsThrottleHeld() {
+		t.Errorf("Halt should release the hold")
+	}
+}
+
+func TestHoldThrottleFailsafe(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	driver := NewDriver()
+	driver.clock = clock
+	driver.SetFailsafe(time.Second)
+	driver.HoldThrottle(1)
+	clock.advance(time.Second * 2)
+	driver.checkFailsafe()
+	if up, _, _, _ := driver.CurrentSticks(); up != 0 || driver.IsThrottleHeld() {
+		t.Errorf("Failsafe should release the hold, throttle %v", up)
+	}
+}
+
+func TestHoldThrottleAutoLand(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	driver := NewDriver()
+	driver.clock = clock
+	driver.HoldThrottle(0.5)
+	held := driver.CommandBytes()[throttleByte]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- driver.AutoLandContext(ctx)
+	}()
+	for i := 0; i < 3; i++ {
+		clock.waitForTimer(t)
+		clock.advance(autoLandStep)
+	}
+	clock.waitForTimer(t)
+	if throttle := driver.CommandBytes()[throttleByte]; throttle >= held || driver.IsThrottleHeld() {
+		t.Errorf("AutoLand should release the hold and lower throttle from %#x, got %#x", held, throttle)
+	}
+	cancel()
+	<-done
+
+	driver.HoldThrottle(0.5)
+	var throttle byte
+	driver.Descend(0.5, func() bool {
+		throttle = driver.CommandBytes()[throttleByte]
+		return true
+	})
+	if throttle >= 0x80 || driver.IsThrottleHeld() {
+		t.Errorf("Descend should release the hold and lower throttle, got %#x", throttle)
+	}
+
+	driver.HoldThrottle(0.5)
+	driver.Land()
+	if driver.IsThrottleHeld() {
+		t.Errorf("Land should release the hold")
+	}
+}
+
+func TestCmdMarshal(t *testing.T) {
+	driver := NewDriver()
+	driver.Sticks(0.5, -1, 0, 1)
+	driver.SetFlag(CompassFlag, true)
+	data, err := driver.cmd.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := NewCmd()
+	if err := cmd.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.String() != driver.cmd.String() {
+		t.Errorf("Round-trip changed command: %s → %s", driver.cmd.String(), cmd.String())
+	}
+	buf := &bytes.Buffer{}
+	if n, err := cmd.WriteTo(buf); err != nil || n != 8 || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("WriteTo wrote % x (%v)", buf.Bytes(), err)
+	}
+
+	data[rollByte]++ // breaks crc
+	if err := cmd.UnmarshalBinary(data); !errors.Is(err, ErrInvalidCmd) {
+		t.Errorf("Wrong crc should be invalid, got %v", err)
+	}
+	if err := cmd.UnmarshalBinary(data[:7]); !errors.Is(err, ErrInvalidCmd) {
+		t.Errorf("Short command should be invalid, got %v", err)
+	}
+}
+
+func TestNewCommand(t *testing.T) {
+	data := NewCommand().Roll(0.5).Pitch(-0.2).Flags(TakeOffFlag).Bytes()
+	if cmd := (Cmd{data: data}); !cmd.isValid() {
+		t.Fatalf("Built command should be valid, got % x", data)
+	}
+	if data[rollByte] != normalize(0.5) || data[pitchByte] != normalize(-0.2) || data[flagsByte] != TakeOffFlag {
+		t.Errorf("Wrong command % x", data)
+	}
+
+	driver := NewDriver()
+	driver.Sticks(0, 0, -0.2, 0.5)
+	driver.SetFlag(TakeOffFlag, true)
+	if expected := driver.CommandBytes(); !bytes.Equal(data, expected) {
+		t.Errorf("Built command should match the one of driver, % x != % x", data, expected)
+	}
+
+	data = NewCommand().Yaw(-3).Throttle(1).Stick(Axis(0), 1).Flags(CompassFlag | GyroFlag).Flags(LandFlag).Bytes()
+	if cmd := (Cmd{data: data}); !cmd.isValid() {
+		t.Fatalf("Built command should be valid, got % x", data)
+	}
+	if data[yawByte] != 0x01 || data[throttleByte] != 0xff || data[0] != 0x66 || data[flagsByte] != LandFlag {
+		t.Errorf("Wrong command % x", data)
+	}
+}
+
+func TestDecodeCmd(t *testing.T) {
+	sticks := map[Axis]float64{Roll: 0.5, Pitch: -0.2, Throttle: -1, Yaw: 0.75}
+	cmd := NewCommand().Flags(TakeOffFlag | CompassFlag)
+	for axis, val := range sticks {
+		cmd.Stick(axis, val)
+	}
+	decoded := (&Cmd{data: cmd.Bytes()}).Decode()
+	for axis, val := range map[Axis]float64{
+		Roll: decoded.Roll, Pitch: decoded.Pitch, Throttle: decoded.Throttle, Yaw: decoded.Yaw,
+	} {
+		if math.Abs(val-sticks[axis]) > 1.0/127 {
+			t.Errorf("Decoded %s should be %.2f, got %f", axis, sticks[axis], val)
+		}
+	}
+	if decoded.Flags != TakeOffFlag|CompassFlag {
+		t.Errorf("Unexpected decoded flags %08b", decoded.Flags)
+	}
+	if str := decoded.String(); str != "roll=+0.50 pitch=-0.20 throttle=-1.00 yaw=+0.75 flags=[takeoff,compass]" {
+		t.Errorf("Unexpected dump %q", str)
+	}
+	if str := NewCommand().Decode().String(); str != "roll=0.00 pitch=0.00 throttle=0.00 yaw=0.00 flags=[]" {
+		t.Errorf("Unexpected dump of neutral command %q", str)
+	}
+	telemetry := Telemetry{Data: [8]byte{0x66, 85, 0, 0, 0, 0, 85, 0x99}, Battery: 85}
+	if str := telemetry.String(); str != "battery=85% frame=66 55 00 00 00 00 55 99" {
+		t.Errorf("Unexpected telemetry dump %q", str)
+	}
+}
+
+func TestWithChecksum(t *testing.T) {
+	xor := func(frame []byte) (sum byte) {
+		for _, b := range frame {
+			sum ^= b
+		}
+		return sum
+	}
+	if _, err := NewDriverWith(WithChecksum(nil)); err == nil {
+		t.Errorf("Nil checksum should be refused")
+	}
+
+	transport := &MemoryTransport{}
+	driver, err := NewDriverWith(WithTransport(transport), WithChecksum(xor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.SetRamp(1)
+	driver.Start()
+	driver.Sticks(1, 0, 0.5, 0)
+	time.Sleep(time.Millisecond * 100)
+	driver.Halt()
+	frames := transport.Frames()
+	if len(frames) == 0 {
+		t.Fatal("No frames sent")
+	}
+	for _, frame := range frames {
+		if frame[crcByte] != xor(append(append([]byte(nil), frame[:crcByte]...), 0, 0x99)) {
+			t.Errorf("Frame % x should have custom checksum", frame)
+		}
+	}
+	if !driver.cmd.isValid() {
+		t.Errorf("Cmd with custom checksum should be valid (%s)", driver.cmd.String())
+	}
+	if err := driver.cmd.UnmarshalBinary(NewCommand().Roll(1).Bytes()); !errors.Is(err, ErrInvalidCmd) {
+		t.Errorf("Frame with default checksum should be invalid for custom one, got %v", err)
+	}
+
+	data := NewCommand().UseChecksum(xor).Roll(0.5).Bytes()
+	if cmd := (Cmd{data: data, checksum: xor}); !cmd.isValid() || data[crcByte] == Checksum(data) {
+		t.Errorf("Command builder should use custom checksum, got % x", data)
+	}
+}
+
+func TestWithInterface(t *testing.T) {
+	defer func(orig func(string) ([]net.Addr, error)) { interfaceAddrs = orig }(interfaceAddrs)
+	interfaceAddrs = func(name string) ([]net.Addr, error) {
+		cidrs := map[string][]string{
+			"eth0":  {"fe80::1/64", "10.0.0.5/8"},
+			"wlan0": {"fe80::2/64", "192.168.1.20/24", "192.168.0.7/24", "192.168.0.3/24"},
+			"ipv6":  {"fe80::3/64"},
+		}[name]
+		if cidrs == nil {
+			return nil, errors.New("no such network interface")
+		}
+		addrs := []net.Addr{&net.IPAddr{IP: net.IPv4(1, 2, 3, 4)}} // not IPNet
+		for _, cidr := range cidrs {
+			ip, ipNet, _ := net.ParseCIDR(cidr)
+			addrs = append(addrs, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+		}
+		return addrs, nil
+	}
+
+	for _, test := range []struct{ iface, drone, expected string }{
+		{"eth0", "192.168.0.1:50000", "10.0.0.5"},
+		{"wlan0", "192.168.0.1:50000", "192.168.0.3"},
+		{"wlan0", "192.168.1.1:50000", "192.168.1.20"},
+		{"wlan0", "172.16.0.1:50000", "192.168.0.3"}, // smallest when none is in subnet
+	} {
+		driver, err := NewDriverWith(WithAddress(test.drone), WithInterface(test.iface))
+		if err != nil {
+			t.Errorf("%s: %v", test.iface, err)
+			continue
+		}
+		if ip := driver.laddr.IP.String(); ip != test.expected {
+			t.Errorf("Source of %s for drone %s should be %s, got %s", test.iface, test.drone, test.expected, ip)
+		}
+	}
+	for _, iface := range []string{"ipv6", "missing"} {
+		if _, err := NewDriverWith(WithInterface(iface)); err == nil {
+			t.Errorf("Interface %q should be refused", iface)
+		}
+	}
+}
+
+func TestPause(t *testing.T) {
+	transport := &MemoryTransport{}
+	driver, err := NewDriverWith(WithTransport(transport))
+	if err != nil {
+		t.Fatal(err)
+	}
+	driver.Start()
+	defer driver.Halt()
+	time.Sleep(time.Millisecond * 100)
+	if len(transport.Frames()) == 0 {
+		t.Fatal("No frames sent before pause")
+	}
+
+	driver.TakeOff()
+	driver.Pause()
+	if !driver.Paused() {
+		t.Error("Driver should be paused")
+	}
+	time.Sleep(time.Millisecond * 50) // frame in flight
+	paused := len(transport.Frames())
+	time.Sleep(time.Millisecond * 200)
+	if n := len(transport.Frames()); n != paused {
+		t.Errorf("%d frames sent while paused", n-paused)
+	}
+	if status := driver.Status(); !status.Enabled {
+		t.Error("Radio loop should keep running while paused")
+	}
+
+	driver.Resume()
+	if driver.Paused() {
+		t.Error("Driver should not be paused after Resume")
+	}
+	time.Sleep(time.Millisecond * 100)
+	frames := transport.Frames()
+	if len(frames) <= paused {
+		t.Fatal("Transmission should continue after Resume")
+	}
+	if last := frames[len(frames)-1]; last[flagsByte]&TakeOffFlag != 0 {
+		t.Errorf("Pending take off should be canceled by pause, got % x", last)
+	}
+
+	driver.Pause()
+	driver.Start()
+	if driver.Paused() {
+		t.Error("Start should resume paused driver")
+	}
+}
+
+func TestNudge(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	driver := NewDriver()
+	driver.clock = clock
+
+	start := time.Now()
+	driver.NudgeLeft(1, time.Second)
+	driver.NudgeForward(1, time.Second*2)
+	if time.Since(start) > time.Millisecond*100 {
+		t.Errorf("Nudges should not block")
+	}
+	if _, _, forwards, sideways := driver.CurrentSticks(); forwards != 1 || sideways != -1 {
+		t.Errorf("Sticks should be moved, got %v %v", forwards, sideways)
+	}
+
+	clock.advance(time.Second)
+	driver.checkNudges()
+	if _, _, forwards, sideways := driver.CurrentSticks(); forwards != 1 || sideways != 0 {
+		t.Errorf("Only first nudge should be over, got %v %v", forwards, sideways)
+	}
+
+	driver.NudgeForward(1, time.Second*2) // prolongs
+	clock.advance(time.Second)
+	driver.checkNudges()
+	if _, _, forwards, _ := driver.CurrentSticks(); forwards != 1 {
+		t.Errorf("Repeated nudge should be prolonged, got %v", forwards)
+	}
+
+	driver.Sticks(0, 0, -1, 0) // takes over the axis
+	clock.advance(time.Second * 2)
+	driver.checkNudges()
+	if _, _, forwards, _ := driver.CurrentSticks(); forwards != -1 {
+		t.Errorf("Axis moved by other command should not be centered, got %v", forwards)
+	}
+}
+
+func TestMove(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	driver := NewDriver()
+	driver.clock = clock
+
+	done, err := driver.Move(MoveSpec{Pitch: 0.5, Yaw: -1, Throttle: 0.25, Duration: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up, rotate, forwards, sideways := driver.CurrentSticks(); math.Abs(up-0.25) > 0.01 || rotate != -1 ||
+		math.Abs(forwards-0.5) > 0.01 || sideways != 0 {
+		t.Errorf("Axes should be set by the move, got %v %v %v %v", up, rotate, forwards, sideways)
+	}
+
+	clock.advance(time.Second / 2)
+	select {
+	case <-done:
+		t.Fatal("Move should last for its duration")
+	case <-time.After(time.Millisecond * 20):
+	}
+	if _, rotate, _, _ := driver.CurrentSticks(); rotate != -1 {
+		t.Errorf("Axes should stay set during the move, got yaw %v", rotate)
+	}
+
+	clock.advance(time.Second / 2)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Move should end after its duration")
+	}
+	if up, rotate, forwards, sideways := driver.CurrentSticks(); up != 0 || rotate != 0 || forwards != 0 || sideways != 0 {
+		t.Errorf("Sticks should be neutral after the move, got %v %v %v %v", up, rotate, forwards, sideways)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done, _ = driver.MoveContext(ctx, MoveSpec{Roll: 1, Duration: time.Hour})
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Canceled move should end")
+	}
+	if _, _, _, sideways := driver.CurrentSticks(); sideways != 0 {
+		t.Errorf("Canceled move should hover, got roll %v", sideways)
+	}
+
+	first, _ := driver.Move(MoveSpec{Roll: 1, Pitch: 1, Duration: time.Second})
+	clock.advance(time.Second / 2)
+	second, _ := driver.Move(MoveSpec{Roll: -1, Duration: time.Second}) // takes over roll and centers pitch
+	driver.Sticks(1, 0, 0, -1)                                          // takes over throttle too
+	clock.advance(time.Second / 2)
+	<-first
+	if up, _, _, sideways := driver.CurrentSticks(); up != 1 || sideways != -1 {
+		t.Errorf("End of first move should not cut off later commands, got throttle %v roll %v", up, sideways)
+	}
+	clock.advance(time.Second / 2)
+	<-second
+	if up, _, _, sideways := driver.CurrentSticks(); up != 1 || sideways != 0 {
+		t.Errorf("Second move should center only its unchanged axes, got throttle %v roll %v", up, sideways)
+	}
+
+	done, err = driver.Move(MoveSpec{Pitch: 2, Duration: time.Millisecond})
+	if !errors.Is(err, ErrStickRange) {
+		t.Errorf("Out of range move should be ErrStickRange, got %v", err)
+	}
+	if _, _, forwards, _ := driver.CurrentSticks(); forwards != 1 {
+		t.Errorf("Out of range value should be clamped, got %v", forwards)
+	}
+	clock.advance(time.Millisecond)
+	<-done
+}
+
+func TestRadioPanic(t *testing.T) {
+	var panicking int32 = 1
+	sent := make(chan bool, 1000)
+	driver, _ := NewDriverWith(WithTransport(FuncTransport(func(frame []byte) {
+		if atomic.LoadInt32(&panicking) == 1 {
+			panic("broken transport")
+		}
+		sent <- true
+	})))
+	errs := make(chan error, 10)
+	driver.OnError(func(err error) { errs <- err })
+
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrRadioPanic) {
+			t.Errorf("Panic should be reported as ErrRadioPanic, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Panic should be reported by OnError")
+	}
+
+	atomic.StoreInt32(&panicking, 0)
+	if err := driver.Start(); err != nil {
+		t.Errorf("Driver should start again, got %v", err)
+	}
+	defer driver.Halt()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Errorf("Restarted driver should transmit")
+	}
+}
+
+// runTakeOff runs TakeOffAndHover with fake clock, before each poll it calls tick
+func runTakeOff(driver *Driver, clock *fakeClock, tick func()) (time.Duration, error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- driver.TakeOffAndHover(context.Background())
+	}()
+	start := clock.Now()
+	for {
+		select {
+		case err := <-done:
+			return clock.Now().Sub(start), err
+		default:
+		}
+		clock.Lock()
+		waiting := len(clock.waiters)
+		clock.Unlock()
+		if waiting == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		tick()
+		clock.advance(takeOffPoll)
+	}
+}
+
+func TestTakeOffAndHoverDelay(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	driver := NewDriver()
+	driver.clock = clock
+	driver.SetAirborneCheck(func(Telemetry) bool { return true }) // but there is no telemetry
+	driver.Sticks(1, 1, 1, 1)
+
+	elapsed, err := runTakeOff(driver, clock, func() {
+		if driver.Flags()&TakeOffFlag == 0 {
+			t.Fatalf("TakeOff flag should be set")
+		}
+	})
+	if err != nil || elapsed != takeOffDelay {
+		t.Errorf("Without telemetry fixed delay should be waited, got %v (%v)", elapsed, err)
+	}
+	if up, rotate, forwards, sideways := driver.CurrentSticks(); up != 0 || rotate != 0 || forwards != 0 || sideways != 0 {
+		t.Errorf("Drone should hover")
+	}
+}
+
+func TestTakeOffAndHoverTelemetry(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	driver := NewDriver()
+	driver.clock = clock
+	driver.SetAirborneCheck(func(telemetry Telemetry) bool { return telemetry.Data[2] == 1 })
+
+	polls := 0
+	elapsed, err := runTakeOff(driver, clock, func() {
+		polls++
+		telemetry := Telemetry{Received: clock.Now()}
+		if polls > 20 {
+			telemetry.Data[2] = 1 // airborne
+		}
+		driver.telemetryMu.Lock()
+		driver.telemetry = telemetry
+		driver.telemetryMu.Unlock()
+	})
+	if err != nil || elapsed != 21*takeOffPoll {
+		t.Errorf("Should wait until telemetry reports airborne drone, waited %v (%v)", elapsed, err)
+	}
+
+	driver.SetAirborneCheck(func(Telemetry) bool { return false })
+	elapsed, err = runTakeOff(driver, clock, func() {
+		driver.telemetryMu.Lock()
+		driver.telemetry = Telemetry{Received: clock.Now()}
+		driver.telemetryMu.Unlock()
+	})
+	if !errors.Is(err, ErrTakeOffTimeout) || elapsed != takeOffTimeout {
+		t.Errorf("Should time out, waited %v (%v)", elapsed, err)
+	}
+}
+
+// recordingLogger keeps logged messages as "level msg"
+type recordingLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) add(level, msg string) {
+	l.Lock()
+	l.lines = append(l.lines, level+" "+msg)
+	l.Unlock()
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.add("debug", msg) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.add("info", msg) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.add("warn", msg) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.add("error", msg) }
+
+// waitFor waits until line is logged
+func (l *recordingLogger) waitFor(line string) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		l.Lock()
+		for _, logged := range l.lines {
+			if logged == line {
+				l.Unlock()
+				return true
+			}
+		}
+		l.Unlock()
+		time.Sleep(time.Millisecond * 5)
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	driver, _ := NewDriverWith(WithTransport(&MemoryTransport{}), WithLogger(logger))
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.waitFor("debug radio start") {
+		t.Errorf("Radio start should be logged at debug level, got %q", logger.lines)
+	}
+	driver.Halt()
+	if !logger.waitFor("debug radio end") {
+		t.Errorf("Radio end should be logged at debug level, got %q", logger.lines)
+	}
+
+	driver.SetLogger(nil) // no-op, must not panic
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	driver.Halt()
+}
+
+func TestLoggerRadioPanic(t *testing.T) {
+	logger := &recordingLogger{}
+	driver, _ := NewDriverWith(WithTransport(FuncTransport(func([]byte) {
+		panic("broken transport")
+	})))
+	driver.SetLogger(logger)
+	if err := driver.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !logger.waitFor("error radio panic") {
+		t.Errorf("Radio panic should be logged as error, got %q", logger.lines)
+	}
+}
+
+// switchTransport fails when failing is set
+type switchTransport struct {
+	failing int32
+}
+
+func (s *switchTransport) Send([]byte) error {
+	if atomic.LoadInt32(&s.failing) == 1 {
+		return errors.New("no link")
+	}
+	return nil
+}
+
+// slowTransport advances the clock by took on each successful send
+type slowTransport struct {
+	switchTransport
+	clock *fakeClock
+	took  time.Duration
+}
+
+func (s *slowTransport) Send(data []byte) error {
+	if err := s.switchTransport.Send(data); err != nil {
+		return err
+	}
+	s.clock.advance(s.took)
+	return nil
+}
+
+// waitForStatus polls Status until cond holds
+func waitForStatus(driver *Driver, cond func(Status) bool) (Status, bool) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		status := driver.Status()
+		if cond(status) || time.Now().After(deadline) {
+			return status, cond(status)
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	transport := &switchTransport{}
+	driver, _ := NewDriverWith(WithTransport(transport))
+	if status := driver.Status(); driver.Connected() || status != (Status{}) {
+		t.Errorf("Not started driver should have empty status, got %+v", status)
+	}
+
+	driver.Start()
+	if !driver.Connected() {
+		t.Errorf("Started driver should be connected")
+	}
+	status, ok := waitForStatus(driver, func(s Status) bool { return s.FramesSent >= 2 })
+	if !ok || !status.Enabled || status.Err != nil {
+		t.Errorf("Started driver should send frames, got %+v", status)
+	}
+
+	atomic.StoreInt32(&transport.failing, 1)
+	status, ok = waitForStatus(driver, func(s Status) bool { return s.Err != nil })
+	if !ok || !status.Enabled {
+		t.Errorf("Failing driver should report error, got %+v", status)
+	}
+	sent := status.FramesSent
+	time.Sleep(time.Millisecond * 100)
+	if status := driver.Status(); status.FramesSent != sent || status.SinceLastSent < time.Millisecond*100 {
+		t.Errorf("Failed frames should not be counted, got %+v (%d before)", status, sent)
+	}
+
+	driver.Halt()
+	if status := driver.Status(); driver.Connected() || status.Enabled || status.Err != nil {
+		t.Errorf("Halted driver should be disabled without error, got %+v", status)
+	}
+
+	atomic.StoreInt32(&transport.failing, 0)
+	driver.Start()
+	defer driver.Halt()
+	if status := driver.Status(); status.FramesSent > 1 { // first one might be sent already
+		t.Errorf("Counters should be reset by Start, got %+v", status)
+	}
+}
+
+func TestStats(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	transport := &slowTransport{clock: clock, took: time.Millisecond * 3}
+	driver, _ := NewDriverWith(WithTransport(transport))
+	driver.clock = clock
+	if stats := driver.Stats(); stats != (Stats{Rate: defaultRate}) {
+		t.Errorf("Not started driver should have empty stats, got %+v", stats)
+	}
+	waitForStats := func(cond func(Stats) bool) Stats {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		stats := driver.Stats()
+		for !cond(stats) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Stats did not change as expected, got %+v", stats)
+			}
+			time.Sleep(time.Millisecond * 5)
+			stats = driver.Stats()
+		}
+		return stats
+	}
+
+	driver.Start()
+	defer driver.Halt()
+	first := waitForStats(func(s Stats) bool { return s.FramesSent >= 1 }).FramesSent
+	stats := waitForStats(func(s Stats) bool { return s.FramesSent >= first+3 })
+	if stats.SendTime != transport.took {
+		t.Errorf("Send time should be measured by the clock, expected %v, got %v", transport.took, stats.SendTime)
+	}
+
+	atomic.StoreInt32(&transport.failing, 1)
+	stats = waitForStats(func(s Stats) bool { return s.WriteErrors >= 2 })
+	if stats.SendTime != transport.took {
+		t.Errorf("Failed send should not change send time, got %v", stats.SendTime)
+	}
+	driver.SetRate(100)
+	if stats := driver.Stats(); stats.Rate != 100 {
+		t.Errorf("Rate should be 100, got %d", stats.Rate)
+	}
+
+	driver.Halt()
+	atomic.StoreInt32(&transport.failing, 0)
+	driver.Start()
+	if stats := driver.Stats(); stats.FramesSent > 1 || stats.WriteErrors != 0 {
+		t.Errorf("Counters should be reset by Start, got %+v", stats)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	first := NewDriver()
+	second := NewDriver()
+	if err := first.SetNameE(""); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Empty name should be rejected, got %v", err)
+	}
+	first.SetName("")
+	if first.Name() == "" {
+		t.Errorf("Empty name should be ignored")
+	}
+
+	first.SetName("alpha")
+	second.SetName("alpha") // fine until they are registered
+	if err := first.Register(); err != nil {
+		t.Fatal(err)
+	}
+	defer first.Unregister()
+	if err := first.Register(); err != nil {
+		t.Errorf("Registering again should do nothing, got %v", err)
+	}
+	if err := second.Register(); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("Duplicate name should be rejected, got %v", err)
+	}
+	if DriverByName("alpha") != first {
+		t.Errorf("Registered driver should be found by name")
+	}
+
+	second.SetName("beta")
+	if err := second.Register(); err != nil {
+		t.Fatal(err)
+	}
+	defer second.Unregister()
+	if err := second.SetNameE("alpha"); !errors.Is(err, ErrInvalidName) || second.Name() != "beta" {
+		t.Errorf("Registered driver should not take name of other one, got %v", err)
+	}
+	if err := second.SetNameE("gamma"); err != nil {
+		t.Fatal(err)
+	}
+	if DriverByName("gamma") != second || DriverByName("beta") != nil {
+		t.Errorf("Renamed driver should be registered under new name")
+	}
+
+	first.Unregister()
+	if DriverByName("alpha") != nil {
+		t.Errorf("Unregistered driver should not be found")
+	}
+}
+
+func TestSafeFlip(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	driver := NewDriver()
+	driver.clock = clock
+	driver.SetFlipPolicy(FlipPolicy{Boost: 0.6, BoostFor: time.Second})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- driver.SafeFlipContext(context.Background(), Backward)
+	}()
+
+	clock.waitForTimer(t)
+	data := driver.CommandBytes()
+	if data[throttleByte] != normalize(0.6) || data[pitchByte] != 0x80 || data[flagsByte]&flipFlag != 0 {
+		t.Errorf("Throttle should be boosted before flip (% x)", data)
+	}
+	clock.advance(time.Second)
+
+	clock.waitForTimer(t)
+	data = driver.CommandBytes()
+	if data[throttleByte] != 0x80 || data[pitchByte] != normalize(-1) || data[flagsByte]&flipFlag == 0 {
+		t.Errorf("Flip flag and direction should be set after boost (% x)", data)
+	}
+	clock.advance(DefaultFlipPolicy.FlipFor)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	data = driver.CommandBytes()
+	if data[throttleByte] != 0x80 || data[pitchByte] != 0x80 || data[rollByte] != 0x80 {
+		t.Errorf("Drone should hover after flip (% x)", data)
+	}
+
+	if err := driver.SafeFlipContext(context.Background(), Direction(42)); err == nil {
+		t.Errorf("Unknown direction should be rejected")
+	}
+}
+
+func TestDoFlip(t *testing.T) {
+	for _, tc := range []struct {
+		direction Direction
+		axis      Axis
+		val       byte
+	}{
+		{Forward, Pitch, 0xff},
+		{Backward, Pitch, 0x01},
+		{Left, Roll, 0x01},
+		{Right, Roll, 0xff},
+	} {
+		driver := NewDriver()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- driver.DoFlipContext(ctx, tc.direction)
+		}()
+		flipped := false
+		for start := time.Now(); time.Since(start) < time.Second/4; time.Sleep(time.Millisecond) {
+			data := driver.CommandBytes()
+			if data[flagsByte]&flipFlag != 0 && data[tc.axis] == tc.val {
+				flipped = true
+				break
+			}
+		}
+		cancel()
+		if err := <-done; err != context.Canceled {
+			t.Errorf("Canceled flip should return context.Canceled, got %v", err)
+		}
+		if !flipped {
+			t.Errorf("Flip %d should set flip flag and %s stick to %02x (%s)", tc.direction, tc.axis, tc.val, driver.cmd.String())
+		}
+		if data := driver.CommandBytes(); data[tc.axis] != 0x80 {
+			t.Errorf("Drone should hover after flip %d (% x)", tc.direction, data)
+		}
+	}
+
+	if err := NewDriver().DoFlipContext(context.Background(), Direction(-1)); err == nil {
+		t.Errorf("Unknown direction should be rejected")
+	}
+}
+
+// runShutdown runs Shutdown with fake clock, before each poll it calls tick
+//
+// Clock is advanced slowly, so the radio has time to transmit.
+func runShutdown(driver *Driver, clock *fakeClock, tick func()) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- driver.Shutdown(context.Background())
+	}()
+	for {
+		select {
+		case err := <-done:
+			return err
+		default:
+		}
+		clock.Lock()
+		waiting := len(clock.waiters)
+		clock.Unlock()
+		if waiting > 0 {
+			tick()
+			clock.advance(takeOffPoll)
+		}
+		time.Sleep(time.Millisecond * 2)
+	}
+}
+
+// flagFrames returns indexes of frames with the flag
+func flagFrames(frames [][]byte, flag byte) (indexes []int) {
+	for i, frame := range frames {
+		if frame[flagsByte]&flag != 0 {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+func TestShutdown(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	transport := &MemoryTransport{}
+	driver, _ := NewDriverWith(WithTransport(transport))
+	driver.clock = clock
+	if err := driver.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown of not started driver should do nothing, got %v", err)
+	}
+
+	driver.Start()
+	driver.Sticks(0.5, 0, 0.5, 0)
+	if err := runShutdown(driver, clock, func() {}); err != nil {
+		t.Fatal(err)
+	}
+	if driver.Connected() {
+		t.Errorf("Radio should be halted after landing")
+	}
+	time.Sleep(time.Millisecond * 30) // radio loop might be in the middle of transmission
+	frames := transport.Frames()
+	landed := flagFrames(frames, landFlag)
+	if len(landed) < shutdownFlagFrames {
+		t.Fatalf("Land should be transmitted before halt, got %d frames", len(landed))
+	}
+	for _, frame := range frames[landed[0]:] {
+		if frame[throttleByte] != 0x80 || frame[pitchByte] != 0x80 {
+			t.Errorf("Sticks should be centered while landing (% x)", frame)
+		}
+	}
+	if len(flagFrames(frames, stopFlag)) != 0 {
+		t.Errorf("Landed drone should not be stopped")
+	}
+	time.Sleep(time.Millisecond * 50)
+	if len(transport.Frames()) != len(frames) {
+		t.Errorf("Nothing should be transmitted after halt")
+	}
+}
+
+func TestOnSuspend(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	driver, _ := NewDriverWith(WithTransport(&MemoryTransport{}))
+	driver.clock = clock
+	waitHalted := func() bool {
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+			if !driver.Connected() {
+				return true
+			}
+		}
+		return false
+	}
+
+	driver.Start()
+	driver.Sticks(0.5, 0, 0.5, 0)
+	driver.OnSuspend(Hover)
+	if up, _, forwards, _ := driver.CurrentSticks(); up != 0 || forwards != 0 {
+		t.Errorf("Drone should hover when suspended, got %v %v", up, forwards)
+	}
+	clock.waitForTimer(t)
+	clock.advance(defaultSuspendGrace - time.Second)
+	if !driver.Connected() {
+		t.Errorf("Radio should run during grace period")
+	}
+	clock.advance(time.Second)
+	if !waitHalted() {
+		t.Errorf("Radio should be halted after grace period")
+	}
+
+	driver.Start()
+	driver.OnSuspend(Hover)
+	clock.waitForTimer(t)
+	driver.Start() // focus is back
+	clock.advance(defaultSuspendGrace)
+	time.Sleep(time.Millisecond * 20)
+	if !driver.Connected() {
+		t.Errorf("Start should cancel pending halt")
+	}
+
+	driver.OnSuspend(Halt)
+	if driver.Connected() {
+		t.Errorf("Halt mode should halt right away")
+	}
+
+	driver.Start()
+	driver.SetSuspendGrace(time.Second)
+	driver.OnSuspend(Land)
+	for start := time.Now(); driver.Connected(); time.Sleep(time.Millisecond * 2) {
+		if time.Since(start) > time.Second*3 {
+			t.Fatal("Radio should be halted after landing")
+		}
+		clock.Lock()
+		waiting := len(clock.waiters)
+		clock.Unlock()
+		if waiting > 0 {
+			clock.advance(autoLandStep)
+		}
+	}
+	if flags := driver.Flags(); flags&landFlag == 0 || flags&stopFlag == 0 {
+		t.Errorf("Drone should land before halting, flags %08b", flags)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	transport := &MemoryTransport{}
+	driver, _ := NewDriverWith(WithTransport(transport))
+	driver.clock = clock
+	driver.SetAirborneCheck(func(Telemetry) bool { return true })
+
+	driver.Start()
+	err := runShutdown(driver, clock, func() {
+		driver.telemetryMu.Lock()
+		driver.telemetry = Telemetry{Received: clock.Now()}
+		driver.telemetryMu.Unlock()
+	})
+	if !errors.Is(err, ErrLandTimeout) {
+		t.Errorf("Drone which did not land should time out, got %v", err)
+	}
+	frames := transport.Frames()
+	landed, stopped := flagFrames(frames, landFlag), flagFrames(frames, stopFlag)
+	if len(landed) == 0 || len(stopped) == 0 || stopped[0] < landed[0] {
+		t.Errorf("Stop should be transmitted after land, got %d land and %d stop frames", len(landed), len(stopped))
+	}
+	if driver.Connected() {
+		t.Errorf("Radio should be halted after stop")
+	}
+}
@@ -0,0 +1,50 @@
+package fly
+
+// HoldThrottle keeps throttle stick at given level until ReleaseThrottle
+//
+// Other control commands (Sticks, Hover, Go*, RawCommand,...) then change only the remaining axes,
+// which gives simple "altitude hold" feel on drones without barometric hold.
+// Note that it only keeps fixed stick value, not altitude - the drone still climbs or sinks
+// depending on its weight, battery, wind,... so the level needs to be adjusted from time to time.
+// Level is in speed scale of the driver; out of range one is clamped and error wrapping ErrStickRange is returned.
+// The hold is released by failsafe, Start and Halt and by landing - Land, Stop, Descend, AutoLand and Shutdown.
+func (d *Driver) HoldThrottle(level float64) error {
+	d.touch()
+	d.cmd.hold(throttleByte, func() byte {
+		return d.axisByte(Throttle, d.unit(level))
+	})
+	return checkRange(d.scale, map[Axis]float64{Throttle: level})
+}
+
+// ReleaseThrottle ends HoldThrottle, throttle stays where it was until next control command
+func (d *Driver) ReleaseThrottle() {
+	d.cmd.unhold(throttleByte)
+}
+
+// IsThrottleHeld says whether throttle is kept by HoldThrottle
+func (d *Driver) IsThrottleHeld() bool {
+	d.cmd.RLock()
+	defer d.cmd.RUnlock()
+	_, held := d.cmd.held[throttleByte]
+	return held
+}
+
+// hold keeps byte at index at value returned by fn through all updates, until unhold
+//
+// fn is called under the lock, like functions passed to update.
+func (c *Cmd) hold(index int, fn func() byte) {
+	c.Lock()
+	if c.held == nil {
+		c.held = map[int]byte{}
+	}
+	c.held[index] = fn()
+	c.Unlock()
+	c.update(func([]byte) {}) // applies it
+}
+
+// unhold stops keeping byte at index, the byte stays as it is until next update of it
+func (c *Cmd) unhold(index int) {
+	c.Lock()
+	delete(c.held, index)
+	c.Unlock()
+}
@@ -0,0 +1,209 @@
+// Package input feeds gamepad (or any other HID) input to fly.Driver
+//
+// It does not depend on any gamepad library - wrap yours into Gamepad interface.
+// Eg. with github.com/0xcafed00d/joystick:
+//
+//	type pad struct{ js joystick.Joystick }
+//
+//	func (p pad) State() (axes []float64, buttons []bool, err error) {
+//		state, err := p.js.Read()
+//		if err != nil {
+//			return nil, nil, err // disconnected
+//		}
+//		for _, val := range state.AxisData {
+//			axes = append(axes, float64(val)/32767)
+//		}
+//		for i := 0; i < p.js.ButtonCount(); i++ {
+//			buttons = append(buttons, state.Buttons&(1<<uint(i)) != 0)
+//		}
+//		return axes, buttons, nil
+//	}
+//
+//	js, _ := joystick.Open(0)
+//	driver := fly.NewDriver()
+//	driver.SetDeadzone(0.1)
+//	driver.Start()
+//	adapter := input.New(driver, pad{js}, input.DefaultMapping)
+//	err := adapter.Run(ctx) // until ctx is canceled or gamepad disconnects
+package input
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/drahoslove/dronio/fly"
+)
+
+// ErrDisconnected is returned by Run when the gamepad fails to report its state
+var ErrDisconnected = errors.New("input: gamepad disconnected")
+
+// Gamepad is source of input state
+type Gamepad interface {
+	// State returns current position of axes (-1 … +1) and which buttons are pressed
+	// Error means that the gamepad is disconnected.
+	State() (axes []float64, buttons []bool, err error)
+}
+
+// Controller is what the input controls, it is implemented by *fly.Driver
+type Controller interface {
+	Sticks(up, rotate, forwards, sideways float64) error
+	Hover()
+	TakeOff()
+	Land()
+	Flip()
+	Stop()
+}
+
+// Axis maps one gamepad axis to stick
+type Axis struct {
+	Index  int  // of the axis in Gamepad.State, -1 = not mapped
+	Invert bool // eg. for Y axes which are usually positive down
+}
+
+// value returns position of the axis from the state, 0 when not present
+func (a Axis) value(axes []float64) float64 {
+	if a.Index < 0 || a.Index >= len(axes) {
+		return 0
+	}
+	if a.Invert {
+		return -axes[a.Index]
+	}
+	return axes[a.Index]
+}
+
+// Mapping says which axes and buttons of the gamepad control what
+//
+// Button values are indexes in Gamepad.State, -1 = not mapped.
+type Mapping struct {
+	Up, Rotate, Forwards, Sideways Axis
+
+	TakeOff, Land, Flip, Stop int
+
+	// Scale is speed scale of the driver (0 = fly.Unit)
+	Scale fly.SpeedScale
+	// Debounce is time after button press when the button is ignored (0 = 300ms)
+	Debounce time.Duration
+	// PollInterval is how often is the gamepad read (0 = 20ms)
+	PollInterval time.Duration
+}
+
+// DefaultMapping is mode 2 layout of common (xbox like) gamepads:
+// left stick = throttle/yaw, right stick = pitch/roll,
+// A = take off, B = land, X = flip, Y = stop
+var DefaultMapping = Mapping{
+	Up:       Axis{Index: 1, Invert: true},
+	Rotate:   Axis{Index: 0},
+	Forwards: Axis{Index: 3, Invert: true},
+	Sideways: Axis{Index: 2},
+	TakeOff:  0,
+	Land:     1,
+	Flip:     2,
+	Stop:     3,
+}
+
+// Adapter reads gamepad and controls the drone accordingly
+//
+// Deadzone and expo are applied by the driver (see fly.Driver.SetDeadzone and SetExpo).
+type Adapter struct {
+	controller Controller
+	gamepad    Gamepad
+	mapping    Mapping
+
+	lastPress map[int]time.Time // of each button, for debouncing
+	pressed   map[int]bool      // in previous state
+	now       func() time.Time
+}
+
+// New creates adapter feeding input of gamepad to controller by given mapping
+func New(controller Controller, gamepad Gamepad, mapping Mapping) *Adapter {
+	if mapping.Scale <= 0 {
+		mapping.Scale = fly.Unit
+	}
+	if mapping.Debounce <= 0 {
+		mapping.Debounce = time.Millisecond * 300
+	}
+	if mapping.PollInterval <= 0 {
+		mapping.PollInterval = time.Millisecond * 20
+	}
+	return &Adapter{
+		controller: controller,
+		gamepad:    gamepad,
+		mapping:    mapping,
+		lastPress:  map[int]time.Time{},
+		pressed:    map[int]bool{},
+		now:        time.Now,
+	}
+}
+
+// Run feeds the input until ctx is canceled or the gamepad disconnects
+//
+// Drone is left hovering in both cases.
+// Returns ctx.Err() when canceled, or error wrapping ErrDisconnected when the gamepad fails.
+func (a *Adapter) Run(ctx context.Context) error {
+	defer a.controller.Hover()
+	ticker := time.NewTicker(a.mapping.PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := a.poll(); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll reads the gamepad once and sends its state to the controller
+func (a *Adapter) poll() error {
+	axes, buttons, err := a.gamepad.State()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDisconnected, err)
+	}
+	m := a.mapping
+	scale := float64(m.Scale)
+	a.controller.Sticks(
+		m.Up.value(axes)*scale,
+		m.Rotate.value(axes)*scale,
+		m.Forwards.value(axes)*scale,
+		m.Sideways.value(axes)*scale,
+	) // out of range is clamped, so the error is not interesting
+
+	// Stop goes first, so it wins over other buttons pressed at the same time
+	for _, button := range []struct {
+		index  int
+		action func()
+	}{
+		{m.Stop, a.controller.Stop},
+		{m.TakeOff, a.controller.TakeOff},
+		{m.Land, a.controller.Land},
+		{m.Flip, a.controller.Flip},
+	} {
+		if a.justPressed(button.index, buttons) {
+			button.action()
+		}
+	}
+	return nil
+}
+
+// justPressed says whether the button was pressed since last poll and not too soon after previous press
+func (a *Adapter) justPressed(index int, buttons []bool) bool {
+	if index < 0 {
+		return false
+	}
+	down := index < len(buttons) && buttons[index]
+	wasDown := a.pressed[index]
+	a.pressed[index] = down
+	if !down || wasDown {
+		return false
+	}
+	now := a.now()
+	if now.Sub(a.lastPress[index]) < a.mapping.Debounce {
+		return false
+	}
+	a.lastPress[index] = now
+	return true
+}
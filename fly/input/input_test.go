@@ -0,0 +1,140 @@
+package input
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/drahoslove/dronio/fly"
+)
+
+// fakeGamepad returns state set by test
+type fakeGamepad struct {
+	sync.Mutex
+	axes    []float64
+	buttons []bool
+	err     error
+}
+
+func (g *fakeGamepad) State() ([]float64, []bool, error) {
+	g.Lock()
+	defer g.Unlock()
+	return g.axes, g.buttons, g.err
+}
+
+// fakeController records what it was commanded
+type fakeController struct {
+	sync.Mutex
+	sticks  [4]float64
+	actions []string
+}
+
+func (c *fakeController) Sticks(up, rotate, forwards, sideways float64) error {
+	c.Lock()
+	defer c.Unlock()
+	c.sticks = [4]float64{up, rotate, forwards, sideways}
+	return nil
+}
+
+func (c *fakeController) action(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.actions = append(c.actions, name)
+}
+
+func (c *fakeController) Hover()   { c.Sticks(0, 0, 0, 0); c.action("hover") }
+func (c *fakeController) TakeOff() { c.action("takeoff") }
+func (c *fakeController) Land()    { c.action("land") }
+func (c *fakeController) Flip()    { c.action("flip") }
+func (c *fakeController) Stop()    { c.action("stop") }
+
+var _ Controller = &fly.Driver{}
+
+func TestMapping(t *testing.T) {
+	pad := &fakeGamepad{axes: []float64{0.5, -1, 0.25, 0.75}}
+	controller := &fakeController{}
+	mapping := DefaultMapping
+	mapping.Scale = fly.Percent
+	adapter := New(controller, pad, mapping)
+
+	if err := adapter.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if controller.sticks != [4]float64{100, 50, -75, 25} {
+		t.Errorf("Unexpected sticks %v", controller.sticks)
+	}
+
+	pad.axes = pad.axes[:1] // missing axes are centered
+	adapter.poll()
+	if controller.sticks != [4]float64{0, 50, 0, 0} {
+		t.Errorf("Unexpected sticks %v", controller.sticks)
+	}
+}
+
+func TestButtonDebounce(t *testing.T) {
+	pad := &fakeGamepad{}
+	controller := &fakeController{}
+	mapping := DefaultMapping
+	mapping.Debounce = time.Millisecond * 350
+	adapter := New(controller, pad, mapping)
+	now := time.Unix(0, 0)
+	adapter.now = func() time.Time { return now }
+
+	press := func(buttons ...bool) {
+		pad.buttons = buttons
+		adapter.poll()
+		now = now.Add(time.Millisecond * 100)
+	}
+	press(true)  // take off
+	press(true)  // held
+	press(false) // released
+	press(true)  // bounce within 350ms
+	press(false)
+	press(false)
+	press(true)        // take off again
+	press(false, true) // land
+	press(true, false, false, true)
+
+	expected := []string{"takeoff", "takeoff", "land", "stop"}
+	if len(controller.actions) != len(expected) {
+		t.Fatalf("Expected actions %v, got %v", expected, controller.actions)
+	}
+	for i := range expected {
+		if controller.actions[i] != expected[i] {
+			t.Errorf("Expected actions %v, got %v", expected, controller.actions)
+		}
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	pad := &fakeGamepad{axes: []float64{1, 1, 1, 1}}
+	controller := &fakeController{}
+	mapping := DefaultMapping
+	mapping.PollInterval = time.Millisecond
+	adapter := New(controller, pad, mapping)
+
+	done := make(chan error)
+	go func() {
+		done <- adapter.Run(context.Background())
+	}()
+	time.Sleep(time.Millisecond * 10)
+	pad.Lock()
+	pad.err = errors.New("unplugged")
+	pad.Unlock()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrDisconnected) {
+			t.Errorf("Expected ErrDisconnected, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Run should end when gamepad disconnects")
+	}
+	controller.Lock()
+	defer controller.Unlock()
+	if controller.sticks != [4]float64{} || controller.actions[len(controller.actions)-1] != "hover" {
+		t.Errorf("Drone should hover after disconnect, sticks %v", controller.sticks)
+	}
+}
@@ -0,0 +1,142 @@
+package fly
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// relayBuffer is how many tapped commands are kept for slow reader of Relay, newer are dropped
+const relayBuffer = 64
+
+// maxPacket is size of the biggest UDP payload, so relayed packets other than commands are not truncated
+const maxPacket = 65507
+
+// Listen receives command frames sent to given UDP address (eg. ":50000"), for sniffing other controller apps
+//
+// Only valid frames (0x66 … crc 0x99) are passed to the channel. It listens forever, see ListenContext.
+func Listen(addr string) (<-chan *Cmd, error) {
+	return ListenContext(context.Background(), addr)
+}
+
+// ListenContext is the same as Listen, but the socket is closed when ctx is done
+// The channel is closed then.
+func ListenContext(ctx context.Context, addr string) (<-chan *Cmd, error) {
+	conn, err := listenUDP(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	cmds := make(chan *Cmd)
+	go func() {
+		defer close(cmds)
+		readFrames(conn, func(frame []byte, _ *net.UDPAddr) {
+			if !(&Cmd{data: frame}).isValid() {
+				return
+			}
+			select {
+			case cmds <- &Cmd{data: append([]byte(nil), frame...)}:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return cmds, nil
+}
+
+// Relay forwards everything received on listenAddr to the drone (and its replies back), while tapping valid commands
+//
+// Point the official app to listenAddr (eg. by running it on other device with the drone address routed here)
+// to see which flags it uses. The channel is buffered, commands are dropped when it is not read fast enough,
+// so a slow reader never delays the forwarding. Relaying stops and the channel is closed when ctx is done.
+func Relay(ctx context.Context, listenAddr, droneAddr string) (<-chan *Cmd, error) {
+	droneUDP, err := net.ResolveUDPAddr("udp4", droneAddr)
+	if err != nil {
+		return nil, err
+	}
+	drone, err := net.DialUDP("udp4", nil, droneUDP)
+	if err != nil {
+		return nil, err
+	}
+	app, err := listenUDP(ctx, listenAddr)
+	if err != nil {
+		drone.Close()
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		drone.Close()
+	}()
+
+	var mu sync.Mutex
+	var appAddr *net.UDPAddr // last sender, for replies of the drone
+	go readFrames(drone, func(reply []byte, _ *net.UDPAddr) {
+		mu.Lock()
+		to := appAddr
+		mu.Unlock()
+		if to != nil {
+			app.WriteToUDP(reply, to)
+		}
+	})
+
+	cmds := make(chan *Cmd, relayBuffer)
+	go func() {
+		defer close(cmds)
+		readFrames(app, func(frame []byte, from *net.UDPAddr) {
+			mu.Lock()
+			appAddr = from
+			mu.Unlock()
+			drone.Write(frame)
+			if !(&Cmd{data: frame}).isValid() {
+				return
+			}
+			select {
+			case cmds <- &Cmd{data: append([]byte(nil), frame...)}:
+			default: // reader is too slow
+			}
+		})
+	}()
+	return cmds, nil
+}
+
+// listenUDP binds UDP socket which is closed when ctx is done
+func listenUDP(ctx context.Context, addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	return conn, nil
+}
+
+// readFrames passes received packets to onFrame until conn is closed or fails, the frame is valid only during the call
+func readFrames(conn *net.UDPConn, onFrame func(frame []byte, from *net.UDPAddr)) {
+	buf := make([]byte, maxPacket)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if canReadOn(err) {
+				continue
+			}
+			return
+		}
+		onFrame(buf[:n], from)
+	}
+}
+
+// canReadOn tells whether reading of UDP socket may continue after err
+//
+// Refused connection (the drone is not listening yet) and temporary errors are skipped,
+// anything else, like closed socket, ends the reading.
+// It does not rely on net.ErrClosed, so it works with Go older than 1.16.
+func canReadOn(err error) bool {
+	var temporary interface{ Temporary() bool }
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &temporary) && temporary.Temporary()
+}
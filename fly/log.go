@@ -0,0 +1,38 @@
+package fly
+
+// Logger receives diagnostic messages of the driver, *slog.Logger satisfies it
+//
+// Args are alternating keys and values, the same as with slog.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger discards everything, it is the default
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// SetLogger sets where the driver logs to (default nowhere), nil disables logging
+//
+// Eg. d.SetLogger(slog.Default()) to get the messages into standard log.
+func (d *Driver) SetLogger(logger Logger) {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	d.Lock()
+	d.logger = logger
+	d.Unlock()
+}
+
+// log returns logger set by SetLogger
+func (d *Driver) log() Logger {
+	d.Lock()
+	defer d.Unlock()
+	return d.logger
+}
@@ -0,0 +1,269 @@
+package fly
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Orbit commands drone to circle around a point in front of it
+//
+// radiusSpeed is sideways speed (-1 … +1, positive = circle to the right),
+// yawSpeed is rotation speed (-1 … +1) which keeps the nose of the drone pointed to the center.
+// Bigger ratio of radiusSpeed to yawSpeed makes bigger circle.
+//
+// It is open-loop - there is no position feedback, so the orbit will drift (wind, gyro imperfections).
+// Blocks until duration passes or ctx is canceled, then hovers.
+// Returns ctx.Err() when canceled.
+func (d *Driver) Orbit(ctx context.Context, radiusSpeed, yawSpeed float64, duration time.Duration) error {
+	defer d.Hover()
+
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	ticker := time.NewTicker(time.Second / 10)
+	defer ticker.Stop()
+
+	for {
+		// keep sticks in orbit position even if something else touched them
+		d.Sticks(0, yawSpeed, 0, radiusSpeed)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// DefaultDescendRate is gentle downward throttle used by Descend
+const DefaultDescendRate = 0.3
+
+// Descend commands drone to slowly go down until the until condition is met, then hovers
+//
+// Unlike Land() it keeps propellers spinning and unlike holding throttle stick manually
+// it never overshoots the condition. rate is downward throttle from 0 to 1 (or 100 with Percent speed scale),
+// DefaultDescendRate is used if it is 0.
+// until is polled 20 times per second - use UntilTimeout and UntilDone or custom condition.
+// Nil until means descending for one second.
+//
+// Drone is returned to hover even if until panics.
+func (d *Driver) Descend(rate float64, until func() bool) {
+	if rate <= 0 {
+		rate = DefaultDescendRate
+	} else {
+		rate = d.unit(rate)
+	}
+	if until == nil {
+		until = UntilTimeout(time.Second)
+	}
+	defer d.Hover()
+
+	d.cmd.unhold(throttleByte) // would keep the throttle up
+	d.setAxis(Throttle, -rate)
+	for !until() {
+		time.Sleep(time.Second / 20)
+	}
+}
+
+// UntilTimeout returns condition which is met after given duration from its creation
+func UntilTimeout(duration time.Duration) func() bool {
+	deadline := time.Now().Add(duration)
+	return func() bool {
+		return !time.Now().Before(deadline)
+	}
+}
+
+// UntilDone returns condition which is met when ctx is canceled or expired
+func UntilDone(ctx context.Context) func() bool {
+	return func() bool {
+		return ctx.Err() != nil
+	}
+}
+
+// timing of AutoLand sequence
+const (
+	autoLandDescent   = 2 * time.Second  // of gradual throttle reduction
+	autoLandStep      = time.Second / 10 // of throttle reduction
+	autoLandThrottle  = -0.5             // reached at the end of descent
+	autoLandStopAfter = 5 * time.Second  // of Land, when Stop is issued
+)
+
+// AutoLand starts landing sequence in background and returns function which cancels it
+//
+// It is meant for panic button - see AutoLandContext for the sequence.
+func (d *Driver) AutoLand() (cancel func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go d.AutoLandContext(ctx)
+	return cancel
+}
+
+// AutoLandContext runs landing sequence and blocks until it is done or ctx is canceled
+//
+// Throttle is gradually reduced from current position for 2 seconds (other sticks are centered),
+// then Land is issued and after 5 more seconds also Stop, as a safety net in case drone did not land.
+// Failsafe is suspended during the sequence so it does not fight with it.
+// When canceled during descent drone hovers, when canceled after Land, Stop is not issued.
+// Returns ctx.Err() when canceled.
+func (d *Driver) AutoLandContext(ctx context.Context) error {
+	d.suspendFailsafe()
+	defer d.resumeFailsafe()
+
+	d.cmd.unhold(throttleByte) // would keep the throttle from going down, descent starts at the held level
+	start, _, _, _ := d.CurrentSticks()
+	start = d.unit(start)
+	steps := int(autoLandDescent / autoLandStep)
+	for step := 1; step <= steps; step++ {
+		up := start + (autoLandThrottle-start)*float64(step)/float64(steps)
+		if up > start { // never go up
+			up = start
+		}
+		d.Sticks(up*float64(d.scale), 0, 0, 0)
+		select {
+		case <-d.clock.After(autoLandStep):
+		case <-ctx.Done():
+			d.Hover()
+			return ctx.Err()
+		}
+	}
+
+	d.Land()
+	select {
+	case <-d.clock.After(autoLandStopAfter):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	d.Stop()
+	return nil
+}
+
+// timing of TakeOffAndHover
+const (
+	takeOffDelay     = 3 * time.Second  // waited for drone without telemetry
+	takeOffTimeout   = 10 * time.Second // of waiting for airborne telemetry
+	takeOffPoll      = time.Second / 20 // of telemetry, sticks are refreshed as well
+	telemetryTimeout = time.Second      // older telemetry is taken as not available
+)
+
+// ErrTakeOffTimeout is returned (wrapped) by TakeOffAndHover when telemetry did not report airborne drone in time
+var ErrTakeOffTimeout = errors.New("fly: drone did not take off in time")
+
+// SetAirborneCheck sets function which tells from telemetry whether the drone is in the air, used by TakeOffAndHover
+//
+// Meaning of status bytes is not known yet (there is no altitude or motor state decoded),
+// so there is no default check - find the byte for your model (eg. by dumping OnTelemetry during take off).
+// Nil check disables it.
+func (d *Driver) SetAirborneCheck(check func(Telemetry) bool) {
+	d.telemetryMu.Lock()
+	d.airborne = check
+	d.telemetryMu.Unlock()
+}
+
+// TakeOffAndHover takes off and blocks until the drone is in the air, so the flight can continue
+//
+// Sticks are held centered while waiting. When airborne check is set (see SetAirborneCheck)
+// and telemetry is being received, it waits until the check passes - at most 10s, then
+// error wrapping ErrTakeOffTimeout is returned. Othervise it waits fixed 3s.
+// Returns ctx.Err() when canceled, drone is left hovering in all cases.
+func (d *Driver) TakeOffAndHover(ctx context.Context) error {
+	d.Hover()
+	d.TakeOff()
+
+	d.telemetryMu.RLock()
+	check := d.airborne
+	d.telemetryMu.RUnlock()
+
+	start := d.clock.Now()
+	for {
+		airborne, live := d.isAirborne(check)
+		if live && airborne {
+			return nil
+		}
+		elapsed := d.clock.Now().Sub(start)
+		if !live && elapsed >= takeOffDelay { // no telemetry to tell
+			return nil
+		}
+		if elapsed >= takeOffTimeout {
+			return ErrTakeOffTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.clock.After(takeOffPoll):
+		}
+		d.Hover() // refreshes failsafe too
+	}
+}
+
+// isAirborne tells by check whether the drone is in the air, live is false when there is no check or recent telemetry
+func (d *Driver) isAirborne(check func(Telemetry) bool) (airborne, live bool) {
+	telemetry := d.Telemetry()
+	live = check != nil && !telemetry.Received.IsZero() && d.clock.Now().Sub(telemetry.Received) < telemetryTimeout
+	return live && check(telemetry), live
+}
+
+// timing of Shutdown
+const (
+	shutdownSettle     = 5 * time.Second  // after Land, waited for drone without telemetry
+	shutdownTimeout    = 10 * time.Second // of waiting for telemetry to report landed drone
+	shutdownStopWait   = time.Second      // at most waited for stop flag to be transmitted
+	shutdownFlagFrames = 5                // of land or stop flag, transmitted before halting
+)
+
+// ErrLandTimeout is returned (wrapped) by Shutdown when telemetry did not report landed drone in time, so it was stopped
+var ErrLandTimeout = errors.New("fly: drone did not land in time")
+
+// Shutdown lands the drone and then halts the radio, so clean exit of the app brings the drone down safely
+//
+// Unlike Halt, which just stops transmitting (the drone then does whatever its own failsafe does,
+// often keeps flying), it issues Land and keeps transmitting centered sticks until the drone settles -
+// until airborne check (see SetAirborneCheck) tells it is on the ground, or for 5s without telemetry.
+// When telemetry still reports airborne drone after 10s, Stop is issued (as the Stop button would do)
+// and error wrapping ErrLandTimeout is returned after halting.
+// When ctx is canceled, radio is left running (and landing) and ctx.Err() is returned.
+// It does nothing when the radio is not running.
+func (d *Driver) Shutdown(ctx context.Context) error {
+	if !d.Connected() {
+		return nil
+	}
+	d.telemetryMu.RLock()
+	check := d.airborne
+	d.telemetryMu.RUnlock()
+
+	d.cmd.unhold(throttleByte) // would keep the drone from landing
+	d.Hover()
+	landSent := d.flagSent(landFlag, shutdownFlagFrames)
+	d.Land()
+	start := d.clock.Now()
+	for {
+		sent := false
+		select {
+		case <-landSent:
+			sent = true
+		default:
+		}
+		airborne, live := d.isAirborne(check)
+		elapsed := d.clock.Now().Sub(start)
+		if sent && ((live && !airborne) || (!live && elapsed >= shutdownSettle)) {
+			return d.Halt()
+		}
+		if elapsed >= shutdownTimeout {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.clock.After(takeOffPoll):
+		}
+		d.Hover() // refreshes failsafe too
+	}
+
+	select {
+	case <-d.StopConfirmed(shutdownFlagFrames):
+	case <-d.clock.After(shutdownStopWait):
+	}
+	d.Halt()
+	return ErrLandTimeout
+}
@@ -0,0 +1,39 @@
+package fly
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrInvalidCmd is returned (wrapped) when bytes are not valid command (0x66 … crc 0x99)
+var ErrInvalidCmd = errors.New("fly: invalid command")
+
+// MarshalBinary returns the command exactly as it is transmitted, eg. for recording sessions
+func (c *Cmd) MarshalBinary() ([]byte, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return append([]byte(nil), c.data...), nil
+}
+
+// UnmarshalBinary sets the command to the given one, eg. for replaying recorded session
+//
+// Error wrapping ErrInvalidCmd is returned when the data is not valid command (wrong length, markers or crc),
+// the command is not changed then.
+func (c *Cmd) UnmarshalBinary(data []byte) error {
+	cmd := Cmd{data: data, checksum: c.checksum}
+	if !cmd.isValid() {
+		return fmt.Errorf("%w: % x", ErrInvalidCmd, data)
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.data = append(c.data[:0], data...)
+	return nil
+}
+
+// WriteTo writes the command as it is transmitted to w
+func (c *Cmd) WriteTo(w io.Writer) (int64, error) {
+	data, _ := c.MarshalBinary()
+	n, err := w.Write(data)
+	return int64(n), err
+}
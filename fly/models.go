@@ -0,0 +1,115 @@
+package fly
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Capability is a feature which only some models of the drone family support
+type Capability string
+
+// Known capabilities
+//
+// There is no video resolution capability - neither the flight nor the vtx protocol has a command
+// which selects the resolution (the camera streams in its fixed one, see the SPS of vtx stream),
+// so there are no options to report.
+const (
+	FlipCapability         Capability = "flip"          // Flip() and Do*Flip()
+	HeadlessCapability     Capability = "headless"      // CompassOn() and CompassOff()
+	FlagCameraCapability   Capability = "flag-camera"   // TakePhoto() and CaptureVideo() of this package
+	VtxCameraCapability    Capability = "vtx-camera"    // camera controlled by vtx package (wifi fpv models)
+	AltitudeHoldCapability Capability = "altitude-hold" // drone keeps altitude when throttle stick is at rest
+)
+
+// allCapabilities is reported when no model is set
+var allCapabilities = []Capability{
+	FlipCapability,
+	HeadlessCapability,
+	FlagCameraCapability,
+	VtxCameraCapability,
+	AltitudeHoldCapability,
+}
+
+// Model is profile of one model of the drone family
+type Model struct {
+	Name         string
+	Capabilities []Capability
+}
+
+// Supports reports whether model has given capability
+func (m Model) Supports(capability Capability) bool {
+	for _, c := range m.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// Profiles of known models
+//
+// Compiled from product descriptions ("h" models has altitude hold, "w" models has wifi fpv camera),
+// none of them is verified on the actual drone - register corrected profile by RegisterModel when it differs.
+var (
+	modelsMu sync.RWMutex
+	models   = map[string]Model{
+		"xs809":   {"xs809", []Capability{FlipCapability, HeadlessCapability}},
+		"xs809s":  {"xs809s", []Capability{FlipCapability, HeadlessCapability, FlagCameraCapability}},
+		"xs809w":  {"xs809w", []Capability{FlipCapability, HeadlessCapability, VtxCameraCapability}},
+		"xs809h":  {"xs809h", []Capability{FlipCapability, HeadlessCapability, FlagCameraCapability, AltitudeHoldCapability}},
+		"xs809hw": {"xs809hw", []Capability{FlipCapability, HeadlessCapability, VtxCameraCapability, AltitudeHoldCapability}},
+	}
+)
+
+// RegisterModel adds profile of new model (or replaces existing one with the same name)
+func RegisterModel(model Model) {
+	modelsMu.Lock()
+	defer modelsMu.Unlock()
+	models[model.Name] = model
+}
+
+// Models returns names of all known models
+func Models() (names []string) {
+	modelsMu.RLock()
+	defer modelsMu.RUnlock()
+	for name := range models {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ModelByName returns profile of model with given name
+func ModelByName(name string) (Model, bool) {
+	modelsMu.RLock()
+	defer modelsMu.RUnlock()
+	model, ok := models[name]
+	return model, ok
+}
+
+// SetModel sets model of the controlled drone
+//
+// It only affects what Capabilities() reports, commands are sent regardless.
+func (d *Driver) SetModel(name string) error {
+	model, ok := ModelByName(name)
+	if !ok {
+		return fmt.Errorf("fly: unknown model %q", name)
+	}
+	d.Lock()
+	d.model = &model
+	d.Unlock()
+	return nil
+}
+
+// Capabilities returns features supported by model set by SetModel
+//
+// All known capabilities are returned when no model was set.
+func (d *Driver) Capabilities() []Capability {
+	d.Lock()
+	defer d.Unlock()
+	if d.model == nil {
+		return append([]Capability{}, allCapabilities...)
+	}
+	return append([]Capability{}, d.model.Capabilities...)
+}
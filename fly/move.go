@@ -0,0 +1,60 @@
+package fly
+
+import (
+	"context"
+	"time"
+)
+
+// MoveSpec is movement of more axes at once for given duration, see Move
+//
+// Values are in speed scale of the driver (-1 … +1 by default), zero axis is centered.
+type MoveSpec struct {
+	Roll     float64 // sideways ◀ … ▶
+	Pitch    float64 // forwards ▼ … ▲
+	Throttle float64 // up ↓ … ↑
+	Yaw      float64 // rotate ↶ … ↷
+	Duration time.Duration
+}
+
+// Move sets all axes of spec at once, holds them for its duration and then centers them, without blocking
+//
+// Returned channel is closed when the move is over. Only axes still holding values of this move are centered then,
+// so other control call (eg. Sticks or next Move) made meanwhile is not cut off (as with Nudge* methods).
+// Sticks are ramped as any other (see SetRamp) and the failsafe is not suspended,
+// so moves longer than its timeout are interrupted by it.
+// Values out of range are clamped, but error wrapping ErrStickRange is returned for them (as by Sticks).
+// Eg. done, _ := d.Move(MoveSpec{Pitch: 0.5, Yaw: 0.2, Duration: time.Second}); <-done to fly forward while turning.
+func (d *Driver) Move(spec MoveSpec) (<-chan struct{}, error) {
+	return d.MoveContext(context.Background(), spec)
+}
+
+// MoveContext is the same as Move, but it can be canceled by ctx
+// Axes are centered right away when canceled.
+func (d *Driver) MoveContext(ctx context.Context, spec MoveSpec) (<-chan struct{}, error) {
+	values := map[Axis]float64{Roll: spec.Roll, Pitch: spec.Pitch, Throttle: spec.Throttle, Yaw: spec.Yaw}
+	moved := map[Axis]byte{}
+	d.touch()
+	d.cmd.update(func(data []byte) {
+		for axis, val := range values {
+			data[axis] = d.axisByte(axis, d.unit(val))
+			moved[axis] = data[axis]
+		}
+	})
+	timer := d.clock.After(spec.Duration)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-timer:
+		case <-ctx.Done():
+		}
+		d.cmd.update(func(data []byte) {
+			for axis, value := range moved {
+				if data[axis] == value { // not moved by other command since
+					data[axis] = d.axisByte(axis, 0)
+				}
+			}
+		})
+	}()
+	return done, checkRange(d.scale, values)
+}
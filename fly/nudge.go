@@ -0,0 +1,101 @@
+package fly
+
+import (
+	"sync"
+	"time"
+)
+
+// nudger keeps track of axes moved by Nudge* methods and returns them to neutral when their time is up
+type nudger struct {
+	sync.Mutex
+	nudges map[Axis]nudge
+}
+
+type nudge struct {
+	until time.Time
+	value byte // transmitted by the nudge, axis is centered only when it was not changed since
+}
+
+// nudgeAxis moves stick of single axis for given duration and returns immediately
+//
+// Axis is returned to neutral by radio loop (see checkNudges), unless other command moved it meanwhile.
+// Repeated nudge of the same axis replaces the previous one.
+func (d *Driver) nudgeAxis(axis Axis, val float64, duration time.Duration) {
+	d.touch()
+	var value byte
+	d.cmd.update(func(data []byte) {
+		data[axis] = d.axisByte(axis, val)
+		value = data[axis]
+	})
+	d.nudger.Lock()
+	defer d.nudger.Unlock()
+	if d.nudger.nudges == nil {
+		d.nudger.nudges = map[Axis]nudge{}
+	}
+	d.nudger.nudges[axis] = nudge{until: d.clock.Now().Add(duration), value: value}
+}
+
+// checkNudges centers axes whose nudges are over
+//
+// It is called by radio loop before each transmission.
+func (d *Driver) checkNudges() {
+	now := d.clock.Now()
+	d.nudger.Lock()
+	defer d.nudger.Unlock()
+	for axis, n := range d.nudger.nudges {
+		if now.Before(n.until) {
+			continue
+		}
+		delete(d.nudger.nudges, axis)
+		d.cmd.update(func(data []byte) {
+			if data[axis] == n.value { // not moved by other command since
+				data[axis] = d.axisByte(axis, 0)
+			}
+		})
+	}
+}
+
+// NudgeUp makes the drone gain altitude for given duration, without blocking
+// speed can be a float value from `0` to `1` (or `100` with Percent speed scale).
+//
+// Unlike GoUp it returns immediately and the stick is returned to neutral by the radio loop,
+// so it can be called rapidly (eg. from event loop) without stacking goroutines.
+// Only the nudged axis is centered afterwards, and only when no other command moved it meanwhile.
+func (d *Driver) NudgeUp(speed float64, duration time.Duration) {
+	d.nudgeAxis(Throttle, +d.unit(speed), duration)
+}
+
+// NudgeDown makes the drone reduce altitude for given duration, see NudgeUp
+func (d *Driver) NudgeDown(speed float64, duration time.Duration) {
+	d.nudgeAxis(Throttle, -d.unit(speed), duration)
+}
+
+// NudgeRight banks the drone to the right for given duration, see NudgeUp
+func (d *Driver) NudgeRight(speed float64, duration time.Duration) {
+	d.nudgeAxis(Roll, +d.unit(speed), duration)
+}
+
+// NudgeLeft banks the drone to the left for given duration, see NudgeUp
+func (d *Driver) NudgeLeft(speed float64, duration time.Duration) {
+	d.nudgeAxis(Roll, -d.unit(speed), duration)
+}
+
+// NudgeForward makes the drone go forward for given duration, see NudgeUp
+func (d *Driver) NudgeForward(speed float64, duration time.Duration) {
+	d.nudgeAxis(Pitch, +d.unit(speed), duration)
+}
+
+// NudgeBackward makes the drone go backward for given duration, see NudgeUp
+func (d *Driver) NudgeBackward(speed float64, duration time.Duration) {
+	d.nudgeAxis(Pitch, -d.unit(speed), duration)
+}
+
+// NudgeClockwise rotates the drone clockwise for given duration, see NudgeUp
+func (d *Driver) NudgeClockwise(speed float64, duration time.Duration) {
+	d.nudgeAxis(Yaw, -d.unit(speed), duration) // same direction as GoClockwise
+}
+
+// NudgeCounterClockwise rotates the drone counter clockwise for given duration, see NudgeUp
+func (d *Driver) NudgeCounterClockwise(speed float64, duration time.Duration) {
+	d.nudgeAxis(Yaw, +d.unit(speed), duration)
+}
@@ -0,0 +1,150 @@
+package fly
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// SpeedScale says which value of sticks and speeds means full deflection
+type SpeedScale float64
+
+const (
+	// Unit scale uses values from -1 to +1 (default)
+	Unit SpeedScale = 1
+	// Percent scale uses values from -100 to +100
+	Percent SpeedScale = 100
+)
+
+// Option configures Driver created by NewDriverWith
+type Option func(*Driver) error
+
+// WithAddress sets UDP address of the drone (default "192.168.0.1:50000")
+func WithAddress(dest string) Option {
+	return func(d *Driver) error {
+		udpaddr, err := net.ResolveUDPAddr("udp4", dest)
+		if err != nil {
+			return err
+		}
+		d.udpaddr = udpaddr
+		return nil
+	}
+}
+
+// WithSource sets local UDP address the commands are sent from (default any)
+func WithSource(src string) Option {
+	return func(d *Driver) error {
+		laddr, err := net.ResolveUDPAddr("udp4", src)
+		if err != nil {
+			return err
+		}
+		d.laddr = laddr
+		return nil
+	}
+}
+
+// WithInterface sets local UDP address to IPv4 address of given network interface (eg. "wlan0")
+//
+// Use it when the commands do nothing because the system sends them through other interface
+// (eg. ethernet instead of hotspot of the drone). When the interface has more addresses, the one
+// in subnet of the drone is preferred, so put WithAddress before it. Last of WithInterface and WithSource wins.
+func WithInterface(name string) Option {
+	return func(d *Driver) error {
+		ip, err := interfaceIP(name, d.udpaddr.IP)
+		if err != nil {
+			return err
+		}
+		d.laddr = &net.UDPAddr{IP: ip}
+		return nil
+	}
+}
+
+// interfaceAddrs lists addresses of network interface of given name, it is replaced in tests
+var interfaceAddrs = func(name string) ([]net.Addr, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return iface.Addrs()
+}
+
+// interfaceIP returns IPv4 address of the interface, the one in the same subnet as droneIP if there is such
+//
+// Smallest address is chosen from more candidates (as vtx does), IPv6 addresses are skipped.
+func interfaceIP(name string, droneIP net.IP) (net.IP, error) {
+	addrs, err := interfaceAddrs(name)
+	if err != nil {
+		return nil, fmt.Errorf("fly: interface %q: %w", name, err)
+	}
+	var bestIP net.IP
+	bestInSubnet := false
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.To4()
+		if ip == nil {
+			continue
+		}
+		inSubnet := (&net.IPNet{IP: ip.Mask(ipNet.Mask), Mask: ipNet.Mask}).Contains(droneIP)
+		if bestIP == nil || inSubnet && !bestInSubnet || inSubnet == bestInSubnet && bytes.Compare(ip, bestIP) < 0 {
+			bestIP = ip
+			bestInSubnet = inSubnet
+		}
+	}
+	if bestIP == nil {
+		return nil, fmt.Errorf("fly: interface %q has no IPv4 address", name)
+	}
+	return bestIP, nil
+}
+
+// WithSpeedScale sets scale of values accepted by Sticks, Go* methods and Descend
+// and returned by CurrentSticks
+//
+// Use Percent to get the -100 … +100 range of integer based API.
+func WithSpeedScale(scale SpeedScale) Option {
+	return func(d *Driver) error {
+		if scale <= 0 {
+			return fmt.Errorf("fly: invalid speed scale %v", scale)
+		}
+		d.scale = scale
+		return nil
+	}
+}
+
+// WithTransport makes the driver send cmd frames to given transport instead of UDP (see Transport)
+//
+// Address options are ignored then.
+func WithTransport(transport Transport) Option {
+	return func(d *Driver) error {
+		d.transport = transport
+		return nil
+	}
+}
+
+// WithLogger sets where the driver logs to (default nowhere), see SetLogger
+func WithLogger(logger Logger) Option {
+	return func(d *Driver) error {
+		d.SetLogger(logger)
+		return nil
+	}
+}
+
+// WithChecksum sets how is crc byte of transmitted frames computed (default Checksum)
+//
+// Some rebadged clones might expect other checksum and ignore commands with the default one.
+func WithChecksum(checksum ChecksumFunc) Option {
+	return func(d *Driver) error {
+		if checksum == nil {
+			return fmt.Errorf("fly: nil checksum function")
+		}
+		d.cmd.UseChecksum(checksum)
+		return nil
+	}
+}
+
+// unit converts value of drivers speed scale to -1 … +1 range
+func (d *Driver) unit(val float64) float64 {
+	return val / float64(d.scale)
+}
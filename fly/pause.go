@@ -0,0 +1,27 @@
+package fly
+
+// Pause stops transmitting frames, but keeps the connection and the radio loop running, see Resume
+//
+// Drone without commands cuts motors (or lands, depending on model), so it is "motors off, link on":
+// unlike Halt there is no reconnect on Resume. Pending flag pulses (eg. TakeOff) are canceled and cleared.
+// Sticks keep their values, center them before resuming if they should not apply right away.
+func (d *Driver) Pause() {
+	d.Lock()
+	d.paused = true
+	d.Unlock()
+	d.cmd.dropPulses()
+}
+
+// Resume continues transmitting frames stopped by Pause
+func (d *Driver) Resume() {
+	d.Lock()
+	d.paused = false
+	d.Unlock()
+}
+
+// Paused says whether transmitting is paused by Pause
+func (d *Driver) Paused() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.paused
+}
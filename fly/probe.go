@@ -0,0 +1,77 @@
+package fly
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	// ErrNotOnDroneNetwork is returned (wrapped) by Probe when no interface of the system is in subnet of the drone
+	// Probably the device is connected to other wifi than the one of the drone.
+	ErrNotOnDroneNetwork = errors.New("fly: not on the wifi of the drone")
+
+	// ErrDroneNotResponding is returned (wrapped) by Probe when the drone is reachable, but it does not answer
+	// Probably the drone is off (or it is not the drone on the address).
+	ErrDroneNotResponding = errors.New("fly: drone is not responding")
+)
+
+// probeTimeout is how long Probe waits for status frame of the drone
+var probeTimeout = time.Second
+
+// systemAddrs lists addresses of all interfaces of the system, it is replaced in tests
+var systemAddrs = net.InterfaceAddrs
+
+// Probe checks whether the drone on given UDP address (eg. "192.168.0.1:50000") can be controlled
+//
+// It sends single neutral command (sticks at rest, no flags) and waits up to 1s for status frame of the drone.
+// Returns error wrapping ErrNotOnDroneNetwork when the device is not on the network of the drone at all,
+// or ErrDroneNotResponding when it is, but no status came back, so UI can tell the user what to fix.
+func Probe(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	onNetwork, err := onNetworkOf(udpAddr.IP)
+	if err != nil {
+		return err
+	}
+	if !onNetwork {
+		return fmt.Errorf("%w: no interface in subnet of %s", ErrNotOnDroneNetwork, udpAddr.IP)
+	}
+
+	conn, err := net.DialUDP("udp4", nil, udpAddr)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotOnDroneNetwork, err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(NewCommand().Bytes()); err != nil {
+		return fmt.Errorf("%w: %v", ErrDroneNotResponding, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(probeTimeout))
+	buf := make([]byte, 64)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil { // timeout or refused (nobody listens on the port)
+			return fmt.Errorf("%w: %v", ErrDroneNotResponding, err)
+		}
+		if _, ok := parseTelemetry(buf[:n], time.Now()); ok {
+			return nil
+		}
+	}
+}
+
+// onNetworkOf says whether some interface of the system is in the same subnet as ip (loopback included)
+func onNetworkOf(ip net.IP) (bool, error) {
+	addrs, err := systemAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
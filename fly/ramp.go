@@ -0,0 +1,73 @@
+package fly
+
+import (
+	"math"
+	"time"
+)
+
+// stickBytes are indexes of command bytes affected by ramping
+var stickBytes = []int{rollByte, pitchByte, throttleByte, yawByte}
+
+// SetRamp enables smoothing of stick changes
+//
+// Transmitted stick values are moving toward the ones set by Sticks (or other commands)
+// by at most maxDeltaPerSecond per second (in drivers speed scale, so 2 means from -1 to +1 in one second).
+// Flags are not affected, so eg. Stop is transmitted immediately.
+// Zero (default) disables the ramping.
+func (d *Driver) SetRamp(maxDeltaPerSecond float64) {
+	if maxDeltaPerSecond < 0 {
+		maxDeltaPerSecond = 0
+	}
+	d.Lock()
+	d.ramp = maxDeltaPerSecond / float64(d.scale)
+	d.Unlock()
+}
+
+// rampPerSecond returns max change of sticks per second in -1 … +1 units (0 = off)
+func (d *Driver) rampPerSecond() float64 {
+	d.Lock()
+	defer d.Unlock()
+	return d.ramp
+}
+
+// ramper interpolates transmitted stick bytes toward the target command
+type ramper struct {
+	pos   [8]float64 // transmitted position of sticks
+	valid bool       // pos was initialized
+	frame []byte
+	sum   func([]byte) byte // crc of the frame, see Cmd.sum (nil = Checksum)
+}
+
+// step returns frame to be transmitted, with sticks moved toward the target by at most maxStep bytes
+//
+// Zero maxStep means no ramping - target is returned as it is.
+func (r *ramper) step(target []byte, maxStep float64) []byte {
+	if maxStep <= 0 {
+		r.valid = false
+		return target
+	}
+	if r.frame == nil {
+		r.frame = make([]byte, len(target))
+	}
+	copy(r.frame, target)
+	for _, i := range stickBytes {
+		if !r.valid {
+			r.pos[i] = float64(target[i])
+		}
+		delta := float64(target[i]) - r.pos[i]
+		r.pos[i] += math.Max(-maxStep, math.Min(maxStep, delta))
+		r.frame[i] = byte(math.Round(r.pos[i]))
+	}
+	r.valid = true
+	if r.sum != nil {
+		r.frame[crcByte] = r.sum(r.frame)
+	} else {
+		r.frame[crcByte] = Checksum(r.frame)
+	}
+	return r.frame
+}
+
+// rampStep converts max change per second to max change of byte per one tick of given period
+func rampStep(perSecond float64, period time.Duration) float64 {
+	return perSecond * 0x7f * period.Seconds()
+}
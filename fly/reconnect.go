@@ -0,0 +1,84 @@
+package fly
+
+import (
+	"net"
+	"time"
+)
+
+// backoff of reconnection attempts, doubled after each failed one
+const (
+	reconnectMinBackoff = time.Second / 10
+	reconnectMaxBackoff = time.Second * 5
+)
+
+// OnReconnect sets function which will be called when radio loop recovers from connection error
+//
+// When sending of cmd fails (eg. wifi blip), the connection is closed and created again,
+// with growing pause between attempts (0.1s … 5s). Each failed attempt is reported by OnError.
+func (d *Driver) OnReconnect(callback func()) {
+	d.Lock()
+	d.onReconnect = callback
+	d.Unlock()
+}
+
+// reconnect replaces broken connection by new one, retrying until it succeeds
+//
+// Returns nil when the radio was halted meanwhile.
+func (d *Driver) reconnect(broken *net.UDPConn, stop <-chan struct{}) *net.UDPConn {
+	broken.Close()
+	backoff := reconnectMinBackoff
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-d.clock.After(backoff):
+		}
+		conn, err := d.redial()
+		if err != nil {
+			d.fail(err)
+			if backoff *= 2; backoff > reconnectMaxBackoff {
+				backoff = reconnectMaxBackoff
+			}
+			continue
+		}
+
+		d.Lock()
+		select {
+		case <-stop:
+			d.Unlock()
+			conn.Close()
+			return nil
+		default:
+		}
+		d.conn = conn
+		onReconnect := d.onReconnect
+		d.Unlock()
+
+		go d.telemetryLoop(conn) // ends when conn is closed
+		if onReconnect != nil {
+			onReconnect()
+		}
+		return conn
+	}
+}
+
+// redial creates new connection and checks it by sending current cmd
+//
+// Refused packet is reported by the system only on following write,
+// so cmd is sent twice, one transmit period apart.
+func (d *Driver) redial() (*net.UDPConn, error) {
+	conn, err := net.DialUDP("udp4", d.laddr, d.udpaddr)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			time.Sleep(d.period())
+		}
+		if _, err := conn.Write(d.CommandBytes()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
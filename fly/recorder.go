@@ -0,0 +1,84 @@
+package fly
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// recording is a sequence of records, each consists of
+// time offset from start of the recording (int64 nanoseconds, little endian)
+// followed by the transmitted 8 byte frame
+const recordSize = 8 + 8
+
+type recorder struct {
+	sync.Mutex
+	w     io.Writer
+	start time.Time
+	buf   [recordSize]byte
+}
+
+// StartRecording starts writing every transmitted command frame with relative timestamp to w
+//
+// Recording already in progress is replaced. Use Replay to play the recording back.
+func (d *Driver) StartRecording(w io.Writer) {
+	d.recorder.Lock()
+	d.recorder.w = w
+	d.recorder.start = time.Now()
+	d.recorder.Unlock()
+}
+
+// StopRecording stops recording started by StartRecording
+func (d *Driver) StopRecording() {
+	d.recorder.Lock()
+	d.recorder.w = nil
+	d.recorder.Unlock()
+}
+
+// record writes frame transmitted at given time if recording is in progress
+//
+// Recording is stopped when writing fails.
+func (d *Driver) record(now time.Time, frame []byte) {
+	r := &d.recorder
+	r.Lock()
+	if r.w == nil {
+		r.Unlock()
+		return
+	}
+	binary.LittleEndian.PutUint64(r.buf[:8], uint64(now.Sub(r.start)))
+	copy(r.buf[8:], frame)
+	_, err := r.w.Write(r.buf[:])
+	if err != nil {
+		r.w = nil
+	}
+	r.Unlock()
+	if err != nil {
+		d.log().Error("recording stopped", "err", err)
+	}
+}
+
+// Replay sets commands read from recording made by StartRecording with their original timing
+//
+// Radio has to be started to actually transmit them. Blocks until whole recording is replayed,
+// then hovers. Returns nil when the recording ends properly.
+func (d *Driver) Replay(r io.Reader) error {
+	defer d.Hover()
+	buf := make([]byte, recordSize)
+	start := time.Now()
+	for {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		offset := time.Duration(binary.LittleEndian.Uint64(buf[:8]))
+		time.Sleep(time.Until(start.Add(offset)))
+		d.touch()
+		d.cmd.update(func(data []byte) {
+			copy(data, buf[8:])
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package fly
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrInvalidName is returned (wrapped) when name of the driver is empty or taken by other registered driver
+var ErrInvalidName = errors.New("fly: invalid driver name")
+
+// registry of drivers by their names, it also guards names of all drivers
+var registry = struct {
+	sync.Mutex
+	drivers map[string]*Driver
+}{drivers: map[string]*Driver{}}
+
+// SetNameE is the same as SetName, but it returns error wrapping ErrInvalidName instead of ignoring invalid name
+//
+// Name must not be empty and registered driver (see Register) can't take name of other registered one.
+func (d *Driver) SetNameE(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: empty name", ErrInvalidName)
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.drivers[d.name] == d {
+		if other, ok := registry.drivers[name]; ok && other != d {
+			return fmt.Errorf("%w: %q is already registered", ErrInvalidName, name)
+		}
+		delete(registry.drivers, d.name)
+		registry.drivers[name] = d
+	}
+	d.name = name
+	return nil
+}
+
+// Register adds the driver to process wide registry, so it can be found by DriverByName
+//
+// It is optional, eg. for fleets of drones wired into gobot by names. Registered drivers must have unique names,
+// so error wrapping ErrInvalidName is returned when the name is already taken. Registering the driver again does nothing.
+func (d *Driver) Register() error {
+	registry.Lock()
+	defer registry.Unlock()
+	if other, ok := registry.drivers[d.name]; ok && other != d {
+		return fmt.Errorf("%w: %q is already registered", ErrInvalidName, d.name)
+	}
+	registry.drivers[d.name] = d
+	return nil
+}
+
+// Unregister removes the driver from registry, so its name can be used by other one
+func (d *Driver) Unregister() {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.drivers[d.name] == d {
+		delete(registry.drivers, d.name)
+	}
+}
+
+// DriverByName returns registered driver of given name, nil when there is none
+func DriverByName(name string) *Driver {
+	registry.Lock()
+	defer registry.Unlock()
+	return registry.drivers[name]
+}
@@ -0,0 +1,73 @@
+package fly
+
+import "time"
+
+// RetryPolicy says how are pulses of critical flags (TakeOff, Land, Stop) repeated
+//
+// Single pulse is transmitted in 50 packets (at 50 Hz), but in RF congested environment most of them might get lost.
+type RetryPolicy struct {
+	Attempts int           // how many pulses are sent at most (1 = no repetition)
+	Pulse    time.Duration // how long is the flag set during one attempt (counted in frames at current rate)
+	Gap      time.Duration // pause between two pulses (flag is not set)
+	// Confirm is optional check whether the drone reacted (eg. using telemetry)
+	// when it returns true after a pulse, no more pulses are sent
+	Confirm func(flag byte) bool
+}
+
+// DefaultRetryPolicy sends single pulse of one second
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts: 1,
+	Pulse:    time.Second,
+}
+
+// SetRetryPolicy sets how are TakeOff, Land and Stop pulses repeated
+//
+// Be careful with repeating without Confirm - eg. repeated TakeOff might be interpreted by some drones as Land.
+func (d *Driver) SetRetryPolicy(policy RetryPolicy) {
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	if policy.Pulse <= 0 {
+		policy.Pulse = DefaultRetryPolicy.Pulse
+	}
+	d.Lock()
+	d.retry = policy
+	d.Unlock()
+}
+
+// pulseCritical sets flag temporarily and repeats it according to retry policy
+//
+// Pulse is measured in transmitted frames and the gap starts once the whole pulse was transmitted.
+// It does not block, repetitions are stopped by Halt or Start.
+func (d *Driver) pulseCritical(flag byte) {
+	d.Lock()
+	policy := d.retry
+	d.Unlock()
+
+	frames := d.framesIn(policy.Pulse)
+	sent := d.flagSent(flag, frames)
+	d.cmd.pulseFlag(flag, frames)
+	if policy.Attempts <= 1 {
+		return
+	}
+	canceled := d.cmd.canceled()
+	go func() {
+		for attempt := 1; attempt < policy.Attempts; attempt++ {
+			select {
+			case <-sent:
+			case <-canceled:
+				return
+			}
+			select {
+			case <-time.After(policy.Gap):
+			case <-canceled:
+				return
+			}
+			if policy.Confirm != nil && policy.Confirm(flag) {
+				return
+			}
+			sent = d.flagSent(flag, frames)
+			d.cmd.pulseFlag(flag, frames)
+		}
+	}()
+}
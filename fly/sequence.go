@@ -0,0 +1,180 @@
+package fly
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrLinkLost is returned (wrapped) by Sequence.Run when the drone stopped being controlled
+// by the sequence - transmission failed or failsafe centered the sticks
+var ErrLinkLost = errors.New("fly: link to the drone lost")
+
+// sequenceRefresh is how often is control refreshed while sequence holds sticks
+const sequenceRefresh = time.Second / 10
+
+// Sequence is script of maneuvers, build it by chained calls and execute by Run
+//
+//	err := d.Sequence().TakeOff().Wait(2*time.Second).Forward(0.5, time.Second).Hover().Land().Run(ctx)
+//
+// Speeds are in speed scale of the driver. Moves keep sticks in given position for given duration
+// and leave them there, so follow them by Hover (or other move) to stop.
+type Sequence struct {
+	d     *Driver
+	steps []step
+}
+
+// step of the sequence, it should return early with error of linkLost when it returns one
+type step func(ctx context.Context, linkLost func() error) error
+
+// Sequence creates empty sequence of maneuvers of the drone
+func (d *Driver) Sequence() *Sequence {
+	return &Sequence{d: d}
+}
+
+// add appends step to the sequence
+func (s *Sequence) add(st step) *Sequence {
+	s.steps = append(s.steps, st)
+	return s
+}
+
+// instant appends step which does not take time
+func (s *Sequence) instant(fn func()) *Sequence {
+	return s.add(func(context.Context, func() error) error {
+		fn()
+		return nil
+	})
+}
+
+// TakeOff adds take off command to the sequence, use Wait after it to give drone time to take off
+func (s *Sequence) TakeOff() *Sequence { return s.instant(s.d.TakeOff) }
+
+// Land adds land command to the sequence
+func (s *Sequence) Land() *Sequence { return s.instant(s.d.Land) }
+
+// Stop adds emergency stop to the sequence
+func (s *Sequence) Stop() *Sequence { return s.instant(s.d.Stop) }
+
+// Hover adds centering of sticks to the sequence
+func (s *Sequence) Hover() *Sequence { return s.instant(s.d.Hover) }
+
+// Wait adds pause to the sequence, sticks stay as they are
+func (s *Sequence) Wait(duration time.Duration) *Sequence {
+	return s.add(func(ctx context.Context, linkLost func() error) error {
+		return s.hold(ctx, linkLost, duration)
+	})
+}
+
+// Sticks adds holding of sticks in given position for duration to the sequence, see Driver.Sticks
+func (s *Sequence) Sticks(up, rotate, forwards, sideways float64, duration time.Duration) *Sequence {
+	return s.add(func(ctx context.Context, linkLost func() error) error {
+		s.d.Sticks(up, rotate, forwards, sideways)
+		return s.hold(ctx, linkLost, duration)
+	})
+}
+
+// Up adds going up by given speed for duration to the sequence
+func (s *Sequence) Up(speed float64, duration time.Duration) *Sequence {
+	return s.Sticks(+speed, 0, 0, 0, duration)
+}
+
+// Down adds going down by given speed for duration to the sequence
+func (s *Sequence) Down(speed float64, duration time.Duration) *Sequence {
+	return s.Sticks(-speed, 0, 0, 0, duration)
+}
+
+// Clockwise adds rotating clockwise by given speed for duration to the sequence
+func (s *Sequence) Clockwise(speed float64, duration time.Duration) *Sequence {
+	return s.Sticks(0, +speed, 0, 0, duration)
+}
+
+// CounterClockwise adds rotating counter clockwise by given speed for duration to the sequence
+func (s *Sequence) CounterClockwise(speed float64, duration time.Duration) *Sequence {
+	return s.Sticks(0, -speed, 0, 0, duration)
+}
+
+// Forward adds going forward by given speed for duration to the sequence
+func (s *Sequence) Forward(speed float64, duration time.Duration) *Sequence {
+	return s.Sticks(0, 0, +speed, 0, duration)
+}
+
+// Backward adds going backward by given speed for duration to the sequence
+func (s *Sequence) Backward(speed float64, duration time.Duration) *Sequence {
+	return s.Sticks(0, 0, -speed, 0, duration)
+}
+
+// Right adds going right by given speed for duration to the sequence
+func (s *Sequence) Right(speed float64, duration time.Duration) *Sequence {
+	return s.Sticks(0, 0, 0, +speed, duration)
+}
+
+// Left adds going left by given speed for duration to the sequence
+func (s *Sequence) Left(speed float64, duration time.Duration) *Sequence {
+	return s.Sticks(0, 0, 0, -speed, duration)
+}
+
+// Run executes steps of the sequence one by one and blocks until they are done
+//
+// Run it in goroutine to fly in background. It can be run repeatedly.
+// When ctx is canceled or link is lost, remaining steps are skipped, drone hovers
+// and ctx.Err() or error wrapping ErrLinkLost is returned.
+func (s *Sequence) Run(ctx context.Context) error {
+	s.d.touch() // so stale failsafe trip is not taken as lost link
+	s.d.Lock()
+	errBefore := s.d.err
+	s.d.Unlock()
+	linkLost := func() error {
+		s.d.Lock()
+		err := s.d.err
+		s.d.Unlock()
+		if err != nil && err != errBefore {
+			return fmt.Errorf("%w: %v", ErrLinkLost, err)
+		}
+		s.d.failsafe.Lock()
+		tripped := s.d.failsafe.tripped
+		s.d.failsafe.Unlock()
+		if tripped {
+			return fmt.Errorf("%w: failsafe centered sticks", ErrLinkLost)
+		}
+		return nil
+	}
+
+	for _, st := range s.steps {
+		err := ctx.Err()
+		if err == nil {
+			err = linkLost()
+		}
+		if err == nil {
+			err = st(ctx, linkLost)
+		}
+		if err != nil {
+			s.d.Hover()
+			return err
+		}
+	}
+	return nil
+}
+
+// hold keeps current sticks (refreshing failsafe) for duration
+//
+// It returns early with ctx.Err() or error of linkLost.
+func (s *Sequence) hold(ctx context.Context, linkLost func() error, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	ticker := time.NewTicker(sequenceRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		case <-ticker.C:
+		}
+		if err := linkLost(); err != nil {
+			return err
+		}
+		s.d.touch()
+	}
+}
@@ -0,0 +1,94 @@
+package fly
+
+import (
+	"sync"
+	"time"
+)
+
+// Status is state of the radio loop, eg. for connection indicator of UI
+type Status struct {
+	Enabled       bool          // radio loop is running
+	Err           error         // last error of the radio loop, nil when there was none since Start
+	FramesSent    int           // successfully sent since Start
+	SinceLastSent time.Duration // since last successful send, 0 when nothing was sent since Start
+}
+
+// Stats are counters of the radio loop, eg. for HUD or detecting degrading link
+type Stats struct {
+	FramesSent  int           // successfully sent since Start
+	WriteErrors int           // failed sends since Start
+	SendTime    time.Duration // how long the last successful send took (there is no round trip, but it grows on congested link)
+	Rate        int           // current transmit rate in Hz, see SetRate
+}
+
+// transmission counts frames sent by radio loop
+type transmission struct {
+	sync.Mutex
+	frames   int
+	errors   int
+	last     time.Time     // of last successful send, zero when none
+	sendTime time.Duration // of last successful send
+}
+
+// Connected says whether the driver is transmitting (between Start and Halt)
+//
+// It does not mean that the drone receives the commands, see Status for errors.
+func (d *Driver) Connected() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.enabled
+}
+
+// Status returns current state of the radio loop, it is cheap enough to be polled
+func (d *Driver) Status() Status {
+	d.Lock()
+	status := Status{Enabled: d.enabled, Err: d.err}
+	d.Unlock()
+	d.sent.Lock()
+	status.FramesSent = d.sent.frames
+	if !d.sent.last.IsZero() {
+		status.SinceLastSent = d.clock.Now().Sub(d.sent.last)
+	}
+	d.sent.Unlock()
+	return status
+}
+
+// Stats returns counters of the radio loop, it is lighter than recording (see StartRecording)
+func (d *Driver) Stats() Stats {
+	d.Lock()
+	stats := Stats{Rate: d.rate}
+	d.Unlock()
+	d.sent.Lock()
+	stats.FramesSent = d.sent.frames
+	stats.WriteErrors = d.sent.errors
+	stats.SendTime = d.sent.sendTime
+	d.sent.Unlock()
+	return stats
+}
+
+// markSent counts successfully sent frame, whose sending started at given time
+func (d *Driver) markSent(start time.Time) {
+	now := d.clock.Now()
+	d.sent.Lock()
+	d.sent.frames++
+	d.sent.last = now
+	d.sent.sendTime = now.Sub(start)
+	d.sent.Unlock()
+}
+
+// markFailed counts frame which failed to be sent
+func (d *Driver) markFailed() {
+	d.sent.Lock()
+	d.sent.errors++
+	d.sent.Unlock()
+}
+
+// resetSent clears the counters, it is called when radio loop starts
+func (d *Driver) resetSent() {
+	d.sent.Lock()
+	d.sent.frames = 0
+	d.sent.errors = 0
+	d.sent.last = time.Time{}
+	d.sent.sendTime = 0
+	d.sent.Unlock()
+}
@@ -0,0 +1,94 @@
+package fly
+
+import (
+	"context"
+	"time"
+)
+
+// SuspendMode says what OnSuspend does with flying drone
+type SuspendMode int
+
+// Suspend modes
+const (
+	Hover SuspendMode = iota // center sticks and halt after grace period
+	Land                     // land (as AutoLand) and halt after grace period
+	Halt                     // halt right away, as Halt()
+)
+
+// defaultSuspendGrace is how long OnSuspend keeps the radio running by default
+const defaultSuspendGrace = 10 * time.Second
+
+// SetSuspendGrace sets how long the radio keeps transmitting after OnSuspend with Hover or Land mode (0 = 10s)
+func (d *Driver) SetSuspendGrace(grace time.Duration) {
+	if grace < 0 {
+		grace = 0
+	}
+	d.Lock()
+	d.suspendGrace = grace
+	d.Unlock()
+}
+
+// OnSuspend makes the drone safe when the app is suspended (eg. loses focus) and halts the radio after grace period
+//
+// Unlike Halt it does not kill the radio mid-flight: Hover mode centers sticks, Land mode lands the drone (as AutoLand).
+// The radio is halted once grace period (see SetSuspendGrace) passes and the landing is done,
+// unless Start is called meanwhile. It does not block.
+//
+// Call it from lifecycle handler of golang.org/x/mobile app instead of Halt, so a notification stealing focus won't crash the drone:
+//
+//	switch e.Crosses(lifecycle.StageVisible) {
+//	case lifecycle.CrossOn:
+//		d.Start() // cancels pending halt
+//	case lifecycle.CrossOff:
+//		d.OnSuspend(fly.Hover)
+//	}
+func (d *Driver) OnSuspend(mode SuspendMode) {
+	ctx, cancel := context.WithCancel(context.Background())
+	d.Lock()
+	d.cancelSuspend() // previous one
+	d.suspended = cancel
+	grace := d.suspendGrace
+	d.Unlock()
+	if grace == 0 {
+		grace = defaultSuspendGrace
+	}
+
+	switch mode {
+	case Halt:
+		d.haltSuspended(ctx)
+		return
+	case Land:
+	default:
+		d.Hover()
+	}
+	go func() {
+		timeout := d.clock.After(grace)
+		if mode == Land && d.AutoLandContext(ctx) != nil {
+			return
+		}
+		select {
+		case <-timeout:
+			d.haltSuspended(ctx)
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// haltSuspended halts the radio unless the suspension was canceled by Start
+func (d *Driver) haltSuspended(ctx context.Context) {
+	d.Lock()
+	defer d.Unlock()
+	if ctx.Err() != nil {
+		return
+	}
+	d.cancelSuspend()
+	d.halt()
+}
+
+// cancelSuspend stops pending halt of OnSuspend, it must be called with the driver locked
+func (d *Driver) cancelSuspend() {
+	if d.suspended != nil {
+		d.suspended()
+		d.suspended = nil
+	}
+}
@@ -0,0 +1,103 @@
+package fly
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Telemetry is status frame sent back by the drone
+//
+// Status frame has the same format as cmd (0x66 … crc 0x99), but meaning of its bytes is mostly unknown.
+type Telemetry struct {
+	Data     [8]byte   // raw status frame
+	Battery  byte      // raw battery level (2nd byte of the frame)
+	Received time.Time // when the frame was received - serves as heartbeat
+}
+
+// parseTelemetry decodes status frame, ok is false for invalid frame
+func parseTelemetry(frame []byte, received time.Time) (telemetry Telemetry, ok bool) {
+	cmd := Cmd{data: frame}
+	if !cmd.isValid() {
+		return telemetry, false
+	}
+	copy(telemetry.Data[:], frame)
+	telemetry.Battery = frame[1]
+	telemetry.Received = received
+	return telemetry, true
+}
+
+// String formats the status like "battery=85% frame=66 55 00 00 00 00 55 99"
+func (t Telemetry) String() string {
+	return fmt.Sprintf("battery=%d%% frame=% x", t.BatteryPercent(), t.Data)
+}
+
+// Telemetry returns last status received from the drone
+//
+// Received is zero time when nothing was received yet.
+func (d *Driver) Telemetry() Telemetry {
+	d.telemetryMu.RLock()
+	defer d.telemetryMu.RUnlock()
+	return d.telemetry
+}
+
+// BatteryPercent returns battery level decoded from the status frame
+//
+// Battery byte (offset 1, right after the 0x66 header) seems to hold percentage directly (0 - 100),
+// bigger values are reported as 100. It is best guess, not all clones may agree.
+func (t Telemetry) BatteryPercent() int {
+	if t.Battery > 100 {
+		return 100
+	}
+	return int(t.Battery)
+}
+
+// Battery returns battery level in percent from last status received from the drone
+//
+// ok is false when no status was received yet. See Telemetry.BatteryPercent for the decoding.
+func (d *Driver) Battery() (percent int, ok bool) {
+	telemetry := d.Telemetry()
+	if telemetry.Received.IsZero() {
+		return 0, false
+	}
+	return telemetry.BatteryPercent(), true
+}
+
+// OnTelemetry sets function which will be called for each status received from the drone
+func (d *Driver) OnTelemetry(callback func(Telemetry)) {
+	d.telemetryMu.Lock()
+	d.onTelemetry = callback
+	d.telemetryMu.Unlock()
+}
+
+// telemetryLoop reads status frames from conn until it is closed
+//
+// Panic (eg. of OnTelemetry callback) ends only the telemetry, it is reported by OnError wrapping ErrRadioPanic.
+func (d *Driver) telemetryLoop(conn *net.UDPConn) {
+	defer func() {
+		if r := recover(); r != nil {
+			d.fail(fmt.Errorf("%w: telemetry: %v", ErrRadioPanic, r))
+		}
+	}()
+	buf := make([]byte, 64)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if canReadOn(err) {
+				continue // eg. connection refused when drone is not listening yet
+			}
+			return
+		}
+		telemetry, ok := parseTelemetry(buf[:n], time.Now())
+		if !ok {
+			continue
+		}
+		d.telemetryMu.Lock()
+		d.telemetry = telemetry
+		callback := d.onTelemetry
+		d.telemetryMu.Unlock()
+		if callback != nil {
+			callback(telemetry)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package fly
+
+import "sync"
+
+// Transport is where the radio loop sends cmd frames instead of UDP socket to the drone
+//
+// It is meant for tests and simulations. Driver with transport does not receive telemetry
+// and does not reconnect - errors returned by Send are only reported by OnError.
+// Send is called from the radio loop, so it should not block.
+type Transport interface {
+	Send(frame []byte) error
+}
+
+// MemoryTransport records all sent frames
+type MemoryTransport struct {
+	sync.Mutex
+	frames [][]byte
+}
+
+// Send stores copy of the frame
+func (t *MemoryTransport) Send(frame []byte) error {
+	t.Lock()
+	defer t.Unlock()
+	t.frames = append(t.frames, append([]byte(nil), frame...))
+	return nil
+}
+
+// Frames returns all frames sent so far
+func (t *MemoryTransport) Frames() [][]byte {
+	t.Lock()
+	defer t.Unlock()
+	return append([][]byte(nil), t.frames...)
+}
+
+// FuncTransport passes each frame to the function, the frame must not be modified
+type FuncTransport func(frame []byte)
+
+// Send calls the function
+func (f FuncTransport) Send(frame []byte) error {
+	f(frame)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+
+	"golang.org/x/mobile/event/size"
+	"golang.org/x/mobile/event/touch"
+	"golang.org/x/mobile/gl"
+)
+
+// joystick is virtual on-screen stick pad
+//
+// Its position is in pixels, value of both axes is -1 … +1 (x to the right, y up).
+type joystick struct {
+	centerX, centerY float32 // of the pad
+	radius           float32 // of the pad
+	knobX, knobY     float32 // position of the knob
+	touch            touch.Sequence
+	active           bool // is dragged
+}
+
+// place moves the pad to given relative position of the screen (0 … 1) and centers the knob
+func (j *joystick) place(sz size.Event, relX, relY float32) {
+	w, h := float32(sz.WidthPx), float32(sz.HeightPx)
+	j.centerX = w * relX
+	j.centerY = h * relY
+	j.radius = float32(math.Min(float64(w/2), float64(h))) * 0.35
+	j.center()
+}
+
+// center returns the knob to the center of the pad
+func (j *joystick) center() {
+	j.knobX, j.knobY = j.centerX, j.centerY
+}
+
+// drag moves the knob to touch position, but not outside of the pad
+func (j *joystick) drag(x, y float32) {
+	dx, dy := x-j.centerX, y-j.centerY
+	if dist := float32(math.Hypot(float64(dx), float64(dy))); dist > j.radius {
+		dx, dy = dx*j.radius/dist, dy*j.radius/dist
+	}
+	j.knobX, j.knobY = j.centerX+dx, j.centerY+dy
+}
+
+// value returns position of the knob in -1 … +1 range
+func (j *joystick) value() (x, y float64) {
+	if j.radius == 0 {
+		return 0, 0
+	}
+	return float64((j.knobX - j.centerX) / j.radius), float64(-(j.knobY - j.centerY) / j.radius)
+}
+
+// handle processes touch event, returns true when the knob was moved
+//
+// Each pad takes touches which began on its half of the screen, so both can be dragged at once.
+func (j *joystick) handle(e touch.Event, sz size.Event) bool {
+	onMyHalf := (e.X < float32(sz.WidthPx)/2) == (j.centerX < float32(sz.WidthPx)/2)
+	switch e.Type {
+	case touch.TypeBegin:
+		if j.active || !onMyHalf {
+			return false
+		}
+		j.active = true
+		j.touch = e.Sequence
+	case touch.TypeMove:
+		if !j.active || e.Sequence != j.touch {
+			return false
+		}
+	case touch.TypeEnd:
+		if !j.active || e.Sequence != j.touch {
+			return false
+		}
+		j.active = false
+		j.center()
+		return true
+	}
+	j.drag(e.X, e.Y)
+	return true
+}
+
+// draw renders the pad and the knob by disc program
+func (j *joystick) draw(glctx gl.Context, sz size.Event) {
+	drawDisc(glctx, sz, j.centerX, j.centerY, j.radius, 0.9, 0.9, 0.9, 0.3) // pad
+	drawDisc(glctx, sz, j.knobX, j.knobY, j.radius/3, 0.9, 0.9, 0.9, 1.0)   // knob - whiteish grey
+}
+
+// drawDisc draws disc of given center and radius in pixels
+func drawDisc(glctx gl.Context, sz size.Event, x, y, radius float32, r, g, b, a float32) {
+	w, h := float32(sz.WidthPx), float32(sz.HeightPx)
+	glctx.Uniform4f(color, r, g, b, a)
+	glctx.Uniform2f(offset, x/w, y/h)
+	glctx.Uniform2f(scale, 2*radius/w, 2*radius/h)
+	glctx.DrawElements(gl.TRIANGLES, len(indices), gl.UNSIGNED_BYTE, 0) // 6 vertices
+}
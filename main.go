@@ -24,12 +24,14 @@ var (
 	fps      *debug.FPS
 	program  gl.Program
 	offset   gl.Uniform
+	scale    gl.Uniform
 	position gl.Attrib
 	color    gl.Uniform
 	buf      gl.Buffer
 	bufi     gl.Buffer
-	touchX   float32
-	touchY   float32
+	left     joystick // throttle/yaw
+	right    joystick // pitch/roll
+	video    videoFeed
 )
 
 var vertices = f32.Bytes(binary.LittleEndian,
@@ -53,8 +55,8 @@ func main() {
 		prolongErr := reAfterFunc(time.Second/4, func() {
 			err = nil
 		})
-		fly := fly.NewDriver("192.168.0.1:50000")
-		fly.OnError(func(e error) {
+		drone := fly.NewDriver("192.168.0.1:50000")
+		drone.OnError(func(e error) {
 			err = e
 			prolongErr()
 		})
@@ -64,17 +66,22 @@ func main() {
 			case lifecycle.Event:
 				switch e.Crosses(lifecycle.StageVisible) {
 				case lifecycle.CrossOn:
-					fly.Start()
+					resumed := drone.Connected() // radio kept running by OnSuspend
+					drone.Start()
+					video.start()
 					// d.Default()
 					// time.AfterFunc(time.Second*2, func() {
 					// 	d.Controls(-1, 0, 0, 0)
 					// })
-					time.AfterFunc(time.Second*4, func() {
-						fly.Calibrate()
-					})
+					if !resumed { // do not calibrate mid-flight
+						time.AfterFunc(time.Second*4, func() {
+							drone.Calibrate()
+						})
+					}
 					// a.Send(paint.Event{})
 				case lifecycle.CrossOff:
-					fly.Halt()
+					drone.OnSuspend(fly.Hover) // halts after grace period, unless focus comes back
+					video.stop()
 				}
 				switch e.Crosses(lifecycle.StageAlive) {
 				case lifecycle.CrossOn:
@@ -87,13 +94,19 @@ func main() {
 			case size.Event:
 				println("size event")
 				sz = e
+				left.place(sz, 0.25, 0.65)
+				right.place(sz, 0.75, 0.65)
+				drone.Hover()
 				// a.Send(paint.Event{})
 			case touch.Event:
 				if e.Type == touch.TypeBegin {
 					log.Println("Touch at", e.X, e.Y)
 				}
-				touchX = e.X
-				touchY = e.Y
+				if left.handle(e, sz) || right.handle(e, sz) {
+					rotate, up := left.value()
+					sideways, forwards := right.value()
+					drone.Sticks(up, rotate, forwards, sideways)
+				}
 				// a.Send(paint.Event{})
 			case paint.Event:
 				if e.External || glctx == nil {
@@ -131,6 +144,7 @@ func onStart(glctx gl.Context) {
 	position = glctx.GetAttribLocation(program, "position")
 	color = glctx.GetUniformLocation(program, "color")
 	offset = glctx.GetUniformLocation(program, "offset")
+	scale = glctx.GetUniformLocation(program, "scale")
 
 	images = glutil.NewImages(glctx)
 	fps = debug.NewFPS(images)
@@ -139,6 +153,7 @@ func onStart(glctx gl.Context) {
 func onStop(glctx gl.Context) {
 	glctx.DeleteProgram(program)
 	glctx.DeleteBuffer(buf)
+	video.release()
 	fps.Release()
 	images.Release()
 }
@@ -146,17 +161,16 @@ func onStop(glctx gl.Context) {
 func onDraw(glctx gl.Context, sz size.Event, err error) {
 	glctx.ClearColor(1, 0, 0, 1) // red backgroundin
 	glctx.Clear(gl.COLOR_BUFFER_BIT)
+	video.draw(sz) // over the background, when there is stream
 	glctx.UseProgram(program)
 
-	glctx.Uniform4f(color, 0.9, 0.9, 0.9, 1.0) // whiteish grey/
-	glctx.Uniform2f(offset, touchX/float32(sz.WidthPx), touchY/float32(sz.HeightPx))
-
 	glctx.BindBuffer(gl.ARRAY_BUFFER, buf)
 	glctx.EnableVertexAttribArray(position)
 	glctx.VertexAttribPointer(position, 3, gl.FLOAT, true, 0, 0) // 4vec attr, 3 coords per
 
 	glctx.BindBuffer(gl.ELEMENT_ARRAY_BUFFER, bufi)
-	glctx.DrawElements(gl.TRIANGLES, len(indices), gl.UNSIGNED_BYTE, 0) // 6 vertices
+	left.draw(glctx, sz)
+	right.draw(glctx, sz)
 
 	glctx.DisableVertexAttribArray(position)
 	fps.Draw(sz)
@@ -177,13 +191,14 @@ func reAfterFunc(duration time.Duration, fn func()) (reset func()) {
 
 const vertexShader = `#version 100
 uniform vec2 offset; // 0.0-1.0
+uniform vec2 scale; // size of the disc relative to the screen
 attribute vec4 position;
 
 varying vec2 vertPos;
 
 void main(){
 	vec4 offset4 = vec4(2.0*offset.x-1.0, -(2.0*offset.y-1.0), 0, 0);
-	gl_Position = position + offset4;
+	gl_Position = vec4(position.xy*scale, position.z, 1) + offset4;
 	vertPos = position.xy;
 }
 `
@@ -198,7 +213,7 @@ varying vec2 vertPos;
 void main(){
 	gl_FragColor = color; // some color
 	if ((vertPos.x * vertPos.x) + (vertPos.y * vertPos.y) >= 1.0) {
-		gl_FragColor.a = 0.1; // transparent
+		gl_FragColor.a = 0.0; // transparent
 	}
 }
 `
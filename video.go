@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	imgcolor "image/color" // color is shader uniform in main.go
+	"image/jpeg"
+	"io"
+	"log"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/mobile/event/size"
+	"golang.org/x/mobile/exp/gl/glutil"
+	"golang.org/x/mobile/geom"
+
+	"github.com/drahoslove/dronio/vtx"
+)
+
+// size of decoded video frames
+const (
+	videoWidth  = 640
+	videoHeight = 360
+)
+
+// videoFeed decodes live stream of the drone into images drawn behind joysticks
+//
+// MJPEG stream is decoded in go. There is no H.264 decoder in go, so ffmpeg found in PATH is used for it.
+// Without ffmpeg (eg. on android) H.264 video is not shown and background stays red.
+// Frames are decoded into two reused buffers - one being drawn, one being decoded into.
+type videoFeed struct {
+	sync.Mutex
+	frame *image.RGBA // last decoded frame, nil until first one
+	spare *image.RGBA // buffer for next frame, nil until it is needed
+	fresh bool        // frame was not uploaded to texture yet
+
+	texture *glutil.Image // created by draw
+	cancel  func()        // stops decoding started by start
+}
+
+// start decodes live stream in background until stop is called
+func (v *videoFeed) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	v.cancel = cancel
+	go v.run(ctx)
+}
+
+// stop ends decoding started by start
+func (v *videoFeed) stop() {
+	if v.cancel != nil {
+		v.cancel()
+		v.cancel = nil
+	}
+}
+
+// errNoFFmpeg is returned by decode for H.264 stream when ffmpeg was not found
+var errNoFFmpeg = errors.New("no video - ffmpeg not found")
+
+// run decodes live stream until ctx is canceled, reconnecting when the stream ends
+func (v *videoFeed) run(ctx context.Context) {
+	ffmpeg, _ := exec.LookPath("ffmpeg") // not needed for MJPEG
+	for ctx.Err() == nil {
+		if err := v.decode(ctx, ffmpeg); err != nil {
+			log.Println("video:", err)
+			if err == errNoFFmpeg {
+				return
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second * 2):
+		}
+	}
+}
+
+// decode pipes live stream through ffmpeg and stores decoded frames
+func (v *videoFeed) decode(ctx context.Context, ffmpeg string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	frames, err := vtx.Frames(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+	defer func() {
+		cancel()
+		for range frames { // let the stream end
+		}
+	}()
+
+	first, ok := <-frames
+	if !ok {
+		return nil
+	}
+	if first.Codec == vtx.CodecMJPEG {
+		return v.decodeJPEG(first, frames)
+	}
+	if ffmpeg == "" {
+		return errNoFFmpeg
+	}
+
+	cmd := exec.CommandContext(ctx, ffmpeg,
+		"-loglevel", "error",
+		"-f", "h264", "-i", "pipe:0",
+		"-vf", fmt.Sprintf("scale=%d:%d", videoWidth, videoHeight),
+		"-f", "rawvideo", "-pix_fmt", "rgba", "pipe:1",
+	)
+	input, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	defer func() {
+		cancel() // kills ffmpeg
+		cmd.Wait()
+	}()
+
+	go func() {
+		defer input.Close()
+		if _, err := input.Write(first.NAL); err != nil {
+			cancel()
+			return
+		}
+		for frame := range frames {
+			if _, err := input.Write(frame.NAL); err != nil {
+				cancel()
+				return
+			}
+		}
+		cancel() // stream ended
+	}()
+
+	for {
+		frame := v.buffer()
+		if _, err := io.ReadFull(output, frame.Pix); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		v.store(frame)
+	}
+}
+
+// decodeJPEG decodes MJPEG stream starting by first frame until the stream ends, broken images are skipped
+func (v *videoFeed) decodeJPEG(first vtx.Frame, frames <-chan vtx.Frame) error {
+	for frame, ok := first, true; ok; frame, ok = <-frames {
+		img, err := jpeg.Decode(bytes.NewReader(frame.JPEG))
+		if err != nil {
+			continue
+		}
+		frame := v.buffer()
+		scaleRGBA(frame, img)
+		v.store(frame)
+	}
+	return nil
+}
+
+// scaleRGBA resizes image into frame of video size (nearest neighbour is good enough for background)
+//
+// Pixels are read from the image buffers directly, as At and Set are too slow for every frame.
+func scaleRGBA(frame *image.RGBA, img image.Image) {
+	bounds := img.Bounds()
+
+	var sample func(p []byte, x, y int) // writes pixel x, y of img to p
+	switch src := img.(type) {
+	case *image.YCbCr: // usual result of jpeg.Decode
+		sample = func(p []byte, x, y int) {
+			i, c := src.YOffset(x, y), src.COffset(x, y)
+			p[0], p[1], p[2] = imgcolor.YCbCrToRGB(src.Y[i], src.Cb[c], src.Cr[c])
+			p[3] = 0xff
+		}
+	case *image.Gray:
+		sample = func(p []byte, x, y int) {
+			g := src.Pix[src.PixOffset(x, y)]
+			p[0], p[1], p[2], p[3] = g, g, g, 0xff
+		}
+	case *image.RGBA:
+		sample = func(p []byte, x, y int) {
+			i := src.PixOffset(x, y)
+			copy(p, src.Pix[i:i+4])
+		}
+	default:
+		sample = func(p []byte, x, y int) {
+			c := imgcolor.RGBAModel.Convert(img.At(x, y)).(imgcolor.RGBA)
+			p[0], p[1], p[2], p[3] = c.R, c.G, c.B, c.A
+		}
+	}
+
+	columns := make([]int, videoWidth) // x of img for each column of frame
+	for x := range columns {
+		columns[x] = bounds.Min.X + x*bounds.Dx()/videoWidth
+	}
+	for y := 0; y < videoHeight; y++ {
+		sy := bounds.Min.Y + y*bounds.Dy()/videoHeight
+		row := frame.Pix[y*frame.Stride : y*frame.Stride+videoWidth*4]
+		for x, sx := range columns {
+			sample(row[x*4:x*4+4], sx, sy)
+		}
+	}
+}
+
+// buffer returns frame to decode into, reusing the one replaced by last store
+func (v *videoFeed) buffer() *image.RGBA {
+	v.Lock()
+	defer v.Unlock()
+	if v.spare == nil {
+		v.spare = image.NewRGBA(image.Rect(0, 0, videoWidth, videoHeight))
+	}
+	frame := v.spare
+	v.spare = nil // owned by decoder until store
+	return frame
+}
+
+// store makes decoded frame the one to be drawn, the previous one is kept for next buffer
+func (v *videoFeed) store(frame *image.RGBA) {
+	v.Lock()
+	v.frame, v.spare = frame, v.frame
+	v.fresh = true
+	v.Unlock()
+}
+
+// draw renders last decoded frame over whole screen, returns false when there is none
+func (v *videoFeed) draw(sz size.Event) bool {
+	v.Lock()
+	if v.frame == nil {
+		v.Unlock()
+		return false
+	}
+	if v.texture == nil {
+		v.texture = images.NewImage(videoWidth, videoHeight)
+	}
+	fresh := v.fresh
+	if fresh { // copied under lock, the frame is reused by decoder after next store
+		copy(v.texture.RGBA.Pix, v.frame.Pix)
+		v.fresh = false
+	}
+	v.Unlock()
+	if fresh {
+		v.texture.Upload()
+	}
+	v.texture.Draw(
+		sz,
+		geom.Point{X: 0, Y: 0},
+		geom.Point{X: sz.WidthPt, Y: 0},
+		geom.Point{X: 0, Y: sz.HeightPt},
+		v.texture.RGBA.Bounds(),
+	)
+	return true
+}
+
+// release frees the texture, it is created again by next draw
+func (v *videoFeed) release() {
+	if v.texture != nil {
+		v.texture.Release()
+		v.texture = nil
+	}
+	v.Lock()
+	v.fresh = v.frame != nil
+	v.Unlock()
+}
@@ -2,148 +2,579 @@ package vtx
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
-var (
-	localOffset = int64(0) // in seconds
-	chinaOffset = int64(8 * 60 * 60)
-)
+// chinaZone is time zone assumed by firmware of the drone by default
+var chinaZone = time.FixedZone("UTC+8", 8*60*60)
 
-func init() {
-	_, offset := time.Now().Local().Zone()
-	localOffset = int64(offset)
+// SetClock sets internal clock of the drone to currnet time (for saving files by actuall current date)
+func (c *Client) SetClock() error {
+	return c.SetClockAt(time.Now())
 }
 
-// SetClock sets internal clock of the drone to currnet time (for saving files by actuall current date)
-func SetClock() {
-	timestamp := uint32(time.Now().Unix() + localOffset - chinaOffset)
-	data := []uint32{timestamp, 0}
-	Action(setClockCmd, data, nil)
+// SetClockAt sets internal clock of the drone to given time, see clockTimestamp for the conversion
+func (c *Client) SetClockAt(t time.Time) error {
+	data := []uint32{clockTimestamp(t, c.droneZone()), 0}
+	return c.Action(setClockCmd, data, nil)
+}
+
+// droneZone returns time zone assumed by the drone
+func (c *Client) droneZone() *time.Location {
+	if c.DroneZone == nil {
+		return chinaZone
+	}
+	return c.DroneZone
+}
+
+// clockTimestamp converts t to timestamp stored by the drone, which assumes it is in zone
+//
+// Drone has no idea about time zones, it formats file names (and dates) from the timestamp as if it was in zone.
+// So to get wall clock time of t (in its own location) in the names, the timestamp is shifted
+// by difference of the offsets: timestamp = unix time of t + offset of t's location - offset of zone.
+// Eg. 12:00 in Prague (UTC+2 in summer) is 10:00 UTC, it is sent shifted by +2h-8h as 04:00 UTC,
+// which is 12:00 in UTC+8.
+func clockTimestamp(t time.Time, zone *time.Location) uint32 {
+	_, localOffset := t.Zone()
+	_, droneOffset := t.In(zone).Zone()
+	return uint32(t.Unix() + int64(localOffset) - int64(droneOffset))
+}
+
+// clockTime converts timestamp stored by the drone, which assumes it is in zone, to local time
+//
+// It is reverse of clockTimestamp for time.Local.
+func clockTime(timestamp uint32, zone *time.Location) time.Time {
+	wall := time.Unix(int64(timestamp), 0).In(zone)
+	return time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, time.Local)
 }
 
-// TakePhoto will take photo and save to current dir
-func TakePhoto() {
-	Action(takePhotoCmd, nil, func(payload []byte) {
-		// parse payload:
-		fileSize := binary.LittleEndian.Uint32(payload[0:4])
-		fileName := string(bytes.Trim(payload[3*4:3*4+100], "\x00"))
-		fileContent := payload[32*4 : 32*4+fileSize]
+// outputPath returns path for saving file of given name (as named on the drone) in given dir
+//
+// OutputDir of the client is used when dir is empty. Dir is created if it does not exist yet.
+func (c *Client) outputPath(dir, fileName string) (string, error) {
+	if dir == "" {
+		dir = c.OutputDir
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, filepath.Base(fileName)), nil
+}
 
-		println(fileSize, fileName)
+// TakePhoto will take photo and save it to OutputDir of the client
+//
+// It is safe to call it concurrently - requests are queued and each returns name of its own photo.
+func (c *Client) TakePhoto() (fileName string, err error) {
+	return c.TakePhotoIn("")
+}
 
-		// output file
-		err := ioutil.WriteFile(filepath.Base(fileName), fileContent, 0777)
+// TakePhotoIn will take photo and save it to given dir (created if needed)
+func (c *Client) TakePhotoIn(dir string) (fileName string, err error) {
+	return c.takePhoto(func(fileName string, content []byte) error {
+		path, err := c.outputPath(dir, fileName)
 		if err != nil {
-			panic(err)
+			return err
 		}
+		return writeFileAtomic(path, content)
+	})
+}
+
+// TakePhotoTo will take photo and write the jpeg to w
+//
+// It returns name of the photo as saved on the drone.
+func (c *Client) TakePhotoTo(w io.Writer) (fileName string, err error) {
+	return c.takePhoto(func(fileName string, content []byte) error {
+		_, err := w.Write(content)
+		return err
 	})
 }
 
-func ListVideos() (videos []struct {
-	Filename string
-	Duration uint32
-}) {
-	Action(listVideosCmd, nil, func(payload []byte) {
-		for ; len(payload) > 0; payload = payload[116:] {
-			duration := binary.LittleEndian.Uint32(payload[4:8])
-			filename := string(bytes.Trim(payload[4*4:4*4+100], "\x00"))
-			videos = append(videos, struct {
-				Filename string
-				Duration uint32
-			}{filename, duration})
+// RetryPolicy says how many times is request repeated and how long to wait between attempts, see Client.PhotoRetry
+type RetryPolicy struct {
+	Attempts int           // at most (1 = no repetition)
+	Backoff  time.Duration // before second attempt, doubled for each next one (±50% jitter)
+}
+
+// DefaultPhotoRetry takes photo at most 3 times, waiting ~0.5s and ~1s before repetitions
+var DefaultPhotoRetry = RetryPolicy{
+	Attempts: 3,
+	Backoff:  time.Second / 2,
+}
+
+// photoRetry returns retry policy of photos with defaults filled in
+func (c *Client) photoRetry() RetryPolicy {
+	policy := c.PhotoRetry
+	if policy == (RetryPolicy{}) {
+		return DefaultPhotoRetry
+	}
+	if policy.Attempts < 1 {
+		policy.Attempts = 1
+	}
+	return policy
+}
+
+// delay returns how long to wait before given attempt (counted from 1), with random jitter
+func (policy RetryPolicy) delay(attempt int) time.Duration {
+	backoff := policy.Backoff << (attempt - 2)
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// takePhoto will take photo and pass its name and content to save function
+//
+// The drone sometimes responds before the jpeg is ready, so incomplete photo is requested again (taken anew)
+// according to PhotoRetry. Save is called only with complete photo, error wrapping ErrIncompletePhoto
+// is returned when all attempts were incomplete.
+func (c *Client) takePhoto(save func(fileName string, content []byte) error) (fileName string, err error) {
+	if c.AutoRotate {
+		save = c.upright(save)
+	}
+	policy := c.photoRetry()
+	c.photoQueue.do(func() {
+		for attempt := 1; attempt <= policy.Attempts; attempt++ {
+			if attempt > 1 {
+				c.log().Debug("photo incomplete, retrying", "attempt", attempt, "err", err)
+				time.Sleep(policy.delay(attempt))
+			}
+			actionErr := c.Action(takePhotoCmd, nil, func(payload []byte) {
+				fileName, err = parsePhoto(payload, save)
+				c.log().Debug("photo taken", "file", fileName, "err", err)
+			})
+			if actionErr != nil {
+				err = actionErr
+			}
+			if !errors.Is(err, ErrIncompletePhoto) {
+				return
+			}
 		}
 	})
-	return
+	return fileName, err
+}
+
+// upright wraps save function of photos, so they are rotated by their EXIF orientation (see AutoRotate)
+//
+// Photo which can't be decoded is saved as it is, so it is not lost.
+func (c *Client) upright(save func(fileName string, content []byte) error) func(fileName string, content []byte) error {
+	return func(fileName string, content []byte) error {
+		rotated, err := uprightJPEG(content)
+		if err != nil {
+			c.log().Warn("photo can't be rotated", "file", fileName, "err", err)
+			return save(fileName, content)
+		}
+		return save(fileName, rotated)
+	}
+}
+
+// parsePhoto decodes take photo response and passes the photo to save function
+//
+// Error wrapping ErrIncompletePhoto is returned (without calling save) for empty or shorter than declared photo.
+func parsePhoto(payload []byte, save func(fileName string, content []byte) error) (fileName string, err error) {
+	if len(payload) < 32*4 {
+		return "", fmt.Errorf("%w: photo response has %dB", ErrIncompletePhoto, len(payload))
+	}
+	fileSize := binary.LittleEndian.Uint32(payload[0:4])
+	fileName = string(bytes.Trim(payload[3*4:3*4+100], "\x00"))
+	if fileSize == 0 {
+		return fileName, fmt.Errorf("%w: empty photo", ErrIncompletePhoto)
+	}
+	if uint32(len(payload)-32*4) < fileSize {
+		return fileName, fmt.Errorf("%w: photo has %dB of declared %dB", ErrIncompletePhoto, len(payload)-32*4, fileSize)
+	}
+	fileContent := payload[32*4 : 32*4+fileSize]
+
+	return fileName, save(fileName, fileContent)
+}
+
+// Video describes video saved on sd card of the drone
+type Video struct {
+	Filename  string
+	Duration  uint32 // in seconds
+	Size      uint32 // in bytes
+	CreatedAt time.Time
+}
+
+// size of one entry of list videos response
+const videoEntrySize = 116
+
+// ListVideos returns videos saved on sd card of the drone
+//
+// When the response ends with incomplete entry, complete ones are returned together with error wrapping ErrShortPayload.
+func (c *Client) ListVideos() (videos []Video, err error) {
+	actionErr := c.Action(listVideosCmd, nil, func(payload []byte) {
+		videos, err = parseVideoList(payload, c.droneZone())
+	})
+	if actionErr != nil {
+		return nil, actionErr
+	}
+	return videos, err
+}
+
+// parseVideoList decodes entries of list videos response
+//
+// Entry has 116 bytes (numbers are little endian uint32):
+//
+//	0 … 4   size of the file
+//	4 … 8   duration in seconds
+//	8 … 12  creation time - timestamp in time zone of the drone, see clockTimestamp
+//	12 … 16 unknown
+//	16 … 116 file name (zero padded)
+//
+// Only duration and file name were confirmed on real drone so far, size and creation time are best guess.
+// Error wrapping ErrShortPayload is returned for trailing incomplete entry.
+func parseVideoList(payload []byte, zone *time.Location) (videos []Video, err error) {
+	for ; len(payload) >= videoEntrySize; payload = payload[videoEntrySize:] {
+		data32 := byteToUint32(payload[:4*4])
+		videos = append(videos, Video{
+			Filename:  string(bytes.Trim(payload[4*4:videoEntrySize], "\x00")),
+			Duration:  data32[1],
+			Size:      data32[0],
+			CreatedAt: clockTime(data32[2], zone),
+		})
+	}
+	if len(payload) > 0 {
+		return videos, fmt.Errorf("%w: video list entry has %dB", ErrShortPayload, len(payload))
+	}
+	return videos, nil
 }
 
 // DeleteVideo deletes video by given name
-func DeleteVideo(filename string) {
+//
+// Returns error wrapping ErrFileNotFound when the drone reports failure (eg. there is no such video).
+func (c *Client) DeleteVideo(filename string) error {
 	payload := make([]byte, 100)
 	copy(payload, filename)
-	Action(deleteVideoCmd, payload, nil)
+	var result error
+	err := c.Action(deleteVideoCmd, payload, func(payload []byte) {
+		result = parseDeleteResult(payload, filename)
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// parseDeleteResult checks response payload of deleteVideoCmd
+//
+// Not confirmed yet - first uint32 seems to be 1 for deleted and 0 for failure (like on/off),
+// empty payload (sent by some firmwares?) is taken as success, because nothing better can be told.
+func parseDeleteResult(payload []byte, filename string) error {
+	if len(payload) == 0 {
+		return nil
+	}
+	if len(payload) < 4 {
+		return fmt.Errorf("%w: delete response", ErrShortPayload)
+	}
+	switch code := byteToUint32(payload[:4])[0]; code {
+	case 1:
+		return nil
+	case 0:
+		return fmt.Errorf("%w: can't delete %q", ErrFileNotFound, filename)
+	default:
+		return fmt.Errorf("%w: unknown delete result %d", ErrProtocol, code)
+	}
+}
+
+// DownloadVideoFile will dowlnoad video by given name to OutputDir of the client
+//
+// File is named as on the drone (filepath.Base of fileName).
+func (c *Client) DownloadVideoFile(fileName string) error {
+	return c.DownloadVideoIn(fileName, "")
 }
 
-// DownloadVideo will dowlnoad video by given name
-func DownloadVideo(fileName string) {
+// DownloadVideoIn will dowlnoad video by given name to given dir (created if needed)
+//
+// File appears under its final name only when it was downloaded completely.
+func (c *Client) DownloadVideoIn(fileName string, dir string) error {
+	path, err := c.outputPath(dir, fileName)
+	if err != nil {
+		return err
+	}
+	file, err := createAtomic(path)
+	if err != nil {
+		return err
+	}
+	defer file.Discard() // does nothing when the download was completed
+	if err := c.DownloadVideo(context.Background(), fileName, file, nil); err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+// DownloadVideo will dowlnoad video by given name and write it to w
+//
+// onProgress (optional) is called after each received chunk.
+// When ctx is canceled the connection is closed and ctx.Err() returned.
+// Error wrapping ErrProtocol is returned when drone sent something unexpected.
+func (c *Client) DownloadVideo(ctx context.Context, fileName string, w io.Writer, onProgress func(bytesLoaded, fileSize int)) error {
+	return c.downloadVideo(ctx, fileName, w, nil, onProgress)
+}
+
+// downloadVideo will dowlnoad video by given name and write it to w, continuing the partial download if given
+func (c *Client) downloadVideo(ctx context.Context, fileName string, w io.Writer, part *partial, onProgress func(bytesLoaded, fileSize int)) error {
 	// create custom connection because we cant use Action in this case
-	conn, closeConn := newConn(portByCmd(downloadVideoCmd))
-	if conn == nil {
-		return
+	conn, closeConn, err := c.newConn(ctx, c.portByCmd(downloadVideoCmd))
+	if err != nil {
+		return err
 	}
 	defer closeConn()
 
 	// send Req for downloading video
-	payload := make([]byte, 196)
+	payload := make([]byte, downloadHeaderSize)
 	copy(payload[4*4:], fileName)
-	Req(downloadVideoCmd, payload, conn)
+	if part != nil {
+		binary.LittleEndian.PutUint32(payload[1*4:], uint32(part.offset))
+	}
+	if err := Req(downloadVideoCmd, payload, conn); err != nil {
+		return err
+	}
+
+	return c.download(ctx, conn, fileName, w, part, onProgress)
+}
+
+// size of header of each download chunk (and of download request)
+const downloadHeaderSize = 196
+
+// download reads chunks of downloaded file from conn and writes them to w
+//
+// When part is given, the download continues after its offset if the drone supports it,
+// othervise part is restarted and whole file is downloaded.
+func (c *Client) download(ctx context.Context, conn *net.TCPConn, fileName string, w io.Writer, part *partial, onProgress func(bytesLoaded, fileSize int)) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close() // interrupts waiting for next chunk
+		case <-done:
+		}
+	}()
 
-	file := &os.File{}
 	bytesLoaded := 0
-loop:
+	checksum := md5.New()
+	resuming := part != nil && part.offset > 0 // until the drone confirms the offset
+	if resuming {
+		bytesLoaded = part.offset
+		checksum = part.checksum
+	}
+	restart := func() error {
+		resuming = false
+		bytesLoaded = 0
+		checksum = md5.New()
+		return part.restart()
+	}
 	for { // obtain responses
-		data := Res(videoDownloadCmd, conn)
-		data32 := byteToUint32(data)
+		data, err := c.nextChunk(conn, videoDownloadCmd)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if len(data) < downloadHeaderSize {
+			return fmt.Errorf("%w: download chunk has %dB", ErrShortPayload, len(data))
+		}
+		data32 := byteToUint32(data[:4*4]) // only header
 		chunkSize := int(data32[1])
 		fileSize := int(data32[2])
 		recvFileName := string(bytes.Trim(data[4*4:4*4+100], "\x00"))
 
 		// check if this is data for requested file
 		if recvFileName != fileName {
-			panic(fmt.Errorf("%v\n%v\n", fmt.Errorf("Can't download this video - bad response"), data[:len(payload)]))
-			return
+			return fmt.Errorf("%w: got chunk of %q while downloading %q", ErrProtocol, recvFileName, fileName)
 		}
 
 		switch data32[0] { // first number is type of data (1 = start, 2 = data, 3 = end)
 		case 1: // start
-			// create empty file
-			err := error(nil)
-			file, err = os.OpenFile(filepath.Base(fileName), os.O_CREATE|os.O_WRONLY, 0777)
-			if err != nil {
-				panic(fmt.Errorf("%v %v\n%v\n", fmt.Errorf("Can't crate video file"), fileName, err))
-				return
+			// drone supporting ranged download confirms the offset in 4th number
+			if resuming && int(data32[3]) != part.offset {
+				if err := restart(); err != nil {
+					return err
+				}
 			}
-			defer file.Close()
+			resuming = false
 		case 2: // load data chunks
+			if resuming { // no confirmation of the offset
+				if err := restart(); err != nil {
+					return err
+				}
+			}
 			// the rest is the file itself
-			chunkContent := data[len(payload) : len(payload)+chunkSize]
-			// save file content to current directory
-			_, err := file.Write(chunkContent)
-			if err != nil {
-				panic(err)
+			if len(data) < downloadHeaderSize+chunkSize {
+				return fmt.Errorf("%w: download chunk has %dB of declared %dB", ErrShortPayload, len(data)-downloadHeaderSize, chunkSize)
+			}
+			chunkContent := data[downloadHeaderSize : downloadHeaderSize+chunkSize]
+			if _, err := w.Write(chunkContent); err != nil {
+				return err
 			}
+			checksum.Write(chunkContent)
 			bytesLoaded += chunkSize
+			if onProgress != nil {
+				onProgress(bytesLoaded, fileSize)
+			}
 		case 3: // end
-			// fmt.Printf("%d%%\n", bytesLoaded*100/fileSize)
-			println("checksum:", chunkSize, bytesLoaded, fileSize, string(data[116:]))
-			if bytesLoaded == fileSize {
-				break loop
+			if bytesLoaded != fileSize {
+				return fmt.Errorf("%w: received %dB of %dB", ErrProtocol, bytesLoaded, fileSize)
 			}
-			println("Not whole file recieved")
-			// TODO check checksum
+			return verifyChecksum(data[116:downloadHeaderSize], checksum.Sum(nil))
 		default:
-			println("!!!wrong state", data32)
-			break loop
+			return fmt.Errorf("%w: unknown download chunk type %d", ErrProtocol, data32[0])
 		}
 	}
-	// println("done")
+}
+
+// verifyChecksum compares checksum field of download end chunk with computed md5 sum of the file
+//
+// The field is expected to contain md5 sum of the whole file as hex string (zero padded to 80 bytes).
+// Empty field is not checked.
+// TODO: confirm the layout - the end chunk in request_video_file_download.pcapng is cut after its type.
+func verifyChecksum(field []byte, sum []byte) error {
+	expected := strings.ToLower(strings.TrimSpace(string(bytes.Trim(field, "\x00"))))
+	if expected == "" {
+		return nil
+	}
+	if actual := hex.EncodeToString(sum); actual != expected {
+		return fmt.Errorf("%w: expected %s, computed %s", ErrChecksumMismatch, expected, actual)
+	}
+	return nil
+}
+
+// Frame is single frame of video sent by the drone
+//
+// It is one chunk of H.264 stream (NAL units) or one whole image of MJPEG stream (JPEG).
+type Frame struct {
+	Codec    Codec  // of live stream, see JPEG (replay is not detected, it is unknown)
+	Keyframe bool   // key frame comes every 2s, the others are delta frames (every JPEG is key frame)
+	Seq      uint16 // sequence number of the frame (counted by receiver for live stream)
+	Timing   uint16 // time of the frame, multiples of 50
+	NAL      []byte // H.264 NAL unit(s) with start codes
+	JPEG     []byte // whole image when the live stream is MJPEG (NAL is nil then)
 }
 
 // ReplayVideo  will stream saved video to provided output writer
-func ReplayVideo(fileName string, output io.Writer) {
+//
+// Frames are written in the pace they were recorded in (or as fast as possible when output is nil).
+// Returns nil when the whole video was replayed,
+// error wrapping ErrProtocol when drone sent something unexpected,
+// or other error when the connection failed.
+func (c *Client) ReplayVideo(fileName string, output io.Writer) error {
 	// create custom connection because we cant use Action in this case
-	conn, closeConn := newConn(portByCmd(downloadVideoCmd))
-	if conn == nil {
-		return
+	conn, closeConn, err := c.newConn(context.Background(), c.portByCmd(downloadVideoCmd))
+	if err != nil {
+		return err
 	}
 	defer closeConn()
 
+	if err := Req(replayVideoCmd, replayRequest(fileName), conn); err != nil {
+		return err
+	}
+	err = c.replay(conn, output, c.newStreamStats())
+	c.log().Debug("video replay end", "file", fileName, "err", err)
+	return err
+}
+
+// ReplayVideoToFile replays saved video into .h264 file (raw elementary stream) in OutputDir of the client
+//
+// The file is named by the video and current time, eg. "2018_05_20_143000_20240101-120000.h264",
+// and it appears only when the replay was completed. Unlike ReplayVideo it runs as fast as the drone sends it.
+// Returns path of the file.
+func (c *Client) ReplayVideoToFile(fileName string) (outPath string, err error) {
+	base := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	outPath, err = c.outputPath("", base+"_"+time.Now().Format("20060102-150405")+".h264")
+	if err != nil {
+		return "", err
+	}
+	conn, closeConn, err := c.newConn(context.Background(), c.portByCmd(downloadVideoCmd))
+	if err != nil {
+		return "", err
+	}
+	defer closeConn()
+
+	file, err := createAtomic(outPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Discard() // does nothing when the file was completed
+
+	if err := Req(replayVideoCmd, replayRequest(fileName), conn); err != nil {
+		return "", err
+	}
+	stats := c.newStreamStats()
+	var writeErr error
+	err = c.replayFrames(conn, func(frame Frame) bool {
+		stats.add(frame)
+		if frame.NAL != nil { // no NAL in ff00 marked chunk
+			_, writeErr = file.Write(frame.NAL)
+		}
+		return writeErr == nil
+	})
+	c.log().Debug("video replay end", "file", fileName, "out", outPath, "err", err)
+	if err != nil {
+		return "", err
+	}
+	if writeErr != nil {
+		return "", writeErr
+	}
+	if err := file.Commit(); err != nil {
+		return "", err
+	}
+	return outPath, nil
+}
+
+// VideoKeyframe returns first H.264 key frame of saved video, eg. for preview in gallery
+//
+// There is no known preview command in the firmware, so the video is replayed only until the first key frame.
+// NAL of the frame is raw H.264 (with SPS and PPS as sent by the drone), it is not an image - there is
+// no H.264 decoder in go, decode it by ffmpeg or platform decoder.
+// Error wrapping ErrProtocol is returned when the video has no key frame.
+func (c *Client) VideoKeyframe(fileName string) (Frame, error) {
+	conn, closeConn, err := c.newConn(context.Background(), c.portByCmd(downloadVideoCmd))
+	if err != nil {
+		return Frame{}, err
+	}
+	defer closeConn() // stops the replay
+
+	if err := Req(replayVideoCmd, replayRequest(fileName), conn); err != nil {
+		return Frame{}, err
+	}
+	var keyframe Frame
+	err = c.replayFrames(conn, func(frame Frame) bool {
+		if frame.Keyframe && frame.NAL != nil {
+			keyframe = frame
+			keyframe.NAL = append([]byte(nil), frame.NAL...)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return Frame{}, err
+	}
+	if keyframe.NAL == nil {
+		return Frame{}, fmt.Errorf("%w: no key frame in %q", ErrProtocol, fileName)
+	}
+	return keyframe, nil
+}
+
+// replayRequest creates payload of replay request for given file
+func replayRequest(fileName string) []byte {
 	payload := make([]byte, 124)
 	// payload32 := byteToUint32(payload)
 	// payload32[1] = 0x0000003a // ??
@@ -155,148 +586,448 @@ func ReplayVideo(fileName string, output io.Writer) {
 	// payload32[27] = 0xffffff00
 	// payload32[29] = 0xffffff00
 	// fmt.Printf("% x\n", payload)
+	return payload
+}
 
-	// file, _ := os.OpenFile("replay"+filepath.Base(fileName)+".h264", os.O_CREATE|os.O_WRONLY, 0777)
-	// defer file.Close()
+// maxTimingGap is the biggest gap between timings of frames which is waited for in replay,
+// bigger one (or timing going back) is taken as discontinuity and not waited for
+const maxTimingGap = time.Second
 
-	Req(replayVideoCmd, payload, conn)
-	const fps = 10 // half the speed of the actual fps
+// replay reads replayed video chunks from conn and writes them to output
+//
+// Frames are written in pace given by their timing. Without output (eg. only for stats)
+// they are read as fast as the drone sends them. stats can be nil.
+func (c *Client) replay(conn *net.TCPConn, output io.Writer, stats *streamStats) error {
+	var start time.Time       // when first frame was written
+	var elapsed time.Duration // video time since first frame
+	var prevTiming uint16
+	return c.replayFrames(conn, func(frame Frame) bool {
+		stats.add(frame)
+		if output == nil {
+			return true
+		}
+		if start.IsZero() {
+			start = time.Now()
+		} else {
+			elapsed += timingGap(prevTiming, frame.Timing)
+			time.Sleep(time.Until(start.Add(elapsed))) // to the schedule, so delays don't add up
+		}
+		prevTiming = frame.Timing
+		if frame.NAL != nil { // no NAL in ff00 marked chunk
+			output.Write(frame.NAL)
+		}
+		return true
+	})
+}
 
-	ticker := time.NewTicker(time.Second / fps)
-	defer ticker.Stop()
+// timingGap returns time between frames of given timings
+//
+// Timing seems to be in milliseconds (multiples of 50 at 20fps), it overflows after ~65s.
+func timingGap(prev, next uint16) time.Duration {
+	gap := time.Duration(next-prev) * time.Millisecond // wraps around on overflow
+	if gap > maxTimingGap {
+		return 0
+	}
+	return gap
+}
 
+// replayFrames reads replayed video chunks from conn and passes them to onFrame until it returns false
+func (c *Client) replayFrames(conn *net.TCPConn, onFrame func(Frame) (more bool)) error {
 	for {
-		<-ticker.C
-
 		// incoming()
-		data := Res(videoReplayCmd, conn)
-		data32 := byteToUint32(data)
-		if len(data) == 0 {
-			println("eend")
+		data, err := c.nextChunk(conn, videoReplayCmd)
+		if err == io.EOF {
 			// Req(closeCmd, nil, conn)
-			return
-		}
-		// 4 x uint32 chunk header:
-		chunkType := data32[0] // 1 or 0 sometimes 256
-		// 1 is key frame (~40-90kB) every 40th (every 2s)
-		// 0 is delta frame (~1-20kB)
-		chunkSize := data32[1]
-		_ = data[2]            // seems to be always zero
-		chunkTime := data32[3] // multiples of 50
-		_ = chunkTime
-		chunkContent := data[32:]
-
-		if chunkSize == 0 {
-			println("end", chunkTime)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		frame, end, err := parseReplayChunk(data)
+		if err != nil {
+			return err
+		}
+		if end {
 			// Req(closeCmd, nil, conn)
-			return
+			return nil
 		}
-
-		if chunkType != 1 && chunkType != 0 {
-			println("!!!chunktype", chunkType)
-			return
+		if !onFrame(frame) {
+			return nil
 		}
+	}
+}
 
-		// another layer with 4 x 16uint values
-		frame := binary.LittleEndian.Uint16(chunkContent[0:2])  // seq number of frame
-		ff := binary.LittleEndian.Uint16(chunkContent[2:4])     // seq number of frame
-		timing := binary.LittleEndian.Uint16(chunkContent[4:6]) // same as chunkTime
-		println(frame, ff, timing)
-		if ff == 0xff00 {
-			continue
-		}
+// parseReplayChunk parses payload of videoReplayCmd chunk
+//
+// end is true for the zero sized chunk which ends the replay.
+// Frame without NAL is returned for chunks which are not part of the video (marked by 0xff00).
+func parseReplayChunk(data []byte) (frame Frame, end bool, err error) {
+	if len(data) < 32+8 {
+		return frame, false, fmt.Errorf("%w: replay chunk has %dB", ErrShortPayload, len(data))
+	}
+	data32 := byteToUint32(data[:4*4]) // only header
+	// 4 x uint32 chunk header:
+	chunkType := data32[0] // 1 or 0 sometimes 256
+	// 1 is key frame (~40-90kB) every 40th (every 2s)
+	// 0 is delta frame (~1-20kB)
+	chunkSize := data32[1]
+	_ = data[2]            // seems to be always zero
+	chunkTime := data32[3] // multiples of 50
+	chunkContent := data[32:]
 
-		if output != nil {
-			output.Write(chunkContent[8:])
-		}
+	if chunkSize == 0 {
+		return Frame{Timing: uint16(chunkTime)}, true, nil
 	}
+
+	if chunkType != 1 && chunkType != 0 {
+		return frame, false, fmt.Errorf("%w: unknown chunk type %d", ErrProtocol, chunkType)
+	}
+
+	// another layer with 4 x 16uint values
+	data16 := byteToUint16(chunkContent[:4*2])
+	frame = Frame{
+		Keyframe: chunkType == 1,
+		Seq:      data16[0], // seq number of frame
+		Timing:   data16[2], // same as chunkTime
+	}
+	if data16[1] != 0xff00 { // seq number of frame, or mark of chunk to skip
+		frame.NAL = chunkContent[8:]
+	}
+	return frame, false, nil
+}
+
+// nextChunk will obtain payload of next response of given chunkCmd type
+//
+// It returns io.EOF when drone signals end of the stream (videoReplayEndCmd)
+// or when the connection was closed by the drone.
+func (c *Client) nextChunk(conn *net.TCPConn, chunkCmd uint32) (data []byte, err error) {
+	resp, err := c.recvSkipKeepAlive(conn)
+	if err != nil {
+		return nil, err
+	}
+	switch recvCmd := resp.headerGet(cmdI); recvCmd {
+	case chunkCmd:
+		conn.SetDeadline(time.Now().Add(time.Second * 10))
+		return resp.payload.Bytes(), nil
+	case videoReplayEndCmd:
+		return nil, io.EOF
+	default:
+		return nil, fmt.Errorf("%w: invalid response command type; exp %v; got %v", ErrProtocol, chunkCmd, recvCmd)
+	}
+}
+
+// LiveStream will stream live video to provided output writer
+//
+// Returns nil when the drone ended the stream,
+// error wrapping ErrProtocol when drone sent something unexpected,
+// or other error when the connection failed.
+func (c *Client) LiveStream(output io.Writer) error {
+	return c.LiveStreamContext(context.Background(), output)
+}
+
+// LiveStreamContext is the same as LiveStream, but it can be stopped by ctx
+//
+// Returns ctx.Err() when stopped.
+func (c *Client) LiveStreamContext(ctx context.Context, output io.Writer) error {
+	conn, stop, err := c.startLiveStream(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	err = c.stream(conn, output, c.newStreamStats())
+	c.log().Debug("live stream end", "err", err)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Frames will stream live video as separate frames
+//
+// Returned channel is closed when the drone ends the stream, the connection fails or ctx is canceled.
+// Error is returned only when the stream can't be started.
+func (c *Client) Frames(ctx context.Context) (<-chan Frame, error) {
+	conn, stop, err := c.startLiveStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	frames := make(chan Frame)
+	stats := c.newStreamStats()
+	go func() {
+		defer close(frames)
+		defer stop()
+		err := c.streamFrames(conn, func(frame Frame) {
+			stats.add(frame)
+			select {
+			case frames <- frame:
+			case <-ctx.Done():
+			}
+		})
+		c.log().Debug("live stream end", "err", err)
+	}()
+	return frames, nil
 }
 
-func LiveStream(output io.Writer) {
+// startLiveStream connects to the drone and requests live stream
+//
+// Connection is closed when ctx is canceled (which interrupts waiting for next chunk)
+// or when returned function is called.
+func (c *Client) startLiveStream(ctx context.Context) (*net.TCPConn, func(), error) {
 	// create custom connection because we cant use Action in this case
-	conn, closeConn := newConn(portByCmd(streamLiveVideoCmd))
-	if conn == nil {
-		return
+	conn, closeConn, err := c.newConn(ctx, c.portByCmd(streamLiveVideoCmd))
+	if err != nil {
+		return nil, nil, err
 	}
-	defer closeConn()
 
 	// send Req for downloading video
-	Req(streamLiveVideoCmd, nil, conn)
+	if err := Req(streamLiveVideoCmd, nil, conn); err != nil {
+		closeConn()
+		return nil, nil, err
+	}
 
 	// go func() {
 	// 	time.Sleep(time.Second * 3)
 	// 	Req(closeCmd, nil, conn)
 	// }()
 
-	for {
-		data := Res(liveStreamVideoCmd, conn)
-		data32 := byteToUint32(data)
-
-		if len(data) == 0 {
-			println("eend")
-			// Req(closeCmd, nil, conn)
-			return
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close() // interrupts waiting for next chunk
+		case <-done:
 		}
+	}()
+	return conn, func() {
+		close(done)
+		closeConn()
+	}, nil
+}
 
-		// header 8 x 32 uint
-		chunkType := data32[0]
-		chunkSize := data32[1]
-		chunkTime := data32[2]
-		// 3th .. 7th - all zeroes
+// stream reads live video chunks from conn and writes them to output
+//
+// MJPEG stream is written as concatenated JPEG images. stats can be nil.
+func (c *Client) stream(conn *net.TCPConn, output io.Writer, stats *streamStats) error {
+	return c.streamFrames(conn, func(frame Frame) {
+		stats.add(frame)
+		if output != nil {
+			output.Write(frame.NAL)
+			output.Write(frame.JPEG)
+		}
+	})
+}
 
-		if chunkSize == 0 {
-			println("end", chunkTime)
+// streamFrames reads live video chunks from conn and passes them to onFrame
+//
+// Codec is detected from the first chunks (see detectCodec), they are held until it is known.
+// MJPEG stream is split into separate JPEG images.
+func (c *Client) streamFrames(conn *net.TCPConn, onFrame func(Frame)) error {
+	codec := CodecUnknown
+	var pending [][]byte // chunks received before the codec was detected
+	jpegs := jpegSplitter{}
+	seq := uint16(0)
+	// handle passes frames of the chunk to onFrame, end is true for the chunk which ends the stream
+	handle := func(data []byte) (end bool, err error) {
+		if codec == CodecMJPEG {
+			content, timing, end, err := parseMJPEGChunk(data)
+			if err != nil || end {
+				return true, err
+			}
+			for _, image := range jpegs.add(content) {
+				onFrame(Frame{Codec: codec, Keyframe: true, Seq: seq, Timing: timing, JPEG: image})
+				seq++
+			}
+			return false, nil
+		}
+		frame, end, err := parseStreamChunk(data)
+		if err != nil || end {
+			return true, err
+		}
+		frame.Codec = codec
+		frame.Seq = seq
+		onFrame(frame)
+		seq++
+		return false, nil
+	}
+	// detected passes the held chunks once the codec is known (H.264 when it was not recognized)
+	detected := func() (end bool, err error) {
+		if codec == CodecUnknown {
+			codec = CodecH264
+		}
+		for len(pending) > 0 {
+			data := pending[0]
+			pending = pending[1:]
+			if end, err := handle(data); end {
+				return true, err
+			}
+		}
+		return false, nil
+	}
+	for {
+		data, err := c.nextChunk(conn, liveStreamVideoCmd)
+		if err == io.EOF {
 			// Req(closeCmd, nil, conn)
-			return
+			_, err := detected()
+			return err
 		}
-
-		if chunkType != 1 && chunkType != 0 {
-			println("!!!chunktype", chunkType)
-			return
+		if err != nil {
+			return err
+		}
+		if codec == CodecUnknown {
+			if len(data) > 32 {
+				codec = detectCodec(data[32:])
+			}
+			pending = append(pending, data)
+			if codec == CodecUnknown && len(pending) < codecProbeChunks && len(data) > 32 {
+				continue // not known yet
+			}
+			if end, err := detected(); end {
+				return err
+			}
+			continue
 		}
+		if end, err := handle(data); end {
+			return err
+		}
+	}
+}
 
-		// println(chunkType, chunkSize, chunkTime)
+// parseStreamChunk parses payload of liveStreamVideoCmd chunk
+//
+// end is true for the zero sized chunk which ends the stream.
+// Live chunks don't carry sequence number, so Seq of the frame is left zero.
+func parseStreamChunk(data []byte) (frame Frame, end bool, err error) {
+	if len(data) < 32 {
+		return frame, false, fmt.Errorf("%w: stream chunk has %dB", ErrShortPayload, len(data))
+	}
+	data32 := byteToUint32(data[:8*4]) // only header
 
-		chunkContent := data[32:]
+	// header 8 x 32 uint
+	chunkType := data32[0]
+	chunkSize := data32[1]
+	chunkTime := data32[2]
+	// 3th .. 7th - all zeroes
 
-		// fmt.Printf("%v\n", chunkContent[:16])
+	if chunkSize == 0 {
+		return Frame{Timing: uint16(chunkTime)}, true, nil
+	}
 
-		if output != nil {
-			output.Write(chunkContent)
-		}
+	if chunkType != 1 && chunkType != 0 {
+		return frame, false, fmt.Errorf("%w: unknown chunk type %d", ErrProtocol, chunkType)
 	}
 
+	return Frame{
+		Keyframe: chunkType == 1,
+		Timing:   uint16(chunkTime),
+		NAL:      data[32:],
+	}, false, nil
 }
 
 // CaptureVideo will capture video of given period of time
-func CaptureVideo(duration time.Duration) {
-	StartVideo()
+func (c *Client) CaptureVideo(duration time.Duration) error {
+	if err := c.StartVideo(); err != nil {
+		return err
+	}
 	time.Sleep(duration)
-	StopVideo()
+	return c.StopVideo()
+}
+
+// CaptureOptions are parameters of video recording, see StartVideoWithOptions
+//
+// Zero options leave the limits up to the drone (recording goes on until stopped or the card is full).
+type CaptureOptions struct {
+	MaxDuration   time.Duration // of whole recording, whole seconds only (0 = 24h, if SegmentLength is set)
+	SegmentLength time.Duration // of each video file, whole seconds only (0 = 5min, if MaxDuration is set)
+}
+
+// SegmentedCapture splits recording into 5 minutes long videos, as the original app does
+var SegmentedCapture = CaptureOptions{
+	MaxDuration:   24*time.Hour - time.Second,
+	SegmentLength: 5 * time.Minute,
+}
+
+// payload returns capture command payload of the options
+//
+// Payload slots of captureVideoCmd are:
+//
+//	[0] on/off
+//	[1] 4 when limits are given, 0 othervise (maybe some mode - other values are not known)
+//	[2] always 0 (unknown)
+//	[3] max duration of whole recording in seconds
+//	[4] length of one segment (video file) in seconds
+func (opts CaptureOptions) payload(onOff uint32) []uint32 {
+	if opts.MaxDuration <= 0 && opts.SegmentLength <= 0 {
+		return []uint32{onOff, 0, 0, 0, 0}
+	}
+	if opts.MaxDuration <= 0 {
+		opts.MaxDuration = SegmentedCapture.MaxDuration
+	}
+	if opts.SegmentLength <= 0 {
+		opts.SegmentLength = SegmentedCapture.SegmentLength
+	}
+	return []uint32{
+		onOff,
+		4,
+		0,
+		uint32(opts.MaxDuration / time.Second),
+		uint32(opts.SegmentLength / time.Second),
+	}
 }
 
 // StartVideo will start video recording (unless it already started)
-func StartVideo() {
-	if !IsCapturing() {
-		// Action(captureVideoCmd, []uint32{on, 4, 0, 24*60*60 - 1, 5 * 60}, nil)
-		Action(captureVideoCmd, []uint32{on, 0, 0, 0, 0}, nil)
+//
+// Limits of the recording are left up to the drone, use StartVideoWithOptions to set them.
+func (c *Client) StartVideo() error {
+	return c.StartVideoWithOptions(CaptureOptions{})
+}
+
+// StartVideoWithOptions will start video recording with given limits (unless it already started)
+//
+// Eg. StartVideoWithOptions(SegmentedCapture) records 5 minutes long videos.
+func (c *Client) StartVideoWithOptions(opts CaptureOptions) error {
+	capturing, err := c.IsCapturing()
+	if err != nil || capturing {
+		return err
+	}
+	segments, err := c.newSegmentWatcher()
+	if err != nil {
+		return err
 	}
+	defer c.InvalidateStatus()
+	if err := c.Action(captureVideoCmd, opts.payload(on), nil); err != nil {
+		return err
+	}
+	c.watchSegments(segments)
+	return nil
 }
 
 // StopVideo will stop video recording (unless it already stopped)
-func StopVideo() {
-	if IsCapturing() {
-		// Action(captureVideoCmd, []uint32{off, 4, 0, 24*60*60 - 1, 5 * 60}, nil)
-		Action(captureVideoCmd, []uint32{off, 0, 0, 0, 0}, nil)
+func (c *Client) StopVideo() error {
+	capturing, err := c.IsCapturing()
+	if err != nil {
+		return err
+	}
+	if capturing {
+		defer c.InvalidateStatus()
+		if err := c.Action(captureVideoCmd, CaptureOptions{}.payload(off), nil); err != nil {
+			return err
+		}
 	}
+	c.stopSegments()
+	return nil
 }
 
-// IsCapturing will fetch payload last set by StartVide/StopVideo and reurn boolean accordingly
-func IsCapturing() bool {
-	isCapturing := false
-	Action(checkVideoCmd, nil, func(payload []byte) {
-		capturing := byteToUint32(payload)[0]
-		isCapturing = capturing == on
-	})
-	return isCapturing
+// checkCapturing asks the drone over conn whether it is capturing video
+func (c *Client) checkCapturing(conn *net.TCPConn) (bool, error) {
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	payload, err := c.request(conn, checkVideoCmd, nil)
+	if err != nil {
+		return false, err
+	}
+	if len(payload) < 4 {
+		return false, fmt.Errorf("%w: capture state response", ErrShortPayload)
+	}
+	capturing := byteToUint32(payload[:4])[0]
+	return capturing == on, nil
 }
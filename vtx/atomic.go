@@ -0,0 +1,71 @@
+package vtx
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// atomicFile is written to temporary file which is renamed to its final name only on Commit
+//
+// So interrupted transfers never leave truncated file looking like complete one.
+type atomicFile struct {
+	*os.File
+	name string // final name
+	done bool
+}
+
+// createAtomic creates temporary file in the same directory as final name
+func createAtomic(name string) (*atomicFile, error) {
+	dir, base := filepath.Split(name)
+	if dir == "" {
+		dir = "."
+	}
+	file, err := ioutil.TempFile(dir, "."+base+".part")
+	if err != nil {
+		return nil, err
+	}
+	return &atomicFile{File: file, name: name}, nil
+}
+
+// Commit closes the file and moves it to its final name
+func (f *atomicFile) Commit() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	err := f.Close()
+	if err == nil {
+		err = os.Chmod(f.File.Name(), 0777)
+	}
+	if err == nil {
+		err = os.Rename(f.File.Name(), f.name)
+	}
+	if err != nil {
+		os.Remove(f.File.Name()) // temporary file is never left behind
+	}
+	return err
+}
+
+// Discard closes and removes the temporary file, unless it was already commited
+func (f *atomicFile) Discard() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.Close()
+	os.Remove(f.File.Name())
+}
+
+// writeFileAtomic is atomic alternative to ioutil.WriteFile
+func writeFileAtomic(name string, data []byte) error {
+	file, err := createAtomic(name)
+	if err != nil {
+		return err
+	}
+	defer file.Discard()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Commit()
+}
@@ -0,0 +1,546 @@
+package vtx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Client talks to vtx of single drone
+//
+// Create it by NewClient, fields can be changed before the client is used.
+// Package level functions (TakePhoto, ListVideos,...) use DefaultClient.
+//
+// Only one connection to each port of the drone is open at a time, because firmware of the drone
+// gets confused by overlapping sessions. So operations on control port (taking photos, capturing
+// and listing videos, SetClock, StorageInfo,...) wait for each other and so do operations
+// on stream port (LiveStream, ReplayVideo, DownloadVideo). The wait is limited by context
+// of the operation and by 10s - eg. download fails with ErrPortBusy while live stream runs.
+// Operations on different ports run independently.
+//
+// Each operation opens its own connection, unless the client is connected by Connect,
+// then request/response operations reuse persistent one. IsCapturing keeps its connection
+// open between calls anyway. Close closes the kept connections.
+type Client struct {
+	IP          net.IP        // of the drone
+	ControlPort int           // for commands (taking photos, capturing and listing videos,...)
+	StreamPort  int           // for live stream, replaying and downloading videos
+	DialTimeout time.Duration // 0 means no timeout (but the system one)
+
+	// KeepAliveInterval is how often are keepalives sent over open connections (0 = 2s)
+	// The drone closes connections which are not written to for 5-10s.
+	KeepAliveInterval time.Duration
+
+	// LocalAddr is source address of connections to the drone
+	// nil IP means automatically chosen IP (see getLocalIP), zero Port means auto port
+	LocalAddr net.TCPAddr
+	// OutputDir is directory where photos and videos are saved ("" = current working directory)
+	OutputDir string
+	// DroneZone is time zone the firmware of the drone assumes for its clock (nil = UTC+8 as in china)
+	// It is used by SetClock and for creation time of videos.
+	DroneZone *time.Location
+	// Logger receives diagnostic messages, eg. slog.Default() (nil = no logging)
+	Logger Logger
+	// Dump receives every LeweiCmd received from the drone, see NewDump (nil = no dumping)
+	Dump *Dump
+	// PhotoRetry says how is photo re-requested when the drone sends incomplete one (zero = DefaultPhotoRetry)
+	PhotoRetry RetryPolicy
+	// AutoRotate makes taken photos upright by their EXIF orientation before saving (re-encoded then, EXIF is kept)
+	// It is off by default, so photos are saved exactly as sent by the drone.
+	AutoRotate bool
+
+	photoQueue fifo   // serializes photo requests, so concurrent ones don't collide on the camera
+	status     status // cached result of IsCapturing
+	onStats    func(StreamStats)
+	onSegment  func(string)
+
+	segmentsMu sync.Mutex
+	segments   *segmentWatcher // polls finished segments of recording, see OnSegment
+
+	portsMu   sync.Mutex
+	ports     map[int]chan struct{} // semaphore of each port, full while connection to the port is used
+	idle      map[int]*idleConn     // open connections which are not used at the moment
+	connected bool                  // by Connect, until Close
+}
+
+// NewClient creates client for drone of given IP with default ports (8060 and 7060)
+func NewClient(ip net.IP) *Client {
+	return &Client{
+		IP:          ip,
+		ControlPort: 8060,
+		StreamPort:  7060,
+	}
+}
+
+// DefaultClient is used by package level functions, it targets the drone at 192.168.0.1
+var DefaultClient = NewClient(net.IPv4(192, 168, 0, 1))
+
+// portByCmd returns port of the drone the cmd is sent to
+func (c *Client) portByCmd(cmd uint32) int {
+	if isStreamCmd(cmd) {
+		return c.StreamPort
+	}
+	return c.ControlPort
+}
+
+// portWait limits how long operation waits until other one frees the port, see Client
+var portWait = 10 * time.Second
+
+// acquirePort takes given port, waiting until other operation releases it by releasePort
+//
+// ctx.Err() is returned when ctx is done meanwhile, error wrapping ErrPortBusy when it takes more than portWait.
+func (c *Client) acquirePort(ctx context.Context, port int) error {
+	c.portsMu.Lock()
+	if c.ports == nil {
+		c.ports = map[int]chan struct{}{}
+	}
+	if c.ports[port] == nil {
+		c.ports[port] = make(chan struct{}, 1)
+	}
+	sem := c.ports[port]
+	c.portsMu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	timer := time.NewTimer(portWait)
+	defer timer.Stop()
+	select {
+	case sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return fmt.Errorf("%w: port %d is used by other operation for %v", ErrPortBusy, port, portWait)
+	}
+}
+
+// releasePort frees port taken by acquirePort
+func (c *Client) releasePort(port int) {
+	c.portsMu.Lock()
+	sem := c.ports[port]
+	c.portsMu.Unlock()
+	<-sem
+}
+
+// newConn connects to given port of the drone and keeps the connection alive until returned func is called
+//
+// It waits until other connection to the same port is closed (see acquirePort) and it always opens new connection
+// (idle one of the port is closed), so it is for operations which leave the connection in unknown state, eg. streams.
+// Returned func must be called on every path (defer it right away), othervise the connection,
+// its keepalive goroutine and the port stay taken. It is safe to call it more than once.
+// Error matching ErrNotConnected is returned when the connection can't be created.
+func (c *Client) newConn(ctx context.Context, port int) (*net.TCPConn, func(), error) {
+	if err := c.acquirePort(ctx, port); err != nil {
+		return nil, nil, err
+	}
+	c.dropIdle(port) // it would be second connection to the port
+	conn, closeConn, _, err := c.takeConn(ctx, port)
+	if err != nil {
+		c.releasePort(port)
+		return nil, nil, err
+	}
+	release := sync.Once{}
+	return conn, func() {
+		closeConn()
+		release.Do(func() { c.releasePort(port) })
+	}, nil
+}
+
+// sharedConn returns connection to given port for request/response operation, reusing idle one when there is
+//
+// It waits until other connection to the same port is released (see acquirePort). Returned func must be called
+// on every path with whether the connection is still fine to use - then it is kept open for next operation
+// if the client is connected (or for keepFor when it is not), othervise it is closed.
+// reused says whether the connection was open before (and so the drone might have closed it meanwhile).
+func (c *Client) sharedConn(ctx context.Context, port int, keepFor time.Duration) (conn *net.TCPConn, release func(ok bool), reused bool, err error) {
+	if err := c.acquirePort(ctx, port); err != nil {
+		return nil, nil, false, err
+	}
+	conn, closeConn, reused, err := c.takeConn(ctx, port)
+	if err != nil {
+		c.releasePort(port)
+		return nil, nil, false, err
+	}
+	once := sync.Once{}
+	return conn, func(ok bool) {
+		once.Do(func() {
+			c.portsMu.Lock()
+			connected := c.connected
+			c.portsMu.Unlock()
+			if ok && connected {
+				c.putIdle(port, conn, closeConn, 0)
+			} else if ok && keepFor > 0 {
+				c.putIdle(port, conn, closeConn, keepFor)
+			} else {
+				closeConn()
+			}
+			c.releasePort(port)
+		})
+	}, reused, nil
+}
+
+// takeConn returns idle connection to given port, or opens new one when there is none
+//
+// Returned func closes the connection and stops its keepalive. Port must be taken by caller (see acquirePort).
+func (c *Client) takeConn(ctx context.Context, port int) (conn *net.TCPConn, closeConn func(), reused bool, err error) {
+	c.portsMu.Lock()
+	idle := c.idle[port]
+	delete(c.idle, port)
+	c.portsMu.Unlock()
+	if idle != nil {
+		if idle.timer != nil {
+			idle.timer.Stop()
+		}
+		return idle.conn, idle.closeConn, true, nil
+	}
+
+	conn, err = c.dial(ctx, port)
+	if err != nil {
+		return nil, nil, false, connError{err}
+	}
+	interval := c.KeepAliveInterval
+	if interval <= 0 {
+		interval = defaultKeepAliveInterval
+	}
+	return conn, keepAlive(conn, interval, c.log()), false, nil
+}
+
+// idleConn is open connection to the drone which is not used at the moment
+type idleConn struct {
+	conn      *net.TCPConn
+	closeConn func()      // closes it and stops its keepalive
+	timer     *time.Timer // closes it when not used for a while, nil when kept until Close
+}
+
+// putIdle keeps the connection open for next operation on the port, for given time (0 = until Close)
+func (c *Client) putIdle(port int, conn *net.TCPConn, closeConn func(), keepFor time.Duration) {
+	conn.SetDeadline(time.Time{}) // so keepalives don't fail while idle
+	idle := &idleConn{conn: conn, closeConn: closeConn}
+	c.portsMu.Lock()
+	defer c.portsMu.Unlock()
+	if keepFor > 0 {
+		idle.timer = time.AfterFunc(keepFor, func() {
+			c.portsMu.Lock()
+			expired := c.idle[port] == idle
+			if expired {
+				delete(c.idle, port)
+			}
+			c.portsMu.Unlock()
+			if expired {
+				closeConn()
+			}
+		})
+	}
+	if c.idle == nil {
+		c.idle = map[int]*idleConn{}
+	}
+	c.idle[port] = idle
+}
+
+// dropIdle closes idle connection to given port, if there is one
+func (c *Client) dropIdle(port int) {
+	c.portsMu.Lock()
+	idle := c.idle[port]
+	delete(c.idle, port)
+	c.portsMu.Unlock()
+	if idle != nil {
+		if idle.timer != nil {
+			idle.timer.Stop()
+		}
+		idle.closeConn()
+	}
+}
+
+// Connect opens persistent connection to the control port of the drone
+//
+// Request/response operations (taking photos, listing videos, IsCapturing,...) then reuse it
+// instead of connecting every time, which makes rapid calls faster. The connection is kept alive until Close.
+// Connection which failed is closed and next operation opens new one.
+// Only the control port is kept - streaming operations (LiveStream, ReplayVideo, DownloadVideo,...)
+// use the stream port exclusively and open their own connection anyway.
+// Connecting is optional - without it every operation connects by itself.
+// Error matching ErrNotConnected is returned when the drone can't be reached.
+func (c *Client) Connect() error {
+	port := c.ControlPort
+	if err := c.acquirePort(context.Background(), port); err != nil {
+		c.Close()
+		return err
+	}
+	conn, closeConn, _, err := c.takeConn(context.Background(), port)
+	if err != nil {
+		c.releasePort(port)
+		c.Close()
+		return err
+	}
+	c.putIdle(port, conn, closeConn, 0)
+	c.releasePort(port)
+	c.portsMu.Lock()
+	c.connected = true
+	c.portsMu.Unlock()
+	return nil
+}
+
+// Close closes persistent connection opened by Connect (and the one kept by IsCapturing)
+//
+// Operations in progress are not interrupted, their connections are closed when they finish.
+// The client can be used (and connected) again after Close.
+func (c *Client) Close() error {
+	c.portsMu.Lock()
+	c.connected = false
+	idle := c.idle
+	c.idle = nil
+	c.portsMu.Unlock()
+	for _, conn := range idle {
+		if conn.timer != nil {
+			conn.timer.Stop()
+		}
+		conn.closeConn()
+	}
+	return nil
+}
+
+// dial connects to given port of the drone, it can be canceled by ctx
+func (c *Client) dial(ctx context.Context, port int) (*net.TCPConn, error) {
+	laddr := &net.TCPAddr{IP: c.LocalAddr.IP, Port: c.LocalAddr.Port}
+	if laddr.IP == nil {
+		laddr.IP = getLocalIP(c.IP) // nil when not found, then the system chooses
+	}
+	dialer := net.Dialer{Timeout: c.DialTimeout, LocalAddr: laddr}
+	conn, err := dialer.DialContext(ctx, "tcp4", (&net.TCPAddr{IP: c.IP, Port: port}).String())
+	if err != nil {
+		return nil, err
+	}
+	tcpConn := conn.(*net.TCPConn)
+	tcpConn.SetDeadline(time.Time{})
+	return tcpConn, nil
+}
+
+// connError wraps network error, so it matches both it and ErrNotConnected
+type connError struct {
+	err error
+}
+
+func (e connError) Error() string {
+	return ErrNotConnected.Error() + ": " + e.err.Error()
+}
+
+func (e connError) Unwrap() error {
+	return e.err
+}
+
+func (e connError) Is(target error) bool {
+	return target == ErrNotConnected
+}
+
+/* Package level functions using DefaultClient */
+
+// Connect calls DefaultClient.Connect
+func Connect() error {
+	return DefaultClient.Connect()
+}
+
+// Close calls DefaultClient.Close
+func Close() error {
+	return DefaultClient.Close()
+}
+
+// SetLocalAddr sets source IP and/or port used for connections to the drone
+//
+// By default (nil IP and zero port) IP is chosen automatically from interfaces in subnet of the drone
+// and port is chosen by the system. Set IP when it picks wrong one (eg. when 192.168.0.2 is taken)
+// and port when fixed source port is needed (eg. because of firewall rules).
+//
+// Note that with fixed port only one connection to each of drones ports may exist at a time
+// and the system might refuse to reuse the port for a while after the connection was closed.
+func SetLocalAddr(ip net.IP, port int) {
+	DefaultClient.LocalAddr = net.TCPAddr{IP: ip, Port: port}
+}
+
+// SetOutputDir sets directory where TakePhoto and DownloadVideoFile save files
+//
+// Empty string means current working directory (default). Directory is created when needed.
+func SetOutputDir(dir string) {
+	DefaultClient.OutputDir = dir
+}
+
+// SetKeepAliveInterval sets how often are keepalives sent over open connections (default 2s)
+func SetKeepAliveInterval(interval time.Duration) {
+	DefaultClient.KeepAliveInterval = interval
+}
+
+// SetLogger sets where DefaultClient logs to (default nowhere), eg. slog.Default()
+func SetLogger(logger Logger) {
+	DefaultClient.Logger = logger
+}
+
+// SetPhotoRetry sets how is incomplete photo re-requested by TakePhoto (default DefaultPhotoRetry)
+func SetPhotoRetry(policy RetryPolicy) {
+	DefaultClient.PhotoRetry = policy
+}
+
+// SetAutoRotate sets whether TakePhoto rotates photos upright by their EXIF orientation (default off)
+func SetAutoRotate(enabled bool) {
+	DefaultClient.AutoRotate = enabled
+}
+
+// Probe calls DefaultClient.Probe
+func Probe() error {
+	return DefaultClient.Probe()
+}
+
+// Action calls DefaultClient.Action
+func Action(cmd uint32, payload interface{}, callback func([]byte)) error {
+	return DefaultClient.Action(cmd, payload, callback)
+}
+
+// ActionContext calls DefaultClient.ActionContext
+func ActionContext(ctx context.Context, cmd uint32, payload interface{}, callback func([]byte)) error {
+	return DefaultClient.ActionContext(ctx, cmd, payload, callback)
+}
+
+// SetClock calls DefaultClient.SetClock
+func SetClock() error {
+	return DefaultClient.SetClock()
+}
+
+// SetClockAt calls DefaultClient.SetClockAt
+func SetClockAt(t time.Time) error {
+	return DefaultClient.SetClockAt(t)
+}
+
+// TakePhoto calls DefaultClient.TakePhoto
+func TakePhoto() (fileName string, err error) {
+	return DefaultClient.TakePhoto()
+}
+
+// TakePhotoIn calls DefaultClient.TakePhotoIn
+func TakePhotoIn(dir string) (fileName string, err error) {
+	return DefaultClient.TakePhotoIn(dir)
+}
+
+// TakePhotoTo calls DefaultClient.TakePhotoTo
+func TakePhotoTo(w io.Writer) (fileName string, err error) {
+	return DefaultClient.TakePhotoTo(w)
+}
+
+// ListVideos calls DefaultClient.ListVideos
+func ListVideos() (videos []Video, err error) {
+	return DefaultClient.ListVideos()
+}
+
+// DeleteVideo calls DefaultClient.DeleteVideo
+func DeleteVideo(filename string) error {
+	return DefaultClient.DeleteVideo(filename)
+}
+
+// DownloadVideoFile calls DefaultClient.DownloadVideoFile
+func DownloadVideoFile(fileName string) error {
+	return DefaultClient.DownloadVideoFile(fileName)
+}
+
+// DownloadVideoIn calls DefaultClient.DownloadVideoIn
+func DownloadVideoIn(fileName string, dir string) error {
+	return DefaultClient.DownloadVideoIn(fileName, dir)
+}
+
+// DownloadVideoResume calls DefaultClient.DownloadVideoResume
+func DownloadVideoResume(fileName string) error {
+	return DefaultClient.DownloadVideoResume(fileName)
+}
+
+// DownloadVideo calls DefaultClient.DownloadVideo
+func DownloadVideo(ctx context.Context, fileName string, w io.Writer, onProgress func(bytesLoaded, fileSize int)) error {
+	return DefaultClient.DownloadVideo(ctx, fileName, w, onProgress)
+}
+
+// ReplayVideo calls DefaultClient.ReplayVideo
+func ReplayVideo(fileName string, output io.Writer) error {
+	return DefaultClient.ReplayVideo(fileName, output)
+}
+
+// ReplayVideoToFile calls DefaultClient.ReplayVideoToFile
+func ReplayVideoToFile(fileName string) (string, error) {
+	return DefaultClient.ReplayVideoToFile(fileName)
+}
+
+// SaveMP4 calls DefaultClient.SaveMP4
+func SaveMP4(fileName, outPath string) error {
+	return DefaultClient.SaveMP4(fileName, outPath)
+}
+
+// VideoKeyframe calls DefaultClient.VideoKeyframe
+func VideoKeyframe(fileName string) (Frame, error) {
+	return DefaultClient.VideoKeyframe(fileName)
+}
+
+// OnStats calls DefaultClient.OnStats
+func OnStats(fn func(StreamStats)) {
+	DefaultClient.OnStats(fn)
+}
+
+// OnSegment calls DefaultClient.OnSegment
+func OnSegment(fn func(fileName string)) {
+	DefaultClient.OnSegment(fn)
+}
+
+// LiveStream calls DefaultClient.LiveStream
+func LiveStream(output io.Writer) error {
+	return DefaultClient.LiveStream(output)
+}
+
+// LiveStreamContext calls DefaultClient.LiveStreamContext
+func LiveStreamContext(ctx context.Context, output io.Writer) error {
+	return DefaultClient.LiveStreamContext(ctx, output)
+}
+
+// Frames calls DefaultClient.Frames
+func Frames(ctx context.Context) (<-chan Frame, error) {
+	return DefaultClient.Frames(ctx)
+}
+
+// ServeHTTP serves live stream of DefaultClient over HTTP on given address, see StreamServer
+//
+// It blocks like http.ListenAndServe.
+func ServeHTTP(addr string) error {
+	return http.ListenAndServe(addr, DefaultClient.StreamServer())
+}
+
+// StorageInfo calls DefaultClient.StorageInfo
+func StorageInfo() (free, total uint64, err error) {
+	return DefaultClient.StorageInfo()
+}
+
+// CaptureVideo calls DefaultClient.CaptureVideo
+func CaptureVideo(duration time.Duration) error {
+	return DefaultClient.CaptureVideo(duration)
+}
+
+// StartVideo calls DefaultClient.StartVideo
+func StartVideo() error {
+	return DefaultClient.StartVideo()
+}
+
+// StartVideoWithOptions calls DefaultClient.StartVideoWithOptions
+func StartVideoWithOptions(opts CaptureOptions) error {
+	return DefaultClient.StartVideoWithOptions(opts)
+}
+
+// StopVideo calls DefaultClient.StopVideo
+func StopVideo() error {
+	return DefaultClient.StopVideo()
+}
+
+// IsCapturing calls DefaultClient.IsCapturing
+func IsCapturing() (bool, error) {
+	return DefaultClient.IsCapturing()
+}
+
+// InvalidateStatus calls DefaultClient.InvalidateStatus
+func InvalidateStatus() {
+	DefaultClient.InvalidateStatus()
+}
@@ -0,0 +1,169 @@
+package vtx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// headerFields is number of uint32 fields in LeweiCmd header
+const headerFields = 9
+
+// CommandBuilder builds custom LeweiCmd
+//
+// It is meant for probing unknown commands and header fields:
+//
+//	resp, err := vtx.NewCommand(0x0003).SetField(1, 1).Payload([]uint32{0}).Send()
+//	fmt.Println(resp.Inspect())
+type CommandBuilder struct {
+	action  uint32
+	fields  map[uint]uint32
+	payload []interface{}
+	port    int
+}
+
+// NewCommand starts building command with given action (first header field)
+func NewCommand(action uint32) *CommandBuilder {
+	return &CommandBuilder{
+		action: action,
+		fields: map[uint]uint32{},
+	}
+}
+
+// SetField sets header field at given index (0-8)
+//
+// Fields set explicitly override the action (index 0) and payload length (index 3)
+func (b *CommandBuilder) SetField(index uint, value uint32) *CommandBuilder {
+	if index < headerFields {
+		b.fields[index] = value
+	}
+	return b
+}
+
+// Payload appends string, byte slice, or uint32 slice to payload of the command
+func (b *CommandBuilder) Payload(data interface{}) *CommandBuilder {
+	b.payload = append(b.payload, data)
+	return b
+}
+
+// Port sets port the command will be sent to
+//
+// By default it is chosen by the action the same way as for known commands (stream or control port)
+func (b *CommandBuilder) Port(port int) *CommandBuilder {
+	b.port = port
+	return b
+}
+
+// Build creates the LeweiCmd
+func (b *CommandBuilder) Build() LeweiCmd {
+	cmd := NewLeweiCmd(b.action)
+	for _, data := range b.payload {
+		cmd.AddPayload(data)
+	}
+	for index, value := range b.fields {
+		cmd.headerSet(index, value)
+	}
+	return cmd
+}
+
+// Send builds the command, sends it to the drone and returns first response which is not keepalive
+func (b *CommandBuilder) Send() (LeweiCmd, error) {
+	return b.SendTo(DefaultClient)
+}
+
+// SendTo is the same as Send, but the command is sent to drone of given client
+func (b *CommandBuilder) SendTo(c *Client) (LeweiCmd, error) {
+	port := b.port
+	if port == 0 {
+		port = c.portByCmd(b.action)
+	}
+	conn, closeConn, err := c.newConn(context.Background(), port)
+	if err != nil {
+		return LeweiCmd{}, err
+	}
+	defer closeConn()
+
+	if err := send(conn, b.Build()); err != nil {
+		return LeweiCmd{}, err
+	}
+	conn.SetDeadline(time.Now().Add(time.Second * 10))
+	return c.recvSkipKeepAlive(conn)
+}
+
+// Fields returns all nine header fields of the command
+func (c *LeweiCmd) Fields() (fields [headerFields]uint32) {
+	for i := range fields {
+		fields[i] = c.headerGet(uint(i))
+	}
+	return fields
+}
+
+// Payload returns payload of the command
+func (c *LeweiCmd) Payload() []byte {
+	return c.payload.Bytes()
+}
+
+// PayloadUint32 returns index-th little endian uint32 number of the payload
+//
+// ok is false when the payload is too short.
+func (c *LeweiCmd) PayloadUint32(index int) (value uint32, ok bool) {
+	data := c.payload.Bytes()
+	if index < 0 || len(data) < (index+1)*4 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(data[index*4:]), true
+}
+
+// MarshalBinary returns the command as it is sent over the wire (header followed by payload)
+func (c *LeweiCmd) MarshalBinary() ([]byte, error) {
+	data := make([]byte, 0, len(c.header)+c.payload.Len())
+	data = append(data, c.header...)
+	return append(data, c.payload.Bytes()...), nil
+}
+
+// UnmarshalBinary reconstructs the command from bytes returned by MarshalBinary
+//
+// Error wrapping ErrProtocol is returned when the data does not start with "lewei_cmd\x00"
+// or when its length does not match payload length in the header (ErrShortPayload when it is shorter).
+func (c *LeweiCmd) UnmarshalBinary(data []byte) error {
+	cmd := NewLeweiCmd(0)
+	if len(data) < len(cmd.header) {
+		return fmt.Errorf("%w: command has %dB", ErrShortPayload, len(data))
+	}
+	if !bytes.HasPrefix(data, []byte(headerMagic)) {
+		return fmt.Errorf("%w: missing lewei_cmd prefix", ErrBadHeader)
+	}
+	copy(cmd.header, data)
+	payload := data[len(cmd.header):]
+	switch payloadLen := int(cmd.headerGet(lenI)); {
+	case len(payload) < payloadLen:
+		return fmt.Errorf("%w: payload has %dB of %dB", ErrShortPayload, len(payload), payloadLen)
+	case len(payload) > payloadLen:
+		return fmt.Errorf("%w: payload has %dB, but header says %dB", ErrProtocol, len(payload), payloadLen)
+	}
+	c.header = cmd.header
+	c.payload.Reset()
+	c.payload.Write(payload)
+	return nil
+}
+
+// WriteTo writes the command as it is sent over the wire to w
+func (c *LeweiCmd) WriteTo(w io.Writer) (int64, error) {
+	data, _ := c.MarshalBinary()
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// Inspect returns human readable dump of all header fields and the payload
+func (c *LeweiCmd) Inspect() string {
+	str := &strings.Builder{}
+	for i, field := range c.Fields() {
+		fmt.Fprintf(str, "field %d: %#08x (%d)\n", i, field, field)
+	}
+	fmt.Fprintf(str, "payload (%dB): % x\n", c.payload.Len(), c.payload.Bytes())
+	return str.String()
+}
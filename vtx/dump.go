@@ -0,0 +1,125 @@
+package vtx
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Dump writes every LeweiCmd received by the client (header + payload in hex), see Client.Dump
+//
+// It is meant for capturing samples needed to reverse engineer the unknown header fields.
+// Create it by NewDump or NewDirDump.
+type Dump struct {
+	write func(cmd *LeweiCmd) error
+
+	errMu sync.Mutex
+	err   error // first error of write
+}
+
+// NewDump creates Dump which writes to given writer
+//
+// Each line is prefixed by the command type of received response.
+// Writes are serialized, so w does not need to be safe for concurrent use.
+func NewDump(w io.Writer) *Dump {
+	var mu sync.Mutex
+	return &Dump{write: func(cmd *LeweiCmd) error {
+		line := fmt.Sprintf("%04x %s\n", cmd.headerGet(cmdI), cmd.hexDump())
+		mu.Lock()
+		defer mu.Unlock()
+		_, err := io.WriteString(w, line)
+		return err
+	}}
+}
+
+// NewDirDump creates Dump which appends to file in given dir
+//
+// Files are named by the command type of received response (eg. 0008.hex for list of videos).
+// Directory is created if it does not exist. Error is returned when the directory is not writable,
+// files which can't be opened later are reported by Err.
+func NewDirDump(dir string) (*Dump, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	probe, err := ioutil.TempFile(dir, ".dump")
+	if err != nil {
+		return nil, err
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return &Dump{write: func(cmd *LeweiCmd) error {
+		name := filepath.Join(dir, fmt.Sprintf("%04x.hex", cmd.headerGet(cmdI)))
+		file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			return err
+		}
+		// single write of whole line, so concurrent appends don't interleave
+		if _, err := file.WriteString(cmd.hexDump() + "\n"); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	}}, nil
+}
+
+// Err returns first error of dumping (eg. file which can't be opened)
+//
+// Dumping goes on after the error, so the other commands are still dumped.
+func (d *Dump) Err() error {
+	if d == nil {
+		return nil
+	}
+	d.errMu.Lock()
+	defer d.errMu.Unlock()
+	return d.err
+}
+
+// dump writes cmd, it does nothing on nil Dump (dumping disabled)
+func (d *Dump) dump(cmd *LeweiCmd) {
+	if d == nil {
+		return
+	}
+	if err := d.write(cmd); err != nil {
+		d.errMu.Lock()
+		if d.err == nil {
+			d.err = err
+		}
+		d.errMu.Unlock()
+	}
+}
+
+// hexDump returns whole cmd in hex - header and payload separated by |
+func (c *LeweiCmd) hexDump() string {
+	return fmt.Sprintf("% x | % x", c.header, c.payload.Bytes())
+}
+
+/* Package level functions using DefaultClient */
+
+// DumpTo sets DefaultClient to dump every received LeweiCmd to given writer, see NewDump
+//
+// Pass nil to disable dumping (default).
+func DumpTo(w io.Writer) {
+	if w == nil {
+		DefaultClient.Dump = nil
+		return
+	}
+	DefaultClient.Dump = NewDump(w)
+}
+
+// DumpToDir sets DefaultClient to dump every received LeweiCmd to files in given dir, see NewDirDump
+func DumpToDir(dir string) error {
+	dump, err := NewDirDump(dir)
+	if err != nil {
+		return err
+	}
+	DefaultClient.Dump = dump
+	return nil
+}
+
+// DumpErr returns first error of dumping of DefaultClient, see Dump.Err
+func DumpErr() error {
+	return DefaultClient.Dump.Err()
+}
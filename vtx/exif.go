@@ -0,0 +1,138 @@
+package vtx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+)
+
+// exifOrientationTag is id of orientation tag in IFD0 of EXIF
+const exifOrientationTag = 0x0112
+
+// jpegOrientation returns EXIF orientation of jpeg (1 … 8), 1 (upright) when there is none
+func jpegOrientation(data []byte) int {
+	field, order := orientationField(exifSegment(data))
+	if field == nil {
+		return 1
+	}
+	orientation := int(order.Uint16(field))
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// exifSegment returns whole APP1 segment (with marker and length) holding EXIF of jpeg, nil when there is none
+//
+// Only segments before the image data are searched.
+func exifSegment(data []byte) []byte {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	for i := 2; i+4 <= len(data) && data[i] == 0xff; {
+		marker := data[i+1]
+		if marker == 0xda { // start of scan, no more metadata
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i : i+2+length]
+		if marker == 0xe1 && bytes.HasPrefix(segment[4:], []byte("Exif\x00\x00")) {
+			return segment
+		}
+		i += 2 + length
+	}
+	return nil
+}
+
+// orientationField returns value of orientation tag from IFD0 of EXIF segment and its byte order, nil when there is none
+func orientationField(segment []byte) ([]byte, binary.ByteOrder) {
+	if len(segment) < 10 {
+		return nil, nil
+	}
+	tiff := segment[10:] // after marker, length and "Exif\0\0"
+	if len(tiff) < 8 {
+		return nil, nil
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, nil
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return nil, nil
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return nil, nil
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			return tiff[entry+8 : entry+10], order
+		}
+	}
+	return nil, nil
+}
+
+// uprightJPEG rotates (or mirrors) jpeg by its EXIF orientation, so it is displayed right without the tag
+//
+// Upright photo is returned unchanged, othervise it is re-encoded with the original EXIF, only its orientation is set to 1.
+func uprightJPEG(data []byte) ([]byte, error) {
+	orientation := jpegOrientation(data)
+	if orientation == 1 {
+		return data, nil
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	out := &bytes.Buffer{}
+	if err := jpeg.Encode(out, orient(img, orientation), &jpeg.Options{Quality: 95}); err != nil {
+		return nil, err
+	}
+	exif := append([]byte(nil), exifSegment(data)...)
+	field, order := orientationField(exif)
+	order.PutUint16(field, 1) // there is one, the photo would be upright othervise
+	encoded := out.Bytes()
+	return append(append(append(make([]byte, 0, len(encoded)+len(exif)), encoded[:2]...), exif...), encoded[2:]...), nil
+}
+
+// orient transforms image stored with given EXIF orientation to upright one
+func orient(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// source pixel of output pixel x, y
+	src := map[int]func(x, y int) (int, int){
+		2: func(x, y int) (int, int) { return w - 1 - x, y },         // mirrored
+		3: func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }, // upside down
+		4: func(x, y int) (int, int) { return x, h - 1 - y },         // mirrored upside down
+		5: func(x, y int) (int, int) { return y, x },                 // transposed
+		6: func(x, y int) (int, int) { return y, h - 1 - x },         // rotated 90° counter clockwise
+		7: func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }, // transversed
+		8: func(x, y int) (int, int) { return w - 1 - y, x },         // rotated 90° clockwise
+	}[orientation]
+	if src == nil {
+		return img
+	}
+	outW, outH := w, h
+	if orientation >= 5 { // sides are swapped
+		outW, outH = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, outW, outH))
+	for y := 0; y < outH; y++ {
+		for x := 0; x < outW; x++ {
+			sx, sy := src(x, y)
+			out.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return out
+}
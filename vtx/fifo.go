@@ -0,0 +1,26 @@
+package vtx
+
+import "sync"
+
+// fifo lets its callers run one at a time in order of their arrival
+//
+// Zero value is ready to use.
+type fifo struct {
+	mu   sync.Mutex
+	tail chan struct{} // closed when the last queued caller is done
+}
+
+// do waits for all previously queued callers and then runs fn
+func (q *fifo) do(fn func()) {
+	done := make(chan struct{})
+	q.mu.Lock()
+	prev := q.tail
+	q.tail = done
+	q.mu.Unlock()
+
+	if prev != nil {
+		<-prev
+	}
+	defer close(done)
+	fn()
+}
@@ -0,0 +1,27 @@
+package vtx
+
+// Logger receives diagnostic messages of the client, *slog.Logger satisfies it
+//
+// Args are alternating keys and values, the same as with slog.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// nopLogger discards everything, it is used when Client.Logger is nil
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// log returns Logger of the client or nopLogger when it is not set
+func (c *Client) log() Logger {
+	if c.Logger == nil {
+		return nopLogger{}
+	}
+	return c.Logger
+}
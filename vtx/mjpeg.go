@@ -0,0 +1,95 @@
+package vtx
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Codec of video stream
+type Codec int
+
+// Known codecs, some xs809w clones stream MJPEG instead of H.264
+const (
+	CodecUnknown Codec = iota // until first frame comes
+	CodecH264
+	CodecMJPEG
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecH264:
+		return "h264"
+	case CodecMJPEG:
+		return "mjpeg"
+	default:
+		return "unknown"
+	}
+}
+
+// JPEG markers of start and end of image
+var (
+	jpegSOI = []byte{0xff, 0xd8}
+	jpegEOI = []byte{0xff, 0xd9}
+)
+
+// codecProbeChunks is how many chunks are searched for JPEG start of image before the stream is taken as H.264
+const codecProbeChunks = 4
+
+// detectCodec guesses codec of the stream from content of its chunk, CodecUnknown when it can't be told yet
+//
+// H.264 is recognized by start code at the beginning of the chunk, MJPEG by JPEG start of image
+// anywhere in the chunk (stream may start in the middle of image).
+func detectCodec(content []byte) Codec {
+	if bytes.HasPrefix(content, []byte{0, 0, 1}) || bytes.HasPrefix(content, []byte{0, 0, 0, 1}) {
+		return CodecH264
+	}
+	if bytes.Contains(content, jpegSOI) {
+		return CodecMJPEG
+	}
+	return CodecUnknown
+}
+
+// parseMJPEGChunk parses payload of liveStreamVideoCmd chunk of MJPEG stream
+//
+// It has the same header as H.264 one, but chunk type is not checked - its meaning is not known for MJPEG.
+// end is true for the zero sized chunk which ends the stream.
+func parseMJPEGChunk(data []byte) (content []byte, timing uint16, end bool, err error) {
+	if len(data) < 32 {
+		return nil, 0, false, fmt.Errorf("%w: stream chunk has %dB", ErrShortPayload, len(data))
+	}
+	data32 := byteToUint32(data[:8*4])
+	chunkSize := data32[1]
+	timing = uint16(data32[2])
+	if chunkSize == 0 {
+		return nil, timing, true, nil
+	}
+	return data[32:], timing, false, nil
+}
+
+// jpegSplitter cuts MJPEG stream into separate JPEG images, regardless of how they are split into chunks
+type jpegSplitter struct {
+	buf []byte // unfinished image (or garbage before it)
+}
+
+// add appends content of chunk and returns images which were completed by it
+func (s *jpegSplitter) add(content []byte) (images [][]byte) {
+	s.buf = append(s.buf, content...)
+	for {
+		start := bytes.Index(s.buf, jpegSOI)
+		if start < 0 {
+			s.buf = s.buf[:0] // no image started, only garbage
+			return images
+		}
+		end := bytes.Index(s.buf[start+len(jpegSOI):], jpegEOI)
+		if end < 0 {
+			s.buf = append(s.buf[:0], s.buf[start:]...)
+			if uint32(len(s.buf)) > MaxPayloadSize { // image which never ends
+				s.buf = s.buf[:0]
+			}
+			return images
+		}
+		end += start + len(jpegSOI) + len(jpegEOI)
+		images = append(images, append([]byte(nil), s.buf[start:end]...))
+		s.buf = s.buf[end:]
+	}
+}
@@ -0,0 +1,543 @@
+package vtx
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// mp4Timescale is number of time units per second of the mp4 file, timing of frames is in ms
+const mp4Timescale = 1000
+
+// defaultFrameDuration is used in ms when timing of frames is unknown (20fps)
+const defaultFrameDuration = 50
+
+// H.264 NAL unit types
+const (
+	nalIDR = 5
+	nalSPS = 7
+	nalPPS = 8
+	nalAUD = 9
+)
+
+// SaveMP4 replays saved video and writes it to outPath as playable .mp4 file
+//
+// It is done by pure go muxer, no external tools are needed. The video is not re-encoded,
+// only the H.264 frames are wrapped into mp4 container (with timing given by the drone).
+// Replay runs as fast as the drone sends it. File appears at outPath only when it was completed.
+// Error wrapping ErrProtocol is returned when the video has no key frame with SPS and PPS.
+func (c *Client) SaveMP4(fileName, outPath string) error {
+	conn, closeConn, err := c.newConn(context.Background(), c.portByCmd(downloadVideoCmd))
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	file, err := createAtomic(outPath)
+	if err != nil {
+		return err
+	}
+	defer file.Discard() // does nothing when the file was completed
+	mp4, err := newMP4Writer(file)
+	if err != nil {
+		return err
+	}
+
+	if err := Req(replayVideoCmd, replayRequest(fileName), conn); err != nil {
+		return err
+	}
+	var elapsed time.Duration // since first frame
+	var prevTiming uint16
+	var writeErr error
+	first := true
+	err = c.replayFrames(conn, func(frame Frame) bool {
+		if !first {
+			gap := timingGap(prevTiming, frame.Timing)
+			if gap == 0 { // discontinuity
+				gap = defaultFrameDuration * time.Millisecond
+			}
+			elapsed += gap
+		}
+		first = false
+		prevTiming = frame.Timing
+		if frame.NAL != nil { // no NAL in ff00 marked chunk
+			writeErr = mp4.writeFrame(frame.NAL, uint32(elapsed/time.Millisecond))
+		}
+		return writeErr == nil
+	})
+	c.log().Debug("video replay end", "file", fileName, "err", err)
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if err := mp4.Close(); err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+// mp4Writer muxes H.264 frames into mp4 file
+//
+// Samples are written into mdat box as they come, moov box with their index is written by Close.
+type mp4Writer struct {
+	w      io.WriteSeeker
+	mdatAt int64 // offset of mdat box
+	size   int64 // of mdat content
+
+	sps, pps []byte   // first ones found
+	sizes    []uint32 // of samples
+	times    []uint32 // of samples, in ms
+	syncs    []uint32 // numbers of key samples, counted from 1
+}
+
+// newMP4Writer starts mp4 file in w
+func newMP4Writer(w io.WriteSeeker) (*mp4Writer, error) {
+	ftyp := box("ftyp", []byte("isom"), be32(0x200), []byte("isomiso2avc1mp41"))
+	if _, err := w.Write(ftyp); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(box("mdat")); err != nil { // size is set by Close
+		return nil, err
+	}
+	return &mp4Writer{w: w, mdatAt: int64(len(ftyp))}, nil
+}
+
+// writeFrame adds frame of NAL units with start codes as sample at given time in ms
+//
+// SPS and PPS are moved to the header, frames before first key frame are dropped.
+func (m *mp4Writer) writeFrame(data []byte, at uint32) error {
+	sample, key := avcSample(data, &m.sps, &m.pps)
+	if len(sample) == 0 || (len(m.syncs) == 0 && !key) {
+		return nil
+	}
+	if _, err := m.w.Write(sample); err != nil {
+		return err
+	}
+	m.size += int64(len(sample))
+	m.sizes = append(m.sizes, uint32(len(sample)))
+	m.times = append(m.times, at)
+	if key {
+		m.syncs = append(m.syncs, uint32(len(m.sizes)))
+	}
+	return nil
+}
+
+// avcSample converts frame of NAL units with start codes to mp4 sample of length prefixed NAL units
+//
+// SPS and PPS are left out, the first ones found are stored to sps and pps. AUD is left out too.
+// key is true when the frame contains IDR.
+func avcSample(data []byte, sps, pps *[]byte) (sample []byte, key bool) {
+	for _, nal := range splitNALs(data) {
+		switch nal[0] & 0x1f {
+		case nalSPS:
+			if *sps == nil {
+				*sps = append([]byte(nil), nal...)
+			}
+			continue
+		case nalPPS:
+			if *pps == nil {
+				*pps = append([]byte(nil), nal...)
+			}
+			continue
+		case nalAUD:
+			continue
+		case nalIDR:
+			key = true
+		}
+		sample = append(sample, be32(uint32(len(nal)))...)
+		sample = append(sample, nal...)
+	}
+	return sample, key
+}
+
+// Close completes the mp4 file, it does not close the underlying writer
+func (m *mp4Writer) Close() error {
+	if m.sps == nil || m.pps == nil || len(m.sizes) == 0 {
+		return fmt.Errorf("%w: no key frame with SPS and PPS in the video", ErrProtocol)
+	}
+	if m.size+8 > math.MaxUint32 {
+		return fmt.Errorf("vtx: video of %dB is too big for mp4", m.size)
+	}
+	width, height, err := parseSPS(m.sps)
+	if err != nil {
+		return err
+	}
+	if _, err := m.w.Seek(m.mdatAt, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := m.w.Write(be32(uint32(m.size + 8))); err != nil {
+		return err
+	}
+	if _, err := m.w.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	_, err = m.w.Write(m.moov(width, height))
+	return err
+}
+
+// moov encodes index of the samples
+func (m *mp4Writer) moov(width, height int) []byte {
+	var duration uint32
+	stts := []uint32{} // pairs of sample count and duration
+	for i := range m.times {
+		delta := uint32(defaultFrameDuration)
+		if i+1 < len(m.times) && m.times[i+1] > m.times[i] {
+			delta = m.times[i+1] - m.times[i]
+		}
+		duration += delta
+		if n := len(stts); n > 0 && stts[n-1] == delta {
+			stts[n-2]++
+		} else {
+			stts = append(stts, 1, delta)
+		}
+	}
+	stbl := box("stbl",
+		fullBox("stsd", 0, be32(1), avc1Box(m.sps, m.pps, width, height)),
+		fullBox("stts", 0, be32(uint32(len(stts)/2)), be32(stts...)),
+		fullBox("stss", 0, be32(uint32(len(m.syncs))), be32(m.syncs...)),
+		fullBox("stsc", 0, be32(1, 1, uint32(len(m.sizes)), 1)), // all samples in one chunk
+		fullBox("stsz", 0, be32(0, uint32(len(m.sizes))), be32(m.sizes...)),
+		fullBox("stco", 0, be32(1, uint32(m.mdatAt+8))),
+	)
+	return moovBox(width, height, duration, stbl)
+}
+
+// moovBox encodes header of mp4 with single video track of given sample table, extra boxes are appended to it
+func moovBox(width, height int, duration uint32, stbl []byte, extra ...[]byte) []byte {
+	matrix := be32(0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000) // identity
+	content := [][]byte{
+		fullBox("mvhd", 0, be32(0, 0, mp4Timescale, duration, 0x10000), be16(0x100), make([]byte, 10),
+			matrix, make([]byte, 24), be32(2)), // next track id
+		box("trak",
+			fullBox("tkhd", 3, be32(0, 0, 1, 0, duration, 0, 0), be16(0, 0, 0, 0),
+				matrix, be32(uint32(width)<<16, uint32(height)<<16)),
+			box("mdia",
+				fullBox("mdhd", 0, be32(0, 0, mp4Timescale, duration), be16(0x55c4, 0)), // language "und"
+				fullBox("hdlr", 0, be32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00")),
+				box("minf",
+					fullBox("vmhd", 1, make([]byte, 8)),
+					box("dinf", fullBox("dref", 0, be32(1), fullBox("url ", 1))),
+					stbl,
+				),
+			),
+		),
+	}
+	return box("moov", append(content, extra...)...)
+}
+
+// avc1Box encodes description of H.264 samples
+func avc1Box(sps, pps []byte, width, height int) []byte {
+	avcC := box("avcC",
+		[]byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1}, // 4B lengths, 1 SPS
+		be16(uint16(len(sps))), sps,
+		[]byte{1}, be16(uint16(len(pps))), pps,
+	)
+	return box("avc1",
+		make([]byte, 6), be16(1), // data reference index
+		make([]byte, 16),
+		be16(uint16(width), uint16(height)),
+		be32(0x480000, 0x480000, 0), // 72 dpi
+		be16(1),                     // frame count
+		make([]byte, 32),            // compressor name
+		be16(0x18, 0xffff),          // depth
+		avcC,
+	)
+}
+
+// fragmentWriter muxes live H.264 frames into fragmented mp4 stream, which browsers play in <video>
+//
+// Init segment (ftyp and moov with SPS and PPS) is written with the first key frame, frames before it are dropped.
+// Every frame is then written as separate fragment (moof and mdat), so it can be played right away.
+type fragmentWriter struct {
+	w        io.Writer
+	sps, pps []byte // first ones found
+	started  bool   // init segment was written
+	seq      uint32 // of last fragment
+	at       uint64 // time of last frame in ms
+	timing   uint16 // of last frame
+}
+
+// writeFrame writes frame of NAL units with start codes as fragment
+func (f *fragmentWriter) writeFrame(frame Frame) error {
+	if f.started {
+		gap := timingGap(f.timing, frame.Timing)
+		if gap == 0 { // discontinuity
+			gap = defaultFrameDuration * time.Millisecond
+		}
+		f.at += uint64(gap / time.Millisecond)
+	}
+	f.timing = frame.Timing
+	sample, key := avcSample(frame.NAL, &f.sps, &f.pps)
+	if len(sample) == 0 {
+		return nil
+	}
+	if !f.started {
+		if !key || f.sps == nil || f.pps == nil {
+			return nil
+		}
+		if err := f.writeInit(); err != nil {
+			return err
+		}
+		f.started = true
+	}
+
+	f.seq++
+	flags := uint32(0x01010000) // depends on other samples, not sync
+	if key {
+		flags = 0x02000000 // does not depend on others
+	}
+	moof := func(dataOffset uint32) []byte {
+		return box("moof",
+			fullBox("mfhd", 0, be32(f.seq)),
+			box("traf",
+				fullBox("tfhd", 0x020000, be32(1)),                           // track 1, offsets from moof
+				fullBox("tfdt", 1<<24, be32(uint32(f.at>>32), uint32(f.at))), // version 1 (64bit time)
+				fullBox("trun", 0x000701, be32(1, dataOffset, defaultFrameDuration, uint32(len(sample)), flags)),
+			),
+		)
+	}
+	header := moof(uint32(len(moof(0)) + 8)) // sample follows mdat header
+	_, err := f.w.Write(append(header, box("mdat", sample)...))
+	return err
+}
+
+// writeInit writes ftyp and moov describing the track, it has no samples as they come in fragments
+func (f *fragmentWriter) writeInit() error {
+	width, height, err := parseSPS(f.sps)
+	if err != nil {
+		return err
+	}
+	stbl := box("stbl",
+		fullBox("stsd", 0, be32(1), avc1Box(f.sps, f.pps, width, height)),
+		fullBox("stts", 0, be32(0)),
+		fullBox("stsc", 0, be32(0)),
+		fullBox("stsz", 0, be32(0, 0)),
+		fullBox("stco", 0, be32(0)),
+	)
+	trex := fullBox("trex", 0, be32(1, 1, defaultFrameDuration, 0, 0)) // track 1, first sample description
+	_, err = f.w.Write(append(
+		box("ftyp", []byte("isom"), be32(0x200), []byte("isomiso5avc1mp41")),
+		moovBox(width, height, 0, stbl, box("mvex", trex))...,
+	))
+	return err
+}
+
+// box encodes mp4 box of given type with given content
+func box(typ string, content ...[]byte) []byte {
+	size := 8
+	for _, part := range content {
+		size += len(part)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, part := range content {
+		b = append(b, part...)
+	}
+	return b
+}
+
+// fullBox encodes mp4 box with version 0 and given flags
+func fullBox(typ string, flags uint32, content ...[]byte) []byte {
+	return box(typ, append([][]byte{be32(flags)}, content...)...)
+}
+
+// be32 encodes values as big endian
+func be32(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, val := range values {
+		binary.BigEndian.PutUint32(b[4*i:], val)
+	}
+	return b
+}
+
+// be16 encodes values as big endian
+func be16(values ...uint16) []byte {
+	b := make([]byte, 2*len(values))
+	for i, val := range values {
+		binary.BigEndian.PutUint16(b[2*i:], val)
+	}
+	return b
+}
+
+// splitNALs splits data by start codes (00 00 01 or 00 00 00 01) into NAL units
+func splitNALs(data []byte) (nals [][]byte) {
+	start := -1 // of current NAL
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nals = appendNAL(nals, data[start:i])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 {
+		nals = appendNAL(nals, data[start:])
+	}
+	return nals
+}
+
+// appendNAL appends nal without trailing zeros (of next 4B start code), empty one is skipped
+func appendNAL(nals [][]byte, nal []byte) [][]byte {
+	for len(nal) > 0 && nal[len(nal)-1] == 0 {
+		nal = nal[:len(nal)-1]
+	}
+	if len(nal) == 0 {
+		return nals
+	}
+	return append(nals, nal)
+}
+
+// parseSPS reads picture size from H.264 sequence parameter set NAL
+func parseSPS(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, fmt.Errorf("%w: SPS has %dB", ErrShortPayload, len(sps))
+	}
+	r := &bitReader{data: unescapeRBSP(sps[4:])} // after NAL header, profile, constraints and level
+	profile := sps[1]
+	r.ue() // seq_parameter_set_id
+	chromaFormat := uint32(1)
+	separateColourPlane := uint32(0)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135: // high profiles
+		if chromaFormat = r.ue(); chromaFormat == 3 {
+			separateColourPlane = r.bits(1)
+		}
+		r.ue()              // bit_depth_luma_minus8
+		r.ue()              // bit_depth_chroma_minus8
+		r.bits(1)           // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.bits(1) // delta_pic_order_always_zero_flag
+		r.se()    // offset_for_non_ref_pic
+		r.se()    // offset_for_top_to_bottom_field
+		for i := r.ue(); i > 0 && r.err == nil; i-- {
+			r.se() // offset_for_ref_frame
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.bits(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := int(r.bits(1))
+	if frameMbsOnly == 0 {
+		r.bits(1) // mb_adaptive_frame_field_flag
+	}
+	r.bits(1) // direct_8x8_inference_flag
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bits(1) == 1 { // frame_cropping_flag
+		cropLeft, cropRight, cropTop, cropBottom = int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+	}
+	if r.err != nil {
+		return 0, 0, fmt.Errorf("%w: SPS: %v", ErrProtocol, r.err)
+	}
+
+	cropUnitX, cropUnitY := 1, 2-frameMbsOnly
+	if chromaFormat != 0 && separateColourPlane == 0 {
+		if chromaFormat == 1 || chromaFormat == 2 {
+			cropUnitX = 2
+		}
+		if chromaFormat == 1 {
+			cropUnitY *= 2
+		}
+	}
+	width = widthMbs*16 - (cropLeft+cropRight)*cropUnitX
+	height = (2-frameMbsOnly)*heightMapUnits*16 - (cropTop+cropBottom)*cropUnitY
+	return width, height, nil
+}
+
+// unescapeRBSP removes emulation prevention bytes (00 00 03 → 00 00)
+func unescapeRBSP(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	zeros := 0
+	for _, b := range data {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// bitReader reads bits and exp-golomb codes, err is set when it runs out of data
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+	err  error
+}
+
+// bits reads n bits (up to 32) as unsigned number
+func (r *bitReader) bits(n int) (val uint32) {
+	for i := 0; i < n; i++ {
+		if r.pos >= 8*len(r.data) {
+			r.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		bit := r.data[r.pos/8] >> (7 - uint(r.pos%8)) & 1
+		val = val<<1 | uint32(bit)
+		r.pos++
+	}
+	return val
+}
+
+// ue reads unsigned exp-golomb code
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for r.bits(1) == 0 && r.err == nil {
+		if zeros++; zeros > 31 {
+			r.err = fmt.Errorf("exp-golomb code too long")
+			return 0
+		}
+	}
+	return 1<<uint(zeros) - 1 + r.bits(zeros)
+}
+
+// se reads signed exp-golomb code
+func (r *bitReader) se() int32 {
+	code := r.ue()
+	if code%2 == 0 {
+		return -int32(code / 2)
+	}
+	return int32(code/2) + 1
+}
@@ -0,0 +1,58 @@
+package vtx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+var (
+	// ErrNotOnDroneNetwork is returned (wrapped) by Probe when no interface of the system is in subnet of the drone
+	// Probably the device is connected to other wifi than the one of the drone.
+	ErrNotOnDroneNetwork = errors.New("vtx: not on the wifi of the drone")
+
+	// ErrDroneNotResponding is returned (wrapped) by Probe when the drone is reachable, but its camera does not answer
+	// Probably the drone is off.
+	ErrDroneNotResponding = errors.New("vtx: drone is not responding")
+)
+
+// probeTimeout limits how long Probe waits for the connection
+var probeTimeout = time.Second
+
+// Probe checks whether camera of the drone can be reached, with more precise error than ErrNotConnected
+//
+// Returns error wrapping ErrNotOnDroneNetwork when the device is not on the network of the drone at all,
+// or ErrDroneNotResponding when it is, but control port (8060) can't be connected within 1s.
+func (c *Client) Probe() error {
+	onNetwork, err := onNetworkOf(c.IP)
+	if err != nil {
+		return err
+	}
+	if !onNetwork {
+		return fmt.Errorf("%w: no interface in subnet of %s", ErrNotOnDroneNetwork, c.IP)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	conn, err := c.dial(ctx, c.ControlPort)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDroneNotResponding, err)
+	}
+	conn.Close()
+	return nil
+}
+
+// onNetworkOf says whether some interface of the system is in the same subnet as ip (loopback included)
+func onNetworkOf(ip net.IP) (bool, error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.Contains(ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,59 @@
+package vtx
+
+import (
+	"context"
+	"crypto/md5"
+	"hash"
+	"io"
+	"os"
+)
+
+// partial describes already downloaded beginning of the file
+type partial struct {
+	offset   int          // size of already downloaded part
+	checksum hash.Hash    // md5 of already downloaded part
+	restart  func() error // discards the downloaded part, when drone can't continue from offset
+}
+
+// DownloadVideoResume will dowlnoad video by given name to OutputDir of the client, continuing interrupted download
+//
+// Incomplete download is kept in file with .part suffix, so the next call can continue after its end.
+// Drone is asked to send the file from that offset. If its firmware does not support it,
+// the part is discarded and whole file is downloaded again.
+// File appears under its final name only when it was downloaded completely.
+func (c *Client) DownloadVideoResume(fileName string) error {
+	path, err := c.outputPath("", fileName)
+	if err != nil {
+		return err
+	}
+	partPath := path + ".part"
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	checksum := md5.New()
+	offset, err := io.Copy(checksum, file) // leaves file at its end
+	if err != nil {
+		return err
+	}
+	part := &partial{
+		offset:   int(offset),
+		checksum: checksum,
+		restart: func() error {
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+			_, err := file.Seek(0, io.SeekStart)
+			return err
+		},
+	}
+	if err := c.downloadVideo(context.Background(), fileName, file, part, nil); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partPath, path)
+}
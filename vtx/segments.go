@@ -0,0 +1,109 @@
+package vtx
+
+import (
+	"time"
+)
+
+// segmentPoll is how often are videos listed while recording to find finished segments
+var segmentPoll = time.Second * 5
+
+// OnSegment sets function called with name of every video file (segment) finished during recording
+//
+// The drone doesn't announce new segments, so videos are listed every 5s while recording started by
+// StartVideo, StartVideoWithOptions or CaptureVideo. A file is finished when newer one appears,
+// the last one when StopVideo is called. Eg. download and delete segments as they come to keep SD card free.
+// It is called from background goroutine (the last one from StopVideo). Set it before recording, nil disables it.
+func (c *Client) OnSegment(fn func(fileName string)) {
+	c.onSegment = fn
+}
+
+// segmentWatcher polls list of videos during recording and reports finished segments
+type segmentWatcher struct {
+	onSegment func(string)
+	known     map[string]bool // files which existed before recording or were already reported
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// newSegmentWatcher remembers present videos, so only new ones are reported
+// It returns nil when nobody listens for segments.
+func (c *Client) newSegmentWatcher() (*segmentWatcher, error) {
+	if c.onSegment == nil {
+		return nil, nil
+	}
+	videos, err := c.ListVideos()
+	if err != nil {
+		return nil, err
+	}
+	w := &segmentWatcher{
+		onSegment: c.onSegment,
+		known:     map[string]bool{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, video := range videos {
+		w.known[video.Filename] = true
+	}
+	return w, nil
+}
+
+// watchSegments starts polling by the watcher until stopSegments, nil watcher is no-op
+func (c *Client) watchSegments(w *segmentWatcher) {
+	if w == nil {
+		return
+	}
+	c.stopSegments() // previous recording which ended on its own
+	c.segmentsMu.Lock()
+	c.segments = w
+	c.segmentsMu.Unlock()
+
+	go func() {
+		defer close(w.done)
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-time.After(segmentPoll):
+			}
+			w.poll(c, false)
+		}
+	}()
+}
+
+// stopSegments stops polling and reports all remaining segments
+func (c *Client) stopSegments() {
+	c.segmentsMu.Lock()
+	w := c.segments
+	c.segments = nil
+	c.segmentsMu.Unlock()
+	if w == nil {
+		return
+	}
+	close(w.stop)
+	<-w.done
+	w.poll(c, true)
+}
+
+// poll reports new videos, but the newest one which is probably still being recorded (unless final)
+// Videos are listed by the drone in order they were created.
+func (w *segmentWatcher) poll(c *Client, final bool) {
+	videos, err := c.ListVideos()
+	if err != nil {
+		c.log().Warn("listing video segments failed", "err", err)
+		return
+	}
+	var fresh []string
+	for _, video := range videos {
+		if !w.known[video.Filename] {
+			fresh = append(fresh, video.Filename)
+		}
+	}
+	if !final && len(fresh) > 0 {
+		fresh = fresh[:len(fresh)-1]
+	}
+	for _, fileName := range fresh {
+		w.known[fileName] = true
+		c.log().Debug("video segment finished", "file", fileName)
+		w.onSegment(fileName)
+	}
+}
@@ -0,0 +1,158 @@
+package vtx
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// streamBuffer is number of frames buffered for each viewer, slower viewers are disconnected
+const streamBuffer = 64
+
+// mjpegBoundary separates images of multipart MJPEG stream
+const mjpegBoundary = "vtxframe"
+
+// StreamServer is http.Handler serving live stream of the drone to any number of viewers
+//
+// H.264 stream is served as fragmented mp4 which browsers play in <video> tag (as well as vlc or ffplay),
+// MJPEG stream as multipart/x-mixed-replace which browsers show directly (eg. in <img> tag).
+// Connection to the drone is made when first viewer connects and closed when the last one disconnects.
+// Viewers joining later see picture from next key frame (up to 2s).
+type StreamServer struct {
+	client *Client
+
+	mu      sync.Mutex
+	viewers map[chan Frame]bool
+	stop    context.CancelFunc // of running stream, nil when not streaming
+}
+
+// StreamServer creates http.Handler serving live stream of the drone
+func (c *Client) StreamServer() *StreamServer {
+	return &StreamServer{
+		client:  c,
+		viewers: map[chan Frame]bool{},
+	}
+}
+
+// ServeHTTP streams the video until the viewer disconnects or the drone ends the stream
+//
+// Response is sent with the first frame, as its type depends on codec of the stream.
+func (s *StreamServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	frames := s.subscribe()
+	defer s.unsubscribe(frames)
+
+	flusher, _ := w.(http.Flusher)
+	var write func(Frame) error // chosen by codec of the first frame
+	for {
+		select {
+		case frame, ok := <-frames:
+			if !ok { // stream ended or viewer is too slow
+				return
+			}
+			if write == nil {
+				w.Header().Set("Cache-Control", "no-cache")
+				if frame.Codec == CodecMJPEG {
+					w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+mjpegBoundary)
+					if _, err := fmt.Fprintf(w, "--%s\r\n", mjpegBoundary); err != nil {
+						return
+					}
+					write = func(frame Frame) error { return writeJPEGPart(w, frame.JPEG) }
+				} else {
+					w.Header().Set("Content-Type", "video/mp4")
+					write = (&fragmentWriter{w: w}).writeFrame // waits for key frame
+				}
+			}
+			if err := write(frame); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeJPEGPart writes image as a part of multipart stream
+//
+// The part is closed by boundary right away, so the viewer shows the image without waiting for next one.
+func writeJPEGPart(w io.Writer, image []byte) error {
+	_, err := fmt.Fprintf(w, "Content-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", len(image))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(image); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "\r\n--%s\r\n", mjpegBoundary)
+	return err
+}
+
+// subscribe adds viewer and starts the stream if it is the first one
+func (s *StreamServer) subscribe() chan Frame {
+	frames := make(chan Frame, streamBuffer)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.viewers[frames] = true
+	if s.stop == nil {
+		ctx, stop := context.WithCancel(context.Background())
+		s.stop = stop
+		go s.run(ctx)
+	}
+	return frames
+}
+
+// unsubscribe removes viewer and stops the stream if it was the last one
+func (s *StreamServer) unsubscribe(frames chan Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.viewers[frames] {
+		delete(s.viewers, frames)
+		close(frames)
+	}
+	if len(s.viewers) == 0 && s.stop != nil {
+		s.stop()
+		s.stop = nil
+	}
+}
+
+// run streams from the drone until ctx is canceled or the stream ends, then disconnects all viewers
+func (s *StreamServer) run(ctx context.Context) {
+	frames, err := s.client.Frames(ctx)
+	if err != nil && err != context.Canceled {
+		s.client.log().Warn("live stream failed", "err", err)
+	}
+	if err == nil {
+		for frame := range frames {
+			s.broadcast(frame)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ctx.Err() != nil { // stopped by last viewer, new stream might be already running
+		return
+	}
+	for frames := range s.viewers {
+		delete(s.viewers, frames)
+		close(frames)
+	}
+	s.stop()
+	s.stop = nil
+}
+
+// broadcast passes frame to all viewers of the server
+func (s *StreamServer) broadcast(frame Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for frames := range s.viewers {
+		select {
+		case frames <- frame:
+		default: // too slow, disconnect it rather than corrupting its stream
+			delete(s.viewers, frames)
+			close(frames)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package vtx
+
+import (
+	"time"
+)
+
+// statsWindow is period over which are FPS and BytesPerSec of StreamStats computed
+const statsWindow = time.Second
+
+// StreamStats are numbers about live stream or replay, eg. for diagnosing laggy feed
+type StreamStats struct {
+	Frames    int   // received frames, including skipped ones
+	Keyframes int   // received key frames
+	Skipped   int   // frames marked by 0xff00 in replay, which are not written to output
+	Bytes     int   // received bytes of NAL units (or JPEG images)
+	Codec     Codec // detected from the live stream, CodecUnknown for replay
+
+	FPS              float64       // frames per second, over last second
+	BytesPerSec      float64       // over last second
+	KeyframeInterval time.Duration // between last two key frames, 0 until second one comes
+}
+
+// OnStats sets function called with updated stats after every frame of LiveStream, Frames and ReplayVideo
+//
+// It is called from the streaming goroutine, so keep it fast. Set it before streaming, nil disables it.
+func (c *Client) OnStats(fn func(StreamStats)) {
+	c.onStats = fn
+}
+
+// streamStats computes StreamStats of single stream
+type streamStats struct {
+	onStats func(StreamStats)
+	now     func() time.Time
+
+	stats        StreamStats
+	lastKeyframe time.Time
+	windowStart  time.Time // zero until first frame
+	windowFrames int
+	windowBytes  int
+}
+
+// newStreamStats returns stats for new stream, or nil when nobody listens for them
+func (c *Client) newStreamStats() *streamStats {
+	if c.onStats == nil {
+		return nil
+	}
+	return &streamStats{onStats: c.onStats, now: time.Now}
+}
+
+// add counts received frame in and reports updated stats, nil stats are no-op
+func (s *streamStats) add(frame Frame) {
+	if s == nil {
+		return
+	}
+	now := s.now()
+	size := len(frame.NAL) + len(frame.JPEG)
+	s.stats.Frames++
+	s.stats.Bytes += size
+	if frame.Codec != CodecUnknown {
+		s.stats.Codec = frame.Codec
+	}
+	if frame.NAL == nil && frame.JPEG == nil {
+		s.stats.Skipped++
+	}
+	if frame.Keyframe {
+		s.stats.Keyframes++
+		if !s.lastKeyframe.IsZero() {
+			s.stats.KeyframeInterval = now.Sub(s.lastKeyframe)
+		}
+		s.lastKeyframe = now
+	}
+
+	if s.windowStart.IsZero() { // first frame only starts the window
+		s.windowStart = now
+	} else {
+		s.windowFrames++
+		s.windowBytes += size
+	}
+	if elapsed := now.Sub(s.windowStart); elapsed >= statsWindow {
+		s.stats.FPS = float64(s.windowFrames) / elapsed.Seconds()
+		s.stats.BytesPerSec = float64(s.windowBytes) / elapsed.Seconds()
+		s.windowStart = now
+		s.windowFrames = 0
+		s.windowBytes = 0
+	}
+
+	s.onStats(s.stats)
+}
@@ -0,0 +1,75 @@
+package vtx
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// statusTTL is how long is result of IsCapturing reused
+const statusTTL = 500 * time.Millisecond
+
+// statusIdleTimeout is how long is connection of IsCapturing kept open after last use
+const statusIdleTimeout = 30 * time.Second
+
+// status is cached capture state
+type status struct {
+	sync.Mutex
+	capturing bool
+	checked   time.Time // zero means nothing cached
+}
+
+// InvalidateStatus drops cached result of IsCapturing, so next call asks the drone
+//
+// Call it when you know the state changed other way than by StartVideo or StopVideo (they do it themselves).
+func (c *Client) InvalidateStatus() {
+	c.status.Lock()
+	c.status.checked = time.Time{}
+	c.status.Unlock()
+}
+
+// IsCapturing will fetch payload last set by StartVide/StopVideo and reurn boolean accordingly
+//
+// It is cheap to poll (eg. by UI) - result is reused for 500ms and connection is kept open between calls.
+func (c *Client) IsCapturing() (bool, error) {
+	if capturing, ok := c.cachedStatus(); ok {
+		return capturing, nil
+	}
+	conn, release, reused, err := c.sharedConn(context.Background(), c.ControlPort, statusIdleTimeout)
+	if err != nil {
+		return false, err
+	}
+	if capturing, ok := c.cachedStatus(); ok { // checked by other call while waiting for the port
+		release(true)
+		return capturing, nil
+	}
+	capturing, err := c.checkCapturing(conn)
+	if err != nil && reused { // drone has probably closed it meanwhile, try fresh one
+		release(false)
+		conn, release, _, err = c.sharedConn(context.Background(), c.ControlPort, statusIdleTimeout)
+		if err != nil {
+			return false, err
+		}
+		capturing, err = c.checkCapturing(conn)
+	}
+	release(err == nil)
+	if err != nil {
+		return false, err
+	}
+
+	c.status.Lock()
+	c.status.capturing = capturing
+	c.status.checked = time.Now()
+	c.status.Unlock()
+	return capturing, nil
+}
+
+// cachedStatus returns result of last IsCapturing, ok is false when it is too old
+func (c *Client) cachedStatus() (capturing, ok bool) {
+	c.status.Lock()
+	defer c.status.Unlock()
+	if c.status.checked.IsZero() || time.Since(c.status.checked) >= statusTTL {
+		return false, false
+	}
+	return c.status.capturing, true
+}
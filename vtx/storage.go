@@ -0,0 +1,63 @@
+package vtx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrNotSupported is returned (wrapped) when the drone does not respond to the command as expected
+var ErrNotSupported = errors.New("vtx: not supported by the drone")
+
+// StorageInfoCmd is action id of sd card storage info request
+//
+// It is not confirmed yet - it is the unused id between checkVideoCmd (0x0006) and listVideosCmd (0x0008)
+// which are the other sd card related commands. Change it if you find the right one (eg. by NewCommand probing).
+var StorageInfoCmd uint32 = 0x0007
+
+// storageInfoTimeout limits waiting for response, drone might never respond to unknown command
+var storageInfoTimeout = 5 * time.Second
+
+// StorageInfo returns free and total space of sd card of the drone in bytes
+//
+// It uses the connection kept by Connect, like other request/response operations.
+// Error wrapping ErrNotSupported is returned when the drone does not understand the request
+// (responds by something else or not at all in 5s).
+func (c *Client) StorageInfo() (free, total uint64, err error) {
+	conn, release, _, err := c.sharedConn(context.Background(), c.portByCmd(StorageInfoCmd), 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	conn.SetReadDeadline(time.Now().Add(storageInfoTimeout))
+	payload, err := c.request(conn, StorageInfoCmd, nil)
+	release(err == nil) // late or unexpected response would be read by next operation, so it is closed then
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return 0, 0, fmt.Errorf("%w: no response in %v", ErrNotSupported, storageInfoTimeout)
+	}
+	if errors.Is(err, ErrProtocol) {
+		return 0, 0, fmt.Errorf("%w: %v", ErrNotSupported, err)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return parseStorageInfo(payload)
+}
+
+// parseStorageInfo decodes storage info response
+//
+// Payload is expected to start with two little endian uint32 numbers - free and total space in kB.
+func parseStorageInfo(payload []byte) (free, total uint64, err error) {
+	if len(payload) < 2*4 {
+		return 0, 0, fmt.Errorf("%w: storage info response too short (%dB)", ErrNotSupported, len(payload))
+	}
+	data32 := byteToUint32(payload[:2*4])
+	free, total = uint64(data32[0])*1024, uint64(data32[1])*1024
+	if free > total {
+		return 0, 0, fmt.Errorf("%w: free space %dB is bigger than total %dB", ErrNotSupported, free, total)
+	}
+	return free, total, nil
+}
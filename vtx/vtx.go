@@ -6,14 +6,14 @@ package vtx
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"os"
-	"reflect"
+	"sync"
 	"time"
-	"unsafe"
 )
 
 const (
@@ -59,6 +59,51 @@ const (
 	videoDownloadCmd   = 0x0106 // recv videofile after downloadVideoCmd
 )
 
+var (
+	// ErrProtocol is returned (wrapped) when drone responds with something unexpected
+	ErrProtocol = errors.New("vtx: unexpected response")
+
+	// ErrShortPayload is returned (wrapped) when response of the drone is shorter than it should be
+	// It also matches ErrProtocol.
+	ErrShortPayload = fmt.Errorf("%w: payload too short", ErrProtocol)
+
+	// ErrIncompletePhoto is returned (wrapped) when the drone sent empty or truncated photo even after retries
+	// It also matches ErrShortPayload.
+	ErrIncompletePhoto = fmt.Errorf("%w: incomplete photo", ErrShortPayload)
+
+	// ErrFileNotFound is returned (wrapped) when the drone refuses operation with file, eg. DeleteVideo
+	ErrFileNotFound = errors.New("vtx: file not found")
+
+	// ErrBadHeader is returned (wrapped) when received packet does not start with "lewei_cmd\0"
+	// It also matches ErrProtocol.
+	ErrBadHeader = fmt.Errorf("%w: bad header", ErrProtocol)
+
+	// ErrPayloadTooLarge is returned (wrapped) when received packet declares payload bigger than MaxPayloadSize
+	// It also matches ErrProtocol.
+	ErrPayloadTooLarge = fmt.Errorf("%w: payload too large", ErrProtocol)
+
+	// ErrChecksumMismatch is returned (wrapped) when downloaded file does not match checksum sent by drone
+	// The download is corrupted then and it can be retried.
+	ErrChecksumMismatch = errors.New("vtx: checksum mismatch")
+
+	// ErrNotConnected is returned (wrapped together with the network error) when connection to the drone
+	// can't be created - probably because the device is not on the wifi of the drone
+	ErrNotConnected = errors.New("vtx: can't connect to the drone, are you on right wifi?")
+
+	// ErrPortBusy is returned (wrapped) when other operation (eg. live stream) keeps the port of the drone
+	// for longer than operation waits for it
+	ErrPortBusy = errors.New("vtx: port of the drone is busy")
+)
+
+// MaxPayloadSize is the biggest payload accepted from the drone (4MB by default)
+//
+// Packets declaring bigger payload are refused with ErrPayloadTooLarge without reading them,
+// so misbehaving or spoofed server on the wifi can't make the client allocate gigabytes.
+var MaxPayloadSize uint32 = 4 << 20
+
+// headerMagic starts header of every LeweiCmd
+const headerMagic = "lewei_cmd\x00"
+
 // LeweiCmd represents data packet (app layer) sent or received by vtx of the drone
 type LeweiCmd struct {
 	// sync.RWMutex
@@ -69,7 +114,7 @@ type LeweiCmd struct {
 // NewLeweiCmd will create new LeweiCmd with correct header initialized and given action set
 func NewLeweiCmd(action uint32) LeweiCmd {
 	header := make([]byte, 46)
-	copy(header, "lewei_cmd\x00")
+	copy(header, headerMagic)
 	cmd := LeweiCmd{header: header}
 	cmd.headerSet(cmdI, action)
 	return cmd
@@ -91,6 +136,9 @@ func (c *LeweiCmd) AddPayload(data interface{}) {
 	if data == nil {
 		return
 	}
+	if str, ok := data.(string); ok {
+		data = []byte(str) // binary.Write can't write strings
+	}
 	binary.Write(&c.payload, binary.LittleEndian, data)
 
 	addLen := func(l int) {
@@ -98,8 +146,6 @@ func (c *LeweiCmd) AddPayload(data interface{}) {
 		c.headerSet(lenI, uint32(l))
 	}
 	switch d := data.(type) {
-	case string:
-		addLen(len(d))
 	case []byte:
 		addLen(len(d))
 	case []uint32:
@@ -115,32 +161,35 @@ func (c *LeweiCmd) String() (str string) {
 	return str
 }
 
-func newConn(port int) (*net.TCPConn, func()) {
-	raddr := &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: port} // IP of drone
-	laddr := &net.TCPAddr{IP: getLocalIP()}                         // auto port
-	conn, err := net.DialTCP("tcp4", laddr, raddr)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "%v\n%v\n", fmt.Errorf("Cant't create connection, are you on right wifi?"), err)
-		return nil, nil
-	}
-	conn.SetDeadline(time.Time{})
-	// conn.SetDeadline(time.Now().Add(time.Second * 50))
-	closeConn := keepAlive(conn)
-	return conn, closeConn
-}
+// keepAliveLogInterval limits how often are routine keepalives logged
+const keepAliveLogInterval = time.Minute
+
+// defaultKeepAliveInterval is used when Client.KeepAliveInterval is not set
+const defaultKeepAliveInterval = time.Second * 2
 
 // KeepAlive will keep connection alive until function returned by it is called
 //
-// Socket will be othervise closed by the server after 5-10s if it is not written to
-func keepAlive(conn *net.TCPConn) func() {
-	ticker := time.NewTicker(time.Second * 2)
+// Socket will be othervise closed by the server after 5-10s if it is not written to.
+// Routine keepalives are logged only once per keepAliveLogInterval, failed ones always.
+// Returned function closes the connection, it may be called more than once.
+func keepAlive(conn *net.TCPConn, interval time.Duration, log Logger) func() {
+	ticker := time.NewTicker(interval)
 	stop := make(chan bool)
 	go func() {
+		sent := 0
+		lastLog := time.Time{}
 		for {
 			select {
-			case <-ticker.C:
-				println("keepalive")
-				Req(keepAliveCmd, nil, conn)
+			case now := <-ticker.C:
+				if err := send(conn, NewLeweiCmd(keepAliveCmd)); err != nil {
+					log.Warn("keepalive failed", "err", err)
+					continue
+				}
+				sent++
+				if now.Sub(lastLog) >= keepAliveLogInterval {
+					log.Debug("keepalive", "sent", sent)
+					lastLog = now
+				}
 			case <-stop:
 				ticker.Stop()
 				conn.Close()
@@ -148,21 +197,38 @@ func keepAlive(conn *net.TCPConn) func() {
 			}
 		}
 	}()
+	once := sync.Once{}
 	return func() {
-		stop <- true
+		once.Do(func() {
+			close(stop) // never blocks, unlike sending to it
+		})
 	}
 }
 
-// getLocalIP gets smallest ip in 192.168.0.* which exists in the system
-func getLocalIP() net.IP {
-	bestIP := net.IPv4(192, 168, 0, 255)
-	addrs, _ := net.InterfaceAddrs()
+// interfaceAddrs lists addresses of the system, it is replaced in tests
+var interfaceAddrs = net.InterfaceAddrs
+
+// getLocalIP gets smallest ip of the system in the same subnet as droneIP
+//
+// Subnet is given by mask of the interface, so it works with other than /24 networks too.
+// IPv6 and loopback addresses are skipped. It returns nil when there is no such ip.
+func getLocalIP(droneIP net.IP) net.IP {
+	var bestIP net.IP
+	addrs, _ := interfaceAddrs()
 	for _, addr := range addrs {
-		ip := addr.(*net.IPNet).IP
-		if ip.Mask(ip.DefaultMask()).Equal(net.IPv4(192, 168, 0, 0)) { // is in same subnet
-			if ip[len(ip)-1] < bestIP[len(bestIP)-1] { // has lower last byte
-				bestIP = ip
-			}
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP.To4()
+		if ip == nil || ip.IsLoopback() {
+			continue
+		}
+		if !(&net.IPNet{IP: ip.Mask(ipNet.Mask), Mask: ipNet.Mask}).Contains(droneIP) {
+			continue // not in same subnet
+		}
+		if bestIP == nil || bytes.Compare(ip, bestIP) < 0 {
+			bestIP = ip
 		}
 	}
 	return bestIP
@@ -170,28 +236,29 @@ func getLocalIP() net.IP {
 
 // send LeweiCmd
 func send(conn *net.TCPConn, cmd LeweiCmd) error {
-	_, err := conn.Write(cmd.header)
-	conn.Write(cmd.payload.Bytes())
+	if _, err := conn.Write(cmd.header); err != nil {
+		return err
+	}
+	_, err := conn.Write(cmd.payload.Bytes())
 	return err
 }
 
 // recv LeweiCmd
+//
+// Error wrapping ErrBadHeader or ErrPayloadTooLarge is returned when the header is not valid,
+// the payload is not read then.
 func recv(conn *net.TCPConn) (LeweiCmd, error) {
 	cmd := NewLeweiCmd(0)
-	n, err := conn.Read(cmd.header)
-	for n != len(cmd.header) {
-		println("waiting for rest of the header", len(cmd.header), n) // correct port?
-		nn, _ := conn.Read(cmd.header[n:])
-		n += nn
-		if n == 0 && nn == 0 { // probably waste of time
-			break
-		}
-	}
-	if err != nil {
-		println("socket probably closed")
+	if _, err := io.ReadFull(conn, cmd.header); err != nil { // socket probably closed
 		return cmd, err
 	}
+	if !bytes.HasPrefix(cmd.header, []byte(headerMagic)) {
+		return cmd, fmt.Errorf("%w: %q", ErrBadHeader, cmd.header[:len(headerMagic)])
+	}
 	payloadLen := cmd.headerGet(lenI)
+	if payloadLen > MaxPayloadSize {
+		return cmd, fmt.Errorf("%w: %dB (max %dB)", ErrPayloadTooLarge, payloadLen, MaxPayloadSize)
+	}
 
 	cmd.payload.Grow(int(payloadLen))
 	recvN := int64(0)
@@ -205,86 +272,202 @@ func recv(conn *net.TCPConn) (LeweiCmd, error) {
 	return cmd, nil
 }
 
-func portByCmd(cmd uint32) int {
+// isStreamCmd says whether cmd is sent to stream port (7060) or control port (8060)
+func isStreamCmd(cmd uint32) bool {
 	switch cmd {
 	case keepAliveCmd, streamLiveVideoCmd, replayVideoCmd, downloadVideoCmd:
-		return 7060
+		return true
 	default:
-		return 8060
+		return false
 	}
 }
 
+// byteToUint16 decodes little endian uint16 numbers from byte slice
+//
+// It does not depend on endianness of the host; trailing odd byte is ignored
 func byteToUint16(arr []byte) []uint16 {
-	arr = arr[:]
-	header := *(*reflect.SliceHeader)(unsafe.Pointer(&arr))
-	header.Len /= 2 // (16 bit = 2 bytes)
-	header.Cap /= 2
-	return *(*[]uint16)(unsafe.Pointer(&header))
+	res := make([]uint16, len(arr)/2) // (16 bit = 2 bytes)
+	for i := range res {
+		res[i] = binary.LittleEndian.Uint16(arr[i*2:])
+	}
+	return res
 }
 
+// byteToUint32 decodes little endian uint32 numbers from byte slice
+//
+// It does not depend on endianness of the host; trailing bytes not forming whole number are ignored
 func byteToUint32(arr []byte) []uint32 {
-	arr = arr[:]
-	header := *(*reflect.SliceHeader)(unsafe.Pointer(&arr))
-	header.Len /= 4 // (32 bit = 4 bytes)
-	header.Cap /= 4
-	return *(*[]uint32)(unsafe.Pointer(&header))
+	res := make([]uint32, len(arr)/4) // (32 bit = 4 bytes)
+	for i := range res {
+		res[i] = binary.LittleEndian.Uint32(arr[i*4:])
+	}
+	return res
 }
 
+// actionTimeout limits how long Action waits for the drone
+const actionTimeout = 30 * time.Second
+
 // Action combines together Req and Res functions and open/closes own connection
 //
 // it will make request of type given by cmd and call callback function with response payload in byte slice
-func Action(cmd uint32, payload interface{}, callback func([]byte)) {
-	conn, closeConn := newConn(portByCmd(cmd))
-	if conn == nil {
-		return
+// Callback is not called when request or response fails.
+// When the client is connected (see Connect), persistent connection is used instead. When it fails,
+// the request is sent again on fresh connection only if it was not sent yet or it is safe to repeat (eg. listing).
+// It gives up after 30s, use ActionContext to choose the timeout or cancel it.
+func (c *Client) Action(cmd uint32, payload interface{}, callback func([]byte)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+	defer cancel()
+	return c.ActionContext(ctx, cmd, payload, callback)
+}
+
+// ActionContext is the same as Action, but it can be canceled by ctx
+//
+// When ctx is canceled while waiting for the port (used by other operation), connecting or waiting for the response,
+// ctx.Err() is returned (and the connection is closed).
+func (c *Client) ActionContext(ctx context.Context, cmd uint32, payload interface{}, callback func([]byte)) error {
+	port := c.portByCmd(cmd)
+	conn, release, reused, err := c.sharedConn(ctx, port, 0)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	data, err := c.requestContext(ctx, conn, cmd, payload)
+	if err != nil && reused && ctx.Err() == nil && canRepeat(cmd, err) { // drone has probably closed it meanwhile
+		release(false)
+		conn, release, _, err = c.sharedConn(ctx, port, 0)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		data, err = c.requestContext(ctx, conn, cmd, payload)
+	}
+	release(err == nil)
+	if err != nil {
+		return err
 	}
-	defer closeConn()
-	Req(cmd, payload, conn)
-	data := Res(cmd, conn)
 
 	if callback != nil {
 		callback(data)
 	}
+	return nil
+}
+
+// repeatableCmds are requests which do not change anything when the drone gets them twice
+var repeatableCmds = map[uint32]bool{
+	keepAliveCmd:  true,
+	setClockCmd:   true,
+	checkVideoCmd: true,
+	listVideosCmd: true,
+}
+
+// canRepeat tells whether failed request of type cmd can be sent again on fresh connection
+//
+// Request which was not sent can be always repeated. Otherwise the drone may have already acted on it
+// (eg. took a photo) and only the response was lost, so only repeatable commands are sent again.
+func canRepeat(cmd uint32, err error) bool {
+	var notSent notSentError
+	if errors.As(err, &notSent) {
+		return true
+	}
+	return repeatableCmds[cmd] && !errors.Is(err, ErrProtocol)
+}
+
+// notSentError is returned (wrapping the network error) by request when the request could not be written
+type notSentError struct {
+	err error
+}
+
+func (e notSentError) Error() string { return e.err.Error() }
+func (e notSentError) Unwrap() error { return e.err }
+
+// request sends request of type cmd over conn and returns payload of its response
+func (c *Client) request(conn *net.TCPConn, cmd uint32, payload interface{}) ([]byte, error) {
+	if err := Req(cmd, payload, conn); err != nil {
+		return nil, notSentError{err}
+	}
+	return c.res(cmd, conn)
+}
+
+// requestContext is the same as request, but conn is closed when ctx is canceled meanwhile
+//
+// ctx.Err() is returned then.
+func (c *Client) requestContext(ctx context.Context, conn *net.TCPConn, cmd uint32, payload interface{}) ([]byte, error) {
+	if ctx.Done() == nil { // can't be canceled
+		return c.request(conn, cmd, payload)
+	}
+	done := make(chan struct{})
+	closed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close() // interrupts waiting for the response
+			closed <- true
+		case <-done:
+			closed <- false
+		}
+	}()
+	data, err := c.request(conn, cmd, payload)
+	close(done)
+	if <-closed {
+		return nil, ctx.Err()
+	}
+	return data, err
 }
 
 // Req will create and send request to TCP conn
 //
 // Use Action instead, if you expect response with same cmd type
-func Req(cmd uint32, payload interface{}, conn *net.TCPConn) {
+func Req(cmd uint32, payload interface{}, conn *net.TCPConn) error {
 	// send request
 	req := NewLeweiCmd(cmd)
 	if cmd == streamLiveVideoCmd {
 		req.headerSet(valI, 1) // TODO ??
 	}
 	req.AddPayload(payload)
-	send(conn, req) // TODO handle error an check closed conn
+	return send(conn, req)
+}
+
+// recvSkipKeepAlive will recv next LeweiCmd which is not keepalive response
+//
+// Every received LeweiCmd (keepalives too) is passed to Dump of the client.
+func (c *Client) recvSkipKeepAlive(conn *net.TCPConn) (LeweiCmd, error) {
+	for {
+		resp, err := recv(conn)
+		if err == nil {
+			c.Dump.dump(&resp)
+		}
+		if err != nil || resp.headerGet(cmdI) != keepAliveCmd {
+			return resp, err
+		}
+	}
 }
 
 // Res will obtain response from TCP conn (while skipping keepalive cmds)
 //
 // Use Action instead, if tis is response for requsest of same cmd type
-func Res(cmd uint32, conn *net.TCPConn) (payload []byte) {
+// Error wrapping ErrProtocol is returned when response is of other cmd type.
+// Received commands are dumped by DefaultClient.Dump.
+func Res(cmd uint32, conn *net.TCPConn) (payload []byte, err error) {
+	return DefaultClient.res(cmd, conn)
+}
+
+// res is the same as Res, but received commands are dumped by Dump of the client
+func (c *Client) res(cmd uint32, conn *net.TCPConn) (payload []byte, err error) {
 	// load payload:
-start:
-	resp, _ := recv(conn)
+	resp, err := c.recvSkipKeepAlive(conn)
+	if err != nil {
+		return nil, err
+	}
 
 	// check return type
-	recvCmd := resp.headerGet(cmdI)
-	if recvCmd != cmd {
-		if recvCmd == keepAliveCmd {
-			// ignore keepAlive response and start over
-			goto start
-		}
-		if cmd == videoReplayCmd && recvCmd == videoReplayEndCmd {
-			println("video replay end")
-			return resp.payload.Bytes()
-		}
-		if recvCmd == 0 { // closed channel? retun empty cmd
-			return []byte{}
-		}
-		panic(fmt.Errorf("invalid response command type; exp %v; got %v", cmd, recvCmd))
+	if recvCmd := resp.headerGet(cmdI); recvCmd != cmd {
+		return nil, fmt.Errorf("%w: invalid response command type; exp %v; got %v", ErrProtocol, cmd, recvCmd)
 	}
 	conn.SetDeadline(time.Now().Add(time.Second * 10))
 
-	return resp.payload.Bytes()
+	return resp.payload.Bytes(), nil
 }
@@ -1,41 +1,2669 @@
 package vtx
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/drahoslove/dronio/vtx/vtxtest"
 )
 
+// fakeServer returns client of local TCP server which pretends to be the drone
+//
+// serve is called with server side of each connection made to the drone.
+// The connections are closed at the end of the test and serve calls are waited for,
+// so they don't outlive the test.
+func fakeServer(t *testing.T, serve func(conn *net.TCPConn)) *Client {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu    sync.Mutex
+		conns []*net.TCPConn
+		wg    sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serve(conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+		wg.Wait()
+	})
+	client := NewClient(net.IPv4(127, 0, 0, 1))
+	client.ControlPort = listener.Addr().(*net.TCPAddr).Port
+	client.StreamPort = client.ControlPort
+	client.DialTimeout = time.Second
+	return client
+}
+
 func TestLiveStream(t *testing.T) {
-	SetClock()
-	LiveStream(nil)
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		req, err := recv(conn)
+		if err != nil || req.headerGet(cmdI) != streamLiveVideoCmd || req.headerGet(valI) != 1 {
+			t.Errorf("Expected stream request, got %s (%v)", req.String(), err)
+			return
+		}
+		send(conn, chunk(liveStreamVideoCmd, []uint32{1, 5, 50}, "frame"))
+		send(conn, chunk(liveStreamVideoCmd, []uint32{0, 5, 100}, "delta"))
+	})
+
+	output := &bytes.Buffer{}
+	if err := client.LiveStream(output); err != nil {
+		t.Errorf("Stream closed by drone should end without error, got %v", err)
+	}
+	if output.String() != "framedelta" {
+		t.Errorf("Unexpected stream output %q", output.String())
+	}
+}
+
+// droneServer returns client of vtxtest fake drone, the server has to be closed
+func droneServer() (*Client, *vtxtest.Server) {
+	srv := vtxtest.NewServer()
+	client := NewClient(srv.IP)
+	client.ControlPort = srv.ControlPort
+	client.StreamPort = srv.StreamPort
+	client.DialTimeout = time.Second
+	return client, srv
 }
+
 func TestTakePhoto(t *testing.T) {
-	return
-	TakePhoto()
+	dir, err := ioutil.TempDir("", "vtx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client, srv := droneServer()
+	defer srv.Close()
+	client.OutputDir = dir
+	srv.Photo = []byte("\xff\xd8photo\xff\xd9")
+
+	fileName, err := client.TakePhoto()
+	if err != nil || fileName != "/mnt/sd/photo/1.jpg" {
+		t.Fatalf("Unexpected photo name %q (%v)", fileName, err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "1.jpg"))
+	if err != nil || string(content) != "\xff\xd8photo\xff\xd9" {
+		t.Errorf("Unexpected saved photo % x (%v)", content, err)
+	}
+	if fileName, _ := client.TakePhoto(); fileName != "/mnt/sd/photo/2.jpg" {
+		t.Errorf("Unexpected name of second photo %q", fileName)
+	}
 }
 
 func TestCaptureVideo(t *testing.T) {
-	return
-	SetClock()
-	// TakePhoto()
-	// ListVideos()
-
-	println("video capture started")
-	CaptureVideo(20 * time.Second)
-	println("video capture ended")
-	time.Sleep(time.Second * 2)
-	videos := ListVideos()
-	println("videos listed")
-	for _, video := range videos {
-		println("downloading video", video.Filename)
-		t1 := time.Now()
-		DownloadVideo(video.Filename)
-		println("saving videoreplay")
-		ReplayVideo(video.Filename, nil)
-		println(time.Now().Sub(t1).String())
-		time.Sleep(time.Second * 2)
-		println("deleting video", video.Filename)
-		DeleteVideo(video.Filename)
-		println("done")
+	dir, err := ioutil.TempDir("", "vtx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client, srv := droneServer()
+	defer srv.Close()
+	client.OutputDir = dir
+	if err := client.SetClock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.CaptureVideo(10 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if srv.Capturing() {
+		t.Error("Capturing was not stopped")
+	}
+	videos, err := client.ListVideos()
+	if err != nil || len(videos) != 1 {
+		t.Fatalf("Expected one recorded video, got %v (%v)", videos, err)
+	}
+	video := videos[0]
+	footage := bytes.Join(vtxtest.DefaultFootage, nil)
+	if int(video.Size) != len(footage) {
+		t.Errorf("Unexpected size %d of %q", video.Size, video.Filename)
+	}
+
+	if err := client.DownloadVideoFile(video.Filename); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, video.Filename))
+	if err != nil || !bytes.Equal(content, footage) {
+		t.Errorf("Unexpected downloaded video % x (%v)", content, err)
+	}
+
+	replayed := &bytes.Buffer{}
+	if err := client.ReplayVideo(video.Filename, replayed); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(replayed.Bytes(), footage) {
+		t.Errorf("Unexpected replayed video % x", replayed.Bytes())
+	}
+
+	if err := client.DeleteVideo(video.Filename); err != nil {
+		t.Fatal(err)
+	}
+	if videos := srv.Videos(); len(videos) != 0 {
+		t.Errorf("Video was not deleted: %v", videos)
+	}
+	if err := client.DeleteVideo(video.Filename); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Expected ErrFileNotFound for deleted video, got %v", err)
+	}
+}
+
+// exifJPEG encodes img as jpeg with EXIF orientation tag
+func exifJPEG(t *testing.T, img image.Image, orientation uint16, order binary.ByteOrder) []byte {
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	tiff := make([]byte, 8+2+12+4) // header, IFD0 with one entry, no next IFD
+	copy(tiff, "II*\x00")
+	if order == binary.BigEndian {
+		copy(tiff, "MM\x00*")
+	}
+	order.PutUint32(tiff[4:], 8) // IFD0 offset
+	order.PutUint16(tiff[8:], 1) // entries
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3) // short
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	segment := append([]byte{0xff, 0xe1, 0, 0}, app1...)
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(app1)+2))
+	data := buf.Bytes()
+	return append(append(append([]byte(nil), data[:2]...), segment...), data[2:]...)
+}
+
+func TestAutoRotate(t *testing.T) {
+	// stored sideways: left half red, right half blue, to be rotated 90° clockwise
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= 8 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	sideways := exifJPEG(t, img, 6, binary.BigEndian)
+
+	client, srv := droneServer()
+	defer srv.Close()
+	srv.Photo = sideways
+	photo := &bytes.Buffer{}
+	if _, err := client.TakePhotoTo(photo); err != nil || !bytes.Equal(photo.Bytes(), sideways) {
+		t.Fatalf("Photo should be saved exactly without AutoRotate (%v)", err)
+	}
+
+	client.AutoRotate = true
+	photo.Reset()
+	if _, err := client.TakePhotoTo(photo); err != nil {
+		t.Fatal(err)
+	}
+	if orientation := jpegOrientation(photo.Bytes()); orientation != 1 {
+		t.Errorf("Rotated photo should be upright, got orientation %d", orientation)
+	}
+	expected := append([]byte(nil), exifSegment(sideways)...)
+	field, order := orientationField(expected)
+	order.PutUint16(field, 1)
+	if kept := exifSegment(photo.Bytes()); !bytes.Equal(kept, expected) {
+		t.Errorf("EXIF of rotated photo should be kept with orientation 1, got % x", kept)
+	}
+	upright, err := jpeg.Decode(photo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := upright.Bounds().Size(); size != image.Pt(8, 16) {
+		t.Fatalf("Rotated photo should be 8×16, got %v", size)
+	}
+	for _, p := range []struct {
+		y         int
+		red, blue bool
+	}{{2, true, false}, {13, false, true}} {
+		r, _, b, _ := upright.At(4, p.y).RGBA()
+		if (r > 0x8000) != p.red || (b > 0x8000) != p.blue {
+			t.Errorf("Unexpected color of rotated photo at row %d: r=%x b=%x", p.y, r, b)
+		}
+	}
+
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		if got := jpegOrientation(exifJPEG(t, img, orientation, binary.LittleEndian)); got != int(orientation) {
+			t.Errorf("Orientation %d read as %d", orientation, got)
+		}
+		if size := orient(img, int(orientation)).Bounds().Size(); (orientation >= 5) != (size == image.Pt(8, 16)) {
+			t.Errorf("Unexpected size %v for orientation %d", size, orientation)
+		}
+	}
+}
+
+func TestTakePhotoTo(t *testing.T) {
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if _, err := recv(conn); err != nil {
+			return
+		}
+		res := NewLeweiCmd(takePhotoCmd)
+		header := make([]byte, 32*4)
+		copy(header, uint32ToByte([]uint32{4}))
+		copy(header[3*4:], "/mnt/sd/photo/1.jpg")
+		res.AddPayload(header)
+		res.AddPayload("\xff\xd8\xff\xd9")
+		send(conn, res)
+	})
+
+	photo := &bytes.Buffer{}
+	fileName, err := client.TakePhotoTo(photo)
+	if err != nil || fileName != "/mnt/sd/photo/1.jpg" {
+		t.Errorf("Unexpected photo name %q (%v)", fileName, err)
+	}
+	if photo.String() != "\xff\xd8\xff\xd9" {
+		t.Errorf("Unexpected photo content % x", photo.Bytes())
+	}
+}
+
+func TestTakePhotoRetry(t *testing.T) {
+	var requests, empty int32
+	complete := int32(3) // request which gets whole photo
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		for {
+			if _, err := recv(conn); err != nil {
+				return
+			}
+			res := NewLeweiCmd(takePhotoCmd)
+			n := atomic.AddInt32(&requests, 1)
+			if n != atomic.LoadInt32(&complete) && atomic.LoadInt32(&empty) == 1 {
+				send(conn, res) // zero payload, not even the header
+				continue
+			}
+			header := make([]byte, 32*4)
+			copy(header, uint32ToByte([]uint32{4}))
+			copy(header[3*4:], "/mnt/sd/photo/1.jpg")
+			res.AddPayload(header)
+			if n == atomic.LoadInt32(&complete) {
+				res.AddPayload("\xff\xd8\xff\xd9")
+			} else {
+				res.AddPayload("\xff\xd8") // not ready yet
+			}
+			send(conn, res)
+		}
+	})
+	client.PhotoRetry = RetryPolicy{Attempts: 3, Backoff: time.Millisecond}
+
+	for _, payload := range []string{"short", "zero"} {
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&complete, 3)
+		if payload == "zero" {
+			atomic.StoreInt32(&empty, 1)
+		}
+		photo := &bytes.Buffer{}
+		fileName, err := client.TakePhotoTo(photo)
+		if err != nil || fileName != "/mnt/sd/photo/1.jpg" || photo.String() != "\xff\xd8\xff\xd9" {
+			t.Errorf("Expected complete photo after %s payload twice, got %q % x (%v)", payload, fileName, photo.Bytes(), err)
+		}
+		if n := atomic.LoadInt32(&requests); n != 3 {
+			t.Errorf("Expected 3 photo requests after %s payload, got %d", payload, n)
+		}
+
+		atomic.StoreInt32(&requests, 0)
+		atomic.StoreInt32(&complete, 4)
+		photo.Reset()
+		_, err = client.TakePhotoTo(photo)
+		if !errors.Is(err, ErrIncompletePhoto) || !errors.Is(err, ErrShortPayload) {
+			t.Errorf("Expected ErrIncompletePhoto after %s payloads, got %v", payload, err)
+		}
+		if photo.Len() != 0 {
+			t.Errorf("Incomplete photo should not be written, got % x", photo.Bytes())
+		}
+		if n := atomic.LoadInt32(&requests); n != 3 {
+			t.Errorf("Expected 3 photo requests after %s payloads, got %d", payload, n)
+		}
+	}
+}
+
+func TestStreamServer(t *testing.T) {
+	connected := make(chan bool, 10)
+	disconnected := make(chan bool, 10)
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if _, err := recv(conn); err != nil {
+			return
+		}
+		connected <- true
+		go func() {
+			for { // until the client closes the connection
+				if _, err := recv(conn); err != nil {
+					disconnected <- true
+					return
+				}
+			}
+		}()
+		keyframe := "\x00\x00\x00\x01" + string(baselineSPS) + "\x00\x00\x00\x01\x68pps\x00\x00\x00\x01\x65idr"
+		for i := uint32(0); ; i++ {
+			frame := chunk(liveStreamVideoCmd, []uint32{0, 7, 50 * i}, "\x00\x00\x00\x01\x41p")
+			if i%4 == 0 {
+				frame = chunk(liveStreamVideoCmd, []uint32{1, uint32(len(keyframe)), 50 * i}, keyframe)
+			}
+			if err := send(conn, frame); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	server := httptest.NewServer(client.StreamServer())
+	defer server.Close()
+
+	viewers := []*http.Response{}
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ := resp.Header.Get("Content-Type"); typ != "video/mp4" {
+			t.Errorf("H.264 should be served as video/mp4, got %q", typ)
+		}
+		// every viewer starts by init segment and key frame
+		for _, expected := range []string{"ftyp", "moov", "moof", "mdat"} {
+			typ, content, err := readBox(resp.Body)
+			if err != nil || typ != expected {
+				t.Fatalf("Viewer %d should get %s box, got %q (%v)", i, expected, typ, err)
+			}
+			if typ == "mdat" && string(content) != "\x00\x00\x00\x04\x65idr" {
+				t.Errorf("Viewer %d should start with key frame, got %q", i, content)
+			}
+		}
+		viewers = append(viewers, resp)
+	}
+	if len(connected) != 1 {
+		t.Errorf("Drone should be connected once for all viewers, got %d", len(connected))
+	}
+
+	viewers[0].Body.Close()
+	select {
+	case <-disconnected:
+		t.Errorf("Stream should continue while some viewer is connected")
+	case <-time.After(100 * time.Millisecond):
+	}
+	viewers[1].Body.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Errorf("Stream should stop when the last viewer disconnects")
+	}
+}
+
+func TestStreamServerMJPEG(t *testing.T) {
+	images := []string{"\xff\xd8first\xff\xd9", "\xff\xd8second\xff\xd9"}
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if _, err := recv(conn); err != nil {
+			return
+		}
+		for i, image := range images {
+			send(conn, chunk(liveStreamVideoCmd, []uint32{5, uint32(len(image)), uint32(50 * i)}, image))
+		}
+		recv(conn) // wait for disconnect
+	})
+	server := httptest.NewServer(client.StreamServer())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" {
+		t.Fatalf("MJPEG should be served as multipart/x-mixed-replace, got %q (%v)", resp.Header.Get("Content-Type"), err)
+	}
+	parts := multipart.NewReader(resp.Body, params["boundary"])
+	for i, image := range images {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil || part.Header.Get("Content-Type") != "image/jpeg" || string(data) != image {
+			t.Errorf("Part %d should be JPEG %q, got %q %q (%v)", i, image, part.Header.Get("Content-Type"), data, err)
+		}
+	}
+}
+
+func TestStorageInfo(t *testing.T) {
+	defer func(timeout time.Duration) { storageInfoTimeout = timeout }(storageInfoTimeout)
+	storageInfoTimeout = 100 * time.Millisecond
+
+	mode := int32(0) // 0 = supported, 1 = unknown response, 2 = no response
+	var conns int32
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		atomic.AddInt32(&conns, 1)
+		for {
+			req, err := recv(conn)
+			if err != nil {
+				return
+			}
+			if req.headerGet(cmdI) != StorageInfoCmd {
+				continue
+			}
+			res := NewLeweiCmd(req.headerGet(cmdI))
+			switch atomic.LoadInt32(&mode) {
+			case 1:
+				res = NewLeweiCmd(0x00ff)
+			case 2:
+				continue
+			}
+			res.AddPayload([]uint32{1024, 8 * 1024 * 1024})
+			send(conn, res)
+		}
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for i := 0; i < 2; i++ {
+		free, total, err := client.StorageInfo()
+		if err != nil || free != 1024*1024 || total != 8*1024*1024*1024 {
+			t.Errorf("Unexpected storage info %d / %d (%v)", free, total, err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Connection kept by Connect should be used, got %d connections", n)
+	}
+
+	atomic.StoreInt32(&mode, 1)
+	if _, _, err := client.StorageInfo(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Unknown response should be ErrNotSupported, got %v", err)
+	}
+	atomic.StoreInt32(&mode, 2)
+	if _, _, err := client.StorageInfo(); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("No response should be ErrNotSupported, got %v", err)
+	}
+	if _, _, err := parseStorageInfo([]byte{1, 2, 3}); !errors.Is(err, ErrNotSupported) {
+		t.Errorf("Short response should be ErrNotSupported, got %v", err)
+	}
+}
+
+func TestPortSerialization(t *testing.T) {
+	// counter of operations running on one port at once, remembering the maximum
+	type counter struct{ active, max int32 }
+	enter := func(c *counter) {
+		n := atomic.AddInt32(&c.active, 1)
+		for {
+			max := atomic.LoadInt32(&c.max)
+			if n <= max || atomic.CompareAndSwapInt32(&c.max, max, n) {
+				return
+			}
+		}
+	}
+	var control, stream counter
+	unblock := make(chan bool)
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		req, err := recv(conn)
+		if err != nil || req.headerGet(cmdI) != checkVideoCmd {
+			return
+		}
+		enter(&control)
+		select {
+		case <-unblock:
+		case <-time.After(20 * time.Millisecond):
+		}
+		res := NewLeweiCmd(checkVideoCmd)
+		res.AddPayload([]uint32{on})
+		atomic.AddInt32(&control.active, -1) // before the response, so next request can't come sooner
+		send(conn, res)
+		recv(conn) // wait for client to close
+	})
+	client.StreamPort = fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		req, err := recv(conn)
+		if err != nil || req.headerGet(cmdI) != downloadVideoCmd {
+			return
+		}
+		enter(&stream)
+		send(conn, downloadChunk(2, 10, "a.avi", "hello"))
+		time.Sleep(20 * time.Millisecond)
+		send(conn, downloadChunk(2, 10, "a.avi", "world"))
+		atomic.AddInt32(&stream.active, -1)
+		send(conn, downloadChunk(3, 10, "a.avi", ""))
+		recv(conn)
+	}).ControlPort
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			client.InvalidateStatus()
+			if capturing, err := client.IsCapturing(); err != nil || !capturing {
+				t.Errorf("IsCapturing failed: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := client.DownloadVideo(context.Background(), "a.avi", ioutil.Discard, nil); err != nil {
+				t.Errorf("DownloadVideo failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if control.max != 1 || stream.max != 1 {
+		t.Errorf("Operations on the same port should not overlap, %d on control and %d on stream port did", control.max, stream.max)
+	}
+
+	// stream port is not blocked by operation on control port
+	client.InvalidateStatus()
+	checked := make(chan error, 1)
+	go func() {
+		_, err := client.IsCapturing()
+		checked <- err
+	}()
+	for atomic.LoadInt32(&control.active) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := client.DownloadVideo(context.Background(), "a.avi", ioutil.Discard, nil); err != nil {
+		t.Errorf("DownloadVideo should not wait for control port, got %v", err)
+	}
+	close(unblock)
+	if err := <-checked; err != nil {
+		t.Errorf("IsCapturing failed: %v", err)
+	}
+	client.Close()
+}
+
+func TestPortBusy(t *testing.T) {
+	defer func(orig time.Duration) { portWait = orig }(portWait)
+	portWait = 50 * time.Millisecond
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		req, err := recv(conn)
+		if err != nil {
+			return
+		}
+		if req.headerGet(cmdI) == downloadVideoCmd {
+			send(conn, downloadChunk(2, 5, "a.avi", "hello"))
+			send(conn, downloadChunk(3, 5, "a.avi", ""))
+			recv(conn)
+			return
+		}
+		for { // live stream until the client closes it
+			if err := send(conn, chunk(liveStreamVideoCmd, []uint32{1, 5, 50}, "frame")); err != nil {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	})
+
+	ctx, stopStream := context.WithCancel(context.Background())
+	defer stopStream()
+	frames, err := client.Frames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-frames
+
+	start := time.Now()
+	if err := client.DownloadVideo(context.Background(), "a.avi", ioutil.Discard, nil); !errors.Is(err, ErrPortBusy) {
+		t.Errorf("Download during live stream should fail with ErrPortBusy, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Download should give up after portWait, took %v", elapsed)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.DownloadVideo(canceled, "a.avi", ioutil.Discard, nil); err != context.Canceled {
+		t.Errorf("Canceled wait for the port should return context.Canceled, got %v", err)
+	}
+
+	stopStream()
+	for range frames { // until the stream releases the port
+	}
+	if err := client.DownloadVideo(context.Background(), "a.avi", ioutil.Discard, nil); err != nil {
+		t.Errorf("Download after live stream should succeed, got %v", err)
+	}
+}
+
+func TestClockTimestamp(t *testing.T) {
+	noon := time.Date(2018, 5, 20, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	if ts, exp := clockTimestamp(noon, chinaZone), time.Date(2018, 5, 20, 4, 0, 0, 0, time.UTC).Unix(); int64(ts) != exp {
+		t.Errorf("Expected timestamp %d (10:00 UTC shifted to 04:00 UTC, 12:00 in UTC+8), got %d", exp, ts)
+	}
+	if ts, exp := clockTimestamp(noon, time.UTC), time.Date(2018, 5, 20, 12, 0, 0, 0, time.UTC).Unix(); int64(ts) != exp {
+		t.Errorf("Expected timestamp %d (12:00 in UTC), got %d", exp, ts)
+	}
+
+	local := time.Date(2018, 5, 20, 12, 0, 0, 0, time.Local)
+	if back := clockTime(clockTimestamp(local, chinaZone), chinaZone); !back.Equal(local) {
+		t.Errorf("Expected %v back, got %v", local, back)
+	}
+
+	sent := make(chan uint32, 1)
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		req, err := recv(conn)
+		if err != nil {
+			return
+		}
+		sent <- binary.LittleEndian.Uint32(req.payload.Bytes())
+		send(conn, NewLeweiCmd(setClockCmd))
+	})
+	client.DroneZone = time.UTC
+	if err := client.SetClockAt(noon); err != nil {
+		t.Fatal(err)
+	}
+	if ts := <-sent; int64(ts) != time.Date(2018, 5, 20, 12, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("Unexpected timestamp sent %d", ts)
+	}
+}
+
+func TestNotConnected(t *testing.T) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.Close() // nobody listens on the port now
+	client := NewClient(net.IPv4(127, 0, 0, 1))
+	client.ControlPort = listener.Addr().(*net.TCPAddr).Port
+
+	err = client.SetClock()
+	if !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Refused connection should be ErrNotConnected, got %v", err)
+	}
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) {
+		t.Errorf("Network error should be wrapped, got %v", err)
+	}
+}
+
+// videoEntry creates one entry of list videos response
+func videoEntry(duration uint32, name string) []byte {
+	entry := make([]byte, videoEntrySize)
+	copy(entry, uint32ToByte([]uint32{0, duration}))
+	copy(entry[4*4:], name)
+	return entry
+}
+
+func TestParseVideoList(t *testing.T) {
+	created := time.Date(2018, 5, 20, 14, 30, 0, 0, time.Local)
+	entry := make([]byte, videoEntrySize)
+	copy(entry, uint32ToByte([]uint32{
+		1234567,                            // size
+		20,                                 // duration
+		clockTimestamp(created, chinaZone), // same as set by SetClock
+		0,
+	}))
+	copy(entry[4*4:], "/mnt/sd/video/20180520143000.avi")
+	payload := append(entry, videoEntry(5, "b.avi")...)
+	payload = append(payload, 0, 0, 0) // incomplete entry
+
+	videos, err := parseVideoList(payload, chinaZone)
+	if len(videos) != 2 {
+		t.Fatalf("Expected 2 videos, got %v", videos)
+	}
+	if !errors.Is(err, ErrShortPayload) {
+		t.Errorf("Incomplete entry should be reported, got %v", err)
+	}
+	video := videos[0]
+	if video.Filename != "/mnt/sd/video/20180520143000.avi" || video.Size != 1234567 || video.Duration != 20 {
+		t.Errorf("Wrong video decoded %+v", video)
+	}
+	if !video.CreatedAt.Equal(created) {
+		t.Errorf("Wrong creation time %v, expected %v", video.CreatedAt, created)
+	}
+}
+
+func TestActionErrors(t *testing.T) {
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		req, err := recv(conn)
+		if err != nil {
+			return
+		}
+		switch req.headerGet(cmdI) {
+		case listVideosCmd:
+			res := NewLeweiCmd(listVideosCmd)
+			res.AddPayload(append(videoEntry(10, "a.avi"), videoEntry(20, "b.avi")...))
+			send(conn, res)
+		case deleteVideoCmd:
+			send(conn, NewLeweiCmd(takePhotoCmd)) // wrong response
+		}
+		// others get no response
+	})
+
+	videos, err := client.ListVideos()
+	if err != nil || len(videos) != 2 || videos[1].Filename != "b.avi" || videos[1].Duration != 20 {
+		t.Errorf("Unexpected videos %v (%v)", videos, err)
+	}
+	if err := client.DeleteVideo("a.avi"); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Wrong response should be protocol error, got %v", err)
+	}
+	if _, err := client.TakePhoto(); err == nil {
+		t.Errorf("Closed connection should return error")
+	}
+}
+
+func TestKeepAliveLeak(t *testing.T) {
+	keepalives := make(chan bool, 100)
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		for {
+			req, err := recv(conn)
+			if err != nil {
+				return
+			}
+			switch req.headerGet(cmdI) {
+			case keepAliveCmd:
+				keepalives <- true
+			case checkVideoCmd:
+				return // no response
+			}
+		}
+	})
+	client.KeepAliveInterval = time.Millisecond * 10
+
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := client.LiveStreamContext(ctx, ioutil.Discard); err == nil {
+		t.Errorf("Canceled stream should fail")
+	}
+	select {
+	case <-keepalives:
+	default:
+		t.Errorf("Keepalives should be sent in configured interval")
+	}
+	if _, err := client.IsCapturing(); err == nil {
+		t.Errorf("Operation without response should fail")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Goroutines leaked: %d before, %d after", before, after)
+	}
+}
+
+func TestKeepAliveStopTwice(t *testing.T) {
+	client, server := tcpPair(t)
+	defer server.Close()
+	stop := keepAlive(client, time.Second, nopLogger{})
+	done := make(chan bool)
+	go func() {
+		stop()
+		stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Stopping keepalive twice should not block")
+	}
+}
+
+func TestDumpToDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vtx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer DumpTo(nil)
+
+	if err := DumpToDir(filepath.Join(dir, "dumps")); err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{Dump: DefaultClient.Dump}
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	for _, cmd := range []uint32{takePhotoCmd, listVideosCmd, takePhotoCmd} {
+		res := NewLeweiCmd(cmd)
+		res.AddPayload("\x01\x02")
+		send(server, res)
+		if _, err := c.recvSkipKeepAlive(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "dumps", "0013.hex"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "6c 65 77 65 69") || !strings.HasSuffix(lines[0], "| 01 02") {
+		t.Errorf("Unexpected dump of photo responses %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dumps", "0008.hex")); err != nil {
+		t.Errorf("List response should be dumped to its own file: %v", err)
+	}
+	if err := DumpErr(); err != nil {
+		t.Errorf("Unexpected dump error %v", err)
+	}
+
+	os.Mkdir(filepath.Join(dir, "dumps", "0004.hex"), 0777) // can't be opened as file
+	send(server, NewLeweiCmd(setClockCmd))
+	if _, err := c.recvSkipKeepAlive(client); err != nil {
+		t.Fatal(err)
+	}
+	if err := DumpErr(); err == nil {
+		t.Errorf("Dump file which can't be opened should be reported")
+	}
+
+	// other client does not dump
+	send(server, NewLeweiCmd(listVideosCmd))
+	if _, err := new(Client).recvSkipKeepAlive(client); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dir, "dumps", "0008.hex")); strings.Count(string(content), "\n") != 1 {
+		t.Errorf("Client without Dump should not dump, got %q", content)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), nil, 0666)
+	if err := DumpToDir(filepath.Join(dir, "file")); err == nil {
+		t.Errorf("Dumping to file instead of directory should fail")
+	}
+}
+
+func TestDump(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	output := &bytes.Buffer{}
+	c := &Client{Dump: NewDump(output)}
+	go func() {
+		send(server, NewLeweiCmd(keepAliveCmd))
+		res := NewLeweiCmd(takePhotoCmd)
+		res.AddPayload("\x01")
+		send(server, res)
+	}()
+	if _, err := c.recvSkipKeepAlive(client); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "0001 6c 65") || !strings.HasPrefix(lines[1], "0013 ") || !strings.HasSuffix(lines[1], "| 01") {
+		t.Errorf("Unexpected dump %q", output)
+	}
+	if err := c.Dump.Err(); err != nil {
+		t.Errorf("Unexpected dump error %v", err)
+	}
+	if err := (*Dump)(nil).Err(); err != nil {
+		t.Errorf("Disabled dump should have no error, got %v", err)
+	}
+}
+
+func TestRecvValidation(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	cmd := NewLeweiCmd(takePhotoCmd)
+	cmd.AddPayload("photo")
+	send(server, cmd)
+	if res, err := recv(client); err != nil || string(res.payload.Bytes()) != "photo" {
+		t.Fatalf("Valid command should be received, got %q (%v)", res.payload.Bytes(), err)
+	}
+
+	bogus := NewLeweiCmd(takePhotoCmd)
+	copy(bogus.header, "lewei_xxx")
+	send(server, bogus)
+	if _, err := recv(client); !errors.Is(err, ErrBadHeader) || !errors.Is(err, ErrProtocol) {
+		t.Errorf("Bogus magic should be ErrBadHeader, got %v", err)
+	}
+
+	huge := NewLeweiCmd(takePhotoCmd)
+	huge.headerSet(lenI, 0xfffffff0)
+	send(server, huge)
+	if _, err := recv(client); !errors.Is(err, ErrPayloadTooLarge) || !errors.Is(err, ErrProtocol) {
+		t.Errorf("Absurd length should be ErrPayloadTooLarge, got %v", err)
+	}
+
+	defer func(max uint32) { MaxPayloadSize = max }(MaxPayloadSize)
+	MaxPayloadSize = 4
+	send(server, cmd)
+	if _, err := recv(client); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("Payload over configured max should be ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+// tcpPair returns two connected TCP connections on localhost
+func tcpPair(t *testing.T) (client, server *net.TCPConn) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err = net.DialTCP("tcp4", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// chunk creates LeweiCmd of given type with chunk header (8 × uint32) followed by content
+func chunk(cmd uint32, header []uint32, content string) LeweiCmd {
+	res := NewLeweiCmd(cmd)
+	chunkHeader := make([]uint32, 8)
+	copy(chunkHeader, header)
+	res.AddPayload(chunkHeader)
+	res.AddPayload(content)
+	return res
+}
+
+// downloadChunk creates response to download request of given type (1 = start, 2 = data, 3 = end)
+func downloadChunk(typ uint32, fileSize int, fileName, content string) LeweiCmd {
+	res := NewLeweiCmd(videoDownloadCmd)
+	header := make([]byte, downloadHeaderSize)
+	copy(header, uint32ToByte([]uint32{typ, uint32(len(content)), uint32(fileSize), 0}))
+	copy(header[4*4:], fileName)
+	res.AddPayload(header)
+	res.AddPayload(content)
+	return res
+}
+
+func uint32ToByte(arr []uint32) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, arr)
+	return buf.Bytes()
+}
+
+func TestDownload(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		send(server, downloadChunk(1, 10, "a.avi", ""))
+		send(server, downloadChunk(2, 10, "a.avi", "hello"))
+		send(server, NewLeweiCmd(keepAliveCmd))
+		send(server, downloadChunk(2, 10, "a.avi", "world"))
+		send(server, downloadChunk(3, 10, "a.avi", ""))
+	}()
+
+	output := &bytes.Buffer{}
+	progress := []int{}
+	err := new(Client).download(context.Background(), client, "a.avi", output, nil, func(loaded, size int) {
+		if size != 10 {
+			t.Errorf("Unexpected file size %d", size)
+		}
+		progress = append(progress, loaded)
+	})
+	if err != nil {
+		t.Fatalf("Download should succeed, got %v", err)
+	}
+	if output.String() != "helloworld" {
+		t.Errorf("Unexpected download output %q", output.String())
+	}
+	if len(progress) != 2 || progress[1] != 10 {
+		t.Errorf("Unexpected progress %v", progress)
+	}
+}
+
+// capturedStartChunk is start chunk of download in analysis/video/request_video_file_download.pcapng
+var capturedStartChunk = "lewei_cmd\x00\x06\x01\x00\x00" + strings.Repeat("\x00", 8) + "\xc4\x00\x00\x00" + strings.Repeat("\x00", 20) +
+	"\x01\x00\x00\x00\x00\x00\x00\x00\x2d\xb9\x08\x00\x00\x00\x00\x00" + // start, chunk size 0, file size 571693, offset 0
+	"a:/Video/20181202_200630.mp4" + strings.Repeat("\x00", 100-28) + strings.Repeat("\x00", 80)
+
+func TestDownloadCaptured(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	const fileName, fileSize = "a:/Video/20181202_200630.mp4", 571693
+	go func() {
+		server.Write([]byte(capturedStartChunk))
+		for rest := fileSize; rest > 0; rest -= 30720 { // chunk size of the capture
+			n := 30720
+			if rest < n {
+				n = rest
+			}
+			send(server, downloadChunk(2, fileSize, fileName, strings.Repeat("\x00", n)))
+		}
+		send(server, downloadChunk(3, fileSize, fileName, ""))
+	}()
+
+	loaded := 0
+	err := new(Client).download(context.Background(), client, fileName, ioutil.Discard, nil, func(bytesLoaded, size int) {
+		loaded = bytesLoaded
+		if size != fileSize {
+			t.Errorf("Expected file size %d, got %d", fileSize, size)
+		}
+	})
+	if err != nil || loaded != fileSize {
+		t.Errorf("Download should succeed, got %dB (%v)", loaded, err)
+	}
+}
+
+// endChunk creates download end chunk with given checksum field
+func endChunk(fileSize int, fileName, checksum string) LeweiCmd {
+	res := downloadChunk(3, fileSize, fileName, "")
+	copy(res.payload.Bytes()[116:], checksum)
+	return res
+}
+
+func TestDownloadResume(t *testing.T) {
+	for _, ranged := range []bool{true, false} {
+		dir, err := ioutil.TempDir("", "vtx")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		ioutil.WriteFile(filepath.Join(dir, "a.avi.part"), []byte("hello"), 0666)
+
+		client := fakeServer(t, func(conn *net.TCPConn) {
+			defer conn.Close()
+			req, err := recv(conn)
+			if err != nil {
+				return
+			}
+			offset := binary.LittleEndian.Uint32(req.payload.Bytes()[4:])
+			if offset != 5 {
+				t.Errorf("Expected request from offset 5, got %d", offset)
+			}
+			start := downloadChunk(1, 10, "a.avi", "")
+			if ranged {
+				copy(start.payload.Bytes()[3*4:], uint32ToByte([]uint32{offset}))
+				send(conn, start)
+			} else { // drone ignores the offset
+				send(conn, start)
+				send(conn, downloadChunk(2, 10, "a.avi", "hello"))
+			}
+			send(conn, downloadChunk(2, 10, "a.avi", "world"))
+			send(conn, endChunk(10, "a.avi", "fc5e038d38a57032085441e7fe7010b0"))
+		})
+		client.OutputDir = dir
+
+		if err := client.DownloadVideoResume("a.avi"); err != nil {
+			t.Fatalf("Resumed download should succeed (ranged %v), got %v", ranged, err)
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, "a.avi"))
+		if err != nil || string(content) != "helloworld" {
+			t.Errorf("Unexpected downloaded file %q (ranged %v, %v)", content, ranged, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "a.avi.part")); !os.IsNotExist(err) {
+			t.Errorf("Part file should be renamed, got %v", err)
+		}
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	for _, tc := range []struct {
+		checksum string
+		err      error
+	}{
+		{"fc5e038d38a57032085441e7fe7010b0", nil}, // md5("helloworld")
+		{"FC5E038D38A57032085441E7FE7010B0", nil},
+		{"", nil}, // not checked
+		{"00000000000000000000000000000000", ErrChecksumMismatch},
+	} {
+		client, server := tcpPair(t)
+		go func(checksum string) {
+			send(server, downloadChunk(2, 10, "a.avi", "hello"))
+			send(server, downloadChunk(2, 10, "a.avi", "world"))
+			send(server, endChunk(10, "a.avi", checksum))
+		}(tc.checksum)
+		err := new(Client).download(context.Background(), client, "a.avi", ioutil.Discard, nil, nil)
+		if !errors.Is(err, tc.err) || (tc.err == nil && err != nil) {
+			t.Errorf("Checksum %q: expected %v, got %v", tc.checksum, tc.err, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestDownloadChecksumMismatch(t *testing.T) {
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if _, err := recv(conn); err != nil {
+			return
+		}
+		send(conn, downloadChunk(2, 10, "a.avi", "helloworld"))
+		send(conn, endChunk(10, "a.avi", "00000000000000000000000000000000"))
+	})
+
+	if err := client.DownloadVideo(context.Background(), "a.avi", ioutil.Discard, nil); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Corrupted download should be checksum mismatch, got %v", err)
+	}
+}
+
+func TestDownloadErrors(t *testing.T) {
+	for name, chunks := range map[string][]LeweiCmd{
+		"wrong file":  {downloadChunk(1, 5, "b.avi", "")},
+		"incomplete":  {downloadChunk(2, 10, "a.avi", "hello"), downloadChunk(3, 10, "a.avi", "")},
+		"wrong type":  {downloadChunk(7, 10, "a.avi", "")},
+		"wrong reply": {chunk(liveStreamVideoCmd, nil, "")},
+	} {
+		client, server := tcpPair(t)
+		go func(chunks []LeweiCmd) {
+			for _, chunk := range chunks {
+				send(server, chunk)
+			}
+		}(chunks)
+		err := new(Client).download(context.Background(), client, "a.avi", ioutil.Discard, nil, nil)
+		if !errors.Is(err, ErrProtocol) {
+			t.Errorf("%s: expected protocol error, got %v", name, err)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestShortPayload(t *testing.T) {
+	photo := make([]byte, 32*4+4)
+	copy(photo, uint32ToByte([]uint32{100})) // declared 100B, only 4 present
+	truncated := downloadChunk(2, 10, "a.avi", "hello")
+	truncated.payload.Truncate(downloadHeaderSize + 3)
+	truncated.headerSet(lenI, downloadHeaderSize+3)
+
+	for name, parse := range map[string]func() error{
+		"photo header": func() error {
+			_, err := parsePhoto(make([]byte, 10), nil)
+			return err
+		},
+		"photo content": func() error {
+			_, err := parsePhoto(photo, nil)
+			return err
+		},
+		"video list": func() error {
+			_, err := parseVideoList(make([]byte, videoEntrySize-1), chinaZone)
+			return err
+		},
+		"replay chunk": func() error {
+			_, _, err := parseReplayChunk(make([]byte, 20))
+			return err
+		},
+		"stream chunk": func() error {
+			_, _, err := parseStreamChunk(make([]byte, 20))
+			return err
+		},
+		"download header": func() error {
+			client, server := tcpPair(t)
+			defer client.Close()
+			defer server.Close()
+			go send(server, chunk(videoDownloadCmd, nil, "short"))
+			return new(Client).download(context.Background(), client, "a.avi", ioutil.Discard, nil, nil)
+		},
+		"download content": func() error {
+			client, server := tcpPair(t)
+			defer client.Close()
+			defer server.Close()
+			go send(server, truncated)
+			return new(Client).download(context.Background(), client, "a.avi", ioutil.Discard, nil, nil)
+		},
+	} {
+		if err := parse(); !errors.Is(err, ErrShortPayload) || !errors.Is(err, ErrProtocol) {
+			t.Errorf("%s: expected ErrShortPayload, got %v", name, err)
+		}
+	}
+}
+
+func TestDownloadCancel(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		send(server, downloadChunk(2, 10, "a.avi", "hello"))
+		// the rest never comes
+	}()
+	err := new(Client).download(ctx, client, "a.avi", ioutil.Discard, nil, func(loaded, size int) {
+		cancel()
+	})
+	if err != context.Canceled {
+		t.Errorf("Canceled download should return context.Canceled, got %v", err)
+	}
+}
+
+func TestStreamEnd(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+
+	go func() {
+		send(server, NewLeweiCmd(keepAliveCmd))
+		send(server, chunk(liveStreamVideoCmd, []uint32{1, 5, 50}, "frame"))
+		send(server, chunk(liveStreamVideoCmd, []uint32{0, 5, 100}, "delta"))
+		server.Close()
+	}()
+
+	output := &bytes.Buffer{}
+	if err := new(Client).stream(client, output, nil); err != nil {
+		t.Errorf("Closed stream should end without error, got %v", err)
+	}
+	if output.String() != "framedelta" {
+		t.Errorf("Unexpected stream output %q", output.String())
+	}
+}
+
+func TestFrames(t *testing.T) {
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if _, err := recv(conn); err != nil {
+			return
+		}
+		send(conn, chunk(liveStreamVideoCmd, []uint32{1, 9, 50}, "\x00\x00\x00\x01frame"))
+		send(conn, chunk(liveStreamVideoCmd, []uint32{0, 9, 100}, "\x00\x00\x00\x01delta"))
+		recv(conn) // wait for cancel
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	frames, err := client.Frames(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Frame{
+		{Keyframe: true, Seq: 0, Timing: 50, NAL: []byte("\x00\x00\x00\x01frame")},
+		{Keyframe: false, Seq: 1, Timing: 100, NAL: []byte("\x00\x00\x00\x01delta")},
+	}
+	for _, exp := range expected {
+		frame, ok := <-frames
+		if !ok || frame.Keyframe != exp.Keyframe || frame.Seq != exp.Seq || frame.Timing != exp.Timing || !bytes.Equal(frame.NAL, exp.NAL) {
+			t.Errorf("Expected frame %+v, got %+v (%v)", exp, frame, ok)
+		}
+	}
+
+	cancel()
+	select {
+	case _, ok := <-frames:
+		if ok {
+			t.Errorf("No more frames expected")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Frames should be closed after cancel")
+	}
+}
+
+func TestStreamMJPEG(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	image1 := "\xff\xd8first\xff\xd9"
+	image2 := "\xff\xd8second\xff\xd9"
+	go func() {
+		send(server, chunk(liveStreamVideoCmd, []uint32{5, 8, 50}, image1[:8]))
+		send(server, chunk(liveStreamVideoCmd, []uint32{5, 10, 100}, image1[8:]+image2[:5]))
+		send(server, chunk(liveStreamVideoCmd, []uint32{5, 11, 150}, image2[5:]+"junk"))
+		send(server, chunk(liveStreamVideoCmd, []uint32{5, 0, 200}, ""))
+	}()
+
+	var frames []Frame
+	var last StreamStats
+	stats := &streamStats{onStats: func(s StreamStats) { last = s }, now: time.Now}
+	err := new(Client).streamFrames(client, func(frame Frame) {
+		stats.add(frame)
+		frames = append(frames, frame)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("Expected 2 JPEG frames, got %d", len(frames))
+	}
+	for i, expected := range []string{image1, image2} {
+		frame := frames[i]
+		if frame.Codec != CodecMJPEG || !frame.Keyframe || frame.NAL != nil || string(frame.JPEG) != expected || frame.Seq != uint16(i) {
+			t.Errorf("Frame %d should be JPEG %q, got %+v", i, expected, frame)
+		}
+	}
+	if frames[1].Timing != 150 {
+		t.Errorf("Frame should have timing of chunk which completed it, got %d", frames[1].Timing)
+	}
+	if last.Codec != CodecMJPEG || last.Frames != 2 || last.Bytes != len(image1+image2) {
+		t.Errorf("Stats should report MJPEG, got %+v", last)
+	}
+}
+
+func TestStreamMJPEGMidImage(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	image := "\xff\xd8first\xff\xd9"
+	go func() {
+		send(server, chunk(liveStreamVideoCmd, []uint32{5, 6, 50}, "tail\xff\xd9"))
+		send(server, chunk(liveStreamVideoCmd, []uint32{5, 9, 100}, image))
+		send(server, chunk(liveStreamVideoCmd, []uint32{5, 0, 150}, ""))
+	}()
+
+	var frames []Frame
+	if err := new(Client).streamFrames(client, func(frame Frame) { frames = append(frames, frame) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 1 || frames[0].Codec != CodecMJPEG || string(frames[0].JPEG) != image {
+		t.Errorf("Stream starting in the middle of image should be MJPEG with one image, got %+v", frames)
+	}
+}
+
+func TestStreamProtocolError(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	go send(server, chunk(liveStreamVideoCmd, []uint32{7, 9, 50}, "\x00\x00\x00\x01frame"))
+
+	if err := new(Client).stream(client, nil, nil); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Unknown chunk type should be protocol error, got %v", err)
+	}
+}
+
+func TestStreamConnectionError(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	client.SetDeadline(time.Now().Add(time.Second / 10)) // server will be silent
+
+	err := new(Client).stream(client, nil, nil)
+	if err == nil || errors.Is(err, ErrProtocol) {
+		t.Errorf("Timeout should be connection error, got %v", err)
+	}
+}
+
+func TestReplayEnd(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		send(server, chunk(videoReplayCmd, []uint32{1, 13, 0, 50}, "\x01\x00\x00\x00\x32\x00\x00\x00frame"))
+		send(server, chunk(videoReplayCmd, []uint32{0, 13, 0, 100}, "\x02\x00\x00\xff\x64\x00\x00\x00skip!"))
+		send(server, NewLeweiCmd(videoReplayEndCmd))
+	}()
+
+	output := &bytes.Buffer{}
+	if err := new(Client).replay(client, output, nil); err != nil {
+		t.Errorf("Replay should end without error, got %v", err)
+	}
+	if output.String() != "frame" {
+		t.Errorf("Unexpected replay output %q", output.String())
+	}
+}
+
+func TestVideoKeyframe(t *testing.T) {
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if _, err := recv(conn); err != nil {
+			return
+		}
+		send(conn, chunk(videoReplayCmd, []uint32{0, 13, 0, 50}, "\x01\x00\x00\x00\x32\x00\x00\x00delta"))
+		send(conn, chunk(videoReplayCmd, []uint32{1, 13, 0, 100}, "\x02\x00\x00\xff\x64\x00\x00\x00skip!"))
+		send(conn, chunk(videoReplayCmd, []uint32{1, 13, 0, 150}, "\x03\x00\x00\x00\x96\x00\x00\x00frame"))
+		send(conn, chunk(videoReplayCmd, []uint32{1, 13, 0, 200}, "\x04\x00\x00\x00\xc8\x00\x00\x00later"))
+		recv(conn) // until closed
+	})
+
+	keyframe, err := client.VideoKeyframe("test.avi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(keyframe.NAL) != "frame" || !keyframe.Keyframe || keyframe.Timing != 150 {
+		t.Errorf("First key frame expected, got %+v", keyframe)
+	}
+}
+
+func TestVideoKeyframeMissing(t *testing.T) {
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if _, err := recv(conn); err != nil {
+			return
+		}
+		send(conn, chunk(videoReplayCmd, []uint32{0, 13, 0, 50}, "\x01\x00\x00\x00\x32\x00\x00\x00delta"))
+		send(conn, NewLeweiCmd(videoReplayEndCmd))
+	})
+
+	if _, err := client.VideoKeyframe("test.avi"); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Video without key frame should be protocol error, got %v", err)
+	}
+}
+
+func TestCaptureOptions(t *testing.T) {
+	for _, tc := range []struct {
+		opts     CaptureOptions
+		expected []uint32
+	}{
+		{CaptureOptions{}, []uint32{on, 0, 0, 0, 0}},
+		{SegmentedCapture, []uint32{on, 4, 0, 24*60*60 - 1, 5 * 60}},
+		{CaptureOptions{SegmentLength: time.Minute}, []uint32{on, 4, 0, 24*60*60 - 1, 60}},
+		{CaptureOptions{MaxDuration: time.Hour}, []uint32{on, 4, 0, 60 * 60, 5 * 60}},
+	} {
+		if payload := tc.opts.payload(on); !reflect.DeepEqual(payload, tc.expected) {
+			t.Errorf("Options %+v should give payload %v, got %v", tc.opts, tc.expected, payload)
+		}
+	}
+}
+
+func TestStartVideoWithOptions(t *testing.T) {
+	sent := make(chan LeweiCmd, 1)
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		req, err := recv(conn)
+		if err != nil {
+			return
+		}
+		switch req.headerGet(cmdI) {
+		case checkVideoCmd:
+			res := NewLeweiCmd(checkVideoCmd)
+			res.AddPayload([]uint32{off})
+			send(conn, res)
+		case captureVideoCmd:
+			sent <- req
+			send(conn, NewLeweiCmd(captureVideoCmd))
+		}
+	})
+
+	if err := client.StartVideoWithOptions(CaptureOptions{MaxDuration: time.Hour, SegmentLength: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	req := <-sent
+	for i, expected := range []uint32{on, 4, 0, 60 * 60, 60} {
+		if value, ok := req.PayloadUint32(i); !ok || value != expected {
+			t.Errorf("Payload slot %d should be %d, got %d", i, expected, value)
+		}
+	}
+}
+
+func TestOnSegment(t *testing.T) {
+	defer func(poll time.Duration) { segmentPoll = poll }(segmentPoll)
+	segmentPoll = time.Millisecond * 10
+
+	var mu sync.Mutex
+	files := []string{"old.avi"}
+	capturing := uint32(off)
+	addFile := func(name string) {
+		mu.Lock()
+		files = append(files, name)
+		mu.Unlock()
+	}
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		for {
+			req, err := recv(conn)
+			if err != nil {
+				return
+			}
+			res := NewLeweiCmd(req.headerGet(cmdI))
+			mu.Lock()
+			switch req.headerGet(cmdI) {
+			case checkVideoCmd:
+				res.AddPayload([]uint32{capturing})
+			case captureVideoCmd:
+				capturing, _ = req.PayloadUint32(0)
+				if capturing == on {
+					files = append(files, "seg1.avi")
+				}
+			case listVideosCmd:
+				var list []byte
+				for _, name := range files {
+					list = append(list, videoEntry(60, name)...)
+				}
+				res.AddPayload(list)
+			}
+			mu.Unlock()
+			send(conn, res)
+		}
+	})
+	segments := make(chan string, 10)
+	client.OnSegment(func(fileName string) {
+		segments <- fileName
+	})
+
+	if err := client.StartVideo(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case name := <-segments:
+		t.Fatalf("Segment %s reported while still recorded", name)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	addFile("seg2.avi")
+	select {
+	case name := <-segments:
+		if name != "seg1.avi" {
+			t.Errorf("Finished segment should be seg1.avi, got %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Finished segment not reported")
+	}
+	addFile("seg3.avi")
+
+	if err := client.StopVideo(); err != nil {
+		t.Fatal(err)
+	}
+	close(segments)
+	var rest []string
+	for name := range segments {
+		rest = append(rest, name)
+	}
+	if len(rest) != 2 || rest[0] != "seg2.avi" || rest[1] != "seg3.avi" {
+		t.Errorf("Remaining segments should be [seg2.avi seg3.avi] after StopVideo, got %v", rest)
+	}
+}
+
+func TestIsCapturingCache(t *testing.T) {
+	var conns, requests int32
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		atomic.AddInt32(&conns, 1)
+		for {
+			req, err := recv(conn)
+			if err != nil {
+				return
+			}
+			switch req.headerGet(cmdI) {
+			case checkVideoCmd:
+				atomic.AddInt32(&requests, 1)
+				res := NewLeweiCmd(checkVideoCmd)
+				res.AddPayload([]uint32{on})
+				send(conn, res)
+			case takePhotoCmd:
+				send(conn, NewLeweiCmd(takePhotoCmd))
+			}
+		}
+	})
+
+	for i := 0; i < 10; i++ {
+		if capturing, err := client.IsCapturing(); err != nil || !capturing {
+			t.Fatalf("IsCapturing failed: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Calls within TTL should make one round-trip, made %d", n)
+	}
+
+	client.InvalidateStatus()
+	if _, err := client.IsCapturing(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Invalidated status should be fetched again, made %d round-trips", n)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Connection should be reused, opened %d", n)
+	}
+
+	// other operation on control port uses it and closes it (client is not connected)
+	client.Action(takePhotoCmd, nil, nil)
+	client.InvalidateStatus()
+	if _, err := client.IsCapturing(); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("Status connection should be reopened after other operation, opened %d", n)
+	}
+	client.Close()
+}
+
+func TestGetLocalIP(t *testing.T) {
+	defer func(orig func() ([]net.Addr, error)) { interfaceAddrs = orig }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		addrs := []net.Addr{&net.IPAddr{IP: net.IPv4(192, 168, 1, 2)}} // not IPNet
+		for _, cidr := range []string{
+			"127.0.0.1/8", "fe80::1/64", "10.0.0.5/8", "192.168.1.20/24", "192.168.1.7/24", "192.168.0.3/24",
+		} {
+			ip, ipNet, _ := net.ParseCIDR(cidr)
+			addrs = append(addrs, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+		}
+		return addrs, nil
+	}
+
+	for drone, expected := range map[string]string{
+		"192.168.1.1": "192.168.1.7",
+		"192.168.0.1": "192.168.0.3",
+		"10.1.2.3":    "10.0.0.5", // /8 mask
+		"172.16.0.1":  "<nil>",
+		"127.0.0.1":   "<nil>", // loopback skipped
+	} {
+		if ip := getLocalIP(net.ParseIP(drone)); ip.String() != expected {
+			t.Errorf("Local IP for drone %s should be %s, got %s", drone, expected, ip)
+		}
+	}
+}
+
+func TestProbe(t *testing.T) {
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		conn.Close()
+	})
+	if err := client.Probe(); err != nil {
+		t.Errorf("Listening drone should pass the probe, got %v", err)
+	}
+
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ControlPort = listener.Addr().(*net.TCPAddr).Port
+	listener.Close() // nobody listens on the port now
+	if err := client.Probe(); !errors.Is(err, ErrDroneNotResponding) {
+		t.Errorf("Drone without camera should be ErrDroneNotResponding, got %v", err)
+	}
+
+	defer func(orig func() ([]net.Addr, error)) { interfaceAddrs = orig }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		_, ipNet, _ := net.ParseCIDR("10.0.0.5/8")
+		return []net.Addr{ipNet}, nil
+	}
+	if err := client.Probe(); !errors.Is(err, ErrNotOnDroneNetwork) {
+		t.Errorf("Drone out of subnets of the system should be ErrNotOnDroneNetwork, got %v", err)
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	var last StreamStats
+	clock := time.Unix(0, 0)
+	stats := &streamStats{
+		onStats: func(s StreamStats) { last = s },
+		now:     func() time.Time { return clock },
+	}
+	// 2s of 20fps stream with 100B frames and key frame every 20th
+	for i := 0; i <= 40; i++ {
+		stats.add(Frame{Keyframe: i%20 == 0, NAL: make([]byte, 100)})
+		clock = clock.Add(time.Second / 20)
+	}
+	if last.Frames != 41 || last.Keyframes != 3 || last.Bytes != 4100 || last.Skipped != 0 {
+		t.Errorf("Wrong counters %+v", last)
+	}
+	if last.FPS != 20 || last.BytesPerSec != 2000 {
+		t.Errorf("Expected 20fps and 2000B/s, got %+v", last)
+	}
+	if last.KeyframeInterval != time.Second {
+		t.Errorf("Expected key frame every second, got %v", last.KeyframeInterval)
+	}
+}
+
+func TestReplayStats(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		send(server, chunk(videoReplayCmd, []uint32{1, 13, 0, 50}, "\x01\x00\x00\x00\x32\x00\x00\x00frame"))
+		send(server, chunk(videoReplayCmd, []uint32{0, 13, 0, 100}, "\x02\x00\x00\xff\x64\x00\x00\x00skip!"))
+		send(server, NewLeweiCmd(videoReplayEndCmd))
+	}()
+
+	var last StreamStats
+	c := NewClient(nil)
+	c.OnStats(func(s StreamStats) { last = s })
+	output := &bytes.Buffer{}
+	if err := c.replay(client, output, c.newStreamStats()); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "frame" {
+		t.Errorf("Stats should not change output, got %q", output.String())
+	}
+	if last.Frames != 2 || last.Keyframes != 1 || last.Skipped != 1 || last.Bytes != 5 {
+		t.Errorf("Wrong stats %+v", last)
+	}
+}
+
+// timedWriter records when was each write made
+type timedWriter struct {
+	times []time.Time
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	w.times = append(w.times, time.Now())
+	return len(p), nil
+}
+
+func TestReplayTiming(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		send(server, chunk(videoReplayCmd, []uint32{1, 13, 0, 65500}, "\x01\x00\x00\x00\xdc\xff\x00\x00frame"))
+		send(server, chunk(videoReplayCmd, []uint32{0, 13, 0, 64}, "\x02\x00\x00\x00\x40\x00\x00\x00delta")) // overflowed
+		send(server, chunk(videoReplayCmd, []uint32{0, 13, 0, 250}, "\x03\x00\x00\xff\xfa\x00\x00\x00skip!"))
+		send(server, chunk(videoReplayCmd, []uint32{0, 13, 0, 300}, "\x04\x00\x00\x00\x2c\x01\x00\x00delta"))
+		send(server, NewLeweiCmd(videoReplayEndCmd))
+	}()
+
+	output := &timedWriter{}
+	if err := new(Client).replay(client, output, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(output.times) != 3 {
+		t.Fatalf("Expected 3 frames, got %d", len(output.times))
+	}
+	for i, expected := range []time.Duration{100, 236} { // 65500 → 64 (+65536), 64 → 300
+		gap := output.times[i+1].Sub(output.times[i])
+		expected *= time.Millisecond
+		if gap < expected-time.Millisecond*5 || gap > expected+time.Millisecond*50 {
+			t.Errorf("Gap before frame %d should be %v, got %v", i+1, expected, gap)
+		}
+	}
+}
+
+func TestReplayWithoutOutput(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		send(server, chunk(videoReplayCmd, []uint32{1, 13, 0, 0}, "\x01\x00\x00\x00\x00\x00\x00\x00frame"))
+		send(server, chunk(videoReplayCmd, []uint32{0, 13, 0, 900}, "\x02\x00\x00\x00\x84\x03\x00\x00delta"))
+		send(server, NewLeweiCmd(videoReplayEndCmd))
+	}()
+
+	start := time.Now()
+	if err := new(Client).replay(client, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Millisecond*500 {
+		t.Errorf("Replay without output should not wait, took %v", elapsed)
+	}
+}
+
+func TestDeleteVideo(t *testing.T) {
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		req, err := recv(conn)
+		if err != nil || req.headerGet(cmdI) != deleteVideoCmd {
+			return
+		}
+		res := NewLeweiCmd(deleteVideoCmd)
+		switch name := strings.TrimRight(string(req.Payload()), "\x00"); name {
+		case "a.avi":
+			res.AddPayload([]uint32{1})
+		case "missing.avi":
+			res.AddPayload([]uint32{0})
+		case "weird.avi":
+			res.AddPayload([]uint32{7})
+		}
+		send(conn, res)
+	})
+
+	if err := client.DeleteVideo("a.avi"); err != nil {
+		t.Errorf("Delete should succeed, got %v", err)
+	}
+	if err := client.DeleteVideo("missing.avi"); !errors.Is(err, ErrFileNotFound) {
+		t.Errorf("Failed delete should be ErrFileNotFound, got %v", err)
+	}
+	if err := client.DeleteVideo("weird.avi"); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Unknown result should be protocol error, got %v", err)
+	}
+	if err := client.DeleteVideo("empty.avi"); err != nil {
+		t.Errorf("Empty response should be taken as success, got %v", err)
+	}
+}
+
+func TestConnect(t *testing.T) {
+	var conns int32
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		atomic.AddInt32(&conns, 1)
+		for {
+			req, err := recv(conn)
+			if err != nil {
+				return
+			}
+			res := NewLeweiCmd(req.headerGet(cmdI))
+			switch req.headerGet(cmdI) {
+			case keepAliveCmd:
+				continue
+			case checkVideoCmd:
+				res.AddPayload([]uint32{off})
+			case listVideosCmd:
+				res.AddPayload(videoEntry(10, "a.avi"))
+			case deleteVideoCmd:
+				res.AddPayload([]uint32{1})
+			}
+			send(conn, res)
+		}
+	})
+	client.KeepAliveInterval = time.Millisecond * 10
+
+	before := runtime.NumGoroutine()
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if videos, err := client.ListVideos(); err != nil || len(videos) != 1 {
+			t.Errorf("ListVideos failed: %v (%v)", videos, err)
+		}
+		if err := client.DeleteVideo("a.avi"); err != nil {
+			t.Errorf("DeleteVideo failed: %v", err)
+		}
+		client.InvalidateStatus()
+		if capturing, err := client.IsCapturing(); err != nil || capturing {
+			t.Errorf("IsCapturing failed: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Operations should reuse persistent connection, %d were opened", n)
+	}
+	client.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("Goroutines leaked: %d before, %d after", before, after)
+	}
+
+	// works without connection too
+	if _, err := client.ListVideos(); err != nil {
+		t.Errorf("ListVideos after Close failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("Operation after Close should open own connection, %d were opened in total", n)
+	}
+}
+
+func TestConnectReopen(t *testing.T) {
+	var conns int32
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if atomic.AddInt32(&conns, 1) == 1 {
+			return // first connection is closed by the drone
+		}
+		for {
+			req, err := recv(conn)
+			if err != nil {
+				return
+			}
+			if req.headerGet(cmdI) == listVideosCmd {
+				res := NewLeweiCmd(listVideosCmd)
+				res.AddPayload(videoEntry(10, "a.avi"))
+				send(conn, res)
+			}
+		}
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	time.Sleep(time.Millisecond * 20) // let the drone close it
+	if _, err := client.ListVideos(); err != nil {
+		t.Errorf("Closed connection should be reopened, got %v", err)
+	}
+}
+
+func TestConnectControlOnly(t *testing.T) {
+	var streamConns int32
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		io.Copy(ioutil.Discard, conn)
+	})
+	client.StreamPort = fakeServer(t, func(conn *net.TCPConn) {
+		atomic.AddInt32(&streamConns, 1)
+		conn.Close()
+	}).StreamPort
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	time.Sleep(time.Millisecond * 20)
+	if n := atomic.LoadInt32(&streamConns); n != 0 {
+		t.Errorf("Stream port should not be kept, %d connections were opened", n)
+	}
+}
+
+func TestConnectRetry(t *testing.T) {
+	var photos, lists int32
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		for {
+			req, err := recv(conn)
+			if err != nil {
+				return
+			}
+			switch req.headerGet(cmdI) {
+			case takePhotoCmd:
+				if atomic.AddInt32(&photos, 1) == 1 {
+					return // photo taken, but the response is lost
+				}
+				send(conn, NewLeweiCmd(takePhotoCmd))
+			case listVideosCmd:
+				if atomic.AddInt32(&lists, 1) == 1 {
+					return
+				}
+				res := NewLeweiCmd(listVideosCmd)
+				res.AddPayload(videoEntry(10, "a.avi"))
+				send(conn, res)
+			}
+		}
+	})
+	if err := client.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if videos, err := client.ListVideos(); err != nil || len(videos) != 1 {
+		t.Errorf("Listing is safe to repeat, got %v (%v)", videos, err)
+	}
+	if n := atomic.LoadInt32(&lists); n != 2 {
+		t.Errorf("Listing should be repeated once, sent %d", n)
+	}
+	if err := client.Action(takePhotoCmd, nil, nil); err == nil {
+		t.Errorf("Photo without response should fail")
+	}
+	if n := atomic.LoadInt32(&photos); n != 1 {
+		t.Errorf("Photo should not be taken again when the request was sent, taken %d", n)
+	}
+
+	if !canRepeat(takePhotoCmd, notSentError{io.ErrClosedPipe}) {
+		t.Errorf("Request which was not sent should be repeatable")
+	}
+	if canRepeat(deleteVideoCmd, io.EOF) || !canRepeat(checkVideoCmd, io.EOF) || canRepeat(listVideosCmd, ErrProtocol) {
+		t.Errorf("Only requests safe to repeat should be repeated after they were sent")
+	}
+}
+
+func TestLeweiCmdMarshal(t *testing.T) {
+	cmd := NewLeweiCmd(listVideosCmd)
+	cmd.headerSet(valI, 7)
+	cmd.AddPayload([]uint32{1, 2})
+	cmd.AddPayload("name")
+	data, err := cmd.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 46+12 {
+		t.Errorf("Unexpected length %d", len(data))
+	}
+	restored := LeweiCmd{}
+	if err := restored.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if restored.Fields() != cmd.Fields() || !bytes.Equal(restored.Payload(), cmd.Payload()) {
+		t.Errorf("Round-trip changed command:\n%s\n%s", cmd.Inspect(), restored.Inspect())
+	}
+	buf := &bytes.Buffer{}
+	if _, err := restored.WriteTo(buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("WriteTo wrote % x (%v)", buf.Bytes(), err)
+	}
+
+	if err := restored.UnmarshalBinary(data[:50]); !errors.Is(err, ErrShortPayload) {
+		t.Errorf("Truncated payload should be ErrShortPayload, got %v", err)
+	}
+	if err := restored.UnmarshalBinary(append(data, 0)); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Extra byte should be protocol error, got %v", err)
+	}
+	broken := append([]byte(nil), data...)
+	broken[0] = 'L'
+	if err := restored.UnmarshalBinary(broken); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("Wrong prefix should be ErrBadHeader, got %v", err)
+	}
+}
+
+func TestFifo(t *testing.T) {
+	queue := fifo{}
+	running := int32(0)
+	order := make(chan int, 10)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 10; i++ {
+		i := i
+		wg.Add(1)
+		go queue.do(func() {
+			defer wg.Done()
+			if atomic.AddInt32(&running, 1) != 1 {
+				t.Errorf("Queued functions overlap")
+			}
+			time.Sleep(time.Millisecond * 5)
+			order <- i
+			atomic.AddInt32(&running, -1)
+		})
+		time.Sleep(time.Millisecond) // let it queue
+	}
+	wg.Wait()
+	close(order)
+
+	expected := 0
+	for i := range order {
+		if i != expected {
+			t.Errorf("Queued function %d run as %d.", i, expected)
+		}
+		expected++
+	}
+}
+
+func TestAtomicFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vtx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "video.avi")
+
+	file, err := createAtomic(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte("partial"))
+	file.Discard()
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Discarded file should leave nothing behind, found %v", files[0].Name())
+	}
+
+	if err := writeFileAtomic(name, []byte("complete")); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(name); string(content) != "complete" {
+		t.Errorf("Commited file has wrong content %q", content)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Temporary file should be renamed, found %d files", len(files))
+	}
+
+	taken := filepath.Join(dir, "taken")
+	os.MkdirAll(filepath.Join(taken, "sub"), 0777) // non-empty dir can't be replaced by rename
+	if err := writeFileAtomic(taken, []byte("lost")); err == nil {
+		t.Errorf("Rename over directory should fail")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 2 {
+		t.Errorf("Failed rename should leave no temporary file, found %d files", len(files))
+	}
+}
+
+func TestHeaderByteOrder(t *testing.T) {
+	cmd := NewLeweiCmd(0x01020304)
+	cmd.headerSet(valI, 0x0a0b0c0d)
+	cmd.AddPayload([]uint32{0x11223344})
+
+	if string(cmd.header[:10]) != "lewei_cmd\x00" {
+		t.Errorf("Wrong header prefix %q", cmd.header[:10])
+	}
+	expected := map[uint][]byte{
+		cmdI: {0x04, 0x03, 0x02, 0x01},
+		valI: {0x0d, 0x0c, 0x0b, 0x0a},
+		lenI: {0x04, 0x00, 0x00, 0x00},
+	}
+	for index, b := range expected {
+		if got := cmd.header[10+index*4 : 10+index*4+4]; !bytes.Equal(got, b) {
+			t.Errorf("Header field %d should be little endian % x, is % x", index, b, got)
+		}
+	}
+	if got := cmd.payload.Bytes(); !bytes.Equal(got, []byte{0x44, 0x33, 0x22, 0x11}) {
+		t.Errorf("Payload should be little endian, is % x", got)
+	}
+	if cmd.headerGet(cmdI) != 0x01020304 || cmd.headerGet(valI) != 0x0a0b0c0d {
+		t.Errorf("headerGet does not match headerSet (%s)", cmd.String())
+	}
+}
+
+func TestByteToUint(t *testing.T) {
+	data := []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09}
+
+	data16 := byteToUint16(data)
+	if len(data16) != 4 || data16[0] != 0x0201 || data16[3] != 0x0807 {
+		t.Errorf("Wrong uint16 decoding %#x", data16)
+	}
+	data32 := byteToUint32(data)
+	if len(data32) != 2 || data32[0] != 0x04030201 || data32[1] != 0x08070605 {
+		t.Errorf("Wrong uint32 decoding %#x", data32)
+	}
+
+	// misaligned data
+	if data32 := byteToUint32(data[1:]); len(data32) != 2 || data32[0] != 0x05040302 {
+		t.Errorf("Wrong misaligned uint32 decoding %#x", data32)
+	}
+	if data16 := byteToUint16(data[1:]); len(data16) != 4 || data16[0] != 0x0302 {
+		t.Errorf("Wrong misaligned uint16 decoding %#x", data16)
+	}
+
+	// header of replay chunk as captured from the drone
+	chunkHeader := []byte{0x01, 0, 0, 0, 0x32, 0x5a, 0, 0, 0, 0, 0, 0, 0x96, 0, 0, 0}
+	if data32 := byteToUint32(chunkHeader); data32[0] != 1 || data32[1] != 0x5a32 || data32[3] != 150 {
+		t.Errorf("Wrong chunk header decoding %v", data32)
+	}
+}
+
+func TestPayloadUint32(t *testing.T) {
+	cmd := NewLeweiCmd(checkVideoCmd)
+	cmd.AddPayload([]uint32{on, 0x01020304})
+	if value, ok := cmd.PayloadUint32(1); !ok || value != 0x01020304 {
+		t.Errorf("Wrong payload number %#x", value)
+	}
+	if _, ok := cmd.PayloadUint32(2); ok {
+		t.Errorf("Reading over the payload should not be ok")
+	}
+}
+
+func TestOutputPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vtx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client := NewClient(nil)
+	if path, _ := client.outputPath("", "/mnt/sd/photo.jpg"); path != "photo.jpg" {
+		t.Errorf("Default output should be current dir, got %s", path)
+	}
+
+	client.OutputDir = filepath.Join(dir, "media")
+	path, err := client.outputPath("", "/mnt/sd/photo.jpg")
+	if err != nil || path != filepath.Join(dir, "media", "photo.jpg") {
+		t.Errorf("Output dir not used, got %s, %v", path, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "media")); err != nil {
+		t.Errorf("Output dir not created: %v", err)
+	}
+
+	path, _ = client.outputPath(filepath.Join(dir, "other"), "/mnt/sd/photo.jpg")
+	if path != filepath.Join(dir, "other", "photo.jpg") {
+		t.Errorf("Per call dir should override output dir, got %s", path)
+	}
+}
+
+func TestCommandBuilder(t *testing.T) {
+	cmd := NewCommand(0x0003).SetField(1, 7).SetField(9, 1).Payload([]uint32{1, 2}).Payload("ab").Build()
+
+	fields := cmd.Fields()
+	if fields[cmdI] != 0x0003 || fields[valI] != 7 || fields[lenI] != 10 {
+		t.Errorf("Wrong header fields %v", fields)
+	}
+	if !bytes.Equal(cmd.Payload(), []byte{1, 0, 0, 0, 2, 0, 0, 0, 'a', 'b'}) {
+		t.Errorf("Wrong payload % x", cmd.Payload())
+	}
+	if inspect := cmd.Inspect(); !strings.Contains(inspect, "field 8:") || !strings.Contains(inspect, "payload (10B)") {
+		t.Errorf("Incomplete inspection:\n%s", inspect)
+	}
+}
+
+// recordingLogger keeps logged messages as "level msg"
+type recordingLogger struct {
+	sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) add(level, msg string) {
+	l.Lock()
+	l.lines = append(l.lines, level+" "+msg)
+	l.Unlock()
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.add("debug", msg) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.add("info", msg) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.add("warn", msg) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.add("error", msg) }
+
+func (l *recordingLogger) has(line string) bool {
+	l.Lock()
+	defer l.Unlock()
+	for _, logged := range l.lines {
+		if logged == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestKeepAliveLogger(t *testing.T) {
+	client, server := tcpPair(t)
+	logger := &recordingLogger{}
+	stop := keepAlive(client, time.Millisecond*10, logger)
+	defer stop()
+
+	deadline := time.Now().Add(time.Second)
+	for !logger.has("debug keepalive") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if !logger.has("debug keepalive") {
+		t.Fatalf("Keepalive should be logged at debug level, got %q", logger.lines)
+	}
+
+	server.Close()
+	client.CloseWrite() // so next keepalive fails
+	deadline = time.Now().Add(time.Second)
+	for !logger.has("warn keepalive failed") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+	if !logger.has("warn keepalive failed") {
+		t.Errorf("Failed keepalive should be logged as warning, got %q", logger.lines)
+	}
+}
+
+func TestLoggerNil(t *testing.T) {
+	client := NewClient(net.IPv4(127, 0, 0, 1))
+	client.log().Debug("nowhere") // must not panic
+	logger := &recordingLogger{}
+	client.Logger = logger
+	client.log().Debug("somewhere")
+	if !logger.has("debug somewhere") {
+		t.Errorf("Logger of the client should be used, got %q", logger.lines)
+	}
+}
+
+// spsNAL encodes SPS NAL with given header bytes and fields given as bits ("0101") or ue codes (int)
+func spsNAL(header string, fields ...interface{}) []byte {
+	bits := ""
+	for _, field := range fields {
+		switch f := field.(type) {
+		case string:
+			bits += f
+		case int:
+			code := strconv.FormatUint(uint64(f)+1, 2)
+			bits += strings.Repeat("0", len(code)-1) + code
+		}
+	}
+	bits += "1" // stop bit
+	for len(bits)%8 != 0 {
+		bits += "0"
+	}
+	nal := []byte(header)
+	for i := 0; i < len(bits); i += 8 {
+		b, _ := strconv.ParseUint(bits[i:i+8], 2, 8)
+		nal = append(nal, byte(b))
+	}
+	return nal
+}
+
+// baselineSPS is SPS of 640x480 video
+var baselineSPS = spsNAL("\x67\x42\xc0\x1e",
+	0, 0, 2, 1, "0", // id, frame num, poc type, refs, gaps
+	39, 29, "1", "1", "0", // size in macroblocks, frame only, direct 8x8, no cropping
+	"0", // no vui
+)
+
+func TestParseSPS(t *testing.T) {
+	highSPS := spsNAL("\x67\x64\x00\x28",
+		0, 1, 0, 0, "0", // id, chroma 4:2:0, bit depths, qpprime
+		"1", "1", 16, "0000000", // scaling matrix with first list ended by delta -8
+		0, 0, 2, 4, "0", // frame num, poc type 0 with lsb, refs, gaps
+		119, 67, "1", "1", // size in macroblocks, frame only, direct 8x8
+		"1", 0, 0, 0, 4, // cropping of 8 rows
+		"0", // no vui
+	)
+	for _, tc := range []struct {
+		sps           []byte
+		width, height int
+	}{
+		{baselineSPS, 640, 480},
+		{highSPS, 1920, 1080},
+	} {
+		width, height, err := parseSPS(tc.sps)
+		if err != nil || width != tc.width || height != tc.height {
+			t.Errorf("SPS % x should be %dx%d, got %dx%d (%v)", tc.sps, tc.width, tc.height, width, height, err)
+		}
+	}
+	if _, _, err := parseSPS([]byte("\x67\x42\xc0\x1e")); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Truncated SPS should be protocol error, got %v", err)
+	}
+	if rbsp := unescapeRBSP([]byte{1, 0, 0, 3, 1, 0, 0, 3}); !bytes.Equal(rbsp, []byte{1, 0, 0, 1, 0, 0}) {
+		t.Errorf("Emulation prevention bytes should be removed, got % x", rbsp)
+	}
+}
+
+func TestSplitNALs(t *testing.T) {
+	nals := splitNALs([]byte("\x00\x00\x00\x01\x67sps\x00\x00\x01\x68pps\x00\x00\x00\x01\x65idr"))
+	if len(nals) != 3 || string(nals[0]) != "\x67sps" || string(nals[1]) != "\x68pps" || string(nals[2]) != "\x65idr" {
+		t.Errorf("NALs should be split by both start codes, got %q", nals)
+	}
+}
+
+// mp4Box finds content of box by path of types, eg. "moov/trak/tkhd"
+func mp4Box(data []byte, path string) []byte {
+	typ := path
+	rest := ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		typ, rest = path[:i], path[i+1:]
+	}
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return nil
+		}
+		if string(data[4:8]) == typ {
+			if rest == "" {
+				return data[8:size]
+			}
+			return mp4Box(data[8:size], rest)
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// replayFrameChunk creates replay chunk of frame with given timing
+func replayFrameChunk(key bool, timing uint32, nal string) LeweiCmd {
+	typ := uint32(0)
+	if key {
+		typ = 1
+	}
+	content := string(uint32ToByte([]uint32{1, timing})) + nal
+	return chunk(videoReplayCmd, []uint32{typ, uint32(len(content)), 0, timing}, content)
+}
+
+// readBox reads next mp4 box from stream
+func readBox(r io.Reader) (typ string, content []byte, err error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", nil, err
+	}
+	content = make([]byte, binary.BigEndian.Uint32(header)-8)
+	_, err = io.ReadFull(r, content)
+	return string(header[4:]), content, err
+}
+
+func TestFragmentWriter(t *testing.T) {
+	keyframe := "\x00\x00\x00\x01" + string(baselineSPS) + "\x00\x00\x00\x01\x68pps\x00\x00\x00\x01\x65idr"
+	output := &bytes.Buffer{}
+	mp4 := &fragmentWriter{w: output}
+	for _, frame := range []Frame{
+		{Timing: 0, NAL: []byte("\x00\x00\x00\x01\x41lost")}, // before key frame
+		{Timing: 50, NAL: []byte(keyframe)},
+		{Timing: 100, NAL: []byte("\x00\x00\x00\x01\x41p1")},
+		{Timing: 200, NAL: []byte("\x00\x00\x00\x01\x41p2")},
+	} {
+		if err := mp4.writeFrame(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := output.Bytes()
+	if typ, _, _ := readBox(bytes.NewReader(data)); typ != "ftyp" {
+		t.Errorf("Stream should start by ftyp, got %q", typ)
+	}
+	if trex := mp4Box(data, "moov/mvex/trex"); len(trex) < 8 || binary.BigEndian.Uint32(trex[4:]) != 1 {
+		t.Errorf("Init segment should have trex of track 1, got % x", trex)
+	}
+	avcC := mp4Box(data[bytes.Index(data, []byte("avcC"))-4:], "avcC")
+	if !bytes.Contains(avcC, baselineSPS) || !bytes.HasSuffix(avcC, []byte("\x00\x04\x68pps")) {
+		t.Errorf("avcC should contain SPS and PPS, got % x", avcC)
+	}
+
+	fragments := data[bytes.Index(data, []byte("moof"))-4:]
+	for i, expected := range []struct {
+		time   uint32
+		flags  uint32
+		sample string
+	}{
+		{0, 0x02000000, "\x00\x00\x00\x04\x65idr"},
+		{50, 0x01010000, "\x00\x00\x00\x03\x41p1"},
+		{150, 0x01010000, "\x00\x00\x00\x03\x41p2"},
+	} {
+		moof := mp4Box(fragments, "moof")
+		if moof == nil {
+			t.Fatalf("Fragment %d is missing", i)
+		}
+		mfhd := byteToUint32BE(mp4Box(moof, "mfhd"))
+		tfdt := byteToUint32BE(mp4Box(moof, "traf/tfdt"))
+		trun := byteToUint32BE(mp4Box(moof, "traf/trun")) // flags, count, offset, duration, size, sample flags
+		if len(mfhd) != 2 || mfhd[1] != uint32(i+1) {
+			t.Errorf("Fragment %d should have sequence number %d, got %v", i, i+1, mfhd)
+		}
+		if len(tfdt) != 3 || tfdt[2] != expected.time {
+			t.Errorf("Fragment %d should be at %dms, got %v", i, expected.time, tfdt)
+		}
+		if len(trun) != 6 || trun[1] != 1 || trun[4] != uint32(len(expected.sample)) || trun[5] != expected.flags {
+			t.Errorf("Fragment %d has unexpected trun %v", i, trun)
+			continue
+		}
+		if sample := fragments[trun[2]:]; !bytes.HasPrefix(sample, []byte(expected.sample)) {
+			t.Errorf("Data offset of fragment %d should point to its sample, got %q", i, sample)
+		}
+		if mdat := mp4Box(fragments[len(moof)+8:], "mdat"); string(mdat) != expected.sample {
+			t.Errorf("Fragment %d should have sample %q, got %q", i, expected.sample, mdat)
+		}
+		fragments = fragments[len(moof)+8+len(expected.sample)+8:]
+	}
+	if len(fragments) != 0 {
+		t.Errorf("Unexpected data after fragments %q", fragments)
+	}
+}
+
+func TestSaveMP4(t *testing.T) {
+	keyframe := "\x00\x00\x00\x01" + string(baselineSPS) + "\x00\x00\x00\x01\x68pps\x00\x00\x00\x01\x65idr"
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if _, err := recv(conn); err != nil {
+			return
+		}
+		send(conn, replayFrameChunk(false, 0, "\x00\x00\x00\x01\x41lost")) // before key frame
+		send(conn, replayFrameChunk(true, 50, keyframe))
+		send(conn, replayFrameChunk(false, 100, "\x00\x00\x00\x01\x41p1"))
+		send(conn, chunk(videoReplayCmd, []uint32{0, 13, 0, 150}, "\x02\x00\x00\xff\x96\x00\x00\x00skip!"))
+		send(conn, replayFrameChunk(false, 200, "\x00\x00\x00\x01\x41p2"))
+		send(conn, NewLeweiCmd(videoReplayEndCmd))
+	})
+	dir, err := ioutil.TempDir("", "vtx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "video.mp4")
+
+	if err := client.SaveMP4("test.avi", path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := "\x00\x00\x00\x04\x65idr" + "\x00\x00\x00\x03\x41p1" + "\x00\x00\x00\x03\x41p2"
+	if mdat := mp4Box(data, "mdat"); string(mdat) != samples {
+		t.Errorf("Samples should be length prefixed NALs without SPS and PPS, got %q", mdat)
+	}
+	stbl := "moov/trak/mdia/minf/stbl/"
+	for _, tc := range []struct {
+		box      string
+		expected []uint32 // after version and flags
+	}{
+		{stbl + "stsz", []uint32{0, 3, 8, 7, 7}},
+		{stbl + "stts", []uint32{3, 1, 50, 1, 100, 1, 50}}, // last one has default duration
+		{stbl + "stss", []uint32{1, 1}},
+		{stbl + "stco", []uint32{1, uint32(bytes.Index(data, []byte(samples)))}},
+	} {
+		content := mp4Box(data, tc.box)
+		if content == nil {
+			t.Errorf("Box %s is missing", tc.box)
+			continue
+		}
+		if values := byteToUint32BE(content[4:]); !reflect.DeepEqual(values, tc.expected) {
+			t.Errorf("Box %s should contain %v, got %v", tc.box, tc.expected, values)
+		}
+	}
+	tkhd := mp4Box(data, "moov/trak/tkhd")
+	if len(tkhd) < 84 || binary.BigEndian.Uint32(tkhd[76:]) != 640<<16 || binary.BigEndian.Uint32(tkhd[80:]) != 480<<16 {
+		t.Errorf("Track should have size from SPS, got % x", tkhd)
+	}
+	if mvhd := mp4Box(data, "moov/mvhd"); len(mvhd) < 20 || binary.BigEndian.Uint32(mvhd[16:]) != 200 {
+		t.Errorf("Duration should be 200ms, got % x", mvhd)
+	}
+	avcC := mp4Box(data[bytes.Index(data, []byte("avcC"))-4:], "avcC")
+	if !bytes.Contains(avcC, baselineSPS) || !bytes.HasSuffix(avcC, []byte("\x00\x04\x68pps")) {
+		t.Errorf("avcC should contain SPS and PPS, got % x", avcC)
+	}
+}
+
+func TestSaveMP4NoKeyframe(t *testing.T) {
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if _, err := recv(conn); err != nil {
+			return
+		}
+		send(conn, replayFrameChunk(false, 0, "\x00\x00\x00\x01\x41p1"))
+		send(conn, NewLeweiCmd(videoReplayEndCmd))
+	})
+	dir, err := ioutil.TempDir("", "vtx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "video.mp4")
+
+	if err := client.SaveMP4("test.avi", path); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Video without key frame should be protocol error, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("No file should be left, got %d", len(files))
+	}
+}
+
+func TestReplayVideoToFile(t *testing.T) {
+	var broken int32
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		if _, err := recv(conn); err != nil {
+			return
+		}
+		send(conn, replayFrameChunk(true, 0, "\x00\x00\x00\x01\x65key"))
+		if atomic.LoadInt32(&broken) != 0 {
+			send(conn, NewLeweiCmd(takePhotoCmd))
+			return
+		}
+		send(conn, replayFrameChunk(false, 50, "\x00\x00\x00\x01\x41p1"))
+		send(conn, NewLeweiCmd(videoReplayEndCmd))
+	})
+	dir, err := ioutil.TempDir("", "vtx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client.OutputDir = dir
+
+	path, err := client.ReplayVideoToFile("/sdcard/test.avi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(path) != dir || !strings.HasPrefix(filepath.Base(path), "test_") || filepath.Ext(path) != ".h264" {
+		t.Errorf("Unexpected output path %s", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "\x00\x00\x00\x01\x65key\x00\x00\x00\x01\x41p1"; string(data) != expected {
+		t.Errorf("File should contain the stream, got %q", data)
+	}
+	os.Remove(path)
+
+	atomic.StoreInt32(&broken, 1)
+	if _, err := client.ReplayVideoToFile("test.avi"); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Broken replay should fail with protocol error, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("Failed replay should leave no file, found %d", len(files))
+	}
+}
+
+// byteToUint32BE decodes big endian uint32s
+func byteToUint32BE(data []byte) []uint32 {
+	values := make([]uint32, len(data)/4)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint32(data[4*i:])
+	}
+	return values
+}
+
+func TestActionContext(t *testing.T) {
+	requests := make(chan bool, 10)
+	client := fakeServer(t, func(conn *net.TCPConn) {
+		defer conn.Close()
+		for {
+			if _, err := recv(conn); err != nil {
+				return
+			}
+			requests <- true // and never respond
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requests
+		cancel()
+	}()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.ActionContext(ctx, takePhotoCmd, nil, func([]byte) {
+			t.Errorf("Callback should not be called")
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Canceled action should return context.Canceled, got %v", err)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatalf("Canceled action should return")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	if err := client.ActionContext(ctx, takePhotoCmd, nil, nil); err != context.DeadlineExceeded {
+		t.Errorf("Timed out action should return context.DeadlineExceeded, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := client.ActionContext(ctx, takePhotoCmd, nil, nil); err != context.Canceled {
+		t.Errorf("Action canceled before dial should return context.Canceled, got %v", err)
+	}
+
+	// port is busy by other operation
+	for len(requests) > 0 {
+		<-requests
+	}
+	if err := client.acquirePort(context.Background(), client.ControlPort); err != nil {
+		t.Fatal(err)
+	}
+	defer client.releasePort(client.ControlPort)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond*20, cancel)
+	start := time.Now()
+	if err := client.ActionContext(ctx, takePhotoCmd, nil, nil); err != context.Canceled {
+		t.Errorf("Action canceled while waiting for the port should return context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Action should stop waiting for the port when canceled, took %v", elapsed)
+	}
+	select {
+	case <-requests:
+		t.Errorf("Action should not send the request when the port was busy")
+	default:
 	}
 }
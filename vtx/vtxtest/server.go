@@ -0,0 +1,445 @@
+// Package vtxtest provides fake drone for testing code which uses vtx, without the real drone
+//
+// The server speaks the LeweiCmd protocol over TCP like the camera of the drone does:
+// it answers keepalives, takes canned photos, records, lists, deletes, downloads and replays videos.
+// Point the client to it:
+//
+//	srv := vtxtest.NewServer()
+//	defer srv.Close()
+//	client := vtx.NewClient(srv.IP)
+//	client.ControlPort, client.StreamPort = srv.ControlPort, srv.StreamPort
+//
+// It implements the wire format on its own (it does not import vtx), so tests of vtx itself can use it too.
+package vtxtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// commands of the protocol (first number of the header)
+const (
+	keepAliveCmd      = 0x0001
+	setClockCmd       = 0x0004
+	checkVideoCmd     = 0x0006
+	listVideosCmd     = 0x0008
+	replayVideoCmd    = 0x0009
+	captureVideoCmd   = 0x0011
+	downloadVideoCmd  = 0x0012
+	takePhotoCmd      = 0x0013
+	deleteVideoCmd    = 0x0014
+	videoReplayCmd    = 0x0103
+	videoReplayEndCmd = 0x0105
+	videoDownloadCmd  = 0x0106
+)
+
+// headerMagic starts header of every LeweiCmd, it is followed by 9 × uint32 (little endian)
+const headerMagic = "lewei_cmd\x00"
+
+// sizes of parts of the packets
+const (
+	headerSize         = len(headerMagic) + 9*4
+	photoHeaderSize    = 32 * 4
+	videoEntrySize     = 116
+	downloadHeaderSize = 196
+	replayHeaderSize   = 32
+	downloadChunkSize  = 30 << 10 // as in request_video_file_download.pcapng
+)
+
+// DefaultPhoto is the smallest jpeg (only start and end of image markers), used when Server.Photo is not set
+var DefaultPhoto = []byte{0xff, 0xd8, 0xff, 0xd9}
+
+// DefaultFootage is H.264 of videos recorded by the server (key frame and two delta frames)
+var DefaultFootage = [][]byte{
+	[]byte("\x00\x00\x00\x01\x67\x42\x00\x1e\x00\x00\x00\x01\x68\xce\x00\x00\x00\x01\x65idr"),
+	[]byte("\x00\x00\x00\x01\x41p1"),
+	[]byte("\x00\x00\x00\x01\x41p2"),
+}
+
+// Video is video file on sd card of the fake drone
+type Video struct {
+	Name      string
+	Duration  uint32   // in seconds
+	Timestamp uint32   // creation time as stored by the drone
+	Frames    [][]byte // H.264 NAL units of the replay, 20fps, every 40th (from the first) is key frame
+	Content   []byte   // downloaded file (nil = Frames joined together)
+}
+
+// content returns bytes of downloaded file
+func (v *Video) content() []byte {
+	if v.Content != nil {
+		return v.Content
+	}
+	return bytes.Join(v.Frames, nil)
+}
+
+// Server is fake drone listening on localhost
+//
+// Set Photo and Footage before the client uses it, videos can be added by AddVideo any time.
+type Server struct {
+	IP          net.IP // always 127.0.0.1
+	ControlPort int    // for photos, capturing and listing videos (8060 of the drone)
+	StreamPort  int    // for downloading and replaying videos (7060 of the drone)
+
+	Photo   []byte   // content of every taken photo (nil = DefaultPhoto)
+	Footage [][]byte // frames of every recorded video (nil = DefaultFootage)
+
+	control *net.TCPListener
+	stream  *net.TCPListener
+	wg      sync.WaitGroup
+
+	mu        sync.Mutex
+	conns     map[*net.TCPConn]bool
+	videos    []Video
+	photos    int
+	capturing time.Time // zero when not capturing
+	requests  []uint32
+	closed    bool
+}
+
+// NewServer starts fake drone on random localhost ports, it panics when it can't listen
+func NewServer() *Server {
+	s := &Server{
+		IP:    net.IPv4(127, 0, 0, 1),
+		conns: map[*net.TCPConn]bool{},
+	}
+	s.control = s.listen()
+	s.stream = s.listen()
+	s.ControlPort = s.control.Addr().(*net.TCPAddr).Port
+	s.StreamPort = s.stream.Addr().(*net.TCPAddr).Port
+	return s
+}
+
+// listen accepts connections on new port until Close
+func (s *Server) listen() *net.TCPListener {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: s.IP})
+	if err != nil {
+		panic(fmt.Sprintf("vtxtest: failed to listen: %v", err))
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				conn.Close()
+				return
+			}
+			s.conns[conn] = true
+			s.wg.Add(1)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return listener
+}
+
+// Close stops the server, closes all connections and waits until they are done
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.control.Close()
+	s.stream.Close()
+	s.wg.Wait()
+}
+
+// AddVideo puts video on the sd card
+func (s *Server) AddVideo(video Video) {
+	s.mu.Lock()
+	s.videos = append(s.videos, video)
+	s.mu.Unlock()
+}
+
+// Videos returns videos on the sd card, in order they were created
+func (s *Server) Videos() []Video {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Video(nil), s.videos...)
+}
+
+// Capturing says whether video is being recorded
+func (s *Server) Capturing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.capturing.IsZero()
+}
+
+// Requests returns commands received so far (but keepalives), in order they came
+func (s *Server) Requests() []uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]uint32(nil), s.requests...)
+}
+
+// serve answers requests over conn until it is closed
+func (s *Server) serve(conn *net.TCPConn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		cmd, payload, err := readCmd(conn)
+		if err != nil {
+			return
+		}
+		if cmd != keepAliveCmd {
+			s.mu.Lock()
+			s.requests = append(s.requests, cmd)
+			s.mu.Unlock()
+		}
+		if err := s.handle(conn, cmd, payload); err != nil {
+			return
+		}
+	}
+}
+
+// handle writes response to the request
+func (s *Server) handle(w io.Writer, cmd uint32, payload []byte) error {
+	switch cmd {
+	case keepAliveCmd, setClockCmd:
+		return writeCmd(w, cmd, payload)
+	case checkVideoCmd:
+		return writeCmd(w, cmd, uint32s(boolToUint32(s.Capturing())))
+	case listVideosCmd:
+		return writeCmd(w, cmd, s.videoList())
+	case captureVideoCmd:
+		if len(payload) < 4 {
+			return errors.New("vtxtest: short capture request")
+		}
+		s.capture(binary.LittleEndian.Uint32(payload) == 1)
+		return writeCmd(w, cmd, nil)
+	case takePhotoCmd:
+		return writeCmd(w, cmd, s.takePhoto())
+	case deleteVideoCmd:
+		return writeCmd(w, cmd, uint32s(boolToUint32(s.deleteVideo(cString(payload)))))
+	case downloadVideoCmd:
+		if len(payload) < downloadHeaderSize {
+			return errors.New("vtxtest: short download request")
+		}
+		offset := int(binary.LittleEndian.Uint32(payload[1*4:]))
+		return s.download(w, cString(payload[4*4:]), offset)
+	case replayVideoCmd:
+		return s.replay(w, replayedName(payload))
+	default: // unknown, so empty response
+		return writeCmd(w, cmd, nil)
+	}
+}
+
+// capture starts or stops recording, stopping adds the recorded video
+func (s *Server) capture(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case on && s.capturing.IsZero():
+		s.capturing = time.Now()
+	case !on && !s.capturing.IsZero():
+		footage := s.Footage
+		if footage == nil {
+			footage = DefaultFootage
+		}
+		s.videos = append(s.videos, Video{
+			Name:      s.capturing.Format("2006_01_02_150405") + fmt.Sprintf("_%d.avi", len(s.videos)),
+			Duration:  uint32(time.Since(s.capturing).Round(time.Second) / time.Second),
+			Timestamp: uint32(s.capturing.Unix()),
+			Frames:    footage,
+		})
+		s.capturing = time.Time{}
+	}
+}
+
+// takePhoto returns response payload with new photo
+func (s *Server) takePhoto() []byte {
+	s.mu.Lock()
+	s.photos++
+	name := fmt.Sprintf("/mnt/sd/photo/%d.jpg", s.photos)
+	photo := s.Photo
+	s.mu.Unlock()
+	if photo == nil {
+		photo = DefaultPhoto
+	}
+	payload := make([]byte, photoHeaderSize, photoHeaderSize+len(photo))
+	binary.LittleEndian.PutUint32(payload, uint32(len(photo)))
+	copy(payload[3*4:], name)
+	return append(payload, photo...)
+}
+
+// videoList returns entries of videos for list response
+func (s *Server) videoList() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	payload := make([]byte, videoEntrySize*len(s.videos))
+	for i, video := range s.videos {
+		entry := payload[i*videoEntrySize:]
+		binary.LittleEndian.PutUint32(entry[0:], uint32(len(video.content())))
+		binary.LittleEndian.PutUint32(entry[4:], video.Duration)
+		binary.LittleEndian.PutUint32(entry[8:], video.Timestamp)
+		copy(entry[4*4:videoEntrySize], video.Name)
+	}
+	return payload
+}
+
+// video returns video of given name
+func (s *Server) video(name string) (Video, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, video := range s.videos {
+		if video.Name == name {
+			return video, true
+		}
+	}
+	return Video{}, false
+}
+
+// deleteVideo removes video of given name, false when there is no such video
+func (s *Server) deleteVideo(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, video := range s.videos {
+		if video.Name == name {
+			s.videos = append(s.videos[:i], s.videos[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// download sends the video in chunks (start, data…, end), from offset when it is valid
+//
+// Chunks are laid out as in analysis/video/request_video_file_download.pcapng. The capture ends
+// right after type of the end chunk, so the rest of its header is left zero (no checksum).
+func (s *Server) download(w io.Writer, name string, offset int) error {
+	video, ok := s.video(name)
+	if !ok {
+		return fmt.Errorf("vtxtest: no video %q", name)
+	}
+	content := video.content()
+	if offset < 0 || offset > len(content) {
+		offset = 0
+	}
+	chunk := func(typ uint32, data []byte) error {
+		header := make([]byte, downloadHeaderSize)
+		copy(header, uint32s(typ, uint32(len(data)), uint32(len(content)), uint32(offset)))
+		copy(header[4*4:116], name)
+		return writeCmd(w, videoDownloadCmd, header, data)
+	}
+	if err := chunk(1, nil); err != nil {
+		return err
+	}
+	for rest := content[offset:]; len(rest) > 0; {
+		n := len(rest)
+		if n > downloadChunkSize {
+			n = downloadChunkSize
+		}
+		if err := chunk(2, rest[:n]); err != nil {
+			return err
+		}
+		rest = rest[n:]
+	}
+	return chunk(3, nil)
+}
+
+// replay sends frames of the video and marks the end, there is no pacing
+func (s *Server) replay(w io.Writer, name string) error {
+	video, ok := s.video(name)
+	if !ok {
+		return writeCmd(w, videoReplayEndCmd, nil)
+	}
+	for i, nal := range video.Frames {
+		timing := uint32(i * 50) // 20fps
+		typ := uint32(0)
+		if i%40 == 0 {
+			typ = 1
+		}
+		header := make([]byte, replayHeaderSize)
+		copy(header, uint32s(typ, uint32(8+len(nal)), 0, timing))
+		// seq number of frame, zero (0xff00 would mark chunk to skip), timing
+		frame := make([]byte, 8)
+		binary.LittleEndian.PutUint16(frame[0:], uint16(i))
+		binary.LittleEndian.PutUint16(frame[4:], uint16(timing))
+		if err := writeCmd(w, videoReplayCmd, header, frame, nal); err != nil {
+			return err
+		}
+	}
+	return writeCmd(w, videoReplayEndCmd, nil)
+}
+
+// replayedName returns name of video from replay request
+func replayedName(payload []byte) string {
+	if len(payload) < 2*4 {
+		return ""
+	}
+	name := bytes.TrimPrefix(payload[2*4:], []byte("_lewei_lib_Lewei"))
+	return cString(name)
+}
+
+// readCmd reads one packet, it returns its command and payload
+func readCmd(r io.Reader) (cmd uint32, payload []byte, err error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if string(header[:len(headerMagic)]) != headerMagic {
+		return 0, nil, errors.New("vtxtest: bad header")
+	}
+	numbers := header[len(headerMagic):]
+	payload = make([]byte, binary.LittleEndian.Uint32(numbers[3*4:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return binary.LittleEndian.Uint32(numbers), payload, nil
+}
+
+// writeCmd writes packet of given command with parts of payload joined together
+func writeCmd(w io.Writer, cmd uint32, payload ...[]byte) error {
+	data := bytes.Join(payload, nil)
+	packet := make([]byte, headerSize, headerSize+len(data))
+	copy(packet, headerMagic)
+	numbers := packet[len(headerMagic):]
+	binary.LittleEndian.PutUint32(numbers, cmd)
+	binary.LittleEndian.PutUint32(numbers[3*4:], uint32(len(data)))
+	_, err := w.Write(append(packet, data...))
+	return err
+}
+
+// uint32s encodes numbers as little endian
+func uint32s(numbers ...uint32) []byte {
+	data := make([]byte, 4*len(numbers))
+	for i, n := range numbers {
+		binary.LittleEndian.PutUint32(data[i*4:], n)
+	}
+	return data
+}
+
+// boolToUint32 returns 1 for true and 0 for false (on/off of the protocol)
+func boolToUint32(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// cString returns string up to the first zero byte
+func cString(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	return string(data)
+}